@@ -1,23 +1,27 @@
 package contentSafe
 
 import (
+	"context"
 	"embed"
 	"fmt"
 	"github.com/23233/ggg/logger"
 	"github.com/23233/ggg/sv"
 	"github.com/23233/ggg/ut"
-	"github.com/23233/lad"
 	"github.com/bluele/gcache"
 	"github.com/imroc/req/v3"
 	"github.com/kataras/iris/v12"
 	"github.com/pkg/errors"
+	"github.com/redis/rueidis"
 	"github.com/schollz/progressbar/v3"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"unicode"
 )
 
@@ -33,7 +37,13 @@ type ContentSafe struct {
 	NsfwHost     string
 	TmpSaveBase  string
 	gc           gcache.Cache
-	lad          *lad.AcMachine
+	dict         atomic.Pointer[wordDict]
+	rebuildLock  sync.Mutex
+	extraWords   []string // AddWords 追加的词 仅在内存中
+	store        WordStore
+	rdb          rueidis.Client
+	channel      string
+	instanceId   string
 }
 
 func NewSafeClient() *ContentSafe {
@@ -43,8 +53,10 @@ func NewSafeClient() *ContentSafe {
 		gc: gcache.New(10000).
 			LRU().
 			Build(),
-		lad: lad.New(),
+		channel:    "content_safe:rebuild",
+		instanceId: ut.RandomStr(12),
 	}
+	client.dict.Store(buildWordDict(nil))
 	_ = client.InitLadClient()
 
 	return client
@@ -63,15 +75,18 @@ func (c *ContentSafe) RegistryRouters(party iris.Party) {
 	party.Post("/hit_image", sv.Run(new(HitImgReq)), c.HitImgHandler)
 }
 
+// RegistryAdminRouters 词库管理接口 需要自行在party上添加鉴权
+func (c *ContentSafe) RegistryAdminRouters(party iris.Party) {
+	party.Get("/words", c.WordsListHandler)
+	party.Post("/words", sv.Run(new(WordsSaveReq)), c.WordsSaveHandler)
+	party.Post("/words/remove", sv.Run(new(WordsRemoveReq)), c.WordsRemoveHandler)
+	party.Post("/words/reload", c.WordsReloadHandler)
+}
+
 // 以下是文字部分
 
 func (c *ContentSafe) InitLadClient() error {
-	err := c.lad.LoadOfFolder(words)
-	if err != nil {
-		return err
-	}
-	c.lad.Build()
-	return nil
+	return c.Rebuild(context.Background())
 }
 
 func (c *ContentSafe) HitTextHandler(ctx iris.Context) {
@@ -85,6 +100,66 @@ func (c *ContentSafe) HitTextHandler(ctx iris.Context) {
 	})
 }
 
+// WordsListHandler 词库中的词 可通过category whitelist过滤
+func (c *ContentSafe) WordsListHandler(ctx iris.Context) {
+	if c.store == nil {
+		_ = ctx.StopWithJSON(iris.StatusBadRequest, iris.Map{"detail": "未设置词库存储"})
+		return
+	}
+	list, err := c.store.List(ctx)
+	if err != nil {
+		_ = ctx.StopWithJSON(iris.StatusInternalServerError, iris.Map{"detail": "获取词库失败"})
+		return
+	}
+	category := ctx.URLParam("category")
+	whitelist := ctx.URLParam("whitelist")
+	result := make([]*WordEntry, 0, len(list))
+	for _, v := range list {
+		if len(category) > 0 && v.Category != category {
+			continue
+		}
+		if len(whitelist) > 0 && v.Whitelist != (whitelist == "true" || whitelist == "1") {
+			continue
+		}
+		result = append(result, v)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].UpdateAt.After(result[j].UpdateAt)
+	})
+	_ = ctx.JSON(iris.Map{"data": result, "count": c.WordCount()})
+}
+
+func (c *ContentSafe) WordsSaveHandler(ctx iris.Context) {
+	r := ctx.Values().Get(sv.GlobalContextKey).(*WordsSaveReq)
+	entries := make([]*WordEntry, 0, len(r.Words))
+	for _, w := range r.Words {
+		entries = append(entries, &WordEntry{Word: w, Category: r.Category, Whitelist: r.Whitelist})
+	}
+	if err := c.SaveWords(ctx, entries...); err != nil {
+		_ = ctx.StopWithJSON(iris.StatusBadRequest, iris.Map{"detail": err.Error()})
+		return
+	}
+	_ = ctx.JSON(iris.Map{"count": c.WordCount()})
+}
+
+func (c *ContentSafe) WordsRemoveHandler(ctx iris.Context) {
+	r := ctx.Values().Get(sv.GlobalContextKey).(*WordsRemoveReq)
+	if err := c.RemoveWords(ctx, r.Words...); err != nil {
+		_ = ctx.StopWithJSON(iris.StatusBadRequest, iris.Map{"detail": err.Error()})
+		return
+	}
+	_ = ctx.JSON(iris.Map{"count": c.WordCount()})
+}
+
+// WordsReloadHandler 从存储中重新加载 并通知其他实例
+func (c *ContentSafe) WordsReloadHandler(ctx iris.Context) {
+	if err := c.notifyRebuild(ctx); err != nil {
+		_ = ctx.StopWithJSON(iris.StatusInternalServerError, iris.Map{"detail": err.Error()})
+		return
+	}
+	_ = ctx.JSON(iris.Map{"count": c.WordCount()})
+}
+
 func (c *ContentSafe) AutoHitText(content string) (success bool, message string) {
 	success = true
 	message = "ok"
@@ -109,7 +184,7 @@ func (c *ContentSafe) HitText(content string) (bool, string) {
 	clear := c.ClearText(content)
 
 	if len(clear) >= 1 {
-		if c.lad.Match(clear) {
+		if c.dict.Load().match(clear) != "" {
 			return false, "中文有不良词汇,请修改"
 		}
 	}
@@ -167,10 +242,13 @@ func (c *ContentSafe) WxTextCheckV1(content string) (bool, error, string) {
 
 }
 
+// AddWords 仅在内存中追加 不会持久化也不会同步到其他实例 需要持久化使用 SaveWords
 func (c *ContentSafe) AddWords(wordList ...string) {
 	if len(wordList) >= 1 {
-		c.lad.AddOfList(wordList)
-		c.lad.Build()
+		c.rebuildLock.Lock()
+		c.extraWords = append(c.extraWords, wordList...)
+		c.rebuildLock.Unlock()
+		_ = c.Rebuild(context.Background())
 	}
 }
 
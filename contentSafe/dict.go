@@ -0,0 +1,413 @@
+package contentSafe
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/23233/ggg/logger"
+	"github.com/23233/lad"
+	"github.com/pkg/errors"
+	"github.com/redis/rueidis"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 敏感词词库
+// 内置的txt词库加上持久化存储中的词 按分类分别构建AC自动机 重建时先构建新的再整体替换 期间不影响检测
+// 多实例时通过redis发布订阅通知其他实例重建
+
+const (
+	WordCategoryGeneral   = "general"   // 通用敏感词
+	WordCategoryPolitical = "political" // 政治类
+	WordCategoryPorn      = "porn"      // 色情类
+	WordCategoryBusiness  = "business"  // 不允许的业务
+	WordCategoryPinyin    = "pinyin"    // 拼音敏感词
+)
+
+// WordCategories 全部分类
+var WordCategories = []string{WordCategoryGeneral, WordCategoryPolitical, WordCategoryPorn, WordCategoryBusiness, WordCategoryPinyin}
+
+// bundledCategory 内置词库文件对应的分类
+var bundledCategory = map[string]string{
+	"敏感词.txt":      WordCategoryGeneral,
+	"政治类-反动词库.txt": WordCategoryPolitical,
+	"不允许业务.txt":    WordCategoryBusiness,
+	"拼音敏感词.txt":    WordCategoryPinyin,
+}
+
+// WordEntry 词条 Whitelist为true时该词不会被检测 包括内置词库中的词
+type WordEntry struct {
+	Word      string    `json:"word" bson:"word"`
+	Category  string    `json:"category,omitempty" bson:"category,omitempty"`
+	Whitelist bool      `json:"whitelist,omitempty" bson:"whitelist,omitempty"`
+	UpdateAt  time.Time `json:"update_at" bson:"update_at"`
+}
+
+// WordStore 词库持久化
+type WordStore interface {
+	List(ctx context.Context) ([]*WordEntry, error)
+	// Save 按词新增或覆盖
+	Save(ctx context.Context, entries ...*WordEntry) error
+	Remove(ctx context.Context, words ...string) error
+}
+
+// MemoryWordStore 内存存储 仅用于测试或单实例
+type MemoryWordStore struct {
+	mu    sync.RWMutex
+	words map[string]*WordEntry
+}
+
+func NewMemoryWordStore() *MemoryWordStore {
+	return &MemoryWordStore{words: make(map[string]*WordEntry)}
+}
+
+func (s *MemoryWordStore) List(ctx context.Context) ([]*WordEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := make([]*WordEntry, 0, len(s.words))
+	for _, v := range s.words {
+		item := *v
+		result = append(result, &item)
+	}
+	return result, nil
+}
+
+func (s *MemoryWordStore) Save(ctx context.Context, entries ...*WordEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range entries {
+		item := *v
+		s.words[v.Word] = &item
+	}
+	return nil
+}
+
+func (s *MemoryWordStore) Remove(ctx context.Context, words ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, w := range words {
+		delete(s.words, w)
+	}
+	return nil
+}
+
+// RedisWordStore 存储在redis的hash中 field为词 value为词条json
+type RedisWordStore struct {
+	rdb rueidis.Client
+	key string
+}
+
+func NewRedisWordStore(rdb rueidis.Client) *RedisWordStore {
+	return &RedisWordStore{rdb: rdb, key: "content_safe:words"}
+}
+
+func (s *RedisWordStore) SetKey(key string) *RedisWordStore {
+	s.key = key
+	return s
+}
+
+func (s *RedisWordStore) List(ctx context.Context) ([]*WordEntry, error) {
+	all, err := s.rdb.Do(ctx, s.rdb.B().Hgetall().Key(s.key).Build()).AsStrMap()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*WordEntry, 0, len(all))
+	for _, v := range all {
+		var item WordEntry
+		if err = json.Unmarshal([]byte(v), &item); err != nil {
+			return nil, err
+		}
+		result = append(result, &item)
+	}
+	return result, nil
+}
+
+func (s *RedisWordStore) Save(ctx context.Context, entries ...*WordEntry) error {
+	if len(entries) < 1 {
+		return nil
+	}
+	cmd := s.rdb.B().Hset().Key(s.key).FieldValue()
+	for _, v := range entries {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		cmd = cmd.FieldValue(v.Word, string(b))
+	}
+	return s.rdb.Do(ctx, cmd.Build()).Error()
+}
+
+func (s *RedisWordStore) Remove(ctx context.Context, words ...string) error {
+	if len(words) < 1 {
+		return nil
+	}
+	return s.rdb.Do(ctx, s.rdb.B().Hdel().Key(s.key).Field(words...).Build()).Error()
+}
+
+// MongoWordStore 存储在mongo中 以word为唯一键
+type MongoWordStore struct {
+	coll *mongo.Collection
+}
+
+func NewMongoWordStore(coll *mongo.Collection) *MongoWordStore {
+	return &MongoWordStore{coll: coll}
+}
+
+// EnsureIndex 创建word的唯一索引
+func (s *MongoWordStore) EnsureIndex(ctx context.Context) error {
+	_, err := s.coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "word", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+func (s *MongoWordStore) List(ctx context.Context) ([]*WordEntry, error) {
+	cur, err := s.coll.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*WordEntry, 0)
+	if err = cur.All(ctx, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *MongoWordStore) Save(ctx context.Context, entries ...*WordEntry) error {
+	if len(entries) < 1 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, 0, len(entries))
+	for _, v := range entries {
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"word": v.Word}).
+			SetReplacement(v).
+			SetUpsert(true))
+	}
+	_, err := s.coll.BulkWrite(ctx, models)
+	return err
+}
+
+func (s *MongoWordStore) Remove(ctx context.Context, words ...string) error {
+	if len(words) < 1 {
+		return nil
+	}
+	_, err := s.coll.DeleteMany(ctx, bson.M{"word": bson.M{"$in": words}})
+	return err
+}
+
+// wordDict 构建完成的词库 构建后只读
+type wordDict struct {
+	machines map[string]*lad.AcMachine
+	count    map[string]int
+}
+
+// bundledWords 读取内置词库 按分类返回
+func bundledWords() (map[string][]string, error) {
+	result := make(map[string][]string)
+	entries, err := fs.ReadDir(words, ".")
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		f, err := words.Open(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		category, ok := bundledCategory[entry.Name()]
+		if !ok {
+			category = WordCategoryGeneral
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if w := strings.TrimSpace(scanner.Text()); len(w) > 0 {
+				result[category] = append(result[category], w)
+			}
+		}
+		_ = f.Close()
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// mergeWords 合并内置词库 存储中的词 内存中追加的词 并去掉白名单中的词
+func mergeWords(bundled map[string][]string, stored []*WordEntry, extra []string) map[string][]string {
+	whitelist := make(map[string]struct{})
+	for _, v := range stored {
+		if v.Whitelist {
+			whitelist[v.Word] = struct{}{}
+		}
+	}
+	result := make(map[string][]string)
+	seen := make(map[string]map[string]struct{})
+	add := func(category, word string) {
+		if _, ok := whitelist[word]; ok || len(word) < 1 {
+			return
+		}
+		if len(category) < 1 {
+			category = WordCategoryGeneral
+		}
+		if seen[category] == nil {
+			seen[category] = make(map[string]struct{})
+		}
+		if _, ok := seen[category][word]; ok {
+			return
+		}
+		seen[category][word] = struct{}{}
+		result[category] = append(result[category], word)
+	}
+	for category, list := range bundled {
+		for _, w := range list {
+			add(category, w)
+		}
+	}
+	for _, v := range stored {
+		if !v.Whitelist {
+			add(v.Category, v.Word)
+		}
+	}
+	for _, w := range extra {
+		add(WordCategoryGeneral, w)
+	}
+	return result
+}
+
+func buildWordDict(categoryWords map[string][]string) *wordDict {
+	d := &wordDict{
+		machines: make(map[string]*lad.AcMachine, len(categoryWords)),
+		count:    make(map[string]int, len(categoryWords)),
+	}
+	for category, list := range categoryWords {
+		if len(list) < 1 {
+			continue
+		}
+		m := lad.New()
+		m.AddOfList(list)
+		m.Build()
+		d.machines[category] = m
+		d.count[category] = len(list)
+	}
+	return d
+}
+
+// match 返回命中的分类 未命中返回空
+func (d *wordDict) match(content string) string {
+	categories := make([]string, 0, len(d.machines))
+	for k := range d.machines {
+		categories = append(categories, k)
+	}
+	sort.Strings(categories)
+	for _, category := range categories {
+		if d.machines[category].Match(content) {
+			return category
+		}
+	}
+	return ""
+}
+
+// SetWordStore 设置词库存储 需要调用 Rebuild 才会加载
+func (c *ContentSafe) SetWordStore(store WordStore) {
+	c.store = store
+}
+
+// Rebuild 重新构建词库 构建完成后替换 构建期间继续使用旧词库
+func (c *ContentSafe) Rebuild(ctx context.Context) error {
+	c.rebuildLock.Lock()
+	defer c.rebuildLock.Unlock()
+	bundled, err := bundledWords()
+	if err != nil {
+		return err
+	}
+	var stored []*WordEntry
+	if c.store != nil {
+		stored, err = c.store.List(ctx)
+		if err != nil {
+			return errors.Wrap(err, "读取词库失败")
+		}
+	}
+	c.dict.Store(buildWordDict(mergeWords(bundled, stored, c.extraWords)))
+	return nil
+}
+
+// WordCount 各分类的词数量
+func (c *ContentSafe) WordCount() map[string]int {
+	d := c.dict.Load()
+	result := make(map[string]int, len(d.count))
+	for k, v := range d.count {
+		result[k] = v
+	}
+	return result
+}
+
+// SaveWords 新增或修改词条 并通知所有实例重建
+func (c *ContentSafe) SaveWords(ctx context.Context, entries ...*WordEntry) error {
+	if c.store == nil {
+		return errors.New("未设置词库存储")
+	}
+	now := time.Now()
+	for _, v := range entries {
+		v.Word = strings.TrimSpace(v.Word)
+		v.UpdateAt = now
+	}
+	if err := c.store.Save(ctx, entries...); err != nil {
+		return err
+	}
+	return c.notifyRebuild(ctx)
+}
+
+// RemoveWords 删除词条 并通知所有实例重建 内置词库中的词需要使用白名单
+func (c *ContentSafe) RemoveWords(ctx context.Context, words ...string) error {
+	if c.store == nil {
+		return errors.New("未设置词库存储")
+	}
+	if err := c.store.Remove(ctx, words...); err != nil {
+		return err
+	}
+	return c.notifyRebuild(ctx)
+}
+
+// notifyRebuild 本实例立即重建 并发布重建消息
+func (c *ContentSafe) notifyRebuild(ctx context.Context) error {
+	if err := c.Rebuild(ctx); err != nil {
+		return err
+	}
+	if c.rdb != nil {
+		return c.rdb.Do(ctx, c.rdb.B().Publish().Channel(c.channel).Message(c.instanceId).Build()).Error()
+	}
+	return nil
+}
+
+// EnableSync 订阅重建消息 收到其他实例的通知后重建 断线后自动重新订阅 ctx取消后退出
+func (c *ContentSafe) EnableSync(ctx context.Context, rdb rueidis.Client) {
+	c.rdb = rdb
+	go func() {
+		for ctx.Err() == nil {
+			err := rdb.Receive(ctx, rdb.B().Subscribe().Channel(c.channel).Build(), func(msg rueidis.PubSubMessage) {
+				if msg.Message == c.instanceId {
+					return
+				}
+				if err := c.Rebuild(ctx); err != nil {
+					logger.JM.ErrorE(err, "重建敏感词库失败")
+				}
+			})
+			if ctx.Err() != nil {
+				return
+			}
+			logger.JM.ErrorE(err, "敏感词库订阅断开 稍后重试")
+			time.Sleep(3 * time.Second)
+			// 断线期间可能错过通知
+			if err = c.Rebuild(ctx); err != nil {
+				logger.JM.ErrorE(err, "重建敏感词库失败")
+			}
+		}
+	}()
+}
@@ -0,0 +1,88 @@
+package contentSafe
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMergeWords(t *testing.T) {
+	bundled := map[string][]string{
+		WordCategoryGeneral:   {"甲", "乙"},
+		WordCategoryPolitical: {"丙"},
+	}
+	stored := []*WordEntry{
+		{Word: "丁", Category: WordCategoryPorn},
+		{Word: "乙", Whitelist: true},
+		{Word: "甲", Category: WordCategoryGeneral},
+	}
+	result := mergeWords(bundled, stored, []string{"戊", "甲"})
+	if len(result[WordCategoryGeneral]) != 2 || result[WordCategoryGeneral][0] != "甲" || result[WordCategoryGeneral][1] != "戊" {
+		t.Fatalf("通用词合并错误 %v", result[WordCategoryGeneral])
+	}
+	if len(result[WordCategoryPorn]) != 1 || len(result[WordCategoryPolitical]) != 1 {
+		t.Fatalf("分类错误 %v", result)
+	}
+}
+
+func TestWordStoreRebuild(t *testing.T) {
+	ctx := context.TODO()
+	client := NewSafeClient()
+	client.SetWordStore(NewMemoryWordStore())
+
+	bundled, err := bundledWords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 选一个不包含其他内置词的词 避免白名单后仍被其他词命中
+	var builtin string
+	for _, w := range bundled[WordCategoryGeneral] {
+		contains := false
+		for _, list := range bundled {
+			for _, other := range list {
+				if other != w && strings.Contains(w, other) {
+					contains = true
+				}
+			}
+		}
+		if !contains && client.ClearText(w) == w {
+			builtin = w
+			break
+		}
+	}
+	if ok, _ := client.HitText(builtin); ok {
+		t.Fatal("内置词应命中")
+	}
+
+	word := "自定义违禁测试词"
+	if ok, _ := client.HitText(word); !ok {
+		t.Fatal("添加前不应命中")
+	}
+	if err = client.SaveWords(ctx, &WordEntry{Word: word, Category: WordCategoryBusiness}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := client.HitText(word); ok {
+		t.Fatal("添加后应命中")
+	}
+	if client.WordCount()[WordCategoryBusiness] < 1 {
+		t.Fatal("分类数量错误")
+	}
+
+	// 白名单可以排除内置词
+	if err = client.SaveWords(ctx, &WordEntry{Word: builtin, Whitelist: true}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := client.HitText(builtin); !ok {
+		t.Fatal("白名单中的词不应命中")
+	}
+
+	if err = client.RemoveWords(ctx, word, builtin); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := client.HitText(word); !ok {
+		t.Fatal("删除后不应命中")
+	}
+	if ok, _ := client.HitText(builtin); ok {
+		t.Fatal("移出白名单后应命中")
+	}
+}
@@ -18,7 +18,9 @@ require (
 	github.com/imroc/req/v3 v3.52.1
 	github.com/kataras/iris/v12 v12.2.11
 	github.com/pkg/errors v0.9.1
+	github.com/redis/rueidis v1.0.60
 	github.com/schollz/progressbar/v3 v3.18.0
+	go.mongodb.org/mongo-driver v1.17.3
 )
 
 require (
@@ -82,7 +84,6 @@ require (
 	github.com/quic-go/qtls-go1-19 v0.3.2 // indirect
 	github.com/quic-go/qtls-go1-20 v0.2.2 // indirect
 	github.com/quic-go/quic-go v0.52.0 // indirect
-	github.com/redis/rueidis v1.0.60 // indirect
 	github.com/redis/rueidis/rueidiscompat v1.0.60 // indirect
 	github.com/refraction-networking/utls v1.7.3 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
@@ -100,7 +101,6 @@ require (
 	github.com/xdg-go/stringprep v1.0.4 // indirect
 	github.com/yosssi/ace v0.0.5 // indirect
 	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78 // indirect
-	go.mongodb.org/mongo-driver v1.17.3 // indirect
 	go.uber.org/atomic v1.11.0 // indirect
 	go.uber.org/automaxprocs v1.6.0 // indirect
 	go.uber.org/mock v0.5.2 // indirect
@@ -14,3 +14,13 @@ type WxTextV1Resp struct {
 	Errmsg  string `json:"errmsg"`
 	TraceId string `json:"trace_id"`
 }
+
+type WordsSaveReq struct {
+	Words     []string `json:"words" comment:"词列表" validate:"required,min=1,max=500,dive,required,max=50"`
+	Category  string   `json:"category" comment:"分类" validate:"omitempty,oneof=general political porn business pinyin"`
+	Whitelist bool     `json:"whitelist" comment:"是否为白名单"`
+}
+
+type WordsRemoveReq struct {
+	Words []string `json:"words" comment:"词列表" validate:"required,min=1,max=500,dive,required"`
+}
@@ -0,0 +1,117 @@
+package pipe
+
+import (
+	"context"
+	"github.com/kataras/iris/v12"
+	"github.com/pkg/errors"
+)
+
+// 邮件相关
+
+type EmailPipe struct {
+	Email      string `json:"email,omitempty" bson:"email,omitempty"`
+	TemplateId string `json:"template_id,omitempty" bson:"template_id,omitempty"`
+	Code       string `json:"code,omitempty" bson:"code,omitempty"`
+	// 以下仅服务端可设置 不会从请求参数中绑定
+	Ip       string `json:"-" bson:"-"` // 用于ip额度 为空时使用 CtxRealIp
+	LinkBase string `json:"-" bson:"-"` // 登录链接的地址 为空时使用 EmailClient.SetLinkBase 的配置
+}
+
+// EmailLinkDep 登录链接换取jwt
+type EmailLinkDep struct {
+	Token string
+	Env   string
+	// Resolve 根据邮箱获取用户id 可在其中完成注册
+	Resolve func(ctx context.Context, email string) (string, error)
+}
+
+func (c *EmailPipe) ip(ctx iris.Context) string {
+	if len(c.Ip) > 0 {
+		return c.Ip
+	}
+	return CtxRealIp(ctx)
+}
+
+var (
+	// EmailSend 邮件验证码发送 检查重发冷却与邮箱 ip的每日额度
+	// 必传params EmailPipe
+	// 必传db EmailClient 的实例
+	EmailSend = &RunnerContext[any, *EmailPipe, *EmailClient, string]{
+		Name: "邮件验证码发送",
+		Key:  "email_send",
+		call: func(ctx iris.Context, origin any, params *EmailPipe, db *EmailClient, more ...any) *RunResp[string] {
+			if params == nil || db == nil {
+				return NewPipeErr[string](PipeDepError)
+			}
+			code, err := db.SendCode(ctx, params.TemplateId, params.Email, params.ip(ctx))
+			return NewPipeResultErr(code, err)
+		},
+	}
+	// EmailValid 邮件验证码验证 通过后删除
+	// 必传params EmailPipe
+	// 必传db EmailClient 的实例
+	EmailValid = &RunnerContext[any, *EmailPipe, *EmailClient, bool]{
+		Name: "邮件验证码验证",
+		Key:  "email_valid",
+		call: func(ctx iris.Context, origin any, params *EmailPipe, db *EmailClient, more ...any) *RunResp[bool] {
+			if params == nil || db == nil {
+				return NewPipeErr[bool](PipeDepError)
+			}
+			if !db.Valid(ctx, params.Email, params.Code) {
+				return NewPipeErr[bool](errors.New("邮件验证码验证失败"))
+			}
+			db.DelKey(context.TODO(), params.Email)
+			return NewPipeResult(true)
+		},
+	}
+	// EmailLinkSend 发送一次性登录链接
+	// 必传params EmailPipe
+	// 必传db EmailClient 的实例 需要通过SetLinkBase配置登录链接的地址
+	EmailLinkSend = &RunnerContext[any, *EmailPipe, *EmailClient, bool]{
+		Name: "邮件登录链接发送",
+		Key:  "email_link_send",
+		call: func(ctx iris.Context, origin any, params *EmailPipe, db *EmailClient, more ...any) *RunResp[bool] {
+			if params == nil || db == nil {
+				return NewPipeErr[bool](PipeDepError)
+			}
+			linkBase := params.LinkBase
+			if len(linkBase) < 1 {
+				linkBase = db.linkBase
+			}
+			if len(linkBase) < 1 {
+				return NewPipeErr[bool](PipeDepError)
+			}
+			err := db.SendMagicLink(ctx, params.TemplateId, params.Email, params.ip(ctx), linkBase)
+			if err != nil {
+				return NewPipeErr[bool](err)
+			}
+			return NewPipeResult(true)
+		},
+	}
+	// EmailLinkLogin 消费登录链接后通过JwtGen生成token 链接仅可使用一次
+	// 必传origin EmailLinkDep
+	// 可选params jwt生成参数
+	// 必传db EmailClient 的实例
+	EmailLinkLogin = &RunnerContext[*EmailLinkDep, *JwtGenPipe, *EmailClient, string]{
+		Name: "邮件登录链接登录",
+		Key:  "email_link_login",
+		call: func(ctx iris.Context, origin *EmailLinkDep, params *JwtGenPipe, db *EmailClient, more ...any) *RunResp[string] {
+			if origin == nil || origin.Resolve == nil || db == nil {
+				return NewPipeErr[string](PipeDepError)
+			}
+			email, err := db.ConsumeMagicLink(ctx, origin.Token)
+			if err != nil {
+				return NewPipeErr[string](err)
+			}
+			uid, err := origin.Resolve(ctx, email)
+			if err != nil {
+				return NewPipeErr[string](err)
+			}
+			return JwtGen.call(ctx, &PipeJwtDep{
+				Env:    origin.Env,
+				UserId: uid,
+				Ip:     CtxRealIp(ctx),
+			}, params, db.rdb)
+		},
+	}
+)
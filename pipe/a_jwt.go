@@ -11,10 +11,13 @@ type JwtGenPipe struct {
 	ExpireDuration time.Duration `json:"expire_duration,omitempty"` // 过期时间 默认24小时
 	Strict         bool          `json:"strict,omitempty"`          // 严格模式才执行同一个环境仅单个登录
 	Force          bool          `json:"force,omitempty"`           // 强制覆盖 仅在严格模式下启用
+	RefreshExpire  time.Duration `json:"refresh_expire,omitempty"`  // 刷新令牌过期时间 默认30天 仅会话模式使用
 }
 type PipeJwtDep struct {
 	Env    string
 	UserId string
+	Device string // 设备信息 会话列表中展示 一般为UA
+	Ip     string
 }
 
 func (c *JwtGenPipe) GetExpire(defaultTimes ...time.Duration) time.Duration {
@@ -29,6 +32,13 @@ func (c *JwtGenPipe) GetExpire(defaultTimes ...time.Duration) time.Duration {
 	return expire
 }
 
+func (c *JwtGenPipe) GetRefreshExpire() time.Duration {
+	if c.RefreshExpire < 1 {
+		return time.Hour * 24 * 30
+	}
+	return c.RefreshExpire
+}
+
 var (
 	// JwtGen jwt 结构设计 Strict模式下 用户一个env下仅可登陆一个设备  [key为userId:env]:value 为token
 	// 必传origin jwt设置
@@ -46,30 +56,9 @@ var (
 				params = new(JwtGenPipe)
 			}
 
-			helper := NewJwtHelper(db)
+			helper := jwtHelperFromCtx(ctx, db)
 
-			redisKey := helper.JwtRedisGenKey(origin.UserId, origin.Env)
-
-			if params.Strict {
-				resp := helper.JwtRedisGetKey(ctx, redisKey)
-				if resp.Error() != nil {
-					// 只要不是为空错误 则为其他错误都直接返回
-					if resp.Error() != rueidis.Nil {
-						return NewPipeErr[string](resp.Error())
-					}
-				}
-
-				// token如果存在 但是不强制刷新
-				st, _ := resp.ToString()
-				if len(st) > 0 && !params.Force {
-					return NewPipeErr[string](errors.New("当前环境有其他设备在线"))
-				}
-			}
-
-			token := helper.GenJwtToken(origin.UserId, origin.Env)
-
-			// 直接写入
-			err := helper.JwtSaveToken(ctx, redisKey, token, params.GetExpire())
+			token, err := jwtIssue(ctx, helper, origin, params, "")
 			if err != nil {
 				return NewPipeErr[string](err)
 			}
@@ -79,3 +68,44 @@ var (
 		},
 	}
 )
+
+// jwtIssue 严格模式判断后生成token并写入 sid不为空时生成会话令牌
+func jwtIssue(ctx iris.Context, helper *JwtHelper, origin *PipeJwtDep, params *JwtGenPipe, sid string) (string, error) {
+	redisKey := helper.JwtRedisGenKey(origin.UserId, origin.Env)
+
+	if params.Strict {
+		resp := helper.JwtRedisGetKey(ctx, redisKey)
+		if resp.Error() != nil {
+			// 只要不是为空错误 则为其他错误都直接返回
+			if resp.Error() != rueidis.Nil {
+				return "", resp.Error()
+			}
+		}
+
+		// token如果存在 但是不强制刷新
+		st, _ := resp.ToString()
+		if len(st) > 0 && !params.Force {
+			return "", errors.New("当前环境有其他设备在线")
+		}
+		// 强制登录时 被挤下线的设备会话直接注销
+		if len(st) > 0 {
+			if err := helper.revokeTokenSession(ctx, origin.UserId, st); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	var token string
+	if len(sid) > 0 {
+		token = helper.GenJwtSessionToken(origin.UserId, origin.Env, sid, params.GetExpire())
+	} else {
+		token = helper.GenJwtToken(origin.UserId, origin.Env)
+	}
+
+	// 直接写入
+	err := helper.JwtSaveToken(ctx, redisKey, token, params.GetExpire())
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
@@ -12,6 +12,7 @@ type JwtFlatBase struct {
 	Env       string `json:"env,omitempty"`
 	Raw       string `json:"raw,omitempty"`
 	LoginTime string `json:"login_time,omitempty"`
+	SessionId string `json:"session_id,omitempty"` // 会话令牌才有
 }
 
 func (c JwtFlatBase) IsShort() bool {
@@ -38,7 +39,7 @@ var (
 
 			dep := origin
 			rdb := db
-			helper := NewJwtHelper(rdb)
+			helper := jwtHelperFromCtx(ctx, rdb)
 
 			pack := dep.FlatMap
 
@@ -52,6 +53,11 @@ var (
 				return NewPipeErr[JwtFlatBase](errors.New("jwt数据包结构错误"))
 			}
 
+			// 会话被注销或用户全部下线后立即失效
+			if err := helper.JwtCheckRevoked(ctx, pack); err != nil {
+				return NewPipeErr[JwtFlatBase](err)
+			}
+
 			// jwt 中的数据集
 			raw := pack.Raw
 
@@ -33,7 +33,7 @@ var (
 				return NewPipeErr[string](errors.New("短令牌无法生成短令牌"))
 			}
 
-			helper := NewJwtHelper(db)
+			helper := jwtHelperFromCtx(ctx, db)
 
 			raw := flatMap.Raw
 			raw = strings.TrimPrefix(raw, JwtPrefix)
@@ -20,7 +20,7 @@ var (
 				return NewPipeErr[JwtFlatBase](errors.New("获取token令牌错误"))
 			}
 
-			helper := NewJwtHelper(rdb)
+			helper := jwtHelperFromCtx(ctx, rdb)
 			isShort := strings.HasPrefix(origin, JwtShortPrefix)
 
 			auth := origin
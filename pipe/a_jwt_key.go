@@ -0,0 +1,373 @@
+package pipe
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/kataras/iris/v12"
+	"github.com/pkg/errors"
+)
+
+// jwt签名秘钥 支持HS256 RS256 ES256 EdDSA
+// 签发时使用当前签名秘钥并在头部写入kid 验证时按kid查找秘钥 轮换后旧秘钥保留用于验证直到移除
+// 没有kid的令牌为旧版签发 使用kid为空的秘钥验证
+
+const (
+	JwtAlgHS256 = "HS256"
+	JwtAlgRS256 = "RS256"
+	JwtAlgES256 = "ES256"
+	JwtAlgEdDSA = "EdDSA"
+)
+
+var (
+	ErrJwtKeyNotFound = errors.New("jwt秘钥不存在")
+	ErrJwtKeyInvalid  = errors.New("jwt秘钥与算法不匹配")
+)
+
+// JwtKey 签名秘钥 非对称算法Private为空时仅用于验证
+type JwtKey struct {
+	Kid     string
+	Alg     string
+	Secret  []byte           // HS256使用
+	Private crypto.Signer    // *rsa.PrivateKey *ecdsa.PrivateKey ed25519.PrivateKey
+	Public  crypto.PublicKey // 为空时从Private获取
+}
+
+// NewJwtKeyHS256 对称秘钥 无法通过JWKS公开
+func NewJwtKeyHS256(kid string, secret []byte) *JwtKey {
+	return &JwtKey{Kid: kid, Alg: JwtAlgHS256, Secret: secret}
+}
+
+// NewJwtKeyFromPEM 从PEM中解析秘钥 私钥可用于签名 公钥仅用于验证
+func NewJwtKeyFromPEM(kid string, alg string, pem []byte) (*JwtKey, error) {
+	key := &JwtKey{Kid: kid, Alg: alg}
+	var err error
+	switch alg {
+	case JwtAlgRS256:
+		var pri *rsa.PrivateKey
+		if pri, err = jwt.ParseRSAPrivateKeyFromPEM(pem); err == nil {
+			key.Private = pri
+		} else {
+			key.Public, err = jwt.ParseRSAPublicKeyFromPEM(pem)
+		}
+	case JwtAlgES256:
+		var pri *ecdsa.PrivateKey
+		if pri, err = jwt.ParseECPrivateKeyFromPEM(pem); err == nil {
+			key.Private = pri
+		} else {
+			key.Public, err = jwt.ParseECPublicKeyFromPEM(pem)
+		}
+	case JwtAlgEdDSA:
+		var pri crypto.PrivateKey
+		if pri, err = jwt.ParseEdPrivateKeyFromPEM(pem); err == nil {
+			key.Private, _ = pri.(crypto.Signer)
+		} else {
+			key.Public, err = jwt.ParseEdPublicKeyFromPEM(pem)
+		}
+	default:
+		return nil, errors.Errorf("不支持的jwt算法 %s", alg)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "解析jwt秘钥失败")
+	}
+	return key, key.validate()
+}
+
+// GenerateJwtKey 生成新的秘钥 用于轮换
+func GenerateJwtKey(kid string, alg string) (*JwtKey, error) {
+	key := &JwtKey{Kid: kid, Alg: alg}
+	var err error
+	switch alg {
+	case JwtAlgHS256:
+		key.Secret = make([]byte, 32)
+		_, err = rand.Read(key.Secret)
+	case JwtAlgRS256:
+		key.Private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case JwtAlgES256:
+		key.Private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case JwtAlgEdDSA:
+		_, key.Private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, errors.Errorf("不支持的jwt算法 %s", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, key.validate()
+}
+
+// validate 校验秘钥类型与算法一致 并补全公钥
+func (c *JwtKey) validate() error {
+	if c.Public == nil && c.Private != nil {
+		c.Public = c.Private.Public()
+	}
+	switch c.Alg {
+	case JwtAlgHS256:
+		if len(c.Secret) < 1 {
+			return ErrJwtKeyInvalid
+		}
+		return nil
+	case JwtAlgRS256:
+		_, ok := c.Public.(*rsa.PublicKey)
+		if ok && c.Private != nil {
+			_, ok = c.Private.(*rsa.PrivateKey)
+		}
+		if !ok {
+			return ErrJwtKeyInvalid
+		}
+	case JwtAlgES256:
+		pub, ok := c.Public.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != elliptic.P256() {
+			return ErrJwtKeyInvalid
+		}
+		if c.Private != nil {
+			if _, ok = c.Private.(*ecdsa.PrivateKey); !ok {
+				return ErrJwtKeyInvalid
+			}
+		}
+	case JwtAlgEdDSA:
+		if _, ok := c.Public.(ed25519.PublicKey); !ok {
+			return ErrJwtKeyInvalid
+		}
+	default:
+		return errors.Errorf("不支持的jwt算法 %s", c.Alg)
+	}
+	return nil
+}
+
+// CanSign 是否可以用于签名
+func (c *JwtKey) CanSign() bool {
+	if c.Alg == JwtAlgHS256 {
+		return len(c.Secret) > 0
+	}
+	return c.Private != nil
+}
+
+func (c *JwtKey) signKey() any {
+	if c.Alg == JwtAlgHS256 {
+		return c.Secret
+	}
+	return c.Private
+}
+
+func (c *JwtKey) verifyKey() any {
+	if c.Alg == JwtAlgHS256 {
+		return c.Secret
+	}
+	return c.Public
+}
+
+// JwtKeySet 秘钥集合 并发安全
+type JwtKeySet struct {
+	mu      sync.RWMutex
+	keys    []*JwtKey
+	signKid string
+}
+
+// NewJwtKeySet 第一个可签名的秘钥作为当前签名秘钥
+func NewJwtKeySet(keys ...*JwtKey) (*JwtKeySet, error) {
+	s := new(JwtKeySet)
+	signKid := ""
+	hasSign := false
+	for _, key := range keys {
+		if err := s.Add(key); err != nil {
+			return nil, err
+		}
+		if !hasSign && key.CanSign() {
+			signKid, hasSign = key.Kid, true
+		}
+	}
+	if !hasSign {
+		return nil, errors.New("至少需要一个可签名的jwt秘钥")
+	}
+	s.signKid = signKid
+	return s, nil
+}
+
+// Add 新增验证秘钥 相同kid会覆盖
+func (s *JwtKeySet) Add(key *JwtKey) error {
+	if key == nil {
+		return ErrJwtKeyInvalid
+	}
+	if err := key.validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, k := range s.keys {
+		if k.Kid == key.Kid {
+			if k.Kid == s.signKid && !key.CanSign() {
+				return errors.New("当前签名秘钥不能替换为仅验证的秘钥")
+			}
+			s.keys[i] = key
+			return nil
+		}
+	}
+	s.keys = append(s.keys, key)
+	return nil
+}
+
+// Remove 移除秘钥 使用该秘钥签发的令牌将无法通过验证 当前签名秘钥不能移除
+func (s *JwtKeySet) Remove(kid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if kid == s.signKid {
+		return errors.New("不能移除当前签名秘钥")
+	}
+	for i, k := range s.keys {
+		if k.Kid == kid {
+			s.keys = append(s.keys[:i], s.keys[i+1:]...)
+			return nil
+		}
+	}
+	return ErrJwtKeyNotFound
+}
+
+// SetSigning 切换签名秘钥
+func (s *JwtKeySet) SetSigning(kid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.keys {
+		if k.Kid == kid {
+			if !k.CanSign() {
+				return errors.New("该秘钥仅可用于验证")
+			}
+			s.signKid = kid
+			return nil
+		}
+	}
+	return ErrJwtKeyNotFound
+}
+
+// Rotate 新增秘钥并作为签名秘钥 旧秘钥继续用于验证
+func (s *JwtKeySet) Rotate(key *JwtKey) error {
+	if err := s.Add(key); err != nil {
+		return err
+	}
+	return s.SetSigning(key.Kid)
+}
+
+func (s *JwtKeySet) Get(kid string) (*JwtKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, k := range s.keys {
+		if k.Kid == kid {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+// SigningKey 当前签名秘钥
+func (s *JwtKeySet) SigningKey() (*JwtKey, error) {
+	s.mu.RLock()
+	kid := s.signKid
+	s.mu.RUnlock()
+	key, ok := s.Get(kid)
+	if !ok {
+		return nil, ErrJwtKeyNotFound
+	}
+	return key, nil
+}
+
+// Sign 使用当前签名秘钥签发
+func (s *JwtKeySet) Sign(claims jwt.Claims) (string, error) {
+	key, err := s.SigningKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Alg), claims)
+	if len(key.Kid) > 0 {
+		token.Header["kid"] = key.Kid
+	}
+	return token.SignedString(key.signKey())
+}
+
+// Keyfunc 按kid查找验证秘钥 令牌的算法必须与秘钥一致 防止算法混淆
+func (s *JwtKeySet) Keyfunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := s.Get(kid)
+	if !ok {
+		return nil, ErrJwtKeyNotFound
+	}
+	if token.Method == nil || token.Method.Alg() != key.Alg {
+		return nil, errors.Errorf("jwt算法不匹配 需要%s", key.Alg)
+	}
+	return key.verifyKey(), nil
+}
+
+// Jwk RFC 7517 公钥
+type Jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type Jwks struct {
+	Keys []Jwk `json:"keys"`
+}
+
+// JWKS 导出全部非对称公钥 对称秘钥不会导出
+func (s *JwtKeySet) JWKS() Jwks {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	enc := base64.RawURLEncoding
+	result := Jwks{Keys: make([]Jwk, 0, len(s.keys))}
+	for _, k := range s.keys {
+		item := Jwk{Kid: k.Kid, Use: "sig", Alg: k.Alg}
+		switch pub := k.Public.(type) {
+		case *rsa.PublicKey:
+			item.Kty = "RSA"
+			item.N = enc.EncodeToString(pub.N.Bytes())
+			item.E = enc.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case *ecdsa.PublicKey:
+			ecdhKey, err := pub.ECDH()
+			if err != nil {
+				continue
+			}
+			// 非压缩格式 0x04 + X + Y
+			raw := ecdhKey.Bytes()[1:]
+			item.Kty = "EC"
+			item.Crv = "P-256"
+			item.X = enc.EncodeToString(raw[:len(raw)/2])
+			item.Y = enc.EncodeToString(raw[len(raw)/2:])
+		case ed25519.PublicKey:
+			item.Kty = "OKP"
+			item.Crv = "Ed25519"
+			item.X = enc.EncodeToString(pub)
+		default:
+			continue
+		}
+		result.Keys = append(result.Keys, item)
+	}
+	return result
+}
+
+// JwksHandler 输出JWKS keys通常为 JwtHelper.Keys()
+func JwksHandler(keys *JwtKeySet) iris.Handler {
+	return func(ctx iris.Context) {
+		ctx.Header("Cache-Control", "public, max-age=300")
+		ctx.StatusCode(http.StatusOK)
+		_ = ctx.JSON(keys.JWKS())
+	}
+}
+
+// MountJwks 在party上挂载 /.well-known/jwks.json
+func MountJwks(party iris.Party, keys *JwtKeySet) {
+	party.Get("/.well-known/jwks.json", JwksHandler(keys))
+}
@@ -0,0 +1,176 @@
+package pipe
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestJwtKeyRotate(t *testing.T) {
+	legacy := NewJwtHelper(nil).GenJwtToken("u1", "web")
+
+	helper := NewJwtHelper(nil)
+	keys := helper.Keys()
+	var err error
+
+	tokens := map[string]string{}
+	for _, alg := range []string{JwtAlgRS256, JwtAlgES256, JwtAlgEdDSA, JwtAlgHS256} {
+		key, err := GenerateJwtKey("k-"+alg, alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = keys.Rotate(key); err != nil {
+			t.Fatal(err)
+		}
+		token := helper.GenJwtToken("u1", "web")
+		parsed, _, err := jwtParser.ParseUnverified(token, jwt.MapClaims{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.Header["alg"] != alg || parsed.Header["kid"] != key.Kid {
+			t.Fatalf("签发头部错误 %v", parsed.Header)
+		}
+		tokens[key.Kid] = token
+	}
+
+	// 轮换后旧秘钥签发的令牌仍然有效
+	tokens["legacy"] = legacy
+	for kid, token := range tokens {
+		flat, err := helper.TokenExtract(JwtPrefix+token, ctJwt)
+		if err != nil {
+			t.Fatalf("%s 验证失败 %s", kid, err)
+		}
+		if flat.UserId != "u1" {
+			t.Fatalf("%s 解析错误 %+v", kid, flat)
+		}
+	}
+
+	// 移除后无法验证
+	if err = keys.Remove("k-" + JwtAlgRS256); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = helper.TokenExtract(tokens["k-"+JwtAlgRS256], ctJwt); err == nil {
+		t.Fatal("秘钥移除后应无法验证")
+	}
+	if err = keys.Remove("k-" + JwtAlgHS256); err == nil {
+		t.Fatal("不能移除当前签名秘钥")
+	}
+}
+
+func TestJwtKeyAlgConfusion(t *testing.T) {
+	key, err := GenerateJwtKey("rsa", JwtAlgRS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewJwtKeySet(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	helper := NewJwtHelperWithKeys(nil, keys)
+
+	// 使用公钥作为HS256秘钥伪造的令牌
+	pubDer, _ := x509.MarshalPKIXPublicKey(key.Public)
+	pubPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDer})
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"userId": "u1", "env": "web", "loginTime": ""})
+	forged.Header["kid"] = "rsa"
+	st, _ := forged.SignedString(pubPem)
+	if _, err = helper.TokenExtract(st, ctJwt); err == nil {
+		t.Fatal("算法不一致的令牌应被拒绝")
+	}
+
+	none := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"userId": "u1", "env": "web", "loginTime": ""})
+	none.Header["kid"] = "rsa"
+	st, _ = none.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if _, err = helper.TokenExtract(st, ctJwt); err == nil {
+		t.Fatal("none算法应被拒绝")
+	}
+
+	// 仅有公钥时可以验证但不能签名
+	verifyOnly, err := NewJwtKeyFromPEM("rsa-pub", JwtAlgRS256, pubPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verifyOnly.CanSign() {
+		t.Fatal("公钥不能用于签名")
+	}
+	if err = keys.Add(verifyOnly); err != nil {
+		t.Fatal(err)
+	}
+	if err = keys.SetSigning("rsa-pub"); err == nil {
+		t.Fatal("仅验证的秘钥不能作为签名秘钥")
+	}
+}
+
+func TestJwtHelperKeys(t *testing.T) {
+	_, rdb := newMiniRedisClient(t)
+	a, b := NewJwtHelper(rdb), NewJwtHelper(rdb)
+	key, err := GenerateJwtKey("a-ed", JwtAlgEdDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 轮换只影响自身
+	if err = a.Keys().Rotate(key); err != nil {
+		t.Fatal(err)
+	}
+	token := a.GenJwtToken("u1", "web")
+	if _, err = b.TokenExtract(token, ctJwt); err == nil {
+		t.Fatal("其他helper不应能验证")
+	}
+	if k, _ := b.Keys().SigningKey(); k.Kid != "" {
+		t.Fatalf("其他helper的签名秘钥不应改变 %s", k.Kid)
+	}
+
+	// pipe使用ctx中的helper签发与验证
+	ctx := mockIrisContext()
+	a.Handler()(ctx)
+	gen := JwtGen.Run(ctx, &PipeJwtDep{Env: "web", UserId: "u1"}, nil, rdb)
+	if gen.Err != nil {
+		t.Fatal(gen.Err)
+	}
+	parsed, _, _ := jwtParser.ParseUnverified(gen.Result, jwt.MapClaims{})
+	if parsed == nil || parsed.Header["kid"] != "a-ed" {
+		t.Fatal("应使用ctx中helper的秘钥签发")
+	}
+	if flat := JwtFlat.Run(ctx, JwtPrefix+gen.Result, nil, rdb); flat.Err != nil || flat.Result.UserId != "u1" {
+		t.Fatalf("应使用ctx中helper的秘钥验证 %v", flat.Err)
+	}
+	if flat := JwtFlat.Run(mockIrisContext(), JwtPrefix+gen.Result, nil, rdb); flat.Err == nil {
+		t.Fatal("没有helper时应使用旧版秘钥验证")
+	}
+}
+
+func TestJwtKeyJWKS(t *testing.T) {
+	rsaKey, _ := GenerateJwtKey("rsa", JwtAlgRS256)
+	ecKey, _ := GenerateJwtKey("ec", JwtAlgES256)
+	edKey, _ := GenerateJwtKey("ed", JwtAlgEdDSA)
+	keys, err := NewJwtKeySet(NewJwtKeyHS256("hs", []byte("secret")), rsaKey, ecKey, edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := keys.JWKS()
+	if len(jwks.Keys) != 3 {
+		t.Fatalf("对称秘钥不应导出 %d", len(jwks.Keys))
+	}
+	want := map[string]string{"rsa": "RSA", "ec": "EC", "ed": "OKP"}
+	for _, k := range jwks.Keys {
+		if want[k.Kid] != k.Kty || k.Use != "sig" {
+			t.Fatalf("jwk错误 %+v", k)
+		}
+		switch k.Kty {
+		case "RSA":
+			if k.E != "AQAB" || len(k.N) < 1 {
+				t.Fatalf("rsa jwk错误 %+v", k)
+			}
+		case "EC":
+			if len(k.X) != 43 || len(k.Y) != 43 || k.Crv != "P-256" {
+				t.Fatalf("ec jwk错误 %+v", k)
+			}
+		case "OKP":
+			if len(k.X) != 43 || k.Crv != "Ed25519" {
+				t.Fatalf("ed25519 jwk错误 %+v", k)
+			}
+		}
+	}
+}
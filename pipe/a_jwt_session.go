@@ -0,0 +1,454 @@
+package pipe
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/kataras/iris/v12"
+	"github.com/pkg/errors"
+	"github.com/redis/rueidis"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 会话 每次登录生成一个会话 访问令牌中携带会话id 刷新令牌为 会话id.随机串
+// 会话存储在 jwt:session:{sid} 的hash中 用户的会话列表为 jwt:sessions:{userId} 的zset 分数为过期时间
+// 刷新令牌每次使用后轮换 旧的刷新令牌再次使用视为泄露 直接注销该会话
+
+var (
+	ErrJwtRevoked          = errors.New("登录已失效")
+	ErrRefreshTokenInvalid = errors.New("刷新令牌无效或已过期")
+	ErrRefreshTokenReused  = errors.New("刷新令牌已被使用 会话已注销")
+)
+
+type JwtSession struct {
+	Id        string `json:"id"`
+	UserId    string `json:"user_id"`
+	Env       string `json:"env"`
+	Device    string `json:"device,omitempty"`
+	Ip        string `json:"ip,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+	LastSeen  int64  `json:"last_seen"`
+	ExpireAt  int64  `json:"expire_at"` // 刷新令牌的过期时间
+}
+
+type JwtTokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	SessionId    string `json:"session_id"`
+	ExpiresIn    int64  `json:"expires_in"` // 访问令牌的有效秒数
+}
+
+type JwtRefreshDep struct {
+	Env          string // 不为空时校验与会话的环境一致
+	RefreshToken string
+}
+
+type JwtRevokeDep struct {
+	UserId    string
+	SessionId string // 为空则注销全部会话
+	Except    string // 注销全部时保留的会话 一般为当前会话
+}
+
+// 校验通过则轮换 不一致则注销会话 -1 会话不存在 0 重复使用 1 成功
+var jwtRefreshScript = rueidis.NewLuaScript(`
+local cur = redis.call("hget", KEYS[1], "refresh")
+if not cur then
+	return -1
+end
+if cur ~= ARGV[1] then
+	redis.call("del", KEYS[1])
+	redis.call("zrem", KEYS[2], ARGV[4])
+	return 0
+end
+redis.call("hset", KEYS[1], "refresh", ARGV[2], "last_seen", ARGV[3], "expire_at", ARGV[6])
+redis.call("pexpire", KEYS[1], ARGV[5])
+redis.call("zadd", KEYS[2], ARGV[6], ARGV[4])
+redis.call("pexpire", KEYS[2], ARGV[5])
+return 1
+`)
+
+// 会话存在时才更新 避免已注销的会话被重新写入
+var jwtTouchScript = rueidis.NewLuaScript(`
+if redis.call("exists", KEYS[1]) == 1 then
+	redis.call("hset", KEYS[1], "last_seen", ARGV[1])
+end
+return 0
+`)
+
+func jwtRandomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func jwtRefreshHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// jwtSplitRefresh 拆分刷新令牌为会话id与秘钥
+func jwtSplitRefresh(token string) (string, string, bool) {
+	sid, secret, ok := strings.Cut(token, ".")
+	if !ok || len(sid) < 1 || len(secret) < 1 {
+		return "", "", false
+	}
+	return sid, secret, true
+}
+
+// SaveSession 写入会话 refreshHash为刷新令牌秘钥的sha256
+func (c *JwtHelper) SaveSession(ctx context.Context, s *JwtSession, refreshHash string, ttl time.Duration) error {
+	key := c.JwtSessionKey(s.Id)
+	listKey := c.JwtSessionListKey(s.UserId)
+	for _, resp := range c.rdb.DoMulti(ctx,
+		c.rdb.B().Hset().Key(key).FieldValue().
+			FieldValue("uid", s.UserId).
+			FieldValue("env", s.Env).
+			FieldValue("device", s.Device).
+			FieldValue("ip", s.Ip).
+			FieldValue("created_at", strconv.FormatInt(s.CreatedAt, 10)).
+			FieldValue("last_seen", strconv.FormatInt(s.LastSeen, 10)).
+			FieldValue("expire_at", strconv.FormatInt(s.ExpireAt, 10)).
+			FieldValue("refresh", refreshHash).Build(),
+		c.rdb.B().Pexpire().Key(key).Milliseconds(ttl.Milliseconds()).Build(),
+		c.rdb.B().Zadd().Key(listKey).ScoreMember().ScoreMember(float64(s.ExpireAt), s.Id).Build(),
+		c.rdb.B().Pexpire().Key(listKey).Milliseconds(ttl.Milliseconds()).Build(),
+	) {
+		if err := resp.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func jwtParseSession(sid string, mp map[string]string) *JwtSession {
+	s := &JwtSession{
+		Id:     sid,
+		UserId: mp["uid"],
+		Env:    mp["env"],
+		Device: mp["device"],
+		Ip:     mp["ip"],
+	}
+	s.CreatedAt, _ = strconv.ParseInt(mp["created_at"], 10, 64)
+	s.LastSeen, _ = strconv.ParseInt(mp["last_seen"], 10, 64)
+	s.ExpireAt, _ = strconv.ParseInt(mp["expire_at"], 10, 64)
+	return s
+}
+
+// GetSession 获取会话 不存在返回ErrJwtRevoked
+func (c *JwtHelper) GetSession(ctx context.Context, sid string) (*JwtSession, error) {
+	mp, err := c.rdb.Do(ctx, c.rdb.B().Hgetall().Key(c.JwtSessionKey(sid)).Build()).AsStrMap()
+	if err != nil {
+		return nil, err
+	}
+	if len(mp["uid"]) < 1 {
+		return nil, ErrJwtRevoked
+	}
+	return jwtParseSession(sid, mp), nil
+}
+
+// ListSessions 用户所有有效的会话 按最后活跃时间倒序
+func (c *JwtHelper) ListSessions(ctx context.Context, userId string) ([]*JwtSession, error) {
+	listKey := c.JwtSessionListKey(userId)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	resps := c.rdb.DoMulti(ctx,
+		c.rdb.B().Zremrangebyscore().Key(listKey).Min("-inf").Max("("+now).Build(),
+		c.rdb.B().Zrange().Key(listKey).Min("0").Max("-1").Build(),
+	)
+	ids, err := resps[1].AsStrSlice()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*JwtSession, 0, len(ids))
+	if len(ids) < 1 {
+		return result, nil
+	}
+	cmds := make(rueidis.Commands, 0, len(ids))
+	for _, sid := range ids {
+		cmds = append(cmds, c.rdb.B().Hgetall().Key(c.JwtSessionKey(sid)).Build())
+	}
+	missing := make([]string, 0)
+	for i, resp := range c.rdb.DoMulti(ctx, cmds...) {
+		mp, err := resp.AsStrMap()
+		if err != nil {
+			return nil, err
+		}
+		if len(mp["uid"]) < 1 {
+			missing = append(missing, ids[i])
+			continue
+		}
+		result = append(result, jwtParseSession(ids[i], mp))
+	}
+	// 已被删除的会话顺带清理
+	if len(missing) > 0 {
+		_ = c.rdb.Do(ctx, c.rdb.B().Zrem().Key(listKey).Member(missing...).Build()).Error()
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastSeen > result[j].LastSeen
+	})
+	return result, nil
+}
+
+// RevokeSession 注销单个会话 该会话的访问令牌与刷新令牌立即失效 仅能注销自己的会话
+func (c *JwtHelper) RevokeSession(ctx context.Context, userId, sid string) error {
+	uid, err := c.rdb.Do(ctx, c.rdb.B().Hget().Key(c.JwtSessionKey(sid)).Field("uid").Build()).ToString()
+	if err != nil && !rueidis.IsRedisNil(err) {
+		return err
+	}
+	if len(uid) > 0 && uid != userId {
+		return errors.New("会话不存在")
+	}
+	for _, resp := range c.rdb.DoMulti(ctx,
+		c.rdb.B().Del().Key(c.JwtSessionKey(sid)).Build(),
+		c.rdb.B().Zrem().Key(c.JwtSessionListKey(userId)).Member(sid).Build(),
+	) {
+		if err := resp.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RevokeAllSessions 注销全部会话 except不为空时保留该会话
+// 未保留会话时同时记录注销时间 此前签发的非会话令牌也会失效
+func (c *JwtHelper) RevokeAllSessions(ctx context.Context, userId, except string) error {
+	listKey := c.JwtSessionListKey(userId)
+	ids, err := c.rdb.Do(ctx, c.rdb.B().Zrange().Key(listKey).Min("0").Max("-1").Build()).AsStrSlice()
+	if err != nil {
+		return err
+	}
+	cmds := make(rueidis.Commands, 0, len(ids)+2)
+	removed := make([]string, 0, len(ids))
+	for _, sid := range ids {
+		if sid == except {
+			continue
+		}
+		removed = append(removed, sid)
+		cmds = append(cmds, c.rdb.B().Del().Key(c.JwtSessionKey(sid)).Build())
+	}
+	if len(removed) > 0 {
+		cmds = append(cmds, c.rdb.B().Zrem().Key(listKey).Member(removed...).Build())
+	}
+	if len(except) < 1 {
+		cmds = append(cmds, c.rdb.B().Set().Key(c.JwtRevokeBeforeKey(userId)).Value(strconv.FormatInt(time.Now().Unix(), 10)).Build())
+	}
+	if len(cmds) < 1 {
+		return nil
+	}
+	for _, resp := range c.rdb.DoMulti(ctx, cmds...) {
+		if err := resp.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revokeTokenSession 注销token所属的会话 token来自redis 无需验证签名
+func (c *JwtHelper) revokeTokenSession(ctx context.Context, userId, token string) error {
+	parsed, _, err := jwtParser.ParseUnverified(strings.TrimPrefix(token, JwtPrefix), jwt.MapClaims{})
+	if err != nil {
+		return nil
+	}
+	claims, ok := parsed.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil
+	}
+	sid, _ := claims["sid"].(string)
+	if len(sid) < 1 {
+		return nil
+	}
+	return c.RevokeSession(ctx, userId, sid)
+}
+
+// JwtCheckRevoked 判断令牌是否已被注销
+// 会话令牌以会话是否存在为准 非会话令牌以全部下线的时间为准
+func (c *JwtHelper) JwtCheckRevoked(ctx context.Context, pack JwtFlatBase) error {
+	if len(pack.SessionId) > 0 {
+		n, err := c.rdb.Do(ctx, c.rdb.B().Exists().Key(c.JwtSessionKey(pack.SessionId)).Build()).AsInt64()
+		if err != nil {
+			return err
+		}
+		if n < 1 {
+			return ErrJwtRevoked
+		}
+		return nil
+	}
+
+	before, err := c.rdb.Do(ctx, c.rdb.B().Get().Key(c.JwtRevokeBeforeKey(pack.UserId)).Build()).AsInt64()
+	if err != nil {
+		if rueidis.IsRedisNil(err) {
+			return nil
+		}
+		return err
+	}
+	loginTime, err := time.Parse(time.RFC3339, pack.LoginTime)
+	if err != nil || loginTime.Unix() <= before {
+		return ErrJwtRevoked
+	}
+	return nil
+}
+
+// TouchSession 更新会话最后活跃时间
+func (c *JwtHelper) TouchSession(ctx context.Context, sid string) error {
+	return jwtTouchScript.Exec(ctx, c.rdb, []string{c.JwtSessionKey(sid)}, []string{strconv.FormatInt(time.Now().Unix(), 10)}).Error()
+}
+
+var (
+	// JwtSessionGen 生成会话令牌 同时返回访问令牌与刷新令牌 严格模式规则与JwtGen一致
+	// 必传origin jwt设置
+	// 可选params 生成参数
+	// 必传db redis Client
+	JwtSessionGen = &RunnerContext[*PipeJwtDep, *JwtGenPipe, rueidis.Client, *JwtTokenPair]{
+		Name: "jwt会话生成",
+		Key:  "jwt_session_gen",
+		call: func(ctx iris.Context, origin *PipeJwtDep, params *JwtGenPipe, db rueidis.Client, more ...any) *RunResp[*JwtTokenPair] {
+			if origin == nil || db == nil {
+				return NewPipeErr[*JwtTokenPair](PipeDepError)
+			}
+			if params == nil {
+				params = new(JwtGenPipe)
+			}
+
+			helper := jwtHelperFromCtx(ctx, db)
+
+			sid, err := jwtRandomHex(16)
+			if err != nil {
+				return NewPipeErr[*JwtTokenPair](err)
+			}
+			secret, err := jwtRandomHex(32)
+			if err != nil {
+				return NewPipeErr[*JwtTokenPair](err)
+			}
+
+			token, err := jwtIssue(ctx, helper, origin, params, sid)
+			if err != nil {
+				return NewPipeErr[*JwtTokenPair](err)
+			}
+
+			now := time.Now()
+			refreshExpire := params.GetRefreshExpire()
+			err = helper.SaveSession(ctx, &JwtSession{
+				Id:        sid,
+				UserId:    origin.UserId,
+				Env:       origin.Env,
+				Device:    origin.Device,
+				Ip:        origin.Ip,
+				CreatedAt: now.Unix(),
+				LastSeen:  now.Unix(),
+				ExpireAt:  now.Add(refreshExpire).Unix(),
+			}, jwtRefreshHash(secret), refreshExpire)
+			if err != nil {
+				return NewPipeErr[*JwtTokenPair](err)
+			}
+
+			return NewPipeResult(&JwtTokenPair{
+				AccessToken:  token,
+				RefreshToken: sid + "." + secret,
+				SessionId:    sid,
+				ExpiresIn:    int64(params.GetExpire().Seconds()),
+			})
+		},
+	}
+	// JwtRefresh 使用刷新令牌换取新的访问令牌 刷新令牌同时轮换
+	// 旧的刷新令牌再次使用时 视为泄露注销整个会话
+	// 必传origin JwtRefreshDep
+	// 可选params 生成参数 仅使用过期时间
+	// 必传db redis Client
+	JwtRefresh = &RunnerContext[*JwtRefreshDep, *JwtGenPipe, rueidis.Client, *JwtTokenPair]{
+		Name: "jwt刷新",
+		Key:  "jwt_refresh",
+		call: func(ctx iris.Context, origin *JwtRefreshDep, params *JwtGenPipe, db rueidis.Client, more ...any) *RunResp[*JwtTokenPair] {
+			if origin == nil || db == nil {
+				return NewPipeErr[*JwtTokenPair](PipeDepError)
+			}
+			if params == nil {
+				params = new(JwtGenPipe)
+			}
+
+			sid, secret, ok := jwtSplitRefresh(origin.RefreshToken)
+			if !ok {
+				return NewPipeErr[*JwtTokenPair](ErrRefreshTokenInvalid)
+			}
+
+			helper := jwtHelperFromCtx(ctx, db)
+			session, err := helper.GetSession(ctx, sid)
+			if err != nil {
+				if errors.Is(err, ErrJwtRevoked) {
+					return NewPipeErr[*JwtTokenPair](ErrRefreshTokenInvalid)
+				}
+				return NewPipeErr[*JwtTokenPair](err)
+			}
+			if len(origin.Env) > 0 && origin.Env != session.Env {
+				return NewPipeErr[*JwtTokenPair](errors.New("刷新令牌环境校验失败"))
+			}
+
+			newSecret, err := jwtRandomHex(32)
+			if err != nil {
+				return NewPipeErr[*JwtTokenPair](err)
+			}
+			now := time.Now()
+			refreshExpire := params.GetRefreshExpire()
+			ret, err := jwtRefreshScript.Exec(ctx, db,
+				[]string{helper.JwtSessionKey(sid), helper.JwtSessionListKey(session.UserId)},
+				[]string{
+					jwtRefreshHash(secret),
+					jwtRefreshHash(newSecret),
+					strconv.FormatInt(now.Unix(), 10),
+					sid,
+					strconv.FormatInt(refreshExpire.Milliseconds(), 10),
+					strconv.FormatInt(now.Add(refreshExpire).Unix(), 10),
+				}).AsInt64()
+			if err != nil {
+				return NewPipeErr[*JwtTokenPair](err)
+			}
+			switch ret {
+			case -1:
+				return NewPipeErr[*JwtTokenPair](ErrRefreshTokenInvalid)
+			case 0:
+				return NewPipeErr[*JwtTokenPair](ErrRefreshTokenReused)
+			}
+
+			token := helper.GenJwtSessionToken(session.UserId, session.Env, sid, params.GetExpire())
+			err = helper.JwtSaveToken(ctx, helper.JwtRedisGenKey(session.UserId, session.Env), token, params.GetExpire())
+			if err != nil {
+				return NewPipeErr[*JwtTokenPair](err)
+			}
+
+			return NewPipeResult(&JwtTokenPair{
+				AccessToken:  token,
+				RefreshToken: sid + "." + newSecret,
+				SessionId:    sid,
+				ExpiresIn:    int64(params.GetExpire().Seconds()),
+			})
+		},
+	}
+	// JwtRevoke 注销会话
+	// 必传origin JwtRevokeDep
+	// 必传db redis Client
+	JwtRevoke = &RunnerContext[*JwtRevokeDep, any, rueidis.Client, bool]{
+		Name: "jwt注销",
+		Key:  "jwt_revoke",
+		call: func(ctx iris.Context, origin *JwtRevokeDep, params any, db rueidis.Client, more ...any) *RunResp[bool] {
+			if origin == nil || db == nil || len(origin.UserId) < 1 {
+				return NewPipeErr[bool](PipeDepError)
+			}
+			helper := jwtHelperFromCtx(ctx, db)
+			var err error
+			if len(origin.SessionId) > 0 {
+				err = helper.RevokeSession(ctx, origin.UserId, origin.SessionId)
+			} else {
+				err = helper.RevokeAllSessions(ctx, origin.UserId, origin.Except)
+			}
+			if err != nil {
+				return NewPipeErr[bool](err)
+			}
+			return NewPipeResult(true)
+		},
+	}
+)
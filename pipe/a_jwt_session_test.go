@@ -0,0 +1,129 @@
+package pipe
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestJwtSessionRefresh(t *testing.T) {
+	_, rdb := newMiniRedisClient(t)
+	ctx := mockIrisContext()
+	dep := &PipeJwtDep{Env: "web", UserId: "u1", Device: "chrome", Ip: "127.0.0.1"}
+
+	gen := JwtSessionGen.Run(ctx, dep, nil, rdb)
+	if gen.Err != nil {
+		t.Fatal(gen.Err)
+	}
+	pair := gen.Result
+	check := func(token string) error {
+		return JwtVisit.Run(ctx, &JwtCheckDep{Env: "web", Authorization: JwtPrefix + token}, nil, rdb).Err
+	}
+	if err := check(pair.AccessToken); err != nil {
+		t.Fatalf("新签发的令牌应有效 %s", err)
+	}
+
+	// 刷新后轮换
+	ref := JwtRefresh.Run(ctx, &JwtRefreshDep{Env: "web", RefreshToken: pair.RefreshToken}, nil, rdb)
+	if ref.Err != nil {
+		t.Fatal(ref.Err)
+	}
+	if ref.Result.SessionId != pair.SessionId || ref.Result.RefreshToken == pair.RefreshToken {
+		t.Fatalf("刷新应保持会话并轮换刷新令牌 %+v", ref.Result)
+	}
+	if err := check(ref.Result.AccessToken); err != nil {
+		t.Fatalf("刷新后的令牌应有效 %s", err)
+	}
+
+	// 旧的刷新令牌再次使用 整个会话注销
+	reuse := JwtRefresh.Run(ctx, &JwtRefreshDep{RefreshToken: pair.RefreshToken}, nil, rdb)
+	if !errors.Is(reuse.Err, ErrRefreshTokenReused) {
+		t.Fatalf("重复使用应被识别 %v", reuse.Err)
+	}
+	if err := check(ref.Result.AccessToken); err == nil {
+		t.Fatal("会话注销后令牌应立即失效")
+	}
+	again := JwtRefresh.Run(ctx, &JwtRefreshDep{RefreshToken: ref.Result.RefreshToken}, nil, rdb)
+	if !errors.Is(again.Err, ErrRefreshTokenInvalid) {
+		t.Fatalf("会话注销后刷新令牌应失效 %v", again.Err)
+	}
+}
+
+func TestJwtSessionRevoke(t *testing.T) {
+	_, rdb := newMiniRedisClient(t)
+	ctx := mockIrisContext()
+	helper := NewJwtHelper(rdb)
+
+	a := JwtSessionGen.Run(ctx, &PipeJwtDep{Env: "web", UserId: "u1", Device: "a"}, nil, rdb).Result
+	b := JwtSessionGen.Run(ctx, &PipeJwtDep{Env: "app", UserId: "u1", Device: "b"}, nil, rdb).Result
+	other := JwtSessionGen.Run(ctx, &PipeJwtDep{Env: "web", UserId: "u2"}, nil, rdb).Result
+
+	sessions, err := helper.ListSessions(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("应有2个会话 %d", len(sessions))
+	}
+
+	// 不能注销其他用户的会话
+	if resp := JwtRevoke.Run(ctx, &JwtRevokeDep{UserId: "u1", SessionId: other.SessionId}, nil, rdb); resp.Err == nil {
+		t.Fatal("注销其他用户的会话应报错")
+	}
+
+	check := func(env, token string) error {
+		return JwtVisit.Run(ctx, &JwtCheckDep{Env: env, Authorization: JwtPrefix + token}, nil, rdb).Err
+	}
+	if resp := JwtRevoke.Run(ctx, &JwtRevokeDep{UserId: "u1", SessionId: b.SessionId}, nil, rdb); resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	if err := check("app", b.AccessToken); err == nil {
+		t.Fatal("被注销的设备应立即失效")
+	}
+	if err := check("web", a.AccessToken); err != nil {
+		t.Fatalf("其他设备不受影响 %s", err)
+	}
+
+	// 全部下线 旧版的非会话令牌同样失效
+	legacy := JwtGen.Run(ctx, &PipeJwtDep{Env: "mini", UserId: "u1"}, nil, rdb).Result
+	if resp := JwtRevoke.Run(ctx, &JwtRevokeDep{UserId: "u1"}, nil, rdb); resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	if err := check("web", a.AccessToken); err == nil {
+		t.Fatal("全部下线后会话令牌应失效")
+	}
+	if err := check("mini", legacy); err == nil {
+		t.Fatal("全部下线后非会话令牌应失效")
+	}
+	if err := check("web", other.AccessToken); err != nil {
+		t.Fatalf("其他用户不受影响 %s", err)
+	}
+	sessions, _ = helper.ListSessions(ctx, "u1")
+	if len(sessions) != 0 {
+		t.Fatalf("全部下线后不应有会话 %d", len(sessions))
+	}
+}
+
+func TestJwtSessionStrictKick(t *testing.T) {
+	_, rdb := newMiniRedisClient(t)
+	ctx := mockIrisContext()
+	dep := &PipeJwtDep{Env: "web", UserId: "u1"}
+
+	first := JwtSessionGen.Run(ctx, dep, &JwtGenPipe{Strict: true}, rdb)
+	if first.Err != nil {
+		t.Fatal(first.Err)
+	}
+	if resp := JwtSessionGen.Run(ctx, dep, &JwtGenPipe{Strict: true}, rdb); resp.Err == nil {
+		t.Fatal("严格模式下不强制应报错")
+	}
+	if resp := JwtSessionGen.Run(ctx, dep, &JwtGenPipe{Strict: true, Force: true}, rdb); resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	// 被挤下线的设备会话已注销
+	resp := JwtVisit.Run(ctx, &JwtCheckDep{Env: "web", Authorization: JwtPrefix + first.Result.AccessToken}, nil, rdb)
+	if resp.Err == nil {
+		t.Fatal("被挤下线的设备应立即失效")
+	}
+	if ref := JwtRefresh.Run(ctx, &JwtRefreshDep{RefreshToken: first.Result.RefreshToken}, nil, rdb); ref.Err == nil {
+		t.Fatal("被挤下线的设备无法刷新")
+	}
+}
@@ -15,6 +15,12 @@ var (
 	jwtSecret = []byte("HefNcCJPz2eT7rq2eW7L9WaFLYO4zZO4446gr")
 )
 
+// jwtLegacyKeys 旧版的HS256秘钥 每次返回新的集合 轮换时互不影响
+func jwtLegacyKeys() *JwtKeySet {
+	keys, _ := NewJwtKeySet(NewJwtKeyHS256("", jwtSecret))
+	return keys
+}
+
 var jwtConfig = irisJwt.Config{
 	//Extractor : jwtToken.FromParameter("token")
 	//Extractor : jwtToken.FromAuthHeader // default
@@ -29,14 +35,14 @@ var jwtConfig = irisJwt.Config{
 		})
 	},
 	ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
+		return jwtLegacyKeys().Keyfunc(token)
 	},
 	Expiration:          false,
 	CredentialsOptional: false,
-	SigningMethod:       jwt.SigningMethodHS256,
 }
 
-var jwtParser = new(jwt.Parser)
+// 算法由秘钥决定 不在列表中的算法(如none)直接拒绝
+var jwtParser = jwt.NewParser(jwt.WithValidMethods([]string{JwtAlgHS256, JwtAlgRS256, JwtAlgES256, JwtAlgEdDSA}))
 
 var ctJwt = irisJwt.New(jwtConfig)
 
@@ -46,8 +52,33 @@ const (
 	JwtShortLen    = 12
 )
 
+const jwtHelperCtxKey = "jwt_helper"
+
+// JwtHelper 签名与验证使用自身的秘钥集合 轮换只影响该helper
 type JwtHelper struct {
-	rdb rueidis.Client
+	rdb  rueidis.Client
+	keys *JwtKeySet
+}
+
+// Keys 秘钥集合 通过Rotate Add Remove轮换
+func (c *JwtHelper) Keys() *JwtKeySet {
+	return c.keys
+}
+
+// Handler 写入ctx 之后的jwt pipe使用该helper的秘钥签发与验证 未写入时使用旧版的HS256秘钥
+func (c *JwtHelper) Handler() iris.Handler {
+	return func(ctx iris.Context) {
+		ctx.Values().Set(jwtHelperCtxKey, c)
+		ctx.Next()
+	}
+}
+
+// jwtHelperFromCtx 获取ctx中的helper redis使用pipe传入的rdb
+func jwtHelperFromCtx(ctx iris.Context, rdb rueidis.Client) *JwtHelper {
+	if h, ok := ctx.Values().Get(jwtHelperCtxKey).(*JwtHelper); ok && h != nil {
+		return NewJwtHelperWithKeys(rdb, h.keys)
+	}
+	return NewJwtHelper(rdb)
 }
 
 // TokenExtract jwt验证
@@ -56,7 +87,7 @@ func (c *JwtHelper) TokenExtract(token string, m *irisJwt.Middleware) (*JwtFlatB
 	if strings.HasPrefix(token, JwtPrefix) {
 		tk = strings.TrimPrefix(token, JwtPrefix)
 	}
-	parsedToken, err := jwtParser.Parse(tk, m.Config.ValidationKeyGetter)
+	parsedToken, err := jwtParser.Parse(tk, c.keys.Keyfunc)
 	if err != nil {
 		return nil, err
 	}
@@ -85,6 +116,9 @@ func (c *JwtHelper) TokenExtract(token string, m *irisJwt.Middleware) (*JwtFlatB
 		st.UserId = claims["userId"].(string)
 		st.Env = claims["env"].(string)
 		st.LoginTime = claims["loginTime"].(string)
+		if sid, ok := claims["sid"].(string); ok {
+			st.SessionId = sid
+		}
 		return st, nil
 	}
 
@@ -98,8 +132,21 @@ func (c *JwtHelper) GenJwtToken(userId, env string) string {
 		"env":       env,
 		"loginTime": n.Format(time.RFC3339),
 	}
-	token := irisJwt.NewTokenWithClaims(jwt.SigningMethodHS256, mcp)
-	tokenString, _ := token.SignedString(jwtSecret)
+	tokenString, _ := c.keys.Sign(mcp)
+	return tokenString
+}
+
+// GenJwtSessionToken 会话令牌 带有会话id与过期时间 过期后使用刷新令牌换取
+func (c *JwtHelper) GenJwtSessionToken(userId, env, sid string, expire time.Duration) string {
+	n := time.Now()
+	mcp := jwt.MapClaims{
+		"userId":    userId,
+		"env":       env,
+		"sid":       sid,
+		"loginTime": n.Format(time.RFC3339),
+		"exp":       n.Add(expire).Unix(),
+	}
+	tokenString, _ := c.keys.Sign(mcp)
 	return tokenString
 }
 
@@ -110,6 +157,16 @@ func (c *JwtHelper) JwtRedisGenKey(userId, env string) string {
 	return "jwt:" + userId + ":" + env
 }
 
+func (c *JwtHelper) JwtSessionKey(sid string) string {
+	return "jwt:session:" + sid
+}
+func (c *JwtHelper) JwtSessionListKey(userId string) string {
+	return "jwt:sessions:" + userId
+}
+func (c *JwtHelper) JwtRevokeBeforeKey(userId string) string {
+	return "jwt:revoke_before:" + userId
+}
+
 func (c *JwtHelper) JwtRedisGetKey(ctx context.Context, key string) rueidis.RedisResult {
 	return c.rdb.Do(ctx, c.rdb.B().Get().Key(key).Build())
 }
@@ -119,8 +176,18 @@ func (c *JwtHelper) JwtSaveToken(ctx context.Context, key string, token string,
 	return insetResp.Error()
 }
 
+// NewJwtHelper 使用旧版的HS256秘钥
 func NewJwtHelper(rdb rueidis.Client) *JwtHelper {
+	return NewJwtHelperWithKeys(rdb, jwtLegacyKeys())
+}
+
+// NewJwtHelperWithKeys 使用独立的秘钥集合 keys为空时使用旧版的HS256秘钥
+func NewJwtHelperWithKeys(rdb rueidis.Client, keys *JwtKeySet) *JwtHelper {
+	if keys == nil {
+		keys = jwtLegacyKeys()
+	}
 	return &JwtHelper{
-		rdb: rdb,
+		rdb:  rdb,
+		keys: keys,
 	}
 }
@@ -38,7 +38,7 @@ var (
 			isShort := pack.IsShort()
 
 			rdb := db
-			helper := NewJwtHelper(rdb)
+			helper := jwtHelperFromCtx(ctx, rdb)
 
 			if isShort {
 				// 如果是short
@@ -62,6 +62,12 @@ var (
 					logger.JM.ErrorE(err, "续期token失败 %s %s", pack.UserId, pack.Env)
 				}
 			}
+			if len(pack.SessionId) > 0 {
+				err := helper.TouchSession(context.Background(), pack.SessionId)
+				if err != nil {
+					logger.JM.ErrorE(err, "更新会话活跃时间失败 %s", pack.SessionId)
+				}
+			}
 			return NewPipeResult(resp.Result)
 		},
 	}
@@ -49,10 +49,10 @@ var (
 			return NewPipeResult(pass)
 		},
 	}
-	// pipeKvListValid 多个kv结构验证器 必传params
-	pipeKvListValid = &RunnerContext[any, *KvsValidPipe, any, []bool]{
-		Name: "kv验证器",
-		Key:  "kv_valid",
+	// KvsValid 多个kv结构验证器 必传params
+	KvsValid = &RunnerContext[any, *KvsValidPipe, any, []bool]{
+		Name: "多kv验证器",
+		Key:  "kvs_valid",
 		call: func(ctx iris.Context, origin any, params *KvsValidPipe, db any, more ...any) *RunResp[[]bool] {
 
 			if params == nil {
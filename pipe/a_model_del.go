@@ -5,34 +5,87 @@ import (
 	"github.com/kataras/iris/v12"
 	"github.com/qiniu/qmgo"
 	"go.mongodb.org/mongo-driver/bson"
+	"slices"
+	"strings"
+	"time"
 )
 
+// SoftDeleteKey 软删除时写入的时间字段
+const SoftDeleteKey = "delete_at"
+
 type ModelDelConfig struct {
-	QueryFilter *ut.QueryFull `json:"query_filter,omitempty"`
-	ModelId     string        `json:"model_id,omitempty"`
-	RowId       string        `json:"row_id,omitempty"`
+	QueryFilter *ut.QueryFull  `json:"query_filter,omitempty"`
+	ModelId     string         `json:"model_id,omitempty"`
+	RowId       string         `json:"row_id,omitempty"`
+	Soft        bool           `json:"soft,omitempty"` // 软删除 仅写入delete_at
+	Before      map[string]any `json:"-"`              // 运行后写入 被操作行的原始值
+}
+
+// SoftDeleteFilter 注入软删除过滤 deleted为true则仅匹配已软删除的行
+// 过滤条件中已有的delete_at条件会被移除 防止客户端传入条件绕过
+func SoftDeleteFilter(ft *ut.QueryFull, deleted bool) {
+	if ft.QueryParse == nil {
+		ft.QueryParse = new(ut.QueryParse)
+	}
+	ft.And = slices.DeleteFunc(ft.And, func(kov *ut.Kov) bool {
+		return kov != nil && (kov.Key == SoftDeleteKey || strings.HasPrefix(kov.Key, SoftDeleteKey+"."))
+	})
+	ft.And = append(ft.And, &ut.Kov{
+		Key:   SoftDeleteKey,
+		Op:    "exists",
+		Value: deleted,
+	})
+}
+
+// modelDelFind 获取出需要操作的那一行写入Before deleted为nil则不判断软删除
+func modelDelFind(ctx iris.Context, params *ModelDelConfig, db *qmgo.Database, deleted *bool) error {
+	ft := params.QueryFilter
+	if ft == nil {
+		ft = new(ut.QueryFull)
+	}
+	if ft.QueryParse == nil {
+		ft.QueryParse = new(ut.QueryParse)
+	}
+	ft.And = append(ft.And, &ut.Kov{
+		Key:   ut.DefaultUidTag,
+		Value: params.RowId,
+	})
+	if deleted != nil {
+		SoftDeleteFilter(ft, *deleted)
+	}
+
+	var result = make(map[string]any)
+	pipeline := ut.QueryToMongoPipeline(ft)
+	err := db.Collection(params.ModelId).Aggregate(ctx, pipeline).One(&result)
+	if err != nil {
+		return err
+	}
+	params.Before = result
+	return nil
 }
 
 var (
 	// ModelDel 模型单条删除
-	// 必传params ModelDelConfig 必传modelId和rowId
+	// 必传params ModelDelConfig 必传modelId和rowId Soft为true时仅写入delete_at
 	// 必传db 为qmgo的qmgo.Database
 	ModelDel = &RunnerContext[any, *ModelDelConfig, *qmgo.Database, any]{
 		Key:  "model_ctx_del",
 		Name: "模型单条删除",
 		call: func(ctx iris.Context, origin any, params *ModelDelConfig, db *qmgo.Database, more ...any) *RunResp[any] {
-			ft := params.QueryFilter
-			if ft == nil {
-				ft = new(ut.QueryFull)
+			if params.Soft {
+				deleted := false
+				err := modelDelFind(ctx, params, db, &deleted)
+				if err != nil {
+					return NewPipeErr[any](err)
+				}
+				err = db.Collection(params.ModelId).UpdateOne(ctx, bson.M{ut.DefaultUidTag: params.RowId}, bson.M{"$set": bson.M{SoftDeleteKey: time.Now()}})
+				if err != nil {
+					return NewPipeErr[any](err)
+				}
+				return NewPipeResult[any]("ok")
 			}
-			ft.And = append(ft.And, &ut.Kov{
-				Key:   ut.DefaultUidTag,
-				Value: params.RowId,
-			})
 
-			var result = make(map[string]any)
-			pipeline := ut.QueryToMongoPipeline(ft)
-			err := db.Collection(params.ModelId).Aggregate(ctx, pipeline).One(&result)
+			err := modelDelFind(ctx, params, db, nil)
 			if err != nil {
 				return NewPipeErr[any](err)
 			}
@@ -44,4 +97,45 @@ var (
 			return NewPipeResult[any]("ok")
 		},
 	}
+	// ModelRestore 恢复软删除的单条
+	// 必传params ModelDelConfig 必传modelId和rowId
+	// 必传db 为qmgo的qmgo.Database
+	ModelRestore = &RunnerContext[any, *ModelDelConfig, *qmgo.Database, any]{
+		Key:  "model_ctx_restore",
+		Name: "模型单条恢复",
+		call: func(ctx iris.Context, origin any, params *ModelDelConfig, db *qmgo.Database, more ...any) *RunResp[any] {
+			deleted := true
+			err := modelDelFind(ctx, params, db, &deleted)
+			if err != nil {
+				return NewPipeErr[any](err)
+			}
+			err = db.Collection(params.ModelId).UpdateOne(ctx, bson.M{ut.DefaultUidTag: params.RowId}, bson.M{
+				"$unset": bson.M{SoftDeleteKey: ""},
+				"$set":   bson.M{"update_at": time.Now()},
+			})
+			if err != nil {
+				return NewPipeErr[any](err)
+			}
+			return NewPipeResult[any]("ok")
+		},
+	}
+	// ModelPurge 彻底删除已软删除的单条
+	// 必传params ModelDelConfig 必传modelId和rowId
+	// 必传db 为qmgo的qmgo.Database
+	ModelPurge = &RunnerContext[any, *ModelDelConfig, *qmgo.Database, any]{
+		Key:  "model_ctx_purge",
+		Name: "模型单条彻底删除",
+		call: func(ctx iris.Context, origin any, params *ModelDelConfig, db *qmgo.Database, more ...any) *RunResp[any] {
+			deleted := true
+			err := modelDelFind(ctx, params, db, &deleted)
+			if err != nil {
+				return NewPipeErr[any](err)
+			}
+			err = db.Collection(params.ModelId).Remove(ctx, bson.M{ut.DefaultUidTag: params.RowId})
+			if err != nil {
+				return NewPipeErr[any](err)
+			}
+			return NewPipeResult[any]("ok")
+		},
+	}
 )
@@ -0,0 +1,25 @@
+package pipe
+
+import (
+	"github.com/23233/ggg/ut"
+	"testing"
+)
+
+func TestSoftDeleteFilter(t *testing.T) {
+	ft := new(ut.QueryFull)
+	SoftDeleteFilter(ft, false)
+	if len(ft.And) != 1 || ft.And[0].Key != SoftDeleteKey || ft.And[0].Op != "exists" || ft.And[0].Value != false {
+		t.Fatalf("软删除过滤注入错误 %+v", ft.And)
+	}
+
+	// 客户端传入的delete_at条件被移除 以注入的为准
+	ft = &ut.QueryFull{QueryParse: &ut.QueryParse{And: []*ut.Kov{
+		{Key: "name", Value: "a"},
+		{Key: SoftDeleteKey, Op: "exists", Value: true},
+		{Key: SoftDeleteKey + ".x", Op: "gt", Value: 1},
+	}}}
+	SoftDeleteFilter(ft, false)
+	if len(ft.And) != 2 || ft.And[0].Key != "name" || ft.And[1].Key != SoftDeleteKey || ft.And[1].Value != false {
+		t.Fatalf("应覆盖客户端传入的delete_at过滤 %+v", ft.And)
+	}
+}
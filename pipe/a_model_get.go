@@ -9,6 +9,9 @@ import (
 type ModelGetData struct {
 	Single        bool `json:"single,omitempty"`          // 仅获取单条 在single的情况下不会返回数量
 	GetQueryCount bool `json:"get_query_count,omitempty"` // 返回匹配条数
+	SoftDelete    bool `json:"soft_delete,omitempty"`     // 模型开启了软删除 为true时才注入delete_at过滤
+	WithDeleted   bool `json:"with_deleted,omitempty"`    // 包含软删除的行
+	OnlyDeleted   bool `json:"only_deleted,omitempty"`    // 仅获取软删除的行 回收站使用
 }
 
 type ModelGetDataDep struct {
@@ -19,7 +22,7 @@ type ModelGetDataDep struct {
 var (
 	// QueryGetData 通过模型解析出query获取内容
 	// 必传origin ModelGetDataDep 中的modelId
-	// 必传params ModelGetData 需要设定为是否为单条以及是否获取匹配条数
+	// 必传params ModelGetData 需要设定为是否为单条以及是否获取匹配条数 SoftDelete为true时默认不返回软删除的行
 	// 必传db 为qmgo的Database
 	QueryGetData = &RunnerContext[*ModelGetDataDep, *ModelGetData, *qmgo.Database, *ut.MongoFacetResult]{
 		Key:  "query_get_data",
@@ -30,6 +33,13 @@ var (
 				origin.Query.PageSize = 1
 			}
 			origin.Query.GetCount = params.GetQueryCount
+			if params.SoftDelete {
+				if params.OnlyDeleted {
+					SoftDeleteFilter(origin.Query, true)
+				} else if !params.WithDeleted {
+					SoftDeleteFilter(origin.Query, false)
+				}
+			}
 			pipeline := ut.QueryToMongoPipeline(origin.Query)
 
 			var err error
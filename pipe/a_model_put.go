@@ -20,7 +20,9 @@ type ModelPutConfig struct {
 	RowId       string         `json:"row_id,omitempty"`
 	UpdateTime  bool           `json:"update_time,omitempty"`
 	UpdateForce bool           `json:"update_force,omitempty"` // 强行覆盖
+	SoftDelete  bool           `json:"soft_delete,omitempty"`  // 模型开启了软删除 为true时软删除的行不允许修改
 	BodyMap     map[string]any `json:"body_map,omitempty"`
+	Before      map[string]any `json:"-"` // 运行后写入 变更字段的原始值
 }
 
 func parseToTime(val interface{}) (time.Time, bool) {
@@ -155,6 +157,10 @@ var (
 				Key:   ut.DefaultUidTag,
 				Value: params.RowId,
 			})
+			// 软删除的行不允许修改
+			if params.SoftDelete {
+				SoftDeleteFilter(ft, false)
+			}
 
 			pipeline := ut.QueryToMongoPipeline(ft)
 
@@ -197,6 +203,11 @@ var (
 				return NewPipeErr[map[string]any](err)
 			}
 
+			params.Before = make(map[string]any, len(diff))
+			for k := range diff {
+				params.Before[k] = result[k]
+			}
+
 			return NewPipeResult[map[string]any](diff)
 		},
 	}
@@ -0,0 +1,193 @@
+package pipe
+
+import (
+	"context"
+	"github.com/kataras/iris/v12"
+	"github.com/qiniu/qmgo"
+	"github.com/redis/rueidis"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// OauthLoginDep 第三方登录
+type OauthLoginDep struct {
+	Provider    OauthProvider
+	Code        string
+	RedirectUri string // 标准oauth2时必须与跳转授权页时一致
+	State       string // 标准oauth2时必传 由 OauthStateGen 生成 需与cookie中的一致
+	Env         string
+	BindUid     string           // 不为空时为已登录用户绑定第三方账号
+	Collection  *qmgo.Collection // 用户表
+}
+
+type OauthLoginResult struct {
+	Token    string           `json:"token"`
+	UserId   string           `json:"user_id"`
+	Created  bool             `json:"created"` // 是否为新注册的用户
+	Platform *AccountPlatform `json:"platform"`
+}
+
+// MergeAccountPlatform 合并平台信息 相同平台相同应用相同pid时更新 否则追加
+func MergeAccountPlatform(platforms []*AccountPlatform, p *AccountPlatform) []*AccountPlatform {
+	for _, v := range platforms {
+		if v.Name != p.Name || v.Appid != p.Appid || v.Pid != p.Pid {
+			continue
+		}
+		if len(p.UnionId) > 0 {
+			v.UnionId = p.UnionId
+		}
+		if len(p.NickName) > 0 {
+			v.NickName = p.NickName
+		}
+		if len(p.AvatarUrl) > 0 {
+			v.AvatarUrl = p.AvatarUrl
+		}
+		if len(p.Phone) > 0 {
+			v.Phone = p.Phone
+		}
+		if len(p.Scopes) > 0 {
+			v.Scopes = p.Scopes
+		}
+		if !p.AuthorTime.IsZero() {
+			v.AuthorTime = p.AuthorTime
+		}
+		return platforms
+	}
+	return append(platforms, p)
+}
+
+// OauthUnionFamily 平台所属的开放平台 为名称中第一个_之前的部分
+// unionid仅在同一开放平台内通用 如 wechat_mini 与 wechat_web
+func OauthUnionFamily(name string) string {
+	family, _, _ := strings.Cut(name, "_")
+	return family
+}
+
+// OauthIndexModel 平台身份的唯一索引 防止并发首次登录时创建重复账号 需要在用户表上创建
+func OauthIndexModel() mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys: bson.D{{Key: "platforms.name", Value: 1}, {Key: "platforms.appid", Value: 1}, {Key: "platforms.pid", Value: 1}},
+		Options: options.Index().SetName("platforms_pid_unique").SetUnique(true).
+			SetPartialFilterExpression(bson.M{"platforms.pid": bson.M{"$exists": true}}),
+	}
+}
+
+// pickOauthAccount 优先选择pid完全一致的账号 其次为同一开放平台下unionid一致的账号
+func pickOauthAccount(accounts []*GenericsAccount, p *AccountPlatform) *GenericsAccount {
+	var union *GenericsAccount
+	family := OauthUnionFamily(p.Name)
+	for _, account := range accounts {
+		for _, v := range account.Platforms {
+			if v.Name == p.Name && v.Appid == p.Appid && v.Pid == p.Pid {
+				return account
+			}
+			if union == nil && len(p.UnionId) > 0 && v.UnionId == p.UnionId && OauthUnionFamily(v.Name) == family {
+				union = account
+			}
+		}
+	}
+	return union
+}
+
+// OauthAccountLink 根据pid或同一开放平台下的unionid查找账号 找到后合并平台信息 未找到时创建新账号
+// bindUid不为空时将平台合并到该用户上 若平台已属于其他用户则返回 ErrOauthBound
+// 用户表需要创建 OauthIndexModel 索引 并发创建冲突时会重新查找已创建的账号
+func OauthAccountLink(ctx context.Context, db *qmgo.Collection, p *AccountPlatform, bindUid string) (*GenericsAccount, bool, error) {
+	return oauthAccountLink(ctx, db, p, bindUid, false)
+}
+
+func oauthAccountLink(ctx context.Context, db *qmgo.Collection, p *AccountPlatform, bindUid string, retried bool) (*GenericsAccount, bool, error) {
+	or := bson.A{bson.M{"platforms": bson.M{"$elemMatch": bson.M{"name": p.Name, "appid": p.Appid, "pid": p.Pid}}}}
+	if len(p.UnionId) > 0 {
+		namePattern := "^" + regexp.QuoteMeta(OauthUnionFamily(p.Name)) + "(_|$)"
+		or = append(or, bson.M{"platforms": bson.M{"$elemMatch": bson.M{"name": bson.M{"$regex": namePattern}, "union_id": p.UnionId}}})
+	}
+	accounts, err := MongoFilters[*GenericsAccount](ctx, db, bson.M{"$or": or})
+	if err != nil {
+		return nil, false, err
+	}
+	account := pickOauthAccount(accounts, p)
+
+	if len(bindUid) > 0 {
+		if account != nil && account.Uid != bindUid {
+			return nil, false, ErrOauthBound
+		}
+		account, err = MongoGetOne[GenericsAccount](ctx, db, bindUid)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	if account != nil {
+		account.Platforms = MergeAccountPlatform(account.Platforms, p)
+		err = MongoUpdateOne(ctx, db, account.Uid, bson.M{"platforms": account.Platforms, "update_at": time.Now()})
+		if err != nil {
+			return nil, false, err
+		}
+		return account, false, nil
+	}
+
+	account = new(GenericsAccount)
+	account.NickName = p.NickName
+	account.AvatarUrl = p.AvatarUrl
+	account.Platforms = []*AccountPlatform{p}
+	_ = account.BeforeInsert(ctx)
+	if _, err = db.InsertOne(ctx, account); err != nil {
+		// 其他请求已经创建了该平台的账号
+		if qmgo.IsDup(err) && !retried {
+			return oauthAccountLink(ctx, db, p, bindUid, true)
+		}
+		return nil, false, err
+	}
+	return account, true, nil
+}
+
+var (
+	// OauthLogin 第三方登录 换取平台身份后查找或创建账号 再通过JwtGen生成token
+	// 必传origin OauthLoginDep
+	// 可选params jwt生成参数
+	// 必传db redis Client
+	OauthLogin = &RunnerContext[*OauthLoginDep, *JwtGenPipe, rueidis.Client, *OauthLoginResult]{
+		Name: "第三方登录",
+		Key:  "oauth_login",
+		call: func(ctx iris.Context, origin *OauthLoginDep, params *JwtGenPipe, db rueidis.Client, more ...any) *RunResp[*OauthLoginResult] {
+			if origin == nil || origin.Provider == nil || origin.Collection == nil || db == nil {
+				return NewPipeErr[*OauthLoginResult](PipeDepError)
+			}
+			if _, ok := origin.Provider.(*OAuth2Provider); ok {
+				if err := OauthStateCheck(ctx, db, origin.State); err != nil {
+					return NewPipeErr[*OauthLoginResult](err)
+				}
+			}
+			platform, err := origin.Provider.Exchange(ctx, origin.Code, origin.RedirectUri)
+			if err != nil {
+				return NewPipeErr[*OauthLoginResult](err)
+			}
+			account, created, err := OauthAccountLink(ctx, origin.Collection, platform, origin.BindUid)
+			if err != nil {
+				return NewPipeErr[*OauthLoginResult](err)
+			}
+			if account.Disable {
+				return NewPipeErr[*OauthLoginResult](ErrOauthDisabled)
+			}
+			token := JwtGen.call(ctx, &PipeJwtDep{
+				Env:    origin.Env,
+				UserId: account.Uid,
+				Ip:     CtxRealIp(ctx),
+			}, params, db)
+			if token.Err != nil {
+				return NewPipeErr[*OauthLoginResult](token.Err)
+			}
+			return NewPipeResult(&OauthLoginResult{
+				Token:    token.Result,
+				UserId:   account.Uid,
+				Created:  created,
+				Platform: platform,
+			})
+		},
+	}
+)
@@ -2,10 +2,11 @@ package pipe
 
 import (
 	"github.com/kataras/iris/v12"
+	"github.com/redis/rueidis"
 	"github.com/ulule/limiter/v3"
-	"github.com/ulule/limiter/v3/drivers/store/memory"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 type RateLimitPipe struct {
@@ -22,23 +23,35 @@ type RateLimitPipe struct {
 	// * 1000 reqs/hour: "1000-H"
 	// * 2000 reqs/day: "2000-D"
 	RatePeriod  string     `json:"rate_period,omitempty"`
-	Store       string     `json:"store,omitempty"`        // 存储 暂时 memory
+	Store       string     `json:"store,omitempty"`        // 存储 memory(默认 进程内共享) redis(多实例共享 需传入db)
 	KeyGen      *StrExpand `json:"key_gen,omitempty"`      // 判断key的来源
 	WriteHeader bool       `json:"write_header,omitempty"` // 是否把rate状态写入到请求header中
 }
 
-func (c *RateLimitPipe) genClient() (*limiter.Limiter, error) {
+func (c *RateLimitPipe) genClient(rdb rueidis.Client) (*limiter.Limiter, error) {
 	rate, err := limiter.NewRateFromFormatted(c.RatePeriod)
 	if err != nil {
 		return nil, err
 	}
-	store := memory.NewStore()
+	var store limiter.Store
+	switch c.Store {
+	case "", RateStoreMemory:
+		store = rateMemoryStore(c.RatePeriod)
+	case RateStoreRedis:
+		if rdb == nil {
+			return nil, PipeDbError
+		}
+		store = NewRueidisRateStore(rdb, RateRedisPrefix+c.RatePeriod)
+	default:
+		return nil, PipeParamsError
+	}
 	return limiter.New(store, rate), nil
 }
 
 var (
 	// RequestRate 限速器 使用 https://github.com/ulule/limiter 实现
 	// 必传params RateLimitPipe
+	// 可选db 为redis Client Store为redis时必传 其他类型视为未传
 	RequestRate = &RunnerContext[any, *RateLimitPipe, any, any]{
 		Name: "请求限速",
 		Key:  "request_rate",
@@ -52,7 +65,8 @@ var (
 				return NewPipeErr[any](err)
 			}
 
-			client, err := params.genClient()
+			rdb, _ := db.(rueidis.Client)
+			client, err := params.genClient(rdb)
 			if err != nil {
 				return NewPipeErr[any](err)
 			}
@@ -71,6 +85,13 @@ var (
 
 			// 超出限速了
 			if rateCtx.Reached {
+				if params.WriteHeader {
+					retry := rateCtx.Reset - time.Now().Unix()
+					if retry < 1 {
+						retry = 1
+					}
+					ctx.Header("Retry-After", strconv.FormatInt(retry, 10))
+				}
 				// 抛出错误
 				return NewPipeErr[any](PipeRatedError).SetReqCode(http.StatusTooManyRequests)
 			}
@@ -0,0 +1,112 @@
+package pipe
+
+import (
+	"context"
+	"github.com/redis/rueidis"
+	"github.com/ulule/limiter/v3"
+	"github.com/ulule/limiter/v3/drivers/store/common"
+	"github.com/ulule/limiter/v3/drivers/store/memory"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	RateStoreMemory = "memory"
+	RateStoreRedis  = "redis"
+	RateRedisPrefix = "rate_limit:"
+)
+
+// 进程内共享的内存存储 以RatePeriod区分
+var rateMemoryStores sync.Map
+
+func rateMemoryStore(period string) limiter.Store {
+	if v, ok := rateMemoryStores.Load(period); ok {
+		return v.(limiter.Store)
+	}
+	v, _ := rateMemoryStores.LoadOrStore(period, memory.NewStoreWithOptions(limiter.StoreOptions{
+		Prefix:          RateRedisPrefix + period,
+		CleanUpInterval: limiter.DefaultCleanUpInterval,
+	}))
+	return v.(limiter.Store)
+}
+
+var (
+	rateIncrScript = rueidis.NewLuaScript(`
+local key = KEYS[1]
+local count = tonumber(ARGV[1])
+local ttl = tonumber(ARGV[2])
+local ret = redis.call("incrby", key, ARGV[1])
+if ret == count then
+	if ttl > 0 then
+		redis.call("pexpire", key, ARGV[2])
+	end
+	return {ret, ttl}
+end
+ttl = redis.call("pttl", key)
+return {ret, ttl}
+`)
+	ratePeekScript = rueidis.NewLuaScript(`
+local key = KEYS[1]
+local v = redis.call("get", key)
+if v == false then
+	return {0, 0}
+end
+local ttl = redis.call("pttl", key)
+return {tonumber(v), ttl}
+`)
+)
+
+// RueidisRateStore 基于rueidis的限速存储 实现 limiter.Store 多实例共享计数
+type RueidisRateStore struct {
+	Prefix string
+	rdb    rueidis.Client
+}
+
+func (c *RueidisRateStore) cacheKey(key string) string {
+	return c.Prefix + ":" + key
+}
+
+func (c *RueidisRateStore) exec(ctx context.Context, script *rueidis.Lua, key string, rate limiter.Rate, args ...string) (limiter.Context, error) {
+	values, err := script.Exec(ctx, c.rdb, []string{c.cacheKey(key)}, args).AsIntSlice()
+	if err != nil {
+		return limiter.Context{}, err
+	}
+	if len(values) != 2 {
+		return limiter.Context{}, PipeRunAfterError
+	}
+	now := time.Now()
+	expiration := now.Add(rate.Period)
+	if values[1] > 0 {
+		expiration = now.Add(time.Duration(values[1]) * time.Millisecond)
+	}
+	return common.GetContextFromState(now, rate, expiration, values[0]), nil
+}
+
+func (c *RueidisRateStore) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	return c.Increment(ctx, key, 1, rate)
+}
+
+func (c *RueidisRateStore) Peek(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	return c.exec(ctx, ratePeekScript, key, rate)
+}
+
+func (c *RueidisRateStore) Reset(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	err := c.rdb.Do(ctx, c.rdb.B().Del().Key(c.cacheKey(key)).Build()).Error()
+	if err != nil {
+		return limiter.Context{}, err
+	}
+	now := time.Now()
+	return common.GetContextFromState(now, rate, now.Add(rate.Period), 0), nil
+}
+
+func (c *RueidisRateStore) Increment(ctx context.Context, key string, count int64, rate limiter.Rate) (limiter.Context, error) {
+	return c.exec(ctx, rateIncrScript, key, rate, strconv.FormatInt(count, 10), strconv.FormatInt(rate.Period.Milliseconds(), 10))
+}
+
+func NewRueidisRateStore(rdb rueidis.Client, prefix string) *RueidisRateStore {
+	return &RueidisRateStore{
+		Prefix: prefix,
+		rdb:    rdb,
+	}
+}
@@ -0,0 +1,118 @@
+package pipe
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/httptest"
+	"github.com/redis/rueidis"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newMiniRedisClient(t *testing.T) (*miniredis.Miniredis, rueidis.Client) {
+	mr := miniredis.RunT(t)
+	rdb, err := rueidis.NewClient(rueidis.ClientOption{
+		InitAddress:       []string{mr.Addr()},
+		DisableCache:      true,
+		ForceSingleClient: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(rdb.Close)
+	return mr, rdb
+}
+
+func rateParams(store string, key string) *RateLimitPipe {
+	return &RateLimitPipe{
+		RatePeriod: "3-M",
+		Store:      store,
+		KeyGen:     &StrExpand{Key: key},
+	}
+}
+
+func TestRequestRateMemory(t *testing.T) {
+	ctx := mockIrisContext()
+	for i := 0; i < 3; i++ {
+		resp := RequestRate.Run(ctx, nil, rateParams(RateStoreMemory, "test_memory"), nil)
+		if resp.Err != nil {
+			t.Fatalf("第%d次请求不应被限速 %s", i+1, resp.Err)
+		}
+	}
+	// 每次调用都应共享同一个存储
+	resp := RequestRate.Run(ctx, nil, rateParams("", "test_memory"), nil)
+	if resp.Err != PipeRatedError || resp.ReqCode != http.StatusTooManyRequests {
+		t.Fatalf("第4次请求应被限速 %v", resp.Err)
+	}
+	// 其他key不受影响
+	resp = RequestRate.Run(ctx, nil, rateParams(RateStoreMemory, "test_memory_other"), nil)
+	if resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+}
+
+func TestRequestRateRedis(t *testing.T) {
+	mr, rdb := newMiniRedisClient(t)
+	ctx := mockIrisContext()
+
+	resp := RequestRate.Run(ctx, nil, rateParams(RateStoreRedis, "test_redis"), nil)
+	if resp.Err != PipeDbError {
+		t.Fatalf("redis存储未传db应报错 %v", resp.Err)
+	}
+	resp = RequestRate.Run(ctx, nil, rateParams(RateStoreRedis, "test_redis"), "rdb")
+	if resp.Err != PipeDbError {
+		t.Fatalf("db不是redis Client时应报错 %v", resp.Err)
+	}
+
+	for i := 0; i < 3; i++ {
+		resp = RequestRate.Run(ctx, nil, rateParams(RateStoreRedis, "test_redis"), rdb)
+		if resp.Err != nil {
+			t.Fatalf("第%d次请求不应被限速 %s", i+1, resp.Err)
+		}
+	}
+	if v, err := mr.Get(RateRedisPrefix + "3-M:test_redis"); err != nil || v != "3" {
+		t.Fatalf("redis计数错误 %s %v", v, err)
+	}
+	if ttl := mr.TTL(RateRedisPrefix + "3-M:test_redis"); ttl <= 0 {
+		t.Fatal("redis计数应有过期时间")
+	}
+
+	resp = RequestRate.Run(ctx, nil, rateParams(RateStoreRedis, "test_redis"), rdb)
+	if resp.Err != PipeRatedError {
+		t.Fatalf("第4次请求应被限速 %v", resp.Err)
+	}
+
+	// 窗口过期之后重新计数
+	mr.FastForward(time.Minute)
+	resp = RequestRate.Run(ctx, nil, rateParams(RateStoreRedis, "test_redis"), rdb)
+	if resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+}
+
+func TestRequestRateHeader(t *testing.T) {
+	_, rdb := newMiniRedisClient(t)
+	app := iris.New()
+	app.Get("/rate", func(ctx iris.Context) {
+		resp := RequestRate.Run(ctx, nil, &RateLimitPipe{
+			RatePeriod:  "2-M",
+			Store:       RateStoreRedis,
+			KeyGen:      &StrExpand{Key: "test_header"},
+			WriteHeader: true,
+		}, rdb)
+		resp.Return(ctx)
+	})
+	e := httptest.New(t, app)
+
+	r := e.GET("/rate").Expect().Status(iris.StatusOK)
+	r.Header("X-RateLimit-Limit").IsEqual("2")
+	r.Header("X-RateLimit-Remaining").IsEqual("1")
+	r.Header("X-RateLimit-Reset").NotEmpty()
+
+	e.GET("/rate").Expect().Status(iris.StatusOK).Header("X-RateLimit-Remaining").IsEqual("0")
+
+	r = e.GET("/rate").Expect().Status(iris.StatusTooManyRequests)
+	r.Header("X-RateLimit-Remaining").IsEqual("0")
+	r.Header("Retry-After").NotEmpty()
+}
@@ -12,17 +12,25 @@ type SmsPipe struct {
 	Mobile     string `json:"mobile,omitempty" bson:"mobile,omitempty"`
 	TemplateId string `json:"template_id,omitempty" bson:"template_id,omitempty"`
 	Code       string `json:"code,omitempty" bson:"code,omitempty"`
+	Ip         string `json:"-" bson:"-"` // 用于ip额度 仅服务端可设置 为空时使用 CtxRealIp
 }
 
 var (
-	// SmsSend 短信发送
+	// SmsSend 短信发送 检查重发冷却与号码 ip的每日额度
 	// 必传params SmsPipe
 	// 必传db SmsClient 的实例
 	SmsSend = &RunnerContext[any, *SmsPipe, *SmsClient, string]{
 		Name: "短信验证码发送",
 		Key:  "sms_send",
 		call: func(ctx iris.Context, origin any, params *SmsPipe, db *SmsClient, more ...any) *RunResp[string] {
-			code, err := db.SendBeforeCheck(ctx, params.TemplateId, params.Mobile)
+			if params == nil || db == nil {
+				return NewPipeErr[string](PipeDepError)
+			}
+			ip := params.Ip
+			if len(ip) < 1 {
+				ip = CtxRealIp(ctx)
+			}
+			code, err := db.SendWithLimit(ctx, params.TemplateId, params.Mobile, ip)
 			return NewPipeResultErr(code, err)
 		},
 	}
@@ -24,6 +24,16 @@ var (
 			return NewPipeResult(sEnc)
 		},
 	}
+	// SwipeImageGet 滑块验证码获取 同时返回服务端渲染的背景与滑块图片 不返回x
+	// 必传db SwipeValidCode 的实例
+	SwipeImageGet = &RunnerContext[any, any, *SwipeValidCode, *SwipeImage]{
+		Name: "滑块验证码图片获取",
+		Key:  "swipe_image_get",
+		call: func(ctx iris.Context, origin any, params any, db *SwipeValidCode, more ...any) *RunResp[*SwipeImage] {
+			img, err := db.GenImage(ctx)
+			return NewPipeResultErr(img, err)
+		},
+	}
 	// SwipeValidCheck 滑块验证码验证
 	// 必传db SwipeValidCode 的实例
 	SwipeValidCheck = &RunnerContext[string, any, *SwipeValidCode, *SwipeValid]{
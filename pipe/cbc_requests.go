@@ -1,14 +1,7 @@
 package pipe
 
 import (
-	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"encoding/base64"
 	"encoding/json"
-	"fmt"
-	"io"
 	"reflect"
 
 	"github.com/kataras/iris/v12"
@@ -17,60 +10,41 @@ import (
 // cbc服务 来解决某些端口需要加密的问题 统一使用post 连query都放在body里面进行加密 没有烦恼
 // iv的下发可以藏起来 通过加密或者unicode等方式增加一些调试难度
 
+// 设置 SetEnvelope 后加密使用信封格式 解密时信封与旧版cbc都支持 iv为空时不再接受旧版cbc
 type CbcService struct {
-	iv []byte
+	iv       []byte
+	envelope *Envelope
 }
 
 func NewCbcService(iv string) *CbcService {
 	return &CbcService{iv: []byte(iv)}
 }
 
-func (c *CbcService) Decrypt(cipherText string) ([]byte, error) {
-	cipherData, err := base64.URLEncoding.DecodeString(cipherText)
-	if err != nil {
-		return nil, err
-	}
+func (c *CbcService) SetEnvelope(envelope *Envelope) *CbcService {
+	c.envelope = envelope
+	return c
+}
 
-	block, err := aes.NewCipher(c.iv)
-	if err != nil {
-		return nil, err
+func (c *CbcService) Decrypt(cipherText string) ([]byte, error) {
+	if IsEnvelope(cipherText) {
+		if c.envelope == nil {
+			return nil, ErrCipherInvalid
+		}
+		return c.envelope.Open(cipherText)
 	}
-
-	if len(cipherData) < aes.BlockSize {
-		return nil, fmt.Errorf("cipher text too short")
+	if len(c.iv) < 1 {
+		return nil, ErrCipherInvalid
 	}
-
-	iv := cipherData[:aes.BlockSize]
-	cipherData = cipherData[aes.BlockSize:]
-
-	mode := cipher.NewCBCDecrypter(block, iv)
-	mode.CryptBlocks(cipherData, cipherData)
-
-	padding := cipherData[len(cipherData)-1]
-	return cipherData[:len(cipherData)-int(padding)], nil
+	return CbcDecrypt(c.iv, cipherText)
 }
 
 func (c *CbcService) Encrypt(plainText []byte) (string, error) {
-	block, err := aes.NewCipher(c.iv)
-	if err != nil {
-		return "", err
+	if c.envelope != nil {
+		return c.envelope.Seal(plainText)
 	}
-
-	padding := aes.BlockSize - len(plainText)%aes.BlockSize
-	padText := bytes.Repeat([]byte{byte(padding)}, padding)
-	plainText = append(plainText, padText...)
-
-	cipherText := make([]byte, aes.BlockSize+len(plainText))
-	iv := cipherText[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return "", err
-	}
-
-	mode := cipher.NewCBCEncrypter(block, iv)
-	mode.CryptBlocks(cipherText[aes.BlockSize:], plainText)
-
-	return base64.URLEncoding.EncodeToString(cipherText), nil
+	return CbcEncrypt(c.iv, plainText)
 }
+
 func (c *CbcService) CbcMainHandler(ctx iris.Context) {
 	// 添加这个 defer 语句
 	defer func() {
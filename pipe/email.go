@@ -0,0 +1,487 @@
+package pipe
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/23233/ggg/ut"
+	"github.com/pkg/errors"
+	"github.com/redis/rueidis"
+	htmlTemplate "html/template"
+	"mime"
+	"net"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// 邮件相关
+// 验证码的存储 重发冷却 每日额度与短信一致 另外支持一次性的登录链接
+
+var (
+	ErrEmailCooldown      = errors.New("邮件已发送,若未收到请稍后重试")
+	ErrEmailQuota         = errors.New("该邮箱今日发送次数已达上限")
+	ErrEmailIpQuota       = errors.New("今日邮件发送次数已达上限")
+	ErrEmailTemplate      = errors.New("邮件模板不存在")
+	ErrEmailLinkInvalid   = errors.New("登录链接无效或已过期")
+	ErrEmailSenderMissing = errors.New("未配置邮件发送")
+)
+
+// EmailMessage 待发送的邮件
+type EmailMessage struct {
+	To      string
+	Subject string
+	Body    string
+	Html    bool
+}
+
+// EmailSender 邮件发送
+type EmailSender interface {
+	Send(ctx context.Context, msg *EmailMessage) error
+}
+
+// SmtpEmailSender 通过smtp发送 465端口使用tls直连 其他端口服务端支持时使用STARTTLS
+type SmtpEmailSender struct {
+	Host        string
+	Port        int
+	Username    string
+	Password    string
+	From        string // 发件人 为空时使用Username
+	FromName    string
+	ImplicitTls bool // 为true时直接使用tls连接 465端口默认开启
+	Timeout     time.Duration
+}
+
+func NewSmtpEmailSender(host string, port int, username, password string) *SmtpEmailSender {
+	return &SmtpEmailSender{
+		Host:        host,
+		Port:        port,
+		Username:    username,
+		Password:    password,
+		ImplicitTls: port == 465,
+		Timeout:     10 * time.Second,
+	}
+}
+
+func (s *SmtpEmailSender) from() string {
+	if len(s.From) > 0 {
+		return s.From
+	}
+	return s.Username
+}
+
+// buildEmail 生成邮件原文 标题与正文均使用utf-8
+func buildEmail(from, fromName string, msg *EmailMessage) []byte {
+	contentType := "text/plain"
+	if msg.Html {
+		contentType = "text/html"
+	}
+	fromHeader := from
+	if len(fromName) > 0 {
+		fromHeader = mime.QEncoding.Encode("UTF-8", fromName) + " <" + from + ">"
+	}
+	var buf bytes.Buffer
+	buf.WriteString("From: " + fromHeader + "\r\n")
+	buf.WriteString("To: " + msg.To + "\r\n")
+	buf.WriteString("Subject: " + mime.QEncoding.Encode("UTF-8", msg.Subject) + "\r\n")
+	buf.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: " + contentType + "; charset=UTF-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	body := base64.StdEncoding.EncodeToString([]byte(msg.Body))
+	for len(body) > 76 {
+		buf.WriteString(body[:76] + "\r\n")
+		body = body[76:]
+	}
+	buf.WriteString(body + "\r\n")
+	return buf.Bytes()
+}
+
+func (s *SmtpEmailSender) Send(ctx context.Context, msg *EmailMessage) error {
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	dialer := &net.Dialer{Timeout: s.Timeout}
+	tlsConfig := &tls.Config{ServerName: s.Host}
+
+	var conn net.Conn
+	var err error
+	if s.ImplicitTls {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return errors.Wrap(err, "连接邮件服务器失败")
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	} else if s.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(s.Timeout))
+	}
+
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if !s.ImplicitTls {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err = c.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		}
+	}
+	if len(s.Username) > 0 {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err = c.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+				return errors.Wrap(err, "邮件服务器认证失败")
+			}
+		}
+	}
+	if err = c.Mail(s.from()); err != nil {
+		return err
+	}
+	if err = c.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(buildEmail(s.from(), s.FromName, msg)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// EmailTemplateData 模板中可用的变量
+type EmailTemplateData struct {
+	Email   string
+	Code    string
+	Link    string
+	Minutes int
+}
+
+// EmailTemplate 邮件模板 使用go template语法 Html为true时正文使用html/template转义
+type EmailTemplate struct {
+	Subject string
+	Body    string
+	Html    bool
+}
+
+func (c *EmailTemplate) Render(data *EmailTemplateData) (*EmailMessage, error) {
+	subject := new(bytes.Buffer)
+	st, err := template.New("subject").Parse(c.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if err = st.Execute(subject, data); err != nil {
+		return nil, err
+	}
+	body := new(bytes.Buffer)
+	if c.Html {
+		bt, err := htmlTemplate.New("body").Parse(c.Body)
+		if err != nil {
+			return nil, err
+		}
+		err = bt.Execute(body, data)
+	} else {
+		bt, err := template.New("body").Parse(c.Body)
+		if err != nil {
+			return nil, err
+		}
+		err = bt.Execute(body, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &EmailMessage{To: data.Email, Subject: subject.String(), Body: body.String(), Html: c.Html}, nil
+}
+
+const (
+	EmailCodeTemplateId = "code"
+	EmailLinkTemplateId = "link"
+)
+
+type EmailClient struct {
+	sender       EmailSender
+	templates    sync.Map
+	linkSecret   []byte
+	expTime      time.Duration // 验证码与链接有效期 默认10分钟
+	cooldown     time.Duration // 重发间隔 默认60秒
+	dailyLimit   int64         // 每个邮箱每日发送上限 默认10 0为不限制
+	ipDailyLimit int64         // 每个ip每日发送上限 默认50 0为不限制
+	maxAttempts  int64         // 验证码允许的验证次数 超过后失效 默认5 0为不限制
+	linkBase     string        // 登录链接的地址
+	redisPrefix  string
+	rdb          rueidis.Client
+}
+
+// NewEmailClient linkSecret用于登录链接签名 多实例部署时需要一致
+func NewEmailClient(sender EmailSender, linkSecret []byte, rdb rueidis.Client) *EmailClient {
+	var client = new(EmailClient)
+	client.sender = sender
+	client.linkSecret = linkSecret
+	if len(client.linkSecret) < 1 {
+		client.linkSecret = make([]byte, 32)
+		_, _ = rand.Read(client.linkSecret)
+	}
+	client.expTime = 10 * time.Minute
+	client.cooldown = time.Minute
+	client.dailyLimit = 10
+	client.ipDailyLimit = 50
+	client.maxAttempts = 5
+	client.redisPrefix = "email_code:"
+	client.rdb = rdb
+	client.SetTemplate(EmailCodeTemplateId, &EmailTemplate{
+		Subject: "您的验证码 {{.Code}}",
+		Body:    "您的验证码为 {{.Code}} ,{{.Minutes}}分钟内有效。如非本人操作请忽略本邮件。",
+	})
+	client.SetTemplate(EmailLinkTemplateId, &EmailTemplate{
+		Subject: "登录链接",
+		Body:    "点击以下链接登录,{{.Minutes}}分钟内有效且仅可使用一次:\n{{.Link}}\n如非本人操作请忽略本邮件。",
+	})
+	return client
+}
+
+func (s *EmailClient) SetSender(sender EmailSender) *EmailClient {
+	s.sender = sender
+	return s
+}
+
+// SetTemplate 注册模板 相同id覆盖
+func (s *EmailClient) SetTemplate(id string, tpl *EmailTemplate) *EmailClient {
+	s.templates.Store(id, tpl)
+	return s
+}
+
+// SetExpire 验证码与链接有效期
+func (s *EmailClient) SetExpire(exp time.Duration) *EmailClient {
+	s.expTime = exp
+	return s
+}
+
+// SetLimit 设置重发间隔与每日额度 额度为0时不限制
+func (s *EmailClient) SetLimit(cooldown time.Duration, dailyLimit, ipDailyLimit int64) *EmailClient {
+	s.cooldown = cooldown
+	s.dailyLimit = dailyLimit
+	s.ipDailyLimit = ipDailyLimit
+	return s
+}
+
+// SetLinkBase 登录链接的地址 token会作为参数拼接在后面 只能由服务端配置
+func (s *EmailClient) SetLinkBase(linkBase string) *EmailClient {
+	s.linkBase = linkBase
+	return s
+}
+
+// SetMaxAttempts 验证码允许的验证次数 超过后需要重新发送 0为不限制
+func (s *EmailClient) SetMaxAttempts(n int64) *EmailClient {
+	s.maxAttempts = n
+	return s
+}
+
+// EmailNormalize 去掉首尾空白并转为小写 作为验证码与额度的key
+func EmailNormalize(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func (s *EmailClient) codeKey(email string) string {
+	return s.redisPrefix + email
+}
+func (s *EmailClient) attemptKey(email string) string {
+	return s.redisPrefix + "attempt:" + email
+}
+func (s *EmailClient) linkKey(nonce string) string {
+	return s.redisPrefix + "link:" + nonce
+}
+
+// limit 检查冷却与额度 kind区分验证码与链接的冷却
+func (s *EmailClient) limit(ctx context.Context, kind, email, ip string) error {
+	day := time.Now().Format("20060102")
+	keys := []string{s.redisPrefix + "cd:" + kind + ":" + email, s.redisPrefix + "day:" + day + ":" + email}
+	if len(ip) > 0 {
+		keys = append(keys, s.redisPrefix+"ip:"+day+":"+ip)
+	}
+	ret, err := sendLimitScript.Exec(ctx, s.rdb, keys, []string{
+		strconv.FormatInt(s.cooldown.Milliseconds(), 10),
+		strconv.FormatInt(s.dailyLimit, 10),
+		strconv.FormatInt(s.ipDailyLimit, 10),
+	}).AsInt64()
+	if err != nil {
+		return err
+	}
+	switch ret {
+	case -1:
+		return ErrEmailCooldown
+	case -2:
+		return ErrEmailQuota
+	case -3:
+		return ErrEmailIpQuota
+	}
+	return nil
+}
+
+func (s *EmailClient) releaseCooldown(ctx context.Context, kind, email string) {
+	_ = s.rdb.Do(ctx, s.rdb.B().Del().Key(s.redisPrefix+"cd:"+kind+":"+email).Build())
+}
+
+func (s *EmailClient) render(templateId string, data *EmailTemplateData) (*EmailMessage, error) {
+	v, ok := s.templates.Load(templateId)
+	if !ok {
+		return nil, ErrEmailTemplate
+	}
+	return v.(*EmailTemplate).Render(data)
+}
+
+func (s *EmailClient) send(ctx context.Context, kind string, templateId string, data *EmailTemplateData, ip string) error {
+	if s.sender == nil {
+		return ErrEmailSenderMissing
+	}
+	msg, err := s.render(templateId, data)
+	if err != nil {
+		return err
+	}
+	if err = s.limit(ctx, kind, data.Email, ip); err != nil {
+		return err
+	}
+	if err = s.sender.Send(ctx, msg); err != nil {
+		// 发送失败允许立即重试 额度依然计算
+		s.releaseCooldown(ctx, kind, data.Email)
+		return err
+	}
+	return nil
+}
+
+// SendCode 发送验证码 templateId为空时使用默认模板
+func (s *EmailClient) SendCode(ctx context.Context, templateId string, email string, ip string) (string, error) {
+	if len(templateId) < 1 {
+		templateId = EmailCodeTemplateId
+	}
+	email = EmailNormalize(email)
+	code := strconv.Itoa(ut.RandomInt(100000, 999999))
+	err := s.send(ctx, "code", templateId, &EmailTemplateData{
+		Email:   email,
+		Code:    code,
+		Minutes: int(s.expTime.Minutes()),
+	}, ip)
+	if err != nil {
+		return "", err
+	}
+	// 新的验证码重新计算验证次数
+	resps := s.rdb.DoMulti(ctx,
+		s.rdb.B().Set().Key(s.codeKey(email)).Value(code).ExSeconds(int64(s.expTime.Seconds())).Build(),
+		s.rdb.B().Del().Key(s.attemptKey(email)).Build(),
+	)
+	for _, resp := range resps {
+		if err = resp.Error(); err != nil {
+			return "", err
+		}
+	}
+	return code, nil
+}
+
+// Valid 验证验证码 每次验证都会计数 超过 maxAttempts 后验证码失效
+func (s *EmailClient) Valid(ctx context.Context, email, code string) bool {
+	if len(code) < 1 {
+		return false
+	}
+	email = EmailNormalize(email)
+	// 先计数再比较 并发的猜测也不会超过次数
+	resps := s.rdb.DoMulti(ctx,
+		s.rdb.B().Get().Key(s.codeKey(email)).Build(),
+		s.rdb.B().Incr().Key(s.attemptKey(email)).Build(),
+		s.rdb.B().Expire().Key(s.attemptKey(email)).Seconds(int64(s.expTime.Seconds())).Build(),
+	)
+	val, err := resps[0].ToString()
+	if err != nil {
+		return false
+	}
+	attempts, err := resps[1].AsInt64()
+	if err != nil {
+		return false
+	}
+	if s.maxAttempts > 0 && attempts > s.maxAttempts {
+		s.DelKey(ctx, email)
+		return false
+	}
+	return hmac.Equal([]byte(code), []byte(val))
+}
+
+// DelKey 删除验证码
+func (s *EmailClient) DelKey(ctx context.Context, email string) {
+	email = EmailNormalize(email)
+	_ = s.rdb.Do(ctx, s.rdb.B().Del().Key(s.codeKey(email), s.attemptKey(email)).Build())
+}
+
+func (s *EmailClient) linkSign(nonce string) string {
+	mac := hmac.New(sha256.New, s.linkSecret)
+	mac.Write([]byte(nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SendMagicLink 发送一次性登录链接 链接为 linkBase 加上 token 参数
+func (s *EmailClient) SendMagicLink(ctx context.Context, templateId string, email string, ip string, linkBase string) error {
+	if len(templateId) < 1 {
+		templateId = EmailLinkTemplateId
+	}
+	email = EmailNormalize(email)
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(b)
+	token := nonce + "." + s.linkSign(nonce)
+
+	link := linkBase
+	sep := "?"
+	if strings.Contains(link, "?") {
+		sep = "&"
+	}
+	link += sep + "token=" + url.QueryEscape(token)
+
+	// 先写入再发送 避免收到邮件后立即点击时链接还未生效
+	err := s.rdb.Do(ctx, s.rdb.B().Set().Key(s.linkKey(nonce)).Value(email).ExSeconds(int64(s.expTime.Seconds())).Build()).Error()
+	if err != nil {
+		return err
+	}
+	err = s.send(ctx, "link", templateId, &EmailTemplateData{
+		Email:   email,
+		Link:    link,
+		Minutes: int(s.expTime.Minutes()),
+	}, ip)
+	if err != nil {
+		_ = s.rdb.Do(ctx, s.rdb.B().Del().Key(s.linkKey(nonce)).Build())
+		return err
+	}
+	return nil
+}
+
+// ConsumeMagicLink 验证并消费登录链接 返回 EmailNormalize 后的邮箱 同一个链接只能使用一次
+func (s *EmailClient) ConsumeMagicLink(ctx context.Context, token string) (string, error) {
+	nonce, sign, ok := strings.Cut(token, ".")
+	if !ok || len(nonce) < 1 || !hmac.Equal([]byte(sign), []byte(s.linkSign(nonce))) {
+		return "", ErrEmailLinkInvalid
+	}
+	email, err := s.rdb.Do(ctx, s.rdb.B().Getdel().Key(s.linkKey(nonce)).Build()).ToString()
+	if err != nil {
+		if rueidis.IsRedisNil(err) {
+			return "", ErrEmailLinkInvalid
+		}
+		return "", err
+	}
+	return email, nil
+}
@@ -0,0 +1,216 @@
+package pipe
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpStandIn 本地smtp替身 只实现发送一封邮件需要的指令
+type smtpStandIn struct {
+	addr  string
+	mails chan string
+}
+
+func newSmtpStandIn(t *testing.T) *smtpStandIn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	s := &smtpStandIn{addr: ln.Addr().String(), mails: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "DATA"):
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.mails <- data.String()
+			reply("250 ok")
+		case strings.HasPrefix(cmd, "QUIT"):
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// body 解出邮件正文
+func (s *smtpStandIn) body(t *testing.T) string {
+	select {
+	case raw := <-s.mails:
+		_, body, _ := strings.Cut(raw, "\r\n\r\n")
+		b, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(body, "\r\n", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	case <-time.After(3 * time.Second):
+		t.Fatal("未收到邮件")
+	}
+	return ""
+}
+
+func newTestEmailClient(t *testing.T) (*smtpStandIn, *EmailClient) {
+	srv := newSmtpStandIn(t)
+	host, portStr, _ := net.SplitHostPort(srv.addr)
+	port, _ := strconv.Atoi(portStr)
+	sender := NewSmtpEmailSender(host, port, "", "")
+	sender.From = "noreply@example.com"
+	_, rdb := newMiniRedisClient(t)
+	return srv, NewEmailClient(sender, []byte("secret"), rdb)
+}
+
+func TestEmailCode(t *testing.T) {
+	srv, client := newTestEmailClient(t)
+	ctx := mockIrisContext()
+	client.SetTemplate("welcome", &EmailTemplate{Subject: "欢迎", Body: "<b>{{.Code}}</b> {{.Email}}", Html: true})
+
+	resp := EmailSend.Run(ctx, nil, &EmailPipe{Email: "a@example.com", TemplateId: "welcome"}, client)
+	if resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	if body := srv.body(t); body != "<b>"+resp.Result+"</b> a@example.com" {
+		t.Fatalf("邮件内容错误 %s", body)
+	}
+	// 大小写与空白不同视为同一个邮箱
+	if r := EmailSend.Run(ctx, nil, &EmailPipe{Email: " A@Example.com "}, client); !errors.Is(r.Err, ErrEmailCooldown) {
+		t.Fatalf("冷却中应拒绝 %v", r.Err)
+	}
+	if r := EmailValid.Run(ctx, nil, &EmailPipe{Email: "a@example.com", Code: "000000"}, client); r.Err == nil {
+		t.Fatal("错误的验证码应验证失败")
+	}
+	if r := EmailValid.Run(ctx, nil, &EmailPipe{Email: "A@EXAMPLE.COM", Code: resp.Result}, client); r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	if r := EmailValid.Run(ctx, nil, &EmailPipe{Email: "a@example.com", Code: resp.Result}, client); r.Err == nil {
+		t.Fatal("验证码只能使用一次")
+	}
+}
+
+func TestEmailCodeAttempts(t *testing.T) {
+	srv, client := newTestEmailClient(t)
+	client.SetMaxAttempts(3).SetLimit(0, 0, 0)
+	ctx := context.Background()
+	code, err := client.SendCode(ctx, "", "c@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.body(t)
+	for i := 0; i < 3; i++ {
+		if client.Valid(ctx, "c@example.com", "000000") {
+			t.Fatal("错误的验证码应验证失败")
+		}
+	}
+	// 超过次数后正确的验证码也失效
+	if client.Valid(ctx, "c@example.com", code) {
+		t.Fatal("超过验证次数后应失效")
+	}
+
+	// 重新发送后重新计数
+	code, err = client.SendCode(ctx, "", "c@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.body(t)
+	if client.Valid(ctx, "c@example.com", "000000") || !client.Valid(ctx, "c@example.com", code) {
+		t.Fatal("重新发送后应可以验证")
+	}
+}
+
+func TestEmailMagicLink(t *testing.T) {
+	srv, client := newTestEmailClient(t)
+	ctx := mockIrisContext()
+
+	// 未配置登录链接地址
+	if r := EmailLinkSend.Run(ctx, nil, &EmailPipe{Email: "b@example.com"}, client); r.Err == nil {
+		t.Fatal("未配置登录链接地址应返回错误")
+	}
+	// 客户端不能通过请求体指定链接地址与ip
+	var params EmailPipe
+	if err := json.Unmarshal([]byte(`{"email":"b@example.com","link_base":"https://evil.com","ip":"9.9.9.9"}`), &params); err != nil || params.LinkBase != "" || params.Ip != "" {
+		t.Fatalf("link_base与ip不应可以绑定 %+v %v", params, err)
+	}
+	client.SetLinkBase("https://example.com/login?from=mail")
+	resp := EmailLinkSend.Run(ctx, nil, &params, client)
+	if resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	body := srv.body(t)
+	start := strings.Index(body, "https://")
+	if start < 0 {
+		t.Fatalf("邮件中没有链接 %s", body)
+	}
+	link, err := url.Parse(strings.Fields(body[start:])[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := link.Query().Get("token")
+	if link.Query().Get("from") != "mail" || len(token) < 1 {
+		t.Fatalf("链接错误 %s", link)
+	}
+
+	dep := &EmailLinkDep{Token: token, Env: "web", Resolve: func(ctx context.Context, email string) (string, error) {
+		return "uid:" + email, nil
+	}}
+	// 篡改的链接
+	if r := EmailLinkLogin.Run(ctx, &EmailLinkDep{Token: token + "x", Resolve: dep.Resolve}, nil, client); !errors.Is(r.Err, ErrEmailLinkInvalid) {
+		t.Fatalf("篡改的链接应拒绝 %v", r.Err)
+	}
+	login := EmailLinkLogin.Run(ctx, dep, nil, client)
+	if login.Err != nil {
+		t.Fatal(login.Err)
+	}
+	visit := JwtVisit.Run(ctx, &JwtCheckDep{Env: "web", Authorization: JwtPrefix + login.Result}, nil, client.rdb)
+	if visit.Err != nil {
+		t.Fatal(visit.Err)
+	}
+	if claims := visit.Result; claims.UserId != "uid:b@example.com" || claims.Env != "web" {
+		t.Fatalf("token内容错误 %+v", claims)
+	}
+	if r := EmailLinkLogin.Run(ctx, dep, nil, client); !errors.Is(r.Err, ErrEmailLinkInvalid) {
+		t.Fatalf("链接只能使用一次 %v", r.Err)
+	}
+}
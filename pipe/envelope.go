@@ -0,0 +1,213 @@
+package pipe
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"strings"
+	"sync"
+)
+
+// 带认证的加密信封
+// 格式为 v1.{alg}.{kid}.{base64url(nonce+密文+tag)} 头部作为附加数据参与认证 kid用于密钥轮换
+// 旧版cbc的密文为纯base64url 不含 . 可以据此区分 迁移期间两种格式同时支持
+
+const (
+	EnvelopeVersion  = "v1"
+	EnvelopeAesGcm   = "gcm"
+	EnvelopeChaCha20 = "c20p"
+)
+
+var (
+	// ErrCipherInvalid 所有解密失败都返回同一个错误 不区分填充 认证 密钥等原因
+	ErrCipherInvalid = errors.New("密文无效")
+	ErrEnvelopeKey   = errors.New("密钥不存在")
+)
+
+type envelopeKey struct {
+	alg  string
+	aead cipher.AEAD
+}
+
+// Envelope 信封加密 支持多个密钥 使用主密钥加密 按kid选择密钥解密
+type Envelope struct {
+	mu      sync.RWMutex
+	keys    map[string]*envelopeKey
+	primary string
+}
+
+func NewEnvelope() *Envelope {
+	return &Envelope{keys: make(map[string]*envelopeKey)}
+}
+
+// NewEnvelopeWithKey 只有一个密钥时的快捷方式
+func NewEnvelopeWithKey(kid, alg string, key []byte) (*Envelope, error) {
+	e := NewEnvelope()
+	if err := e.AddKey(kid, alg, key); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// AddKey 添加密钥 gcm支持16 24 32位密钥 c20p为32位 第一个添加的密钥为主密钥
+func (e *Envelope) AddKey(kid, alg string, key []byte) error {
+	if len(kid) < 1 || len(kid) > 32 || strings.Contains(kid, ".") {
+		return errors.New("kid长度需要在1-32之间且不能包含.")
+	}
+	var aead cipher.AEAD
+	switch alg {
+	case EnvelopeAesGcm:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		if aead, err = cipher.NewGCM(block); err != nil {
+			return err
+		}
+	case EnvelopeChaCha20:
+		var err error
+		if aead, err = chacha20poly1305.New(key); err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("不支持的加密算法 %s", alg)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.keys[kid] = &envelopeKey{alg: alg, aead: aead}
+	if len(e.primary) < 1 {
+		e.primary = kid
+	}
+	return nil
+}
+
+// SetPrimary 设置加密使用的密钥 旧密钥保留用于解密
+func (e *Envelope) SetPrimary(kid string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.keys[kid]; !ok {
+		return ErrEnvelopeKey
+	}
+	e.primary = kid
+	return nil
+}
+
+// RemoveKey 移除密钥 不能移除主密钥
+func (e *Envelope) RemoveKey(kid string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if kid == e.primary {
+		return errors.New("不能移除主密钥")
+	}
+	delete(e.keys, kid)
+	return nil
+}
+
+func (e *Envelope) Primary() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.primary
+}
+
+// Seal 使用主密钥加密
+func (e *Envelope) Seal(plainText []byte) (string, error) {
+	e.mu.RLock()
+	kid := e.primary
+	key, ok := e.keys[kid]
+	e.mu.RUnlock()
+	if !ok {
+		return "", ErrEnvelopeKey
+	}
+	header := EnvelopeVersion + "." + key.alg + "." + kid
+	out := make([]byte, key.aead.NonceSize(), key.aead.NonceSize()+len(plainText)+key.aead.Overhead())
+	if _, err := rand.Read(out); err != nil {
+		return "", err
+	}
+	out = key.aead.Seal(out, out, plainText, []byte(header))
+	return header + "." + base64.RawURLEncoding.EncodeToString(out), nil
+}
+
+// Open 解密信封 任何错误都返回 ErrCipherInvalid
+func (e *Envelope) Open(cipherText string) ([]byte, error) {
+	parts := strings.SplitN(cipherText, ".", 4)
+	if len(parts) != 4 || parts[0] != EnvelopeVersion {
+		return nil, ErrCipherInvalid
+	}
+	e.mu.RLock()
+	key, ok := e.keys[parts[2]]
+	e.mu.RUnlock()
+	if !ok || key.alg != parts[1] {
+		return nil, ErrCipherInvalid
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[3], "="))
+	if err != nil || len(data) < key.aead.NonceSize()+key.aead.Overhead() {
+		return nil, ErrCipherInvalid
+	}
+	nonce, sealed := data[:key.aead.NonceSize()], data[key.aead.NonceSize():]
+	plain, err := key.aead.Open(nil, nonce, sealed, []byte(parts[0]+"."+parts[1]+"."+parts[2]))
+	if err != nil {
+		return nil, ErrCipherInvalid
+	}
+	return plain, nil
+}
+
+// IsEnvelope 是否为信封格式 否则按旧版cbc处理
+func IsEnvelope(cipherText string) bool {
+	return strings.HasPrefix(cipherText, EnvelopeVersion+".")
+}
+
+// CbcDecrypt 旧版cbc解密 密文为base64url(iv+密文) 长度与填充错误不会panic 填充校验为常量时间
+func CbcDecrypt(key []byte, cipherText string) ([]byte, error) {
+	cipherData, err := base64.URLEncoding.DecodeString(cipherText)
+	if err != nil {
+		return nil, ErrCipherInvalid
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(cipherData) < aes.BlockSize*2 || len(cipherData)%aes.BlockSize != 0 {
+		return nil, ErrCipherInvalid
+	}
+	iv := cipherData[:aes.BlockSize]
+	plain := make([]byte, len(cipherData)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, cipherData[aes.BlockSize:])
+
+	// pkcs7 填充检查 遍历最后一个块的全部字节 不因填充内容提前返回
+	padding := plain[len(plain)-1]
+	good := subtle.ConstantTimeLessOrEq(1, int(padding)) & subtle.ConstantTimeLessOrEq(int(padding), aes.BlockSize)
+	for i := 1; i <= aes.BlockSize; i++ {
+		inPadding := subtle.ConstantTimeLessOrEq(i, int(padding))
+		match := subtle.ConstantTimeByteEq(plain[len(plain)-i], padding)
+		// 在填充范围内的字节必须等于填充值
+		good &= subtle.ConstantTimeSelect(inPadding, match, 1)
+	}
+	if good != 1 {
+		return nil, ErrCipherInvalid
+	}
+	return plain[:len(plain)-int(padding)], nil
+}
+
+// CbcEncrypt 旧版cbc加密 仅用于兼容未升级的客户端
+func CbcEncrypt(key []byte, plainText []byte) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	padding := aes.BlockSize - len(plainText)%aes.BlockSize
+	padded := make([]byte, len(plainText)+padding)
+	copy(padded, plainText)
+	for i := len(plainText); i < len(padded); i++ {
+		padded[i] = byte(padding)
+	}
+	out := make([]byte, aes.BlockSize+len(padded))
+	if _, err := rand.Read(out[:aes.BlockSize]); err != nil {
+		return "", err
+	}
+	cipher.NewCBCEncrypter(block, out[:aes.BlockSize]).CryptBlocks(out[aes.BlockSize:], padded)
+	return base64.URLEncoding.EncodeToString(out), nil
+}
@@ -0,0 +1,141 @@
+package pipe
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEnvelope(t *testing.T) {
+	gcmKey := []byte("0123456789abcdef0123456789abcdef")
+	chachaKey := []byte("fedcba9876543210fedcba9876543210")
+	env, err := NewEnvelopeWithKey("k1", EnvelopeAesGcm, gcmKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := []byte(`{"router":"/test1"}`)
+
+	sealed, err := env.Seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, "v1.gcm.k1.") || !IsEnvelope(sealed) {
+		t.Fatalf("信封格式错误 %s", sealed)
+	}
+	got, err := env.Open(sealed)
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("解密失败 %v %s", err, got)
+	}
+
+	// 轮换到新密钥 旧密文仍可解密
+	if err = env.AddKey("k2", EnvelopeChaCha20, chachaKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = env.SetPrimary("k2"); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := env.Seal(plain)
+	if err != nil || !strings.HasPrefix(rotated, "v1.c20p.k2.") {
+		t.Fatalf("轮换后加密错误 %v %s", err, rotated)
+	}
+	for _, s := range []string{sealed, rotated} {
+		if got, err = env.Open(s); err != nil || !bytes.Equal(got, plain) {
+			t.Fatalf("解密失败 %v", err)
+		}
+	}
+	if err = env.RemoveKey("k2"); err == nil {
+		t.Fatal("不应允许移除主密钥")
+	}
+	if err = env.RemoveKey("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = env.Open(sealed); !errors.Is(err, ErrCipherInvalid) {
+		t.Fatalf("移除的密钥不应能解密 %v", err)
+	}
+
+	// 篡改内容 头部 以及各种畸形输入都返回同一个错误
+	body := rotated[strings.LastIndex(rotated, ".")+1:]
+	raw, _ := base64.RawURLEncoding.DecodeString(body)
+	raw[len(raw)-1] ^= 1
+	bad := []string{
+		"v1.c20p.k2." + base64.RawURLEncoding.EncodeToString(raw),
+		"v1.gcm.k2." + body,
+		"v1.c20p.k3." + body,
+		"v2.c20p.k2." + body,
+		"v1.c20p.k2.",
+		"v1.c20p.k2.@@@",
+		"v1.c20p",
+		"",
+	}
+	for _, s := range bad {
+		if _, err = env.Open(s); !errors.Is(err, ErrCipherInvalid) {
+			t.Fatalf("%q 应返回 ErrCipherInvalid 实际 %v", s, err)
+		}
+	}
+
+	if err = env.AddKey("a.b", EnvelopeAesGcm, gcmKey); err == nil {
+		t.Fatal("kid不应包含.")
+	}
+	if err = env.AddKey("k4", EnvelopeChaCha20, gcmKey[:16]); err == nil {
+		t.Fatal("c20p密钥长度错误")
+	}
+	if err = env.AddKey("k5", "cbc", gcmKey); err == nil {
+		t.Fatal("不支持的算法")
+	}
+}
+
+func TestCbcCompat(t *testing.T) {
+	key := []byte("mysecretpassword")
+	plain := []byte("hello world")
+
+	legacy, err := CbcEncrypt(key, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := CbcDecrypt(key, legacy)
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("cbc解密失败 %v", err)
+	}
+
+	// 畸形密文不能panic
+	raw, _ := base64.URLEncoding.DecodeString(legacy)
+	flipped := append([]byte{}, raw...)
+	flipped[len(flipped)-1] ^= 0xff
+	bad := []string{
+		"",
+		"not base64!",
+		base64.URLEncoding.EncodeToString(raw[:16]),
+		base64.URLEncoding.EncodeToString(raw[:20]),
+		base64.URLEncoding.EncodeToString(flipped),
+	}
+	for _, s := range bad {
+		if _, err = CbcDecrypt(key, s); !errors.Is(err, ErrCipherInvalid) {
+			t.Fatalf("%q 应返回 ErrCipherInvalid 实际 %v", s, err)
+		}
+	}
+
+	// 同时配置信封与旧密钥时两种格式都能解密 加密使用信封
+	env, err := NewEnvelopeWithKey("k1", EnvelopeAesGcm, []byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewCbcService(string(key)).SetEnvelope(env)
+	if got, err = svc.Decrypt(legacy); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("旧版cbc兼容失败 %v", err)
+	}
+	sealed, err := svc.Encrypt(plain)
+	if err != nil || !IsEnvelope(sealed) {
+		t.Fatalf("应使用信封加密 %v %s", err, sealed)
+	}
+	if got, err = svc.Decrypt(sealed); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("信封解密失败 %v", err)
+	}
+
+	// 未配置旧密钥时拒绝cbc
+	strict := NewCbcService("").SetEnvelope(env)
+	if _, err = strict.Decrypt(legacy); !errors.Is(err, ErrCipherInvalid) {
+		t.Fatalf("应拒绝旧版cbc %v", err)
+	}
+}
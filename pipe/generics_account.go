@@ -51,11 +51,15 @@ func (a *AccountPass) GetUserName() string {
 	return a.UserName
 }
 
-// SetPassword 设置密码 明文 会自动加密
-func (a *AccountPass) SetPassword(newPassword string) {
-	m5ps, salt := a.PasswordMd5(newPassword)
-	a.Password = m5ps
-	a.Salt = salt
+// SetPassword 设置密码 明文 会使用默认的密码算法加密 失败时不修改原密码
+func (a *AccountPass) SetPassword(newPassword string) error {
+	encoded, err := PasswordHash(newPassword)
+	if err != nil {
+		return err
+	}
+	a.Password = encoded
+	a.Salt = ""
+	return nil
 }
 func (a *AccountPass) GetPassword() string {
 	return a.Password
@@ -74,7 +78,7 @@ func (a *AccountPass) GetTelPhone() string {
 	return a.TelPhone
 }
 
-// PasswordMd5 通过原始密码生成加密的m5为password
+// PasswordMd5 通过原始密码生成加密的m5为password 旧版算法 仅用于兼容
 func (a *AccountPass) PasswordMd5(rawPassword string) (m5ps string, salt string) {
 	if len(a.Salt) < 1 {
 		a.Salt = ut.RandomStr(4)
@@ -87,14 +91,23 @@ func (a *AccountPass) PasswordMd5(rawPassword string) (m5ps string, salt string)
 	return m5ps, a.Salt
 }
 
-// ValidPassword 验证密码输出是否正确 password 为输入密码
+// ValidPassword 验证密码输出是否正确 password 为输入密码 兼容旧版md5
 func (a *AccountPass) ValidPassword(rawPassword string) bool {
-	r := md5.New()
-	r.Write([]byte(rawPassword))
-	r.Write([]byte(a.Salt))
-	st := r.Sum(nil)
-	ps := hex.EncodeToString(st)
-	return ps == a.Password
+	ok, _ := PasswordVerify(rawPassword, a.Password, a.Salt)
+	return ok
+}
+
+// ValidPasswordUpgrade 验证密码 若密码正确但算法或参数已过时则重新加密
+// upgraded为true时需要调用方持久化 Password 与 Salt 重新加密失败时保留原密码 upgraded为false
+func (a *AccountPass) ValidPasswordUpgrade(rawPassword string) (ok bool, upgraded bool) {
+	ok, needRehash := PasswordVerify(rawPassword, a.Password, a.Salt)
+	if !ok || !needRehash {
+		return ok, false
+	}
+	if err := a.SetPassword(rawPassword); err != nil {
+		return true, false
+	}
+	return true, true
 }
 
 type AccountCoin struct {
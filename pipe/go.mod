@@ -14,6 +14,7 @@ require (
 	github.com/23233/ggg/ut v0.0.0-20250521015733-ba3370e5e495
 	github.com/23233/jsonschema v0.11.2
 	github.com/23233/user_agent v0.1.1
+	github.com/alicebob/miniredis/v2 v2.35.0
 	github.com/bluele/gcache v0.0.2
 	github.com/casbin/casbin/v2 v2.105.0
 	github.com/casbin/redis-adapter/v2 v2.4.0
@@ -25,6 +26,7 @@ require (
 	github.com/iris-contrib/middleware/jwt v0.0.0-20250207234507-372f6828ef8c
 	github.com/json-iterator/go v1.1.12
 	github.com/kataras/iris/v12 v12.2.11
+	github.com/kataras/realip v0.0.2
 	github.com/pkg/errors v0.9.1
 	github.com/qiniu/qmgo v1.1.9
 	github.com/redis/rueidis v1.0.60
@@ -36,7 +38,9 @@ require (
 	github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/sms v1.0.1115
 	github.com/ulule/limiter/v3 v3.11.2
 	go.mongodb.org/mongo-driver v1.17.3
+	golang.org/x/crypto v0.38.0
 	golang.org/x/net v0.40.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -138,12 +142,12 @@ require (
 	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78 // indirect
 	github.com/yudai/gojsondiff v1.0.0 // indirect
 	github.com/yudai/golcs v0.0.0-20170316035057-ecda9a501e82 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 	go.uber.org/atomic v1.11.0 // indirect
 	go.uber.org/automaxprocs v1.6.0 // indirect
 	go.uber.org/mock v0.5.2 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
 	go.uber.org/zap v1.27.0 // indirect
-	golang.org/x/crypto v0.38.0 // indirect
 	golang.org/x/exp v0.0.0-20250506013437-ce4c2cf36ca6 // indirect
 	golang.org/x/mod v0.24.0 // indirect
 	golang.org/x/sync v0.14.0 // indirect
@@ -155,7 +159,6 @@ require (
 	google.golang.org/protobuf v1.36.6 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 	gorm.io/gorm v1.26.1 // indirect
 	moul.io/http2curl/v2 v2.3.0 // indirect
 )
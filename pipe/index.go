@@ -6,6 +6,7 @@ import (
 	"github.com/23233/ggg/ut"
 	"github.com/23233/user_agent"
 	"github.com/kataras/iris/v12"
+	"github.com/kataras/realip"
 	"reflect"
 	"strings"
 )
@@ -26,6 +27,11 @@ func CtxGetEnv(ctx iris.Context, defaultStr ...string) string {
 	return "default"
 }
 
+// CtxRealIp 获取客户端真实ip 反向代理后会读取X-Forwarded-For等请求头
+func CtxRealIp(ctx iris.Context) string {
+	return realip.Get(ctx.Request())
+}
+
 // OpValid 操作符验证
 func OpValid(input any, op string, value string) bool {
 
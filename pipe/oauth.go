@@ -0,0 +1,331 @@
+package pipe
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"github.com/pkg/errors"
+	"github.com/redis/rueidis"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// 第三方登录
+// 各平台只负责用code换取平台身份 返回AccountPlatform 账号的查找 创建 合并在 OauthAccountLink 中统一处理
+
+var (
+	ErrOauthState    = errors.New("授权状态无效或已过期")
+	ErrOauthBound    = errors.New("该第三方账号已绑定其他用户")
+	ErrOauthDisabled = errors.New("账号已被禁用")
+)
+
+const (
+	OauthWechatMini = "wechat_mini"
+	OauthDouyinMini = "douyin_mini"
+
+	OauthStateCookie = "oauth_state" // 保存state的cookie 回调时与参数中的state比对
+	oauthMaxBody     = 1 << 20       // 第三方接口响应的最大长度
+)
+
+// OauthProvider 第三方登录平台
+type OauthProvider interface {
+	Name() string
+	// Exchange 使用授权码换取平台身份 redirectUri仅标准oauth2需要
+	Exchange(ctx context.Context, code string, redirectUri string) (*AccountPlatform, error)
+}
+
+func oauthHttpClient(c *http.Client) *http.Client {
+	if c != nil {
+		return c
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+// oauthDoJson 发送请求并解析json响应
+func oauthDoJson(client *http.Client, req *http.Request, result any) error {
+	resp, err := oauthHttpClient(client).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, oauthMaxBody))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("第三方接口请求失败 %d %s", resp.StatusCode, string(body))
+	}
+	return json.Unmarshal(body, result)
+}
+
+// OAuth2Provider 标准oauth2授权码模式 获取token后请求用户信息接口
+type OAuth2Provider struct {
+	ProviderName string
+	ClientId     string
+	ClientSecret string
+	AuthUrl      string
+	TokenUrl     string
+	UserInfoUrl  string
+	Scopes       []string
+	// 用户信息中的字段名 默认为 oidc 的 sub name picture
+	IdField     string
+	UnionField  string
+	NameField   string
+	AvatarField string
+	HttpClient  *http.Client
+}
+
+func NewOAuth2Provider(name, clientId, clientSecret, authUrl, tokenUrl, userInfoUrl string, scopes ...string) *OAuth2Provider {
+	return &OAuth2Provider{
+		ProviderName: name,
+		ClientId:     clientId,
+		ClientSecret: clientSecret,
+		AuthUrl:      authUrl,
+		TokenUrl:     tokenUrl,
+		UserInfoUrl:  userInfoUrl,
+		Scopes:       scopes,
+		IdField:      "sub",
+		NameField:    "name",
+		AvatarField:  "picture",
+	}
+}
+
+func (p *OAuth2Provider) Name() string {
+	return p.ProviderName
+}
+
+// AuthCodeURL 跳转授权页的地址
+func (p *OAuth2Provider) AuthCodeURL(state string, redirectUri string) string {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ClientId)
+	v.Set("redirect_uri", redirectUri)
+	if len(p.Scopes) > 0 {
+		v.Set("scope", strings.Join(p.Scopes, " "))
+	}
+	v.Set("state", state)
+	sep := "?"
+	if strings.Contains(p.AuthUrl, "?") {
+		sep = "&"
+	}
+	return p.AuthUrl + sep + v.Encode()
+}
+
+func (p *OAuth2Provider) Exchange(ctx context.Context, code string, redirectUri string) (*AccountPlatform, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectUri)
+	form.Set("client_id", p.ClientId)
+	form.Set("client_secret", p.ClientSecret)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		Scope       string `json:"scope"`
+		Error       string `json:"error"`
+		ErrorDesc   string `json:"error_description"`
+	}
+	if err = oauthDoJson(p.HttpClient, req, &token); err != nil {
+		return nil, err
+	}
+	if len(token.Error) > 0 || len(token.AccessToken) < 1 {
+		return nil, errors.Errorf("获取授权令牌失败 %s %s", token.Error, token.ErrorDesc)
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, p.UserInfoUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Accept", "application/json")
+	info := make(map[string]any)
+	if err = oauthDoJson(p.HttpClient, req, &info); err != nil {
+		return nil, err
+	}
+	field := func(name string) string {
+		if len(name) < 1 || info[name] == nil {
+			return ""
+		}
+		// github等平台的id为数字
+		return fmt.Sprint(info[name])
+	}
+	pid := field(p.IdField)
+	if len(pid) < 1 {
+		return nil, errors.New("用户信息中没有用户id")
+	}
+	platform := &AccountPlatform{
+		Appid:      p.ClientId,
+		Name:       p.ProviderName,
+		Pid:        pid,
+		UnionId:    field(p.UnionField),
+		NickName:   field(p.NameField),
+		AvatarUrl:  field(p.AvatarField),
+		AuthorTime: time.Now(),
+	}
+	if len(token.Scope) > 0 {
+		platform.Scopes = strings.FieldsFunc(token.Scope, func(r rune) bool { return r == ' ' || r == ',' })
+	} else {
+		platform.Scopes = p.Scopes
+	}
+	return platform, nil
+}
+
+// WechatMiniProvider 微信小程序 code2session
+type WechatMiniProvider struct {
+	Appid      string
+	Secret     string
+	Endpoint   string // 默认 https://api.weixin.qq.com/sns/jscode2session
+	HttpClient *http.Client
+}
+
+func NewWechatMiniProvider(appid, secret string) *WechatMiniProvider {
+	return &WechatMiniProvider{
+		Appid:    appid,
+		Secret:   secret,
+		Endpoint: "https://api.weixin.qq.com/sns/jscode2session",
+	}
+}
+
+func (p *WechatMiniProvider) Name() string {
+	return OauthWechatMini
+}
+
+func (p *WechatMiniProvider) Exchange(ctx context.Context, code string, redirectUri string) (*AccountPlatform, error) {
+	v := url.Values{}
+	v.Set("appid", p.Appid)
+	v.Set("secret", p.Secret)
+	v.Set("js_code", code)
+	v.Set("grant_type", "authorization_code")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Endpoint+"?"+v.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		OpenId     string `json:"openid"`
+		SessionKey string `json:"session_key"`
+		UnionId    string `json:"unionid"`
+		ErrCode    int    `json:"errcode"`
+		ErrMsg     string `json:"errmsg"`
+	}
+	if err = oauthDoJson(p.HttpClient, req, &result); err != nil {
+		return nil, err
+	}
+	if result.ErrCode != 0 || len(result.OpenId) < 1 {
+		return nil, errors.Errorf("微信登录失败 %d %s", result.ErrCode, result.ErrMsg)
+	}
+	return &AccountPlatform{
+		Appid:      p.Appid,
+		Name:       OauthWechatMini,
+		Pid:        result.OpenId,
+		UnionId:    result.UnionId,
+		AuthorTime: time.Now(),
+	}, nil
+}
+
+// DouyinMiniProvider 抖音小程序 code2session
+type DouyinMiniProvider struct {
+	Appid      string
+	Secret     string
+	Endpoint   string // 默认 https://developer.toutiao.com/api/apps/v2/jscode2session
+	HttpClient *http.Client
+}
+
+func NewDouyinMiniProvider(appid, secret string) *DouyinMiniProvider {
+	return &DouyinMiniProvider{
+		Appid:    appid,
+		Secret:   secret,
+		Endpoint: "https://developer.toutiao.com/api/apps/v2/jscode2session",
+	}
+}
+
+func (p *DouyinMiniProvider) Name() string {
+	return OauthDouyinMini
+}
+
+func (p *DouyinMiniProvider) Exchange(ctx context.Context, code string, redirectUri string) (*AccountPlatform, error) {
+	body, _ := json.Marshal(map[string]string{
+		"appid":  p.Appid,
+		"secret": p.Secret,
+		"code":   code,
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var result struct {
+		ErrNo   int    `json:"err_no"`
+		ErrTips string `json:"err_tips"`
+		Data    struct {
+			SessionKey string `json:"session_key"`
+			OpenId     string `json:"openid"`
+			UnionId    string `json:"unionid"`
+		} `json:"data"`
+	}
+	if err = oauthDoJson(p.HttpClient, req, &result); err != nil {
+		return nil, err
+	}
+	if result.ErrNo != 0 || len(result.Data.OpenId) < 1 {
+		return nil, errors.Errorf("抖音登录失败 %d %s", result.ErrNo, result.ErrTips)
+	}
+	return &AccountPlatform{
+		Appid:      p.Appid,
+		Name:       OauthDouyinMini,
+		Pid:        result.Data.OpenId,
+		UnionId:    result.Data.UnionId,
+		AuthorTime: time.Now(),
+	}, nil
+}
+
+func oauthStateKey(state string) string {
+	return "oauth:state:" + state
+}
+
+// OauthStateGen 生成授权跳转时的state 防止csrf
+// state同时写入cookie 与发起授权的浏览器绑定 需要在跳转授权页的请求中调用
+func OauthStateGen(ctx iris.Context, rdb rueidis.Client, expire time.Duration) (string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	state := base64.RawURLEncoding.EncodeToString(raw)
+	err := rdb.Do(ctx, rdb.B().Set().Key(oauthStateKey(state)).Value("1").ExSeconds(int64(expire.Seconds())).Build()).Error()
+	if err != nil {
+		return "", err
+	}
+	ctx.SetCookieKV(OauthStateCookie, state, iris.CookieExpires(expire), iris.CookieHTTPOnly(true), iris.CookieSameSite(http.SameSiteLaxMode))
+	return state, nil
+}
+
+// OauthStateCheck 校验并消费state 必须与当前浏览器cookie中的state一致
+func OauthStateCheck(ctx iris.Context, rdb rueidis.Client, state string) error {
+	if len(state) < 1 {
+		return ErrOauthState
+	}
+	if subtle.ConstantTimeCompare([]byte(ctx.GetCookie(OauthStateCookie)), []byte(state)) != 1 {
+		return ErrOauthState
+	}
+	ctx.RemoveCookie(OauthStateCookie)
+	err := rdb.Do(ctx, rdb.B().Getdel().Key(oauthStateKey(state)).Build()).Error()
+	if err != nil {
+		if rueidis.IsRedisNil(err) {
+			return ErrOauthState
+		}
+		return err
+	}
+	return nil
+}
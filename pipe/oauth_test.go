@@ -0,0 +1,183 @@
+package pipe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/kataras/iris/v12"
+	irisContext "github.com/kataras/iris/v12/context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOAuth2Provider(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if r.PostForm.Get("code") != "good" || r.PostForm.Get("client_secret") != "secret" {
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token":"at","token_type":"bearer","scope":"read:user,user:email"}`))
+	})
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer at" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":123456,"login":"octo","avatar_url":"https://a/b.png"}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	p := NewOAuth2Provider("github", "cid", "secret", srv.URL+"/auth", srv.URL+"/token", srv.URL+"/user")
+	p.IdField, p.NameField, p.AvatarField = "id", "login", "avatar_url"
+
+	u, _ := url.Parse(p.AuthCodeURL("st", "https://example.com/cb"))
+	if u.Query().Get("state") != "st" || u.Query().Get("client_id") != "cid" {
+		t.Fatalf("授权地址错误 %s", u)
+	}
+	platform, err := p.Exchange(context.TODO(), "good", "https://example.com/cb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if platform.Pid != "123456" || platform.NickName != "octo" || platform.Appid != "cid" || len(platform.Scopes) != 2 {
+		t.Fatalf("平台信息错误 %+v", platform)
+	}
+	if _, err = p.Exchange(context.TODO(), "bad", ""); err == nil {
+		t.Fatal("错误的code应失败")
+	}
+}
+
+func TestMiniProgramProviders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			if r.URL.Query().Get("js_code") != "wx" {
+				_, _ = w.Write([]byte(`{"errcode":40029,"errmsg":"invalid code"}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"openid":"o1","session_key":"k","unionid":"u1"}`))
+			return
+		}
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if body["code"] != "dy" {
+			_, _ = w.Write([]byte(`{"err_no":40015,"err_tips":"bad code"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"err_no":0,"data":{"openid":"d1","session_key":"k","unionid":"u2"}}`))
+	}))
+	defer srv.Close()
+
+	wx := NewWechatMiniProvider("wxapp", "s")
+	wx.Endpoint = srv.URL
+	p, err := wx.Exchange(context.TODO(), "wx", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != OauthWechatMini || p.Pid != "o1" || p.UnionId != "u1" || p.Appid != "wxapp" {
+		t.Fatalf("微信平台信息错误 %+v", p)
+	}
+	if _, err = wx.Exchange(context.TODO(), "bad", ""); err == nil {
+		t.Fatal("微信错误码应返回错误")
+	}
+
+	dy := NewDouyinMiniProvider("dyapp", "s")
+	dy.Endpoint = srv.URL
+	p, err = dy.Exchange(context.TODO(), "dy", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != OauthDouyinMini || p.Pid != "d1" || p.UnionId != "u2" {
+		t.Fatalf("抖音平台信息错误 %+v", p)
+	}
+	if _, err = dy.Exchange(context.TODO(), "bad", ""); err == nil {
+		t.Fatal("抖音错误码应返回错误")
+	}
+}
+
+func TestOauthAccountMerge(t *testing.T) {
+	web := &AccountPlatform{Name: "wechat_web", Appid: "a1", Pid: "p1", UnionId: "u1"}
+	other := &GenericsAccount{Platforms: []*AccountPlatform{{Name: OauthDouyinMini, Appid: "d", Pid: "x"}}}
+	owner := &GenericsAccount{Platforms: []*AccountPlatform{web}}
+
+	// unionid一致的账号可以被找到 pid一致的优先
+	mini := &AccountPlatform{Name: OauthWechatMini, Appid: "a2", Pid: "p2", UnionId: "u1", NickName: "n"}
+	if pickOauthAccount([]*GenericsAccount{other, owner}, mini) != owner {
+		t.Fatal("应通过unionid找到账号")
+	}
+	// 其他开放平台相同的unionid不应匹配
+	douyin := &GenericsAccount{Platforms: []*AccountPlatform{{Name: OauthDouyinMini, Appid: "d", Pid: "y", UnionId: "u1"}}}
+	if pickOauthAccount([]*GenericsAccount{douyin, owner}, mini) != owner {
+		t.Fatal("unionid只能在同一开放平台内匹配")
+	}
+	if OauthUnionFamily(OauthWechatMini) != "wechat" || OauthUnionFamily("github") != "github" {
+		t.Fatal("开放平台解析错误")
+	}
+	exact := &GenericsAccount{Platforms: []*AccountPlatform{{Name: OauthWechatMini, Appid: "a2", Pid: "p2"}}}
+	if pickOauthAccount([]*GenericsAccount{owner, exact}, mini) != exact {
+		t.Fatal("pid一致的账号应优先")
+	}
+
+	owner.Platforms = MergeAccountPlatform(owner.Platforms, mini)
+	if len(owner.Platforms) != 2 {
+		t.Fatalf("新平台应追加 %d", len(owner.Platforms))
+	}
+	now := time.Now()
+	owner.Platforms = MergeAccountPlatform(owner.Platforms, &AccountPlatform{Name: OauthWechatMini, Appid: "a2", Pid: "p2", AvatarUrl: "img", AuthorTime: now})
+	if len(owner.Platforms) != 2 || owner.Platforms[1].AvatarUrl != "img" || owner.Platforms[1].NickName != "n" || !owner.Platforms[1].AuthorTime.Equal(now) {
+		t.Fatalf("相同平台应更新 %+v", owner.Platforms[1])
+	}
+}
+
+func TestOauthState(t *testing.T) {
+	_, rdb := newMiniRedisClient(t)
+	app := iris.New()
+	// newCtx 模拟一次请求 cookie为浏览器携带的state
+	newCtx := func(cookie string) (iris.Context, *httptest.ResponseRecorder) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if len(cookie) > 0 {
+			r.AddCookie(&http.Cookie{Name: OauthStateCookie, Value: cookie})
+		}
+		ctx := irisContext.NewContext(app)
+		ctx.BeginRequest(w, r)
+		return ctx, w
+	}
+
+	ctx, w := newCtx("")
+	state, err := OauthStateGen(ctx, rdb, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(w.Header().Get("Set-Cookie"), OauthStateCookie+"="+state) {
+		t.Fatalf("state应写入cookie %s", w.Header().Get("Set-Cookie"))
+	}
+	other, _ := OauthStateGen(ctx, rdb, time.Minute)
+	if len(state) != 32 || other == state {
+		t.Fatalf("state生成错误 %s", state)
+	}
+
+	// 其他浏览器拿到state也无法使用
+	ctx, _ = newCtx("")
+	if err = OauthStateCheck(ctx, rdb, state); !errors.Is(err, ErrOauthState) {
+		t.Fatalf("没有cookie应拒绝 %v", err)
+	}
+	ctx, _ = newCtx(other)
+	if err = OauthStateCheck(ctx, rdb, state); !errors.Is(err, ErrOauthState) {
+		t.Fatalf("cookie不一致应拒绝 %v", err)
+	}
+
+	ctx, _ = newCtx(state)
+	if err = OauthStateCheck(ctx, rdb, state); err != nil {
+		t.Fatal(err)
+	}
+	ctx, _ = newCtx(state)
+	if err = OauthStateCheck(ctx, rdb, state); !errors.Is(err, ErrOauthState) {
+		t.Fatalf("state只能使用一次 %v", err)
+	}
+}
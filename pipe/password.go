@@ -0,0 +1,223 @@
+package pipe
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"sync"
+)
+
+// 密码哈希 编码结果以算法前缀开头 可以从密文中识别出算法
+// bcrypt 为 $2a$cost$... argon2id 为 $argon2id$v=19$m=..,t=..,p=..$salt$hash
+// 没有前缀的为旧版的 md5(密码+salt) salt单独存储 仅用于验证 验证通过后应当重新哈希
+
+const (
+	PasswordHasherBcrypt   = "bcrypt"
+	PasswordHasherArgon2id = "argon2id"
+)
+
+// PasswordHasher 密码哈希算法
+type PasswordHasher interface {
+	// Id 算法标识
+	Id() string
+	// Match 密文是否由该算法生成
+	Match(encoded string) bool
+	Hash(raw string) (string, error)
+	Verify(raw, encoded string) (bool, error)
+	// NeedsRehash 参数与当前配置不一致时需要重新哈希
+	NeedsRehash(encoded string) bool
+}
+
+var (
+	passwordHashers       sync.Map
+	passwordDefaultHasher = PasswordHasherArgon2id
+)
+
+func init() {
+	RegisterPasswordHasher(&BcryptHasher{Cost: bcrypt.DefaultCost})
+	RegisterPasswordHasher(&Argon2idHasher{Time: 3, Memory: 64 * 1024, Threads: 2, KeyLen: 32, SaltLen: 16})
+}
+
+// RegisterPasswordHasher 注册算法 相同id会覆盖
+func RegisterPasswordHasher(h PasswordHasher) {
+	passwordHashers.Store(h.Id(), h)
+}
+
+// SetDefaultPasswordHasher 设置新密码使用的算法 已有的密码会在下次登录时迁移
+func SetDefaultPasswordHasher(id string) error {
+	if _, ok := passwordHashers.Load(id); !ok {
+		return errors.Errorf("未注册的密码算法 %s", id)
+	}
+	passwordDefaultHasher = id
+	return nil
+}
+
+func GetPasswordHasher(id string) (PasswordHasher, bool) {
+	v, ok := passwordHashers.Load(id)
+	if !ok {
+		return nil, false
+	}
+	return v.(PasswordHasher), true
+}
+
+// passwordMatchHasher 从密文中识别算法
+func passwordMatchHasher(encoded string) PasswordHasher {
+	var result PasswordHasher
+	passwordHashers.Range(func(key, value any) bool {
+		h := value.(PasswordHasher)
+		if h.Match(encoded) {
+			result = h
+			return false
+		}
+		return true
+	})
+	return result
+}
+
+// PasswordHash 使用默认算法哈希密码
+func PasswordHash(raw string) (string, error) {
+	h, ok := GetPasswordHasher(passwordDefaultHasher)
+	if !ok {
+		return "", errors.Errorf("未注册的密码算法 %s", passwordDefaultHasher)
+	}
+	return h.Hash(raw)
+}
+
+// PasswordVerify 验证密码 salt仅旧版md5使用
+// needRehash 为true时表示密码正确但需要使用默认算法重新哈希
+func PasswordVerify(raw, encoded, salt string) (ok bool, needRehash bool) {
+	if len(encoded) < 1 {
+		return false, false
+	}
+	h := passwordMatchHasher(encoded)
+	if h == nil {
+		if !strings.HasPrefix(encoded, "$") && subtle.ConstantTimeCompare([]byte(PasswordLegacyMd5(raw, salt)), []byte(encoded)) == 1 {
+			return true, true
+		}
+		return false, false
+	}
+	ok, err := h.Verify(raw, encoded)
+	if err != nil || !ok {
+		return false, false
+	}
+	return true, h.Id() != passwordDefaultHasher || h.NeedsRehash(encoded)
+}
+
+// PasswordLegacyMd5 旧版的md5(密码+salt)
+func PasswordLegacyMd5(raw, salt string) string {
+	m5 := md5.New()
+	m5.Write([]byte(raw))
+	m5.Write([]byte(salt))
+	return hex.EncodeToString(m5.Sum(nil))
+}
+
+// BcryptHasher bcrypt 密码超过72字节的部分会被忽略
+type BcryptHasher struct {
+	Cost int
+}
+
+func (c *BcryptHasher) Id() string {
+	return PasswordHasherBcrypt
+}
+func (c *BcryptHasher) Match(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+func (c *BcryptHasher) Hash(raw string) (string, error) {
+	bin, err := bcrypt.GenerateFromPassword([]byte(raw), c.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(bin), nil
+}
+func (c *BcryptHasher) Verify(raw, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(raw))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+func (c *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != c.Cost
+}
+
+// Argon2idHasher argon2id 使用PHC字符串格式
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+type argon2idParams struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	hash    []byte
+}
+
+func (c *Argon2idHasher) decode(encoded string) (*argon2idParams, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != PasswordHasherArgon2id {
+		return nil, errors.New("argon2id密文格式错误")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, err
+	}
+	if version != argon2.Version {
+		return nil, errors.Errorf("不支持的argon2版本 %d", version)
+	}
+	p := new(argon2idParams)
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return nil, err
+	}
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, err
+	}
+	if p.hash, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (c *Argon2idHasher) Id() string {
+	return PasswordHasherArgon2id
+}
+func (c *Argon2idHasher) Match(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+func (c *Argon2idHasher) Hash(raw string) (string, error) {
+	salt := make([]byte, c.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	hash := argon2.IDKey([]byte(raw), salt, c.Time, c.Memory, c.Threads, c.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, c.Memory, c.Time, c.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+func (c *Argon2idHasher) Verify(raw, encoded string) (bool, error) {
+	p, err := c.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	hash := argon2.IDKey([]byte(raw), p.salt, p.time, p.memory, p.threads, uint32(len(p.hash)))
+	return subtle.ConstantTimeCompare(hash, p.hash) == 1, nil
+}
+func (c *Argon2idHasher) NeedsRehash(encoded string) bool {
+	p, err := c.decode(encoded)
+	if err != nil {
+		return true
+	}
+	return p.memory != c.Memory || p.time != c.Time || p.threads != c.Threads || uint32(len(p.hash)) != c.KeyLen
+}
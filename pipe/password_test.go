@@ -0,0 +1,125 @@
+package pipe
+
+import (
+	"github.com/pkg/errors"
+	"strings"
+	"testing"
+)
+
+func TestPasswordHasher(t *testing.T) {
+	for _, id := range []string{PasswordHasherBcrypt, PasswordHasherArgon2id} {
+		h, ok := GetPasswordHasher(id)
+		if !ok {
+			t.Fatalf("未注册 %s", id)
+		}
+		encoded, err := h.Hash("123456")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !h.Match(encoded) {
+			t.Fatalf("%s 无法识别自己的密文 %s", id, encoded)
+		}
+		if ok, _ := h.Verify("123456", encoded); !ok {
+			t.Fatalf("%s 验证失败", id)
+		}
+		if ok, _ := h.Verify("1234567", encoded); ok {
+			t.Fatalf("%s 错误的密码验证通过", id)
+		}
+		if h.NeedsRehash(encoded) {
+			t.Fatalf("%s 当前参数不应该需要重新哈希", id)
+		}
+	}
+}
+
+func TestPasswordVerify(t *testing.T) {
+	encoded, err := PasswordHash("pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encoded, "$"+PasswordHasherArgon2id+"$") {
+		t.Fatalf("默认算法错误 %s", encoded)
+	}
+	ok, rehash := PasswordVerify("pass", encoded, "")
+	if !ok || rehash {
+		t.Fatalf("ok:%v rehash:%v", ok, rehash)
+	}
+
+	// 旧版md5 验证通过后需要重新哈希
+	legacy := PasswordLegacyMd5("pass", "ab12")
+	ok, rehash = PasswordVerify("pass", legacy, "ab12")
+	if !ok || !rehash {
+		t.Fatalf("旧版 ok:%v rehash:%v", ok, rehash)
+	}
+	if ok, _ = PasswordVerify("pass", legacy, "other"); ok {
+		t.Fatal("旧版salt错误时不应通过")
+	}
+
+	// 非默认算法也需要迁移
+	bc, _ := GetPasswordHasher(PasswordHasherBcrypt)
+	bcEncoded, _ := bc.Hash("pass")
+	ok, rehash = PasswordVerify("pass", bcEncoded, "")
+	if !ok || !rehash {
+		t.Fatalf("bcrypt ok:%v rehash:%v", ok, rehash)
+	}
+
+	if err = SetDefaultPasswordHasher("none"); err == nil {
+		t.Fatal("未注册的算法应该返回错误")
+	}
+}
+
+func TestAccountPassUpgrade(t *testing.T) {
+	a := new(AccountPass)
+	m5, salt := a.PasswordMd5("pass")
+	a.Password = m5
+	a.Salt = salt
+
+	ok, upgraded := a.ValidPasswordUpgrade("wrong")
+	if ok || upgraded {
+		t.Fatal("错误的密码不应通过")
+	}
+	ok, upgraded = a.ValidPasswordUpgrade("pass")
+	if !ok || !upgraded {
+		t.Fatal("旧版密码应该被升级")
+	}
+	if len(a.Salt) > 0 || !strings.HasPrefix(a.Password, "$argon2id$") {
+		t.Fatalf("升级后的密码错误 %s %s", a.Password, a.Salt)
+	}
+	if !a.ValidPassword("pass") {
+		t.Fatal("升级后验证失败")
+	}
+}
+
+// failHasher 加密总是失败
+type failHasher struct{}
+
+func (c *failHasher) Id() string                               { return "fail" }
+func (c *failHasher) Match(encoded string) bool                { return strings.HasPrefix(encoded, "$fail$") }
+func (c *failHasher) Hash(raw string) (string, error)          { return "", errors.New("hash failed") }
+func (c *failHasher) Verify(raw, encoded string) (bool, error) { return false, nil }
+func (c *failHasher) NeedsRehash(encoded string) bool          { return false }
+
+func TestAccountPassHashFail(t *testing.T) {
+	RegisterPasswordHasher(new(failHasher))
+	if err := SetDefaultPasswordHasher("fail"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDefaultPasswordHasher(PasswordHasherArgon2id)
+
+	a := new(AccountPass)
+	m5, salt := a.PasswordMd5("pass")
+	a.Password = m5
+	a.Salt = salt
+	if err := a.SetPassword("new"); err == nil {
+		t.Fatal("加密失败时应返回错误")
+	}
+	if a.Password != m5 || a.Salt != salt {
+		t.Fatal("加密失败时不应修改原密码")
+	}
+	ok, upgraded := a.ValidPasswordUpgrade("pass")
+	if !ok || upgraded {
+		t.Fatalf("加密失败时不应视为已升级 ok:%v upgraded:%v", ok, upgraded)
+	}
+	if a.Password != m5 {
+		t.Fatal("升级失败时不应修改原密码")
+	}
+}
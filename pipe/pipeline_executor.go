@@ -0,0 +1,351 @@
+package pipe
+
+import (
+	"bytes"
+	"encoding/json"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/core/router"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// OriginSource 数据来源 用于组装步骤的origin和params
+// From 可选
+// * prev 上一步的结果 默认
+// * step 指定别名步骤的结果 Key为别名 可用.继续取下级
+// * body 请求的json body
+// * query url参数 Key为空则是全部参数
+// * header 请求头
+// * param 路由参数
+// * env 由ua解析出的环境
+// * ip 请求方ip
+// * value 常量 取Value
+// * none 空值
+type OriginSource struct {
+	From  string `json:"from,omitempty" yaml:"from,omitempty"`
+	Key   string `json:"key,omitempty" yaml:"key,omitempty"`
+	Value any    `json:"value,omitempty" yaml:"value,omitempty"`
+}
+
+// PipelineStep 单个执行步骤
+type PipelineStep struct {
+	Key       string                   `json:"key" yaml:"key"`                                   // 运行器key
+	Alias     string                   `json:"alias,omitempty" yaml:"alias,omitempty"`           // 结果别名 后续步骤可通过step引用
+	Params    json.RawMessage          `json:"params,omitempty" yaml:"params,omitempty"`         // 运行器参数
+	ParamsMap map[string]*OriginSource `json:"params_map,omitempty" yaml:"params_map,omitempty"` // 参数覆盖 key为params中的路径 用.分割
+	Origin    *OriginSource            `json:"origin,omitempty" yaml:"origin,omitempty"`         // origin来源 为空则是上一步结果
+	OriginMap map[string]*OriginSource `json:"origin_map,omitempty" yaml:"origin_map,omitempty"` // origin由多个来源组装为map 优先于Origin
+	Db        string                   `json:"db,omitempty" yaml:"db,omitempty"`                 // 依赖名称 从执行器的Deps中获取
+	Ignore    bool                     `json:"ignore,omitempty" yaml:"ignore,omitempty"`         // 忽略错误继续执行
+	ErrMsg    string                   `json:"err_msg,omitempty" yaml:"err_msg,omitempty"`       // 出错时的错误说明
+	ErrCode   int                      `json:"err_code,omitempty" yaml:"err_code,omitempty"`     // 出错时的请求状态码
+}
+
+// PipelineDef 操作序列定义
+type PipelineDef struct {
+	Name   string          `json:"name,omitempty" yaml:"name,omitempty"`
+	Method string          `json:"method,omitempty" yaml:"method,omitempty"` // 挂载时的请求方法 默认POST
+	Path   string          `json:"path,omitempty" yaml:"path,omitempty"`     // 挂载时的路径
+	Steps  []*PipelineStep `json:"steps" yaml:"steps"`
+	Result string          `json:"result,omitempty" yaml:"result,omitempty"` // 返回哪个别名的结果 默认最后一步
+}
+
+// ParsePipelineDef 解析json或yaml格式的定义
+func ParsePipelineDef(raw []byte) (*PipelineDef, error) {
+	// yaml是json的超集 统一转换为json再解析 params才能保持为json
+	var mid any
+	err := yaml.Unmarshal(raw, &mid)
+	if err != nil {
+		return nil, errors.Wrap(err, "操作序列定义解析失败")
+	}
+	bin, err := jsoniter.Marshal(mid)
+	if err != nil {
+		return nil, err
+	}
+	var def = new(PipelineDef)
+	err = jsoniter.Unmarshal(bin, def)
+	if err != nil {
+		return nil, errors.Wrap(err, "操作序列定义解析失败")
+	}
+	return def, nil
+}
+
+// LoadPipelineFile 从文件中加载定义 支持 .json .yaml .yml
+func LoadPipelineFile(fp string) (*PipelineDef, error) {
+	switch strings.ToLower(filepath.Ext(fp)) {
+	case ".json", ".yaml", ".yml":
+	default:
+		return nil, errors.New("操作序列定义文件格式不支持")
+	}
+	raw, err := os.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePipelineDef(raw)
+}
+
+// PipelineExecutor 操作序列执行器
+type PipelineExecutor struct {
+	Def      *PipelineDef
+	Registry *Registry
+	Deps     map[string]any // 依赖 例如 rdb mdb
+}
+
+// pipelineState 单次执行中的状态
+type pipelineState struct {
+	prev    any
+	results map[string]any
+	body    any
+	hasBody bool
+}
+
+func (c *PipelineExecutor) Check() error {
+	if c.Def == nil || len(c.Def.Steps) < 1 {
+		return errors.New("操作序列步骤不能为空")
+	}
+	aliases := make(map[string]struct{})
+	for i, step := range c.Def.Steps {
+		if _, ok := c.Registry.Get(step.Key); !ok {
+			return errors.Errorf("第%d步 运行器 %s 未注册", i+1, step.Key)
+		}
+		if len(step.Db) > 0 {
+			if _, ok := c.Deps[step.Db]; !ok {
+				return errors.Errorf("第%d步 依赖 %s 未找到", i+1, step.Db)
+			}
+		}
+		if len(step.Alias) > 0 {
+			if _, ok := aliases[step.Alias]; ok {
+				return errors.Errorf("第%d步 别名 %s 重复", i+1, step.Alias)
+			}
+			aliases[step.Alias] = struct{}{}
+		}
+	}
+	if len(c.Def.Result) > 0 {
+		if _, ok := aliases[c.Def.Result]; !ok {
+			return errors.Errorf("返回别名 %s 未找到", c.Def.Result)
+		}
+	}
+	return nil
+}
+
+func (c *PipelineExecutor) resolve(ctx iris.Context, state *pipelineState, src *OriginSource) (any, error) {
+	if src == nil {
+		return state.prev, nil
+	}
+	switch src.From {
+	case "", "prev":
+		return pickPath(state.prev, src.Key)
+	case "step":
+		name, path, _ := strings.Cut(src.Key, ".")
+		v, ok := state.results[name]
+		if !ok {
+			return nil, errors.Errorf("步骤别名 %s 未找到结果", name)
+		}
+		return pickPath(v, path)
+	case "body":
+		if !state.hasBody {
+			state.hasBody = true
+			// 不依赖Content-Length 分块传输时没有该请求头 以实际读取到的内容为准 空请求体视为没有参数
+			raw, err := ctx.GetBody()
+			if err != nil {
+				return nil, errors.Wrap(err, "请求体读取失败")
+			}
+			if len(bytes.TrimSpace(raw)) > 0 {
+				if err = json.Unmarshal(raw, &state.body); err != nil {
+					return nil, errors.Wrap(err, "请求体解析失败")
+				}
+			}
+		}
+		return pickPath(state.body, src.Key)
+	case "query":
+		if len(src.Key) < 1 {
+			return ctx.URLParams(), nil
+		}
+		return ctx.URLParam(src.Key), nil
+	case "header":
+		return ctx.GetHeader(src.Key), nil
+	case "param":
+		return ctx.Params().Get(src.Key), nil
+	case "env":
+		return CtxGetEnv(ctx), nil
+	case "ip":
+		return ctx.RemoteAddr(), nil
+	case "value":
+		return src.Value, nil
+	case "none":
+		return nil, nil
+	}
+	return nil, errors.Errorf("数据来源 %s 不支持", src.From)
+}
+
+func (c *PipelineExecutor) buildOrigin(ctx iris.Context, state *pipelineState, step *PipelineStep) (any, error) {
+	if len(step.OriginMap) < 1 {
+		return c.resolve(ctx, state, step.Origin)
+	}
+	mp := make(map[string]any, len(step.OriginMap))
+	for k, src := range step.OriginMap {
+		v, err := c.resolve(ctx, state, src)
+		if err != nil {
+			return nil, err
+		}
+		mp[k] = v
+	}
+	return mp, nil
+}
+
+func (c *PipelineExecutor) buildParams(ctx iris.Context, state *pipelineState, step *PipelineStep) ([]byte, error) {
+	if len(step.ParamsMap) < 1 {
+		return step.Params, nil
+	}
+	mp := make(map[string]any)
+	if len(step.Params) > 0 {
+		err := jsoniter.Unmarshal(step.Params, &mp)
+		if err != nil {
+			return nil, errors.Wrap(err, "参数覆盖时params必须为对象")
+		}
+	}
+	for k, src := range step.ParamsMap {
+		v, err := c.resolve(ctx, state, src)
+		if err != nil {
+			return nil, err
+		}
+		setPath(mp, k, v)
+	}
+	return jsoniter.Marshal(mp)
+}
+
+// Execute 顺序执行所有步骤
+// 某一步IsBreak时中断后续执行 若无错误或为主动跳出则以该步结果为成功返回
+func (c *PipelineExecutor) Execute(ctx iris.Context) *RunResp[any] {
+	state := &pipelineState{
+		results: make(map[string]any),
+	}
+
+	for _, step := range c.Def.Steps {
+		runner, ok := c.Registry.Get(step.Key)
+		if !ok {
+			return NewPipeErr[any](PipeDepNotFound)
+		}
+
+		origin, err := c.buildOrigin(ctx, state, step)
+		if err != nil {
+			return c.stepErr(step, NewPipeErr[any](err))
+		}
+		params, err := c.buildParams(ctx, state, step)
+		if err != nil {
+			return c.stepErr(step, NewPipeErr[any](err))
+		}
+		var db any
+		if len(step.Db) > 0 {
+			db = c.Deps[step.Db]
+		}
+
+		resp := runner.RunAny(ctx, origin, params, db)
+
+		if resp.IsBreak {
+			if resp.Err == nil || errors.Is(resp.Err, PipeCacheHasError) || errors.Is(resp.Err, PipeBreakError) {
+				return NewPipeResult(resp.Result).SetBreak(true)
+			}
+			return c.stepErr(step, resp)
+		}
+		if resp.Err != nil {
+			if !step.Ignore {
+				return c.stepErr(step, resp)
+			}
+			continue
+		}
+
+		state.prev = resp.Result
+		if len(step.Alias) > 0 {
+			state.results[step.Alias] = resp.Result
+		}
+	}
+
+	if len(c.Def.Result) > 0 {
+		return NewPipeResult(state.results[c.Def.Result])
+	}
+	return NewPipeResult(state.prev)
+}
+
+func (c *PipelineExecutor) stepErr(step *PipelineStep, resp *RunResp[any]) *RunResp[any] {
+	if len(step.ErrMsg) > 0 {
+		resp.Msg = step.ErrMsg
+	}
+	if step.ErrCode > 0 {
+		resp.ReqCode = step.ErrCode
+	}
+	return resp
+}
+
+func (c *PipelineExecutor) Handler() iris.Handler {
+	return func(ctx iris.Context) {
+		c.Execute(ctx).Return(ctx)
+	}
+}
+
+// Mount 按定义中的method与path挂载
+func (c *PipelineExecutor) Mount(party router.Party) *router.Route {
+	method := strings.ToUpper(c.Def.Method)
+	if len(method) < 1 {
+		method = http.MethodPost
+	}
+	return party.Handle(method, c.Def.Path, c.Handler())
+}
+
+func NewPipelineExecutor(def *PipelineDef, registry *Registry, deps map[string]any) (*PipelineExecutor, error) {
+	if registry == nil {
+		registry = DefaultRegistry
+	}
+	inst := &PipelineExecutor{
+		Def:      def,
+		Registry: registry,
+		Deps:     deps,
+	}
+	err := inst.Check()
+	if err != nil {
+		return nil, err
+	}
+	return inst, nil
+}
+
+// pickPath 通过.分割的路径取值 非map时会先转为通用结构
+func pickPath(input any, path string) (any, error) {
+	if len(path) < 1 || input == nil {
+		return input, nil
+	}
+	var mp map[string]any
+	if v, ok := input.(map[string]any); ok {
+		mp = v
+	} else {
+		bin, err := jsoniter.Marshal(input)
+		if err != nil {
+			return nil, err
+		}
+		err = jsoniter.Unmarshal(bin, &mp)
+		if err != nil {
+			return nil, errors.Wrap(err, "数据无法按路径取值")
+		}
+	}
+	key, rest, _ := strings.Cut(path, ".")
+	return pickPath(mp[key], rest)
+}
+
+// setPath 通过.分割的路径设置值
+func setPath(mp map[string]any, path string, value any) {
+	key, rest, found := strings.Cut(path, ".")
+	if !found {
+		mp[key] = value
+		return
+	}
+	child, ok := mp[key].(map[string]any)
+	if !ok {
+		child = make(map[string]any)
+		mp[key] = child
+	}
+	setPath(child, rest, value)
+}
@@ -0,0 +1,97 @@
+package pipe
+
+import (
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/httptest"
+	"strings"
+	"testing"
+)
+
+const testPipelineYaml = `
+name: kv
+method: post
+path: /kv
+steps:
+  - key: kv_valid
+    alias: check
+    params:
+      value: abcd
+    params_map:
+      origin:
+        from: body
+        key: name
+    err_code: 422
+  - key: hash_gen
+    alias: hash
+    params:
+      type: b62
+    params_map:
+      cols:
+        from: value
+        value: ["a", "b"]
+  - key: response_parse
+    origin:
+      from: none
+    params:
+      type: json
+    params_map:
+      items.pass:
+        from: step
+        key: check
+      items.hash:
+        from: step
+        key: hash
+`
+
+func TestPipelineExecutor(t *testing.T) {
+	def, err := ParsePipelineDef([]byte(testPipelineYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec, err := NewPipelineExecutor(def, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := iris.New()
+	exec.Mount(app)
+	e := httptest.New(t, app)
+
+	data := e.POST("/kv").WithJSON(iris.Map{"name": "abcd"}).Expect().Status(iris.StatusOK).JSON().Object().Value("data").Object()
+	data.Value("json").Object().ValueEqual("pass", true)
+	data.Value("json").Object().Value("hash").String().NotEmpty()
+
+	data = e.POST("/kv").WithJSON(iris.Map{"name": "a"}).Expect().Status(iris.StatusOK).JSON().Object().Value("data").Object()
+	data.Value("json").Object().ValueEqual("pass", false)
+
+	// 分块传输的请求体 ContentLength为-1
+	data = e.POST("/kv").WithHeader("Content-Type", "application/json").WithChunked(strings.NewReader(`{"name":"abcd"}`)).Expect().Status(iris.StatusOK).JSON().Object().Value("data").Object()
+	data.Value("json").Object().ValueEqual("pass", true)
+}
+
+func TestPipelineExecutorCheck(t *testing.T) {
+	def := &PipelineDef{Steps: []*PipelineStep{{Key: "not_exist"}}}
+	if _, err := NewPipelineExecutor(def, nil, nil); err == nil {
+		t.Error("未注册的运行器应当报错")
+	}
+
+	def = &PipelineDef{Steps: []*PipelineStep{{Key: "jwt_check", Db: "rdb"}}}
+	if _, err := NewPipelineExecutor(def, nil, nil); err == nil {
+		t.Error("缺失依赖应当报错")
+	}
+
+	if _, ok := DefaultRegistry.Get("kvs_valid"); !ok {
+		t.Error("多kv验证器应使用独立的key")
+	}
+
+	def = &PipelineDef{Steps: []*PipelineStep{{Key: "kv_valid"}}}
+	exec, err := NewPipelineExecutor(def, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 参数为空 运行器内部报错
+	resp := exec.Execute(mockIrisContext())
+	if resp.Err == nil {
+		t.Error("空参数应当报错")
+	}
+}
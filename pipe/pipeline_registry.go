@@ -0,0 +1,163 @@
+package pipe
+
+import (
+	jsoniter "github.com/json-iterator/go"
+	"github.com/kataras/iris/v12"
+	"github.com/pkg/errors"
+	"sort"
+	"sync"
+)
+
+// IRunner 抹去泛型之后的运行器 供注册表和执行器使用
+type IRunner interface {
+	GetKey() string
+	GetName() string
+	GetDesc() string
+	// RunAny origin会尝试转换为运行器的T params为json 会解析为运行器的P db会断言为运行器的D
+	RunAny(ctx iris.Context, origin any, params []byte, db any, more ...any) *RunResp[any]
+}
+
+func (c *RunnerContext[T, P, D, R]) GetKey() string {
+	return c.Key
+}
+func (c *RunnerContext[T, P, D, R]) GetName() string {
+	return c.Name
+}
+func (c *RunnerContext[T, P, D, R]) GetDesc() string {
+	return c.Desc
+}
+
+func (c *RunnerContext[T, P, D, R]) RunAny(ctx iris.Context, origin any, params []byte, db any, more ...any) *RunResp[any] {
+	o, err := anyConvert[T](origin)
+	if err != nil {
+		return NewPipeErrMsg[any](err.Error(), PipeOriginError)
+	}
+
+	var p P
+	if len(params) > 0 {
+		err = jsoniter.Unmarshal(params, &p)
+		if err != nil {
+			return NewPipeErrMsg[any](err.Error(), PipeParamsError)
+		}
+	}
+
+	var d D
+	if db != nil {
+		dv, ok := db.(D)
+		if !ok {
+			return NewPipeErr[any](PipeDbError)
+		}
+		d = dv
+	}
+
+	resp := c.Run(ctx, o, p, d, more...)
+	return &RunResp[any]{
+		Result:       resp.Result,
+		Msg:          resp.Msg,
+		Err:          resp.Err,
+		ReqCode:      resp.ReqCode,
+		BusinessCode: resp.BusinessCode,
+		IsBreak:      resp.IsBreak,
+	}
+}
+
+// anyConvert 把任意值转换为T 类型一致直接断言 否则通过json中转
+func anyConvert[T any](input any) (T, error) {
+	var result T
+	if input == nil {
+		return result, nil
+	}
+	if v, ok := input.(T); ok {
+		return v, nil
+	}
+	bin, err := jsoniter.Marshal(input)
+	if err != nil {
+		return result, err
+	}
+	err = jsoniter.Unmarshal(bin, &result)
+	return result, err
+}
+
+// Registry 运行器注册表 通过Key查找运行器
+type Registry struct {
+	sync.RWMutex
+	runners map[string]IRunner
+}
+
+func (c *Registry) Register(runners ...IRunner) error {
+	c.Lock()
+	defer c.Unlock()
+	for _, runner := range runners {
+		k := runner.GetKey()
+		if len(k) < 1 {
+			return errors.New("运行器key不能为空")
+		}
+		if _, ok := c.runners[k]; ok {
+			return errors.Errorf("运行器key %s 已存在", k)
+		}
+		c.runners[k] = runner
+	}
+	return nil
+}
+
+// MustRegister 注册失败直接panic
+func (c *Registry) MustRegister(runners ...IRunner) *Registry {
+	err := c.Register(runners...)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func (c *Registry) Get(key string) (IRunner, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	r, ok := c.runners[key]
+	return r, ok
+}
+
+func (c *Registry) Keys() []string {
+	c.RLock()
+	defer c.RUnlock()
+	keys := make([]string, 0, len(c.runners))
+	for k := range c.runners {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		runners: make(map[string]IRunner),
+	}
+}
+
+// NewDefaultRegistry 注册了所有内置运行器的注册表
+func NewDefaultRegistry() *Registry {
+	return NewRegistry().MustRegister(
+		RequestRate,
+		RequestCacheGet, RequestCacheSet,
+		LocalCacheGet, LocalCacheSet,
+		EmailSend, EmailValid, EmailLinkSend, EmailLinkLogin,
+		HashGen,
+		HttpRequest,
+		ImgSafe, TextSafe,
+		JwtGen, JwtCheck, JwtExchange, JwtFlat, JwtVisit,
+		JwtSessionGen, JwtRefresh, JwtRevoke,
+		KvValid, KvsValid,
+		ModelAdd, ModelMapper, ModelDel, ModelRestore, ModelPurge, QueryGetData, ModelPut,
+		OauthLogin,
+		QueryParse,
+		RandomGen,
+		RbacGetRoles, RbacAllow,
+		RedisCommand, RedisCommands,
+		ResponseParse,
+		RulesValid,
+		SchemaValid,
+		SmsSend, SmsValid,
+		SwipeValidGet, SwipeImageGet, SwipeValidCheck,
+	)
+}
+
+var DefaultRegistry = NewDefaultRegistry()
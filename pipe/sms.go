@@ -18,37 +18,55 @@ import (
 )
 
 // 短信相关
+// 发送由SmsProvider实现 验证码存储 重发冷却 每日额度在SmsClient中统一处理 与服务商无关
 
-type SmsClient struct {
-	secretId    string
-	secretKey   string
-	sign        string
-	appId       string
-	region      string
-	expTime     time.Duration // 过期时间 默认5分钟
-	redisPrefix string
-	rdb         rueidis.Client
+var (
+	ErrSmsCooldown   = orginErrors.New("已有信息在路上,若未收到请稍后重试")
+	ErrSmsPhoneQuota = orginErrors.New("该号码今日短信发送次数已达上限")
+	ErrSmsIpQuota    = orginErrors.New("今日短信发送次数已达上限")
+)
+
+// SmsMessage 待发送的短信 Params按模板中参数的顺序
+type SmsMessage struct {
+	Mobile     string
+	TemplateId string
+	Params     []string
 }
 
-func NewSmsClient(secretId, secretKey, sign, appId string, rdb rueidis.Client) *SmsClient {
-	var client = new(SmsClient)
-	client.secretKey = secretKey
-	client.secretId = secretId
-	client.sign = sign
-	client.appId = appId
-	client.expTime = 5 * time.Minute
-	client.redisPrefix = "code:"
-	client.rdb = rdb
-	return client
+// SmsProvider 短信服务商
+type SmsProvider interface {
+	Name() string
+	Send(ctx context.Context, msg *SmsMessage) error
 }
 
-func NewDefaultSmsClient(rdb rueidis.Client) *SmsClient {
-	client := NewSmsClient("", "", "", "", rdb)
-	client.region = ""
-	return client
+// TencentSmsProvider 腾讯云短信 sms/v20190711
+type TencentSmsProvider struct {
+	secretId  string
+	secretKey string
+	sign      string
+	appId     string
+	region    string
+}
+
+func NewTencentSmsProvider(secretId, secretKey, sign, appId, region string) *TencentSmsProvider {
+	return &TencentSmsProvider{
+		secretId:  secretId,
+		secretKey: secretKey,
+		sign:      sign,
+		appId:     appId,
+		region:    region,
+	}
+}
+
+func (s *TencentSmsProvider) Name() string {
+	return "tencent"
 }
 
-func (s *SmsClient) send(phones []string, TemplateID string, TemplateParamSet []string) error {
+func (s *TencentSmsProvider) Send(ctx context.Context, msg *SmsMessage) error {
+	phone := msg.Mobile
+	if !strings.HasPrefix(phone, "+") {
+		phone = "+86" + phone
+	}
 	credential := common.NewCredential(
 		s.secretId,
 		s.secretKey,
@@ -59,11 +77,11 @@ func (s *SmsClient) send(phones []string, TemplateID string, TemplateParamSet []
 
 	request := sms.NewSendSmsRequest()
 
-	request.PhoneNumberSet = common.StringPtrs(phones)
-	request.TemplateID = common.StringPtr(TemplateID)
+	request.PhoneNumberSet = common.StringPtrs([]string{phone})
+	request.TemplateID = common.StringPtr(msg.TemplateId)
 	// 签名内容 https://console.cloud.tencent.com/smsv2/csms-sign
 	request.Sign = common.StringPtr(s.sign)
-	request.TemplateParamSet = common.StringPtrs(TemplateParamSet)
+	request.TemplateParamSet = common.StringPtrs(msg.Params)
 	// 短信应用ID https://console.cloud.tencent.com/smsv2/app-manage
 	request.SmsSdkAppid = common.StringPtr(s.appId)
 
@@ -86,12 +104,73 @@ func (s *SmsClient) send(phones []string, TemplateID string, TemplateParamSet []
 	return nil
 }
 
-// Send 这个是发送的登录验证码
+type SmsClient struct {
+	provider     SmsProvider
+	expTime      time.Duration // 过期时间 默认5分钟
+	cooldown     time.Duration // 重发间隔 默认60秒
+	dailyLimit   int64         // 每个号码每日发送上限 默认10 0为不限制
+	ipDailyLimit int64         // 每个ip每日发送上限 默认50 0为不限制
+	redisPrefix  string
+	rdb          rueidis.Client
+}
+
+func NewSmsClient(secretId, secretKey, sign, appId string, rdb rueidis.Client) *SmsClient {
+	return NewSmsClientWithProvider(NewTencentSmsProvider(secretId, secretKey, sign, appId, ""), rdb)
+}
+
+func NewDefaultSmsClient(rdb rueidis.Client) *SmsClient {
+	return NewSmsClient("", "", "", "", rdb)
+}
+
+// NewSmsClientWithProvider 使用任意服务商
+func NewSmsClientWithProvider(provider SmsProvider, rdb rueidis.Client) *SmsClient {
+	var client = new(SmsClient)
+	client.provider = provider
+	client.expTime = 5 * time.Minute
+	client.cooldown = time.Minute
+	client.dailyLimit = 10
+	client.ipDailyLimit = 50
+	client.redisPrefix = "code:"
+	client.rdb = rdb
+	return client
+}
+
+func (s *SmsClient) Provider() SmsProvider {
+	return s.provider
+}
+
+func (s *SmsClient) SetProvider(provider SmsProvider) *SmsClient {
+	s.provider = provider
+	return s
+}
+
+// SetExpire 验证码有效期
+func (s *SmsClient) SetExpire(exp time.Duration) *SmsClient {
+	s.expTime = exp
+	return s
+}
+
+// SetLimit 设置重发间隔与每日额度 额度为0时不限制
+func (s *SmsClient) SetLimit(cooldown time.Duration, dailyLimit, ipDailyLimit int64) *SmsClient {
+	s.cooldown = cooldown
+	s.dailyLimit = dailyLimit
+	s.ipDailyLimit = ipDailyLimit
+	return s
+}
+
+func (s *SmsClient) codeKey(mobile string) string {
+	return s.redisPrefix + mobile
+}
+func (s *SmsClient) cooldownKey(mobile string) string {
+	return s.redisPrefix + "cd:" + mobile
+}
+func (s *SmsClient) dailyKey(kind, target string) string {
+	return s.redisPrefix + kind + ":" + time.Now().Format("20060102") + ":" + target
+}
+
+// Send 这个是发送的登录验证码 不检查冷却与额度
 func (s *SmsClient) Send(ctx context.Context, templateID string, mobile string) (string, error) {
 
-	var phones = []string{
-		"+86" + mobile,
-	}
 	code := ut.RandomInt(1000, 9999)
 	codeStr := strconv.Itoa(code)
 
@@ -101,12 +180,16 @@ func (s *SmsClient) Send(ctx context.Context, templateID string, mobile string)
 		fmt.Sprintf("%v", s.expTime.Minutes()),
 	}
 
-	err := s.send(phones, templateID, sendParams)
+	err := s.provider.Send(ctx, &SmsMessage{
+		Mobile:     mobile,
+		TemplateId: templateID,
+		Params:     sendParams,
+	})
 	if err != nil {
 		return "", err
 	}
 
-	resp := s.rdb.Do(ctx, s.rdb.B().Set().Key(s.redisPrefix+mobile).Value(codeStr).ExSeconds(int64(s.expTime.Seconds())).Build())
+	resp := s.rdb.Do(ctx, s.rdb.B().Set().Key(s.codeKey(mobile)).Value(codeStr).ExSeconds(int64(s.expTime.Seconds())).Build())
 	if resp.Error() != nil {
 		return "", resp.Error()
 	}
@@ -115,26 +198,67 @@ func (s *SmsClient) Send(ctx context.Context, templateID string, mobile string)
 
 }
 
-func (s *SmsClient) SendBeforeCheck(ctx context.Context, templateId string, mobile string) (string, error) {
-	// 先验证key是否存在
-	resp := s.rdb.Do(ctx, s.rdb.B().Exists().Key(s.redisPrefix+mobile).Build())
-	if resp.Error() != nil {
-		// 如果不存在的时候才进行发送
-		if resp.Error() == rueidis.Nil {
-			return s.Send(ctx, templateId, mobile)
-		}
-		return "", resp.Error()
+// 冷却与额度的检查和计数原子执行 -1 冷却中 -2 号码超额 -3 ip超额
+var sendLimitScript = rueidis.NewLuaScript(`
+if redis.call("exists", KEYS[1]) == 1 then
+	return -1
+end
+local phoneLimit = tonumber(ARGV[2])
+if phoneLimit > 0 and tonumber(redis.call("get", KEYS[2]) or "0") >= phoneLimit then
+	return -2
+end
+local ipLimit = tonumber(ARGV[3])
+if #KEYS > 2 and ipLimit > 0 and tonumber(redis.call("get", KEYS[3]) or "0") >= ipLimit then
+	return -3
+end
+if tonumber(ARGV[1]) > 0 then
+	redis.call("set", KEYS[1], "1", "PX", ARGV[1])
+end
+for i = 2, #KEYS do
+	redis.call("incr", KEYS[i])
+	redis.call("expire", KEYS[i], 86400)
+end
+return 1
+`)
+
+// SendWithLimit 检查重发冷却 号码与ip的每日额度后发送 ip为空时不检查ip额度
+func (s *SmsClient) SendWithLimit(ctx context.Context, templateId string, mobile string, ip string) (string, error) {
+	keys := []string{s.cooldownKey(mobile), s.dailyKey("day", mobile)}
+	if len(ip) > 0 {
+		keys = append(keys, s.dailyKey("ip", ip))
+	}
+	ret, err := sendLimitScript.Exec(ctx, s.rdb, keys, []string{
+		strconv.FormatInt(s.cooldown.Milliseconds(), 10),
+		strconv.FormatInt(s.dailyLimit, 10),
+		strconv.FormatInt(s.ipDailyLimit, 10),
+	}).AsInt64()
+	if err != nil {
+		return "", err
+	}
+	switch ret {
+	case -1:
+		return "", ErrSmsCooldown
+	case -2:
+		return "", ErrSmsPhoneQuota
+	case -3:
+		return "", ErrSmsIpQuota
 	}
 
-	has, _ := resp.AsBool()
-	if has {
-		return "", orginErrors.New("已有信息在路上,若未收到请稍后重试")
+	code, err := s.Send(ctx, templateId, mobile)
+	if err != nil {
+		// 发送失败允许立即重试 额度依然计算 防止利用失败刷接口
+		_ = s.rdb.Do(ctx, s.rdb.B().Del().Key(s.cooldownKey(mobile)).Build())
+		return "", err
 	}
-	return s.Send(ctx, templateId, mobile)
+	return code, nil
+}
+
+func (s *SmsClient) SendBeforeCheck(ctx context.Context, templateId string, mobile string) (string, error) {
+	return s.SendWithLimit(ctx, templateId, mobile, "")
 }
 
 func (s *SmsClient) Valid(ctx context.Context, mobile, code string) bool {
-	resp := s.rdb.Do(ctx, s.rdb.B().Get().Key(s.redisPrefix+mobile).Build())
+	resp := s.rdb.Do(ctx, s.rdb.B().Get().Key(s.codeKey(mobile)).Build())
 	if resp.Error() != nil {
 		return false
 	}
@@ -147,5 +271,5 @@ func (s *SmsClient) Valid(ctx context.Context, mobile, code string) bool {
 
 // DelKey 删除 key 让code验证
 func (s *SmsClient) DelKey(ctx context.Context, mobile string) {
-	_ = s.rdb.Do(ctx, s.rdb.B().Del().Key(s.redisPrefix+mobile).Build())
+	_ = s.rdb.Do(ctx, s.rdb.B().Del().Key(s.codeKey(mobile)).Build())
 }
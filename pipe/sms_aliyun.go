@@ -0,0 +1,124 @@
+package pipe
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/23233/ggg/ut"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AliyunSmsProvider 阿里云短信 dysmsapi 2017-05-25 使用RPC签名直接请求 不依赖sdk
+type AliyunSmsProvider struct {
+	accessKeyId     string
+	accessKeySecret string
+	sign            string
+	region          string
+	// ParamNames 阿里云模板参数为具名参数 按顺序对应SmsMessage.Params 默认为 code
+	ParamNames []string
+	Endpoint   string // 默认 https://dysmsapi.aliyuncs.com/
+	HttpClient *http.Client
+}
+
+func NewAliyunSmsProvider(accessKeyId, accessKeySecret, sign string) *AliyunSmsProvider {
+	return &AliyunSmsProvider{
+		accessKeyId:     accessKeyId,
+		accessKeySecret: accessKeySecret,
+		sign:            sign,
+		region:          "cn-hangzhou",
+		ParamNames:      []string{"code"},
+		Endpoint:        "https://dysmsapi.aliyuncs.com/",
+		HttpClient:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *AliyunSmsProvider) Name() string {
+	return "aliyun"
+}
+
+// aliyunPercentEncode RPC签名要求的编码
+func aliyunPercentEncode(s string) string {
+	s = url.QueryEscape(s)
+	s = strings.ReplaceAll(s, "+", "%20")
+	s = strings.ReplaceAll(s, "*", "%2A")
+	s = strings.ReplaceAll(s, "%7E", "~")
+	return s
+}
+
+// aliyunSignature 计算签名 返回签名后的完整query
+func aliyunSignature(method string, params map[string]string, secret string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, aliyunPercentEncode(k)+"="+aliyunPercentEncode(params[k]))
+	}
+	query := strings.Join(pairs, "&")
+	stringToSign := method + "&" + aliyunPercentEncode("/") + "&" + aliyunPercentEncode(query)
+	mac := hmac.New(sha1.New, []byte(secret+"&"))
+	mac.Write([]byte(stringToSign))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return "Signature=" + aliyunPercentEncode(signature) + "&" + query
+}
+
+func (s *AliyunSmsProvider) Send(ctx context.Context, msg *SmsMessage) error {
+	tplParams := make(map[string]string, len(msg.Params))
+	for i, v := range msg.Params {
+		if i >= len(s.ParamNames) {
+			break
+		}
+		tplParams[s.ParamNames[i]] = v
+	}
+	tplBin, err := json.Marshal(tplParams)
+	if err != nil {
+		return err
+	}
+	params := map[string]string{
+		"AccessKeyId":      s.accessKeyId,
+		"Action":           "SendSms",
+		"Format":           "JSON",
+		"PhoneNumbers":     strings.TrimPrefix(msg.Mobile, "+"),
+		"RegionId":         s.region,
+		"SignName":         s.sign,
+		"SignatureMethod":  "HMAC-SHA1",
+		"SignatureNonce":   ut.RandomStr(32),
+		"SignatureVersion": "1.0",
+		"TemplateCode":     msg.TemplateId,
+		"TemplateParam":    string(tplBin),
+		"Timestamp":        time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+		"Version":          "2017-05-25",
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.Endpoint+"?"+aliyunSignature(http.MethodGet, params, s.accessKeySecret), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Code      string `json:"Code"`
+		Message   string `json:"Message"`
+		RequestId string `json:"RequestId"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return errors.Wrap(err, "解析阿里云短信响应失败")
+	}
+	if result.Code != "OK" {
+		return errors.Errorf("短信发送失败 %s %s", result.Code, result.Message)
+	}
+	return nil
+}
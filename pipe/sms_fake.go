@@ -0,0 +1,60 @@
+package pipe
+
+import (
+	"context"
+	"sync"
+)
+
+// FakeSmsProvider 本地测试使用 不真正发送 记录所有短信
+type FakeSmsProvider struct {
+	mu       sync.Mutex
+	messages []SmsMessage
+	Err      error // 不为空时发送返回该错误 用于模拟发送失败
+}
+
+func NewFakeSmsProvider() *FakeSmsProvider {
+	return new(FakeSmsProvider)
+}
+
+func (s *FakeSmsProvider) Name() string {
+	return "fake"
+}
+
+func (s *FakeSmsProvider) Send(ctx context.Context, msg *SmsMessage) error {
+	if s.Err != nil {
+		return s.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, SmsMessage{
+		Mobile:     msg.Mobile,
+		TemplateId: msg.TemplateId,
+		Params:     append([]string(nil), msg.Params...),
+	})
+	return nil
+}
+
+// Messages 已发送的全部短信
+func (s *FakeSmsProvider) Messages() []SmsMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SmsMessage(nil), s.messages...)
+}
+
+// Last 发送给该号码的最后一条短信
+func (s *FakeSmsProvider) Last(mobile string) (SmsMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if s.messages[i].Mobile == mobile {
+			return s.messages[i], true
+		}
+	}
+	return SmsMessage{}, false
+}
+
+func (s *FakeSmsProvider) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = nil
+}
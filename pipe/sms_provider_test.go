@@ -0,0 +1,149 @@
+package pipe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSmsClientLimit(t *testing.T) {
+	mr, rdb := newMiniRedisClient(t)
+	ctx := context.TODO()
+	fake := NewFakeSmsProvider()
+	client := NewSmsClientWithProvider(fake, rdb).SetLimit(time.Minute, 2, 3)
+
+	code, err := client.SendWithLimit(ctx, "tpl", "13800000000", "1.1.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, ok := fake.Last("13800000000")
+	if !ok || msg.TemplateId != "tpl" || msg.Params[0] != code {
+		t.Fatalf("短信内容错误 %+v", msg)
+	}
+	if !client.Valid(ctx, "13800000000", code) {
+		t.Fatal("验证码应验证通过")
+	}
+
+	// 冷却中
+	if _, err = client.SendWithLimit(ctx, "tpl", "13800000000", "1.1.1.1"); !errors.Is(err, ErrSmsCooldown) {
+		t.Fatalf("冷却中应拒绝 %v", err)
+	}
+	mr.FastForward(time.Minute)
+	if _, err = client.SendWithLimit(ctx, "tpl", "13800000000", "1.1.1.1"); err != nil {
+		t.Fatal(err)
+	}
+	mr.FastForward(time.Minute)
+	// 号码额度
+	if _, err = client.SendWithLimit(ctx, "tpl", "13800000000", "1.1.1.1"); !errors.Is(err, ErrSmsPhoneQuota) {
+		t.Fatalf("号码超额应拒绝 %v", err)
+	}
+	// ip额度
+	if _, err = client.SendWithLimit(ctx, "tpl", "13800000001", "1.1.1.1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.SendWithLimit(ctx, "tpl", "13800000002", "1.1.1.1"); !errors.Is(err, ErrSmsIpQuota) {
+		t.Fatalf("ip超额应拒绝 %v", err)
+	}
+	if _, err = client.SendWithLimit(ctx, "tpl", "13800000002", "2.2.2.2"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.Messages()) != 4 {
+		t.Fatalf("应发送4条 %d", len(fake.Messages()))
+	}
+
+	// 发送失败不进入冷却
+	fake.Err = errors.New("fail")
+	if _, err = client.SendWithLimit(ctx, "tpl", "13800000003", ""); err == nil {
+		t.Fatal("应返回发送错误")
+	}
+	fake.Err = nil
+	if _, err = client.SendWithLimit(ctx, "tpl", "13800000003", ""); err != nil {
+		t.Fatalf("发送失败后可以立即重试 %v", err)
+	}
+}
+
+func TestSmsSendRealIp(t *testing.T) {
+	// 客户端不能通过请求体指定ip
+	var params SmsPipe
+	if err := json.Unmarshal([]byte(`{"mobile":"13800000000","ip":"9.9.9.9"}`), &params); err != nil || params.Ip != "" {
+		t.Fatalf("ip不应可以绑定 %+v %v", params, err)
+	}
+
+	_, rdb := newMiniRedisClient(t)
+	client := NewSmsClientWithProvider(NewFakeSmsProvider(), rdb).SetLimit(0, 0, 1)
+	send := func(mobile, forwarded string) error {
+		ctx := mockIrisContext()
+		ctx.Request().RemoteAddr = "10.0.0.1:1234"
+		ctx.Request().Header.Set("X-Forwarded-For", forwarded)
+		return SmsSend.Run(ctx, nil, &SmsPipe{TemplateId: "tpl", Mobile: mobile}, client).Err
+	}
+	if err := send("13800000000", "3.3.3.3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := send("13800000001", "3.3.3.3"); !errors.Is(err, ErrSmsIpQuota) {
+		t.Fatalf("同一个真实ip应计入额度 %v", err)
+	}
+	// 同一个代理后的不同客户端互不影响
+	if err := send("13800000002", "4.4.4.4"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAliyunSignature(t *testing.T) {
+	// 阿里云文档中的签名示例
+	params := map[string]string{
+		"AccessKeyId":      "testId",
+		"Action":           "SendSms",
+		"Format":           "XML",
+		"OutId":            "123",
+		"PhoneNumbers":     "15300000001",
+		"RegionId":         "cn-hangzhou",
+		"SignName":         "阿里云短信测试专用",
+		"SignatureMethod":  "HMAC-SHA1",
+		"SignatureNonce":   "45e25e9b-0a6f-4070-8c85-2956eda1b466",
+		"SignatureVersion": "1.0",
+		"TemplateCode":     "SMS_71390007",
+		"TemplateParam":    `{"customer":"test"}`,
+		"Timestamp":        "2017-07-12T02:42:19Z",
+		"Version":          "2017-05-25",
+	}
+	query := aliyunSignature(http.MethodGet, params, "testSecret")
+	if !strings.HasPrefix(query, "Signature=zJDF%2BLrzhj%2FThnlvIToysFRq6t4%3D&") {
+		t.Fatalf("签名错误 %s", query)
+	}
+}
+
+func TestAliyunSmsProvider(t *testing.T) {
+	var got map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = map[string]string{}
+		for k, v := range r.URL.Query() {
+			got[k] = v[0]
+		}
+		if got["PhoneNumbers"] == "13800000009" {
+			_, _ = w.Write([]byte(`{"Code":"isv.BUSINESS_LIMIT_CONTROL","Message":"触发流控"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"Code":"OK","Message":"OK"}`))
+	}))
+	defer srv.Close()
+
+	p := NewAliyunSmsProvider("id", "secret", "签名")
+	p.Endpoint = srv.URL + "/"
+	err := p.Send(context.TODO(), &SmsMessage{Mobile: "13800000000", TemplateId: "SMS_1", Params: []string{"1234", "5"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["TemplateParam"] != `{"code":"1234"}` || got["SignName"] != "签名" || len(got["Signature"]) < 1 {
+		t.Fatalf("请求参数错误 %v", got)
+	}
+	err = p.Send(context.TODO(), &SmsMessage{Mobile: "13800000009", TemplateId: "SMS_1", Params: []string{"1234"}})
+	if err == nil || !strings.Contains(err.Error(), "BUSINESS_LIMIT_CONTROL") {
+		t.Fatalf("应返回服务商错误 %v", err)
+	}
+}
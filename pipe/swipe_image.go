@@ -0,0 +1,230 @@
+package pipe
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"github.com/23233/ggg/ut"
+	"github.com/pkg/errors"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// 滑块验证码图片生成
+// 背景从图片池中随机选取 缩放裁剪到画布大小 未配置图片池时生成随机背景
+
+// SwipeImage 滑块图片 Token与 swipe_valid_get 返回的结构一致 但不包含x
+type SwipeImage struct {
+	Token  string `json:"token"`
+	Bg     string `json:"bg"`    // 背景图 png base64
+	Piece  string `json:"piece"` // 滑块图 png base64 宽为滑块大小 高与背景一致
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+type swipeImagePool struct {
+	sync.RWMutex
+	images []image.Image
+}
+
+func (p *swipeImagePool) random() image.Image {
+	p.RLock()
+	defer p.RUnlock()
+	switch len(p.images) {
+	case 0:
+		return nil
+	case 1:
+		return p.images[0]
+	}
+	return p.images[ut.RandomInt(0, len(p.images))]
+}
+
+// SetImages 设置背景图片池 会覆盖原有图片
+func (c *SwipeValidCode) SetImages(images ...image.Image) {
+	c.pool.Lock()
+	defer c.pool.Unlock()
+	c.pool.images = images
+}
+
+// LoadImages 从目录中加载png jpg图片到图片池
+func (c *SwipeValidCode) LoadImages(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	images := make([]image.Image, 0, len(entries))
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".png" && ext != ".jpg" && ext != ".jpeg") {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		img, _, err := image.Decode(f)
+		_ = f.Close()
+		if err != nil {
+			return errors.Wrapf(err, "图片解析失败 %s", entry.Name())
+		}
+		images = append(images, img)
+	}
+	if len(images) < 1 {
+		return errors.New("目录中没有可用图片")
+	}
+	c.SetImages(images...)
+	return nil
+}
+
+// swipeCover 等比缩放并居中裁剪到指定大小
+func swipeCover(src image.Image, w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	sb := src.Bounds()
+	scale := math.Max(float64(w)/float64(sb.Dx()), float64(h)/float64(sb.Dy()))
+	offX := (float64(sb.Dx())*scale - float64(w)) / 2
+	offY := (float64(sb.Dy())*scale - float64(h)) / 2
+	for y := 0; y < h; y++ {
+		sy := sb.Min.Y + int((float64(y)+offY)/scale)
+		for x := 0; x < w; x++ {
+			sx := sb.Min.X + int((float64(x)+offX)/scale)
+			dst.Set(x, y, src.At(sx, sy))
+		}
+	}
+	return dst
+}
+
+// swipeRandomBg 随机渐变加色块 用于未配置图片池时
+func swipeRandomBg(w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	from := [3]int{ut.RandomInt(40, 200), ut.RandomInt(40, 200), ut.RandomInt(40, 200)}
+	to := [3]int{ut.RandomInt(40, 200), ut.RandomInt(40, 200), ut.RandomInt(40, 200)}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			f := float64(x+y) / float64(w+h)
+			dst.Set(x, y, color.RGBA{
+				R: uint8(float64(from[0]) + f*float64(to[0]-from[0])),
+				G: uint8(float64(from[1]) + f*float64(to[1]-from[1])),
+				B: uint8(float64(from[2]) + f*float64(to[2]-from[2])),
+				A: 255,
+			})
+		}
+	}
+	// 干扰色块 避免背景过于平滑时缺口一眼可见
+	for i := 0; i < 12; i++ {
+		cx, cy, r := ut.RandomInt(0, w), ut.RandomInt(0, h), ut.RandomInt(8, h/4)
+		col := color.RGBA{R: uint8(ut.RandomInt(0, 255)), G: uint8(ut.RandomInt(0, 255)), B: uint8(ut.RandomInt(0, 255)), A: 255}
+		for y := cy - r; y <= cy+r; y++ {
+			for x := cx - r; x <= cx+r; x++ {
+				if (x-cx)*(x-cx)+(y-cy)*(y-cy) <= r*r && image.Pt(x, y).In(dst.Rect) {
+					dst.Set(x, y, swipeBlend(dst.RGBAAt(x, y), col, 0.35))
+				}
+			}
+		}
+	}
+	return dst
+}
+
+func swipeBlend(a, b color.RGBA, f float64) color.RGBA {
+	mix := func(x, y uint8) uint8 {
+		return uint8(float64(x)*(1-f) + float64(y)*f)
+	}
+	return color.RGBA{R: mix(a.R, b.R), G: mix(a.G, b.G), B: mix(a.B, b.B), A: 255}
+}
+
+// swipeMask 拼图形状 正方形加顶部与右侧的凸起 坐标为滑块框内坐标
+func swipeMask(x, y, size int) bool {
+	if x < 0 || y < 0 || x >= size || y >= size {
+		return false
+	}
+	r := size / 6
+	if x >= r && x < size-r && y >= r && y < size-r {
+		return true
+	}
+	in := func(cx, cy int) bool {
+		return (x-cx)*(x-cx)+(y-cy)*(y-cy) <= r*r
+	}
+	return in(size/2, r) || in(size-r, size/2)
+}
+
+func swipeMaskEdge(x, y, size int) bool {
+	return swipeMask(x, y, size) && (!swipeMask(x-1, y, size) || !swipeMask(x+1, y, size) || !swipeMask(x, y-1, size) || !swipeMask(x, y+1, size))
+}
+
+// Render 根据滑块要素生成背景与滑块的png
+func (c *SwipeValidCode) Render(item *SwipeItem) (bg []byte, piece []byte, err error) {
+	var canvas *image.RGBA
+	if src := c.pool.random(); src != nil {
+		canvas = swipeCover(src, c.drawMaxWidth, c.drawMaxHeight)
+	} else {
+		canvas = swipeRandomBg(c.drawMaxWidth, c.drawMaxHeight)
+	}
+	size := item.B
+	left, top := item.X-size/2, item.Y-size/2
+
+	pieceImg := image.NewRGBA(image.Rect(0, 0, size, c.drawMaxHeight))
+	white := color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	black := color.RGBA{A: 255}
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if !swipeMask(x, y, size) {
+				continue
+			}
+			px, py := left+x, top+y
+			if !image.Pt(px, py).In(canvas.Rect) {
+				continue
+			}
+			origin := canvas.RGBAAt(px, py)
+			if swipeMaskEdge(x, y, size) {
+				pieceImg.SetRGBA(x, py, swipeBlend(origin, white, 0.8))
+				canvas.SetRGBA(px, py, swipeBlend(origin, white, 0.6))
+				continue
+			}
+			pieceImg.SetRGBA(x, py, origin)
+			canvas.SetRGBA(px, py, swipeBlend(origin, black, 0.5))
+		}
+	}
+
+	encode := func(img draw.Image) ([]byte, error) {
+		buf := new(bytes.Buffer)
+		if err := png.Encode(buf, img); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	if bg, err = encode(canvas); err != nil {
+		return nil, nil, err
+	}
+	if piece, err = encode(pieceImg); err != nil {
+		return nil, nil, err
+	}
+	return bg, piece, nil
+}
+
+// GenImage 生成滑块要素并渲染图片 返回给客户端的内容不包含x
+func (c *SwipeValidCode) GenImage(ctx context.Context) (*SwipeImage, error) {
+	sp, err := c.Gen(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bg, piece, err := c.Render(sp)
+	if err != nil {
+		return nil, err
+	}
+	public := *sp
+	public.X = 0
+	return &SwipeImage{
+		Token:  base64.StdEncoding.EncodeToString([]byte(public.ToString())),
+		Bg:     base64.StdEncoding.EncodeToString(bg),
+		Piece:  base64.StdEncoding.EncodeToString(piece),
+		Width:  c.drawMaxWidth,
+		Height: c.drawMaxHeight,
+	}, nil
+}
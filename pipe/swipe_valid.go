@@ -70,6 +70,91 @@ type SwipeValid struct {
 	S            float64   `json:"s,omitempty"`             // 拖动速度
 	N            float64   `json:"n,omitempty"`             // 归一化 拖动X平均值波动值最高
 	Nm           float64   `json:"nm,omitempty"`            // 归一化 拖动X平均值波动值最低
+	// 拖动轨迹 由客户端在拖动过程中采样
+	Track []SwipeTrackPoint `json:"track,omitempty"`
+}
+
+// SwipeTrackPoint 轨迹点 T为距离开始拖动的毫秒数
+type SwipeTrackPoint struct {
+	X int64 `json:"x"`
+	Y int64 `json:"y"`
+	T int64 `json:"t"`
+}
+
+// SwipeTrackRule 轨迹验证规则
+type SwipeTrackRule struct {
+	Required    bool          // 为true时必须提交轨迹 否则仅在提交了轨迹时验证 默认为false 兼容未提交轨迹的旧版前端
+	MinPoints   int           // 最少轨迹点数量
+	MinDuration time.Duration // 最短拖动时长
+	MaxDuration time.Duration // 最长拖动时长
+	MinSpeedCv  float64       // 速度变异系数下限 脚本匀速拖动时接近0
+	MaxEndDiff  int64         // 轨迹终点与提交位置的最大差值
+}
+
+func DefaultSwipeTrackRule() *SwipeTrackRule {
+	return &SwipeTrackRule{
+		Required:    false,
+		MinPoints:   5,
+		MinDuration: 300 * time.Millisecond,
+		MaxDuration: 20 * time.Second,
+		MinSpeedCv:  0.1,
+		MaxEndDiff:  5,
+	}
+}
+
+// Check 验证轨迹 x为最终提交的位置
+func (r *SwipeTrackRule) Check(track []SwipeTrackPoint, x int64) error {
+	if len(track) < 1 {
+		if r.Required {
+			return errors.New("缺少拖动轨迹")
+		}
+		return nil
+	}
+	if len(track) < r.MinPoints {
+		return errors.New("拖动轨迹过短")
+	}
+	duration := time.Duration(track[len(track)-1].T-track[0].T) * time.Millisecond
+	if duration < r.MinDuration {
+		return errors.New("拖动过快")
+	}
+	if r.MaxDuration > 0 && duration > r.MaxDuration {
+		return errors.New("拖动超时")
+	}
+	if math.Abs(float64(track[len(track)-1].X-x)) > float64(r.MaxEndDiff) {
+		return errors.New("轨迹与位置不符")
+	}
+	// 各段速度 时间必须递增
+	speeds := make([]float64, 0, len(track)-1)
+	for i := 1; i < len(track); i++ {
+		dt := track[i].T - track[i-1].T
+		if dt < 0 {
+			return errors.New("轨迹时间错误")
+		}
+		if dt == 0 {
+			continue
+		}
+		speeds = append(speeds, float64(track[i].X-track[i-1].X)/float64(dt))
+	}
+	if len(speeds) < 2 {
+		return errors.New("拖动轨迹过短")
+	}
+	var sum float64
+	for _, v := range speeds {
+		sum += v
+	}
+	mean := sum / float64(len(speeds))
+	if mean <= 0 {
+		return errors.New("轨迹方向错误")
+	}
+	var variance float64
+	for _, v := range speeds {
+		variance += (v - mean) * (v - mean)
+	}
+	variance /= float64(len(speeds))
+	if math.Sqrt(variance)/mean < r.MinSpeedCv {
+		return errors.New("拖动轨迹异常")
+	}
+	return nil
 }
 
 // SwipeValidCode 滑块验证码实例
@@ -81,6 +166,8 @@ type SwipeValidCode struct {
 	drawMaxWidth  int       // 暂定300
 	drawMaxHeight int       // 暂定160
 	blockSize     int       // 滑块大小
+	pool          *swipeImagePool
+	trackRule     *SwipeTrackRule
 
 	// 历史记录
 	history []SwipeValidCode
@@ -98,6 +185,8 @@ func NewSwipeValidInst(rdb rueidis.Client) *SwipeValidCode {
 	m.drawMaxWidth = 300
 	m.drawMaxHeight = 160
 	m.blockSize = 45
+	m.pool = new(swipeImagePool)
+	m.trackRule = DefaultSwipeTrackRule()
 	m.rdb = rdb
 	return m
 }
@@ -136,7 +225,7 @@ func (c *SwipeValidCode) Gen(ctx context.Context) (*SwipeItem, error) {
 	// board 写入redis
 	resp := c.rdb.Do(ctx, c.rdb.B().Set().Key("sv:"+d.Id).Value(string(marshal)).ExSeconds(c.ExpireSec).Build())
 	if resp.Error() != nil {
-		return nil, err
+		return nil, resp.Error()
 	}
 
 	return d, nil
@@ -160,7 +249,7 @@ func (c *SwipeValidCode) Check(ctx iris.Context, raw string) (*SwipeValid, error
 	// 进行验证 首先判断id是否存在
 	resp := c.rdb.Do(ctx, c.rdb.B().Get().Key("sv:"+item.Sid).Build())
 	if resp.Error() != nil {
-		return nil, err
+		return nil, resp.Error()
 	}
 	dataPack, err := resp.ToString()
 	if err != nil {
@@ -175,7 +264,7 @@ func (c *SwipeValidCode) Check(ctx iris.Context, raw string) (*SwipeValid, error
 	// 进行验证
 
 	// 开始和结束的时间必须有一定的间隔 ms
-	if item.T.Sub(item.Te).Milliseconds() > 300 {
+	if item.Te.Sub(item.T).Milliseconds() < 300 {
 		return nil, errors.New("拖动过快")
 	}
 
@@ -184,7 +273,7 @@ func (c *SwipeValidCode) Check(ctx iris.Context, raw string) (*SwipeValid, error
 	if dataItem.N {
 		// 验证请求包中参数 只看原始请求包
 		rawBody := make(map[string]any)
-		err = json.Unmarshal(decodeStr, rawBody)
+		err = json.Unmarshal(decodeStr, &rawBody)
 		if err != nil {
 			return nil, errors.Wrap(err, "原始请求参数体解构失败")
 		}
@@ -224,6 +313,13 @@ func (c *SwipeValidCode) Check(ctx iris.Context, raw string) (*SwipeValid, error
 		return nil, errors.New("位置未命中")
 	}
 
+	// 轨迹验证
+	if c.trackRule != nil {
+		if err = c.trackRule.Check(item.Track, item.X); err != nil {
+			return nil, err
+		}
+	}
+
 	// 对于验证正确的 直接删除key 不用关心删除结果
 	_ = c.rdb.Do(ctx, c.rdb.B().Del().Key("sv:"+item.Sid).Build())
 
@@ -231,6 +327,11 @@ func (c *SwipeValidCode) Check(ctx iris.Context, raw string) (*SwipeValid, error
 
 }
 
+// SetTrackRule 设置轨迹验证规则 为nil时不验证轨迹
+func (c *SwipeValidCode) SetTrackRule(rule *SwipeTrackRule) {
+	c.trackRule = rule
+}
+
 func (c *SwipeValidCode) SetRandomCount(newCount int8) {
 	c.history = append(c.history, *c)
 	c.RandomCount = newCount
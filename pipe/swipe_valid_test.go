@@ -1,12 +1,16 @@
 package pipe
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"github.com/23233/ggg/ut"
 	"github.com/kataras/iris/v12"
 	"github.com/kataras/iris/v12/httptest"
 	"github.com/redis/rueidis"
+	"image"
+	"image/png"
+	"strings"
 	"testing"
 	"time"
 )
@@ -97,3 +101,169 @@ func TestSwipeValid(t *testing.T) {
 	resp.JSON().Object().Value("sid").String().Equal(rawItem.Id)
 
 }
+
+func TestSwipeRender(t *testing.T) {
+	inst := NewSwipeValidInst(nil)
+	item := &SwipeItem{X: 150, Y: 80, B: inst.BlockSize(false)}
+	bgBin, pieceBin, err := inst.Render(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bg, err := png.Decode(bytes.NewReader(bgBin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	piece, err := png.Decode(bytes.NewReader(pieceBin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bg.Bounds().Dx() != 300 || bg.Bounds().Dy() != 160 || piece.Bounds().Dx() != item.B || piece.Bounds().Dy() != 160 {
+		t.Fatalf("图片尺寸错误 %v %v", bg.Bounds(), piece.Bounds())
+	}
+	// 滑块中心不透明 滑块外透明
+	if _, _, _, a := piece.At(item.B/2, item.Y).RGBA(); a == 0 {
+		t.Fatal("滑块中心应不透明")
+	}
+	if _, _, _, a := piece.At(item.B/2, 5).RGBA(); a != 0 {
+		t.Fatal("滑块外应透明")
+	}
+
+	// 图片池
+	src := image.NewRGBA(image.Rect(0, 0, 600, 400))
+	for i := range src.Pix {
+		src.Pix[i] = 200
+	}
+	inst.SetImages(src)
+	bgBin, _, err = inst.Render(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bg, _ = png.Decode(bytes.NewReader(bgBin))
+	if r, _, _, _ := bg.At(5, 5).RGBA(); r>>8 != 200 {
+		t.Fatalf("应使用图片池中的图片 %d", r>>8)
+	}
+	if r, _, _, _ := bg.At(item.X, item.Y).RGBA(); r>>8 >= 200 {
+		t.Fatal("缺口位置应变暗")
+	}
+}
+
+func TestSwipeTrackRule(t *testing.T) {
+	rule := DefaultSwipeTrackRule()
+	human := []SwipeTrackPoint{{0, 0, 0}, {5, 1, 40}, {20, 1, 90}, {48, 2, 160}, {80, 2, 240}, {98, 3, 330}, {104, 3, 420}, {105, 3, 500}}
+	if err := rule.Check(human, 105); err != nil {
+		t.Fatal(err)
+	}
+	// 脚本匀速拖动
+	robot := make([]SwipeTrackPoint, 0, 11)
+	for i := int64(0); i <= 10; i++ {
+		robot = append(robot, SwipeTrackPoint{X: i * 10, T: i * 50})
+	}
+	if err := rule.Check(robot, 100); err == nil {
+		t.Fatal("匀速轨迹应拒绝")
+	}
+	if err := rule.Check(human[:5], 80); err == nil {
+		t.Fatal("过快的轨迹应拒绝")
+	}
+	if err := rule.Check(human, 60); err == nil {
+		t.Fatal("终点不符应拒绝")
+	}
+	if err := rule.Check(nil, 60); err != nil {
+		t.Fatal("非必须时可以不传轨迹")
+	}
+	rule.Required = true
+	if err := rule.Check(nil, 60); err == nil {
+		t.Fatal("必须时应拒绝")
+	}
+}
+
+func TestSwipeGenRedisError(t *testing.T) {
+	mr, rdb := newMiniRedisClient(t)
+	inst := NewSwipeValidInst(rdb)
+	mr.Close()
+	if _, err := inst.Gen(mockIrisContext()); err == nil {
+		t.Fatal("redis不可用时应返回错误")
+	}
+}
+
+func TestSwipeCheckBaseline(t *testing.T) {
+	mr, rdb := newMiniRedisClient(t)
+	inst := NewSwipeValidInst(rdb)
+	inst.SetTrackRule(nil)
+
+	// 参数在请求包中传递
+	item := &SwipeItem{Id: "sid1", C: 2, N: true, P: "ab", T: time.Now(), X: 100, Y: 50, B: 40}
+	raw, _ := json.Marshal(item)
+	if err := mr.Set("sv:"+item.Id, string(raw)); err != nil {
+		t.Fatal(err)
+	}
+	body := func(te time.Duration) string {
+		start := time.Now()
+		b, _ := json.Marshal(map[string]any{
+			"sid":  item.Id,
+			"x":    item.X - item.B/2,
+			"y":    item.Y - item.B/2,
+			"t":    start,
+			"te":   start.Add(te),
+			"ab-1": 1,
+			"ab-2": 2,
+		})
+		return base64.StdEncoding.EncodeToString(b)
+	}
+
+	// 拖动时间过短
+	_, err := inst.Check(mockIrisContext(), body(100*time.Millisecond))
+	if err == nil || !strings.Contains(err.Error(), "拖动过快") {
+		t.Fatalf("应判定拖动过快 %v", err)
+	}
+
+	// 正常拖动 请求包中的随机参数可以被解析
+	if _, err = inst.Check(mockIrisContext(), body(800*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 验证成功后key被删除
+	if _, err = inst.Check(mockIrisContext(), body(800*time.Millisecond)); err == nil {
+		t.Fatal("重复验证应失败")
+	}
+}
+
+func TestSwipeCheckWithoutTrack(t *testing.T) {
+	mr, rdb := newMiniRedisClient(t)
+	inst := NewSwipeValidInst(rdb)
+
+	item := &SwipeItem{Id: "sid2", C: 2, N: true, P: "ab", T: time.Now(), X: 100, Y: 50, B: 40}
+	raw, _ := json.Marshal(item)
+	// 旧版前端的请求 没有轨迹
+	body := func() string {
+		start := time.Now()
+		b, _ := json.Marshal(map[string]any{
+			"sid":  item.Id,
+			"x":    item.X - item.B/2,
+			"y":    item.Y - item.B/2,
+			"t":    start,
+			"te":   start.Add(800 * time.Millisecond),
+			"ab-1": 1,
+			"ab-2": 2,
+		})
+		return base64.StdEncoding.EncodeToString(b)
+	}
+
+	// 默认规则不要求轨迹
+	if err := mr.Set("sv:"+item.Id, string(raw)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inst.Check(mockIrisContext(), body()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 开启后必须提交轨迹
+	rule := DefaultSwipeTrackRule()
+	rule.Required = true
+	inst.SetTrackRule(rule)
+	if err := mr.Set("sv:"+item.Id, string(raw)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inst.Check(mockIrisContext(), body()); err == nil || !strings.Contains(err.Error(), "缺少拖动轨迹") {
+		t.Fatalf("要求轨迹时应拒绝 %v", err)
+	}
+}
@@ -3,11 +3,13 @@ package pmb
 import (
 	"context"
 	"embed"
+	"encoding/json"
 	"github.com/23233/gocaptcha"
 	"io/fs"
 	"net/http"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/23233/ggg/logger"
 	"github.com/23233/ggg/pipe"
@@ -34,11 +36,12 @@ type Backend struct {
 	connectInfo
 	models          []IModelItem
 	modelContextKey string
-	msg             *MessageQueue
+	msg             MessageStore
 	Prefix          string
 	LoginUseValid   bool
 	RegUseValid     bool
 	ValidHard       gocaptcha.CaptchaDifficulty
+	ApiInfo         OpenApiInfo // openapi文档信息
 }
 
 func (b *Backend) GetModel(name string) (IModelItem, bool) {
@@ -154,6 +157,10 @@ func (b *Backend) RegistryRoute(party iris.Party) {
 		})
 	})
 	apiParty.Get("/message", mustLoginMiddleware, b.GetMsgHandler)
+	apiParty.Get("/message/list", mustLoginMiddleware, b.GetMsgListHandler)
+	apiParty.Post("/message/read", mustLoginMiddleware, b.MsgReadHandler)
+	apiParty.Get("/message/sse", mustLoginMiddleware, b.MsgSseHandler)
+	apiParty.Get("/openapi.json", mustLoginMiddleware, b.OpenApiHandler(strings.ReplaceAll(apiParty.GetRelPath(), "//", "/")))
 
 	apiParty.Get("/config/{unique:string}",
 		mustLoginMiddleware,
@@ -240,6 +247,94 @@ func (b *Backend) RegistryRoute(party iris.Party) {
 			return
 		}
 	})
+	// 批量操作 每行的结果单独返回
+	batchReq := func(ctx iris.Context) (IModelItem, *BatchReq, bool) {
+		model := ctx.Values().Get(b.modelContextKey).(IModelItem)
+		req := new(BatchReq)
+		err := ctx.ReadBody(req)
+		if err != nil {
+			IrisRespErr("解析批量操作参数失败", err, ctx)
+			return nil, nil, false
+		}
+		return model, req, true
+	}
+	batchResp := func(ctx iris.Context, resp *BatchResp, err error) {
+		if err != nil {
+			IrisRespErr("", err, ctx)
+			return
+		}
+		ctx.JSON(resp)
+	}
+	curd.Post("/batch", recordBodyMiddleware, func(ctx iris.Context) {
+		model, req, ok := batchReq(ctx)
+		if !ok {
+			return
+		}
+		user := ctx.Values().Get(UserContextKey).(*SimpleUserModel)
+		injectData := make(map[string]any)
+		if model.HaveUserKey(model.GetSchema(SchemaModeAdd)) {
+			injectData[UserIdFieldName] = user.Uid
+		}
+		resp, err := model.BatchAdd(ctx, ut.ModelCtxMapperPack{InjectData: injectData}, req)
+		batchResp(ctx, resp, err)
+	})
+	curd.Put("/batch", recordBodyMiddleware, func(ctx iris.Context) {
+		model, req, ok := batchReq(ctx)
+		if !ok {
+			return
+		}
+		resp, err := model.BatchPut(ctx, pipe.ModelPutConfig{
+			UpdateTime: true,
+			DropKeys:   []string{UserIdFieldName},
+		}, req)
+		batchResp(ctx, resp, err)
+	})
+	curd.Delete("/batch", recordBodyMiddleware, func(ctx iris.Context) {
+		model, req, ok := batchReq(ctx)
+		if !ok {
+			return
+		}
+		resp, err := model.BatchDel(ctx, pipe.ModelDelConfig{}, req)
+		batchResp(ctx, resp, err)
+	})
+	// 修订记录与回滚
+	revisionHandler := func(ctx iris.Context) {
+		model := ctx.Values().Get(b.modelContextKey).(IModelItem)
+		model.RevisionHandler(ctx)
+	}
+	curd.Get("/{uid:string}/revisions", revisionHandler)
+	curd.Post("/{uid:string}/revisions/{rev:string}/revert", revisionHandler)
+	// 导入导出 导出参数与列表一致 通过format指定csv或xlsx
+	curd.Get("/export", func(ctx iris.Context) {
+		model := ctx.Values().Get(b.modelContextKey).(IModelItem)
+		err := model.Export(ctx, pipe.QueryParseConfig{}, pipe.ModelGetData{}, ctx.URLParamDefault("format", FileFormatXlsx))
+		if err != nil {
+			IrisRespErr("", err, ctx)
+			return
+		}
+	})
+	curd.Post("/import", func(ctx iris.Context) {
+		user := ctx.Values().Get(UserContextKey).(*SimpleUserModel)
+		model := ctx.Values().Get(b.modelContextKey).(IModelItem)
+		injectData := make(map[string]any)
+		if model.HaveUserKey(model.GetSchema(SchemaModeAdd)) {
+			injectData[UserIdFieldName] = user.Uid
+		}
+		resp, err := model.Import(ctx, ut.ModelCtxMapperPack{InjectData: injectData})
+		if err != nil {
+			IrisRespErr("", err, ctx)
+			return
+		}
+		ctx.JSON(resp)
+	})
+	// 回收站 仅开启了软删除的模型可用
+	trashHandler := func(ctx iris.Context) {
+		model := ctx.Values().Get(b.modelContextKey).(IModelItem)
+		model.TrashHandler(ctx)
+	}
+	curd.Get("/trash", trashHandler)
+	curd.Post("/trash/{uid:string}/restore", trashHandler)
+	curd.Delete("/trash/{uid:string}", trashHandler)
 	apiParty.Get("/captcha_img", func(ctx iris.Context) {
 		imgWidth := ctx.Params().GetIntDefault("width", 120)
 		imgHeight := ctx.Params().GetIntDefault("height", 44)
@@ -255,6 +350,16 @@ func (b *Backend) RegistryRoute(party iris.Party) {
 		_, _ = ctx.Write(bt)
 	})
 	apiParty.Post("/login", recordBodyMiddleware, UserInstance.LoginUseUserNameHandler(b.LoginUseValid))
+	apiParty.Post("/login_2fa", recordBodyMiddleware, UserInstance.Login2faHandler())
+	apiParty.Post("/login_2fa/setup", UserInstance.Login2faSetupHandler())
+	apiParty.Post("/token/refresh", UserInstance.TokenRefreshHandler())
+	apiParty.Get("/sessions", mustLoginMiddleware, UserInstance.SessionListHandler())
+	apiParty.Post("/sessions/revoke", mustLoginMiddleware, UserInstance.SessionRevokeHandler())
+	apiParty.Get("/totp", mustLoginMiddleware, UserInstance.TotpStatusHandler())
+	apiParty.Post("/totp/setup", mustLoginMiddleware, UserInstance.TotpSetupHandler())
+	apiParty.Post("/totp/enable", mustLoginMiddleware, UserInstance.TotpEnableHandler())
+	apiParty.Post("/totp/disable", mustLoginMiddleware, UserInstance.TotpDisableHandler())
+	apiParty.Post("/totp/recovery_codes", mustLoginMiddleware, UserInstance.TotpRecoveryCodesHandler())
 	apiParty.Post("/user_change_password", recordBodyMiddleware, mustLoginMiddleware, UserInstance.ChangePassword(b.LoginUseValid))
 	apiParty.Get("/set_role", func(ctx iris.Context) {
 		p := path.Join(apiParty.GetRelPath(), "set_role")
@@ -318,33 +423,197 @@ func (b *Backend) InsertUserModel() {
 	b.AddModel(m)
 }
 
+// SetMsgStore 设置消息存储 多实例部署时需要使用redis存储
+func (b *Backend) SetMsgStore(store MessageStore) {
+	b.msg = store
+}
+func (b *Backend) GetMsgStore() MessageStore {
+	return b.msg
+}
+
 func (b *Backend) SendMsg(ctx context.Context, uid, content string) {
 	user, err := UserInstance.FuzzGetUser(ctx, uid)
 	if err != nil {
 		logger.JM.ErrorE(err, "[%s]未找到用户 发送的消息是%s ", uid, content)
 		return
 	}
-	b.msg.Put(user.Uid, content)
+	_, err = b.msg.Put(ctx, user.Uid, content)
+	if err != nil {
+		logger.JM.ErrorE(err, "[%s]写入消息失败 发送的消息是%s ", uid, content)
+	}
 }
+
+// GetMsgHandler 获取当前设备(User-Agent)的下一条消息 每个设备各消费一次 同时标记为已读
 func (b *Backend) GetMsgHandler(ctx iris.Context) {
 	user := ctx.Values().Get(UserContextKey).(*SimpleUserModel)
-	msg, has := b.msg.Consume(user.GetUid(), ctx.GetHeader("User-Agent"))
-	if !has {
+	msg, err := ConsumeDeviceMessage(ctx, b.msg, user.GetUid(), ctx.GetHeader("User-Agent"))
+	if err != nil {
+		IrisRespErr("获取消息失败", err, ctx)
+		return
+	}
+	if msg == nil {
 		IrisRespErr("未获取到消息", nil, ctx)
 		return
 	}
 	ctx.JSON(msg)
 }
 
+// GetMsgListHandler 获取消息列表 after为上一页最后一条的id
+func (b *Backend) GetMsgListHandler(ctx iris.Context) {
+	user := ctx.Values().Get(UserContextKey).(*SimpleUserModel)
+	limit := ctx.URLParamInt64Default("limit", 20)
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	after := ctx.URLParam("after")
+	if len(after) > 0 && !MsgIdValid(after) {
+		IrisRespErr("", ErrMsgIdInvalid, ctx)
+		return
+	}
+	msgs, err := b.msg.List(ctx, user.GetUid(), after, limit)
+	if err != nil {
+		IrisRespErr("获取消息失败", err, ctx)
+		return
+	}
+	cursor, err := b.msg.Cursor(ctx, user.GetUid())
+	if err != nil {
+		IrisRespErr("获取消息失败", err, ctx)
+		return
+	}
+	unread, err := b.msg.Unread(ctx, user.GetUid())
+	if err != nil {
+		IrisRespErr("获取消息失败", err, ctx)
+		return
+	}
+	ctx.JSON(iris.Map{
+		"data":   msgs,
+		"cursor": cursor,
+		"unread": unread,
+	})
+}
+
+// MsgReadHandler 标记已读 id及之前的消息均为已读 不传id则全部已读
+func (b *Backend) MsgReadHandler(ctx iris.Context) {
+	user := ctx.Values().Get(UserContextKey).(*SimpleUserModel)
+	var body struct {
+		Id string `json:"id"`
+	}
+	_ = ctx.ReadBody(&body)
+	id := body.Id
+	if len(id) > 0 && !MsgIdValid(id) {
+		IrisRespErr("", ErrMsgIdInvalid, ctx)
+		return
+	}
+	if len(id) < 1 {
+		// 找到最后一条
+		after, err := b.msg.Cursor(ctx, user.GetUid())
+		if err != nil {
+			IrisRespErr("标记已读失败", err, ctx)
+			return
+		}
+		for {
+			msgs, err := b.msg.List(ctx, user.GetUid(), after, 100)
+			if err != nil {
+				IrisRespErr("标记已读失败", err, ctx)
+				return
+			}
+			if len(msgs) < 1 {
+				break
+			}
+			after = msgs[len(msgs)-1].Id
+		}
+		id = after
+	}
+	if len(id) < 1 {
+		// 没有任何消息
+		ctx.JSON(iris.Map{"cursor": id})
+		return
+	}
+	err := b.msg.MarkRead(ctx, user.GetUid(), id)
+	if err != nil {
+		IrisRespErr("标记已读失败", err, ctx)
+		return
+	}
+	ctx.JSON(iris.Map{"cursor": id})
+}
+
+// MsgSseHandler 通过server-sent events推送新消息 支持Last-Event-ID补发断线期间的消息
+func (b *Backend) MsgSseHandler(ctx iris.Context) {
+	user := ctx.Values().Get(UserContextKey).(*SimpleUserModel)
+	reqCtx := ctx.Request().Context()
+	ch, err := b.msg.Subscribe(reqCtx, user.GetUid())
+	if err != nil {
+		IrisRespErr("订阅消息失败", err, ctx)
+		return
+	}
+
+	ctx.ContentType("text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("Connection", "keep-alive")
+	ctx.Header("X-Accel-Buffering", "no")
+
+	last := ctx.GetHeader("Last-Event-ID")
+	if !MsgIdValid(last) {
+		last = ""
+	}
+	send := func(msg *Message) bool {
+		if MsgIdCompare(msg.Id, last) <= 0 {
+			return true
+		}
+		bin, _ := json.Marshal(msg)
+		if _, err := ctx.Writef("id: %s\nevent: message\ndata: %s\n\n", msg.Id, bin); err != nil {
+			return false
+		}
+		last = msg.Id
+		ctx.ResponseWriter().Flush()
+		return true
+	}
+
+	if len(last) > 0 {
+		msgs, err := b.msg.List(ctx, user.GetUid(), last, 100)
+		if err == nil {
+			for _, msg := range msgs {
+				if !send(msg) {
+					return
+				}
+			}
+		}
+	}
+	_, _ = ctx.WriteString(": connected\n\n")
+	ctx.ResponseWriter().Flush()
+
+	ticker := time.NewTicker(25 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-reqCtx.Done():
+			return
+		case <-ticker.C:
+			if _, err := ctx.WriteString(": ping\n\n"); err != nil {
+				return
+			}
+			ctx.ResponseWriter().Flush()
+		case msg, ok := <-ch:
+			if !ok || !send(msg) {
+				return
+			}
+		}
+	}
+}
+
 func NewBackend() *Backend {
 	b := new(Backend)
 	b.modelContextKey = "now_model"
-	b.msg = NewMessageQueue()
+	b.msg = NewMemoryMessageStore()
 	BkInst = b
 	b.Prefix = "/manager"
 	b.LoginUseValid = true
 	b.RegUseValid = true
 	b.ValidHard = gocaptcha.CaptchaVeryEasy
+	b.ApiInfo = OpenApiInfo{
+		Title:   "pmb",
+		Version: "1.0.0",
+	}
 	return b
 }
 
@@ -372,6 +641,8 @@ func NewFullBackend(party iris.Party, mongodb *qmgo.Database, redisAddress strin
 	bk.RegUseValid = regUseValid
 	bk.AddDb(mongodb)
 	bk.AddRdb(rdb)
+	bk.SetMsgStore(NewRedisMessageStore(rdb, "pmb:"))
+	ImgCaptchaInst.SetStore(NewRedisCaptchaStore(rdb, "pmb:"))
 	bk.AddRbacUseUri(redisAddress, redisPassword)
 	bk.RegistryRoute(party)
 	UserInstance.SetConn(bk.CloneConn())
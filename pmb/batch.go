@@ -0,0 +1,379 @@
+package pmb
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/23233/ggg/pipe"
+	"github.com/23233/ggg/ut"
+	"github.com/kataras/iris/v12"
+	"github.com/pkg/errors"
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"strings"
+	"sync"
+)
+
+// BatchMaxRows 单次批量操作的最大行数
+var BatchMaxRows = 500
+
+// 批量操作类型
+const (
+	BatchOpAdd = "add"
+	BatchOpPut = "put"
+	BatchOpDel = "del"
+)
+
+// BatchReq 批量操作请求 rows/uids与filter二选一
+type BatchReq struct {
+	Rows   []map[string]any `json:"rows,omitempty"`   // 新增或修改的行 修改时每行必须包含uid
+	Uids   []string         `json:"uids,omitempty"`   // 删除的行uid
+	Filter *ut.QueryFull    `json:"filter,omitempty"` // 通过过滤条件选择行 修改和删除可用
+	Data   map[string]any   `json:"data,omitempty"`   // 通过过滤条件修改时写入的内容
+}
+
+type BatchRowResult struct {
+	Index int    `json:"index"`
+	Uid   string `json:"uid,omitempty"`
+	Ok    bool   `json:"ok"`
+	Err   string `json:"err,omitempty"`
+	Data  any    `json:"data,omitempty"`
+}
+
+type BatchResp struct {
+	Transaction bool              `json:"transaction"` // 是否在事务中执行
+	RolledBack  bool              `json:"rolled_back"` // 事务中任意一行失败则全部回滚
+	Success     int               `json:"success"`
+	Failed      int               `json:"failed"`
+	Results     []*BatchRowResult `json:"results"`
+}
+
+type batchTask struct {
+	uid  string
+	call func(ctx iris.Context) (any, *opLogEntry, error)
+}
+
+// mongoTxSupport 记录每个连接是否支持事务 仅副本集和分片集群支持
+var mongoTxSupport sync.Map
+
+// mongoTransactionClient 获取支持事务的连接 不支持则返回nil
+func mongoTransactionClient(ctx context.Context, coll *qmgo.Collection) *mongo.Client {
+	cl, err := coll.CloneCollection()
+	if err != nil {
+		return nil
+	}
+	client := cl.Database().Client()
+	if v, ok := mongoTxSupport.Load(client); ok {
+		if v.(bool) {
+			return client
+		}
+		return nil
+	}
+	var hello bson.M
+	err = client.Database("admin").RunCommand(ctx, bson.D{{"hello", 1}}).Decode(&hello)
+	support := err == nil && (hello["setName"] != nil || hello["msg"] == "isdbgrid")
+	mongoTxSupport.Store(client, support)
+	if support {
+		return client
+	}
+	return nil
+}
+
+// batchFilterUids 通过过滤条件获取出需要操作的行uid 会注入上下文过滤且不包含软删除的行
+func (s *SchemaModel[T]) batchFilterUids(ctx iris.Context, filter *ut.QueryFull) ([]string, error) {
+	if filter == nil || filter.QueryParse == nil || len(filter.And)+len(filter.Or) < 1 {
+		return nil, errors.New("批量操作的过滤条件不能为空")
+	}
+	injectQuery, err := s.ParseInject(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ft := &ut.QueryFull{
+		QueryParse: &ut.QueryParse{
+			And: append([]*ut.Kov{}, filter.And...),
+			Or:  append([]*ut.Kov{}, filter.Or...),
+		},
+		BaseQuery: &ut.BaseQuery{
+			BasePage: &ut.BasePage{Page: 1, PageSize: int64(BatchMaxRows) + 1},
+		},
+	}
+	ft.InsertOrReplaces("and", injectQuery...)
+	ft.InsertOrReplaces("and", s.queryFilterInject...)
+	if s.SoftDelete {
+		pipe.SoftDeleteFilter(ft, false)
+	}
+
+	var rows = make([]map[string]any, 0)
+	err = s.GetCollection().Aggregate(ctx, ut.QueryToMongoPipeline(ft)).All(&rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) > BatchMaxRows {
+		return nil, errors.Errorf("匹配行数超出批量上限%d", BatchMaxRows)
+	}
+	uids := make([]string, 0, len(rows))
+	for _, row := range rows {
+		if uid, ok := row[ut.DefaultUidTag].(string); ok {
+			uids = append(uids, uid)
+		}
+	}
+	return uids, nil
+}
+
+// cloneQueryFilter 每一行都会追加uid过滤 需要复制一份避免互相影响
+func cloneQueryFilter(ft *ut.QueryFull) *ut.QueryFull {
+	if ft == nil || ft.QueryParse == nil {
+		return nil
+	}
+	return &ut.QueryFull{
+		QueryParse: &ut.QueryParse{
+			And: append([]*ut.Kov{}, ft.And...),
+			Or:  append([]*ut.Kov{}, ft.Or...),
+		},
+	}
+}
+
+func (s *SchemaModel[T]) rowToRaw(row map[string]any) (any, error) {
+	newV := s.newRaw()
+	bin, err := json.Marshal(row)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(bin, newV)
+	if err != nil {
+		return nil, err
+	}
+	return newV, nil
+}
+
+// BatchAdd 批量新增 每行都会经过新增的hooks
+func (s *SchemaModel[T]) BatchAdd(ctx iris.Context, params ut.ModelCtxMapperPack, req *BatchReq) (*BatchResp, error) {
+	if s.Hooks.CustomAddHandler != nil {
+		return nil, errors.New("自定义新增不支持批量操作")
+	}
+	params, err := s.addParamsPrepare(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	tasks := make([]*batchTask, 0, len(req.Rows))
+	for _, row := range req.Rows {
+		row := row
+		tasks = append(tasks, &batchTask{
+			call: func(ctx iris.Context) (any, *opLogEntry, error) {
+				newV, err := s.rowToRaw(row)
+				if err != nil {
+					return nil, nil, err
+				}
+				return s.addRow(ctx, params, newV)
+			},
+		})
+	}
+	return s.runBatch(ctx, BatchOpAdd, req, tasks)
+}
+
+// BatchPut 批量修改 传入rows时每行按uid修改 传入filter时把data写入所有匹配行
+func (s *SchemaModel[T]) BatchPut(ctx iris.Context, params pipe.ModelPutConfig, req *BatchReq) (*BatchResp, error) {
+	params.ModelId = s.GetTableName()
+	newTask := func(uid string, body map[string]any) *batchTask {
+		return &batchTask{
+			uid: uid,
+			call: func(ctx iris.Context) (any, *opLogEntry, error) {
+				p := params
+				p.RowId = uid
+				p.BodyMap = body
+				p.DropKeys = append([]string{}, params.DropKeys...)
+				p.QueryFilter = cloneQueryFilter(params.QueryFilter)
+				err := s.putParamsPrepare(ctx, &p)
+				if err != nil {
+					return nil, nil, err
+				}
+				newV, err := s.rowToRaw(body)
+				if err != nil {
+					return nil, nil, err
+				}
+				return s.putRow(ctx, p, newV, "put", "批量修改行")
+			},
+		}
+	}
+
+	tasks := make([]*batchTask, 0)
+	if req.Filter != nil {
+		if len(req.Data) < 1 {
+			return nil, errors.New("批量修改的内容不能为空")
+		}
+		uids, err := s.batchFilterUids(ctx, req.Filter)
+		if err != nil {
+			return nil, err
+		}
+		for _, uid := range uids {
+			tasks = append(tasks, newTask(uid, req.Data))
+		}
+	} else {
+		for _, row := range req.Rows {
+			uid, _ := row[ut.DefaultUidTag].(string)
+			tasks = append(tasks, newTask(uid, row))
+		}
+	}
+	return s.runBatch(ctx, BatchOpPut, req, tasks)
+}
+
+// BatchDel 批量删除 开启软删除时仅写入delete_at
+func (s *SchemaModel[T]) BatchDel(ctx iris.Context, params pipe.ModelDelConfig, req *BatchReq) (*BatchResp, error) {
+	uids := req.Uids
+	if req.Filter != nil {
+		var err error
+		uids, err = s.batchFilterUids(ctx, req.Filter)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tasks := make([]*batchTask, 0, len(uids))
+	for _, uid := range uids {
+		uid := uid
+		tasks = append(tasks, &batchTask{
+			uid: uid,
+			call: func(ctx iris.Context) (any, *opLogEntry, error) {
+				p := params
+				p.RowId = uid
+				p.QueryFilter = cloneQueryFilter(params.QueryFilter)
+				err := s.delParamsPrepare(ctx, &p)
+				if err != nil {
+					return nil, nil, err
+				}
+				return s.delRow(ctx, p)
+			},
+		})
+	}
+	return s.runBatch(ctx, BatchOpDel, req, tasks)
+}
+
+// runBatch 执行批量任务 数据库支持事务时在事务中执行 任意一行失败则全部回滚
+// 不支持事务时逐行执行 单行失败不影响其他行 操作日志在生效后统一写入
+func (s *SchemaModel[T]) runBatch(ctx iris.Context, op string, req *BatchReq, tasks []*batchTask) (*BatchResp, error) {
+	if len(tasks) < 1 {
+		return nil, errors.New("批量操作的行不能为空")
+	}
+	if len(tasks) > BatchMaxRows {
+		return nil, errors.Errorf("批量操作行数超出上限%d", BatchMaxRows)
+	}
+	if s.Hooks.OnBatchBefore != nil {
+		err := s.Hooks.OnBatchBefore(ctx, op, req, s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resp := new(BatchResp)
+	var logs []*opLogEntry
+
+	run := func(stopOnErr bool) error {
+		resp.Results = make([]*BatchRowResult, 0, len(tasks))
+		logs = make([]*opLogEntry, 0, len(tasks))
+		for i, task := range tasks {
+			r := &BatchRowResult{Index: i, Uid: task.uid}
+			resp.Results = append(resp.Results, r)
+			if op != BatchOpAdd && len(task.uid) < 1 {
+				r.Err = "行uid不能为空"
+				if stopOnErr {
+					return errors.New(r.Err)
+				}
+				continue
+			}
+			data, log, err := task.call(ctx)
+			if err != nil {
+				r.Err = err.Error()
+				if stopOnErr {
+					return err
+				}
+				continue
+			}
+			r.Ok = true
+			r.Data = data
+			if log != nil && len(r.Uid) < 1 {
+				r.Uid = log.rowId
+			}
+			logs = append(logs, log)
+		}
+		return nil
+	}
+
+	client := mongoTransactionClient(ctx, s.GetCollection())
+	if client != nil {
+		resp.Transaction = true
+		sess, err := client.StartSession()
+		if err != nil {
+			return nil, err
+		}
+		defer sess.EndSession(ctx)
+		origin := ctx.Request()
+		_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (any, error) {
+			// 通过请求的context传递session 使各个管道内的数据库操作加入事务
+			ctx.ResetRequest(origin.WithContext(sc))
+			defer ctx.ResetRequest(origin)
+			return nil, run(true)
+		})
+		if err != nil {
+			resp.RolledBack = true
+			logs = nil
+			for _, r := range resp.Results {
+				if r.Ok {
+					r.Ok = false
+					r.Data = nil
+					r.Err = "事务已回滚"
+				}
+			}
+			for i := len(resp.Results); i < len(tasks); i++ {
+				resp.Results = append(resp.Results, &BatchRowResult{Index: i, Uid: tasks[i].uid, Err: "未执行 事务已回滚"})
+			}
+		}
+	} else {
+		_ = run(false)
+	}
+
+	for _, r := range resp.Results {
+		if r.Ok {
+			resp.Success += 1
+		} else {
+			resp.Failed += 1
+		}
+	}
+
+	s.writeOpLog(ctx, logs...)
+
+	if s.Hooks.OnBatchAfter != nil {
+		err := s.Hooks.OnBatchAfter(ctx, op, resp, s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// BatchHandler 批量操作 post为新增 put为修改 delete为删除
+func (s *SchemaModel[T]) BatchHandler(ctx iris.Context) {
+	var req = new(BatchReq)
+	err := ctx.ReadBody(req)
+	if err != nil {
+		IrisRespErr("解析批量操作参数失败", err, ctx)
+		return
+	}
+
+	var resp *BatchResp
+	switch strings.ToLower(ctx.Method()) {
+	case "post":
+		resp, err = s.BatchAdd(ctx, s.PostHandlerConfig, req)
+	case "put":
+		params := s.PutHandlerConfig
+		params.UpdateTime = true
+		resp, err = s.BatchPut(ctx, params, req)
+	case "delete":
+		resp, err = s.BatchDel(ctx, s.DeleteHandlerConfig, req)
+	default:
+		err = errors.New("未被支持的方法")
+	}
+	if err != nil {
+		IrisRespErr("", err, ctx)
+		return
+	}
+	ctx.JSON(resp)
+}
@@ -1,16 +1,19 @@
 package pmb
 
 import (
+	"context"
 	"time"
 
 	"sync"
 
+	"strconv"
 	"strings"
 
 	"errors"
 
 	"github.com/23233/gocaptcha"
 	"github.com/google/uuid"
+	"github.com/redis/rueidis"
 )
 
 var (
@@ -20,11 +23,23 @@ var (
 type ImgCaptchaItem struct {
 	Text       string
 	CreateTime time.Time
+	Attempts   int
+}
+
+// CaptchaStore 验证码答案的存储 验证通过或错误次数达到上限后删除
+type CaptchaStore interface {
+	// Set 写入答案 ttl后过期
+	Set(ctx context.Context, id, text string, ttl time.Duration) error
+	// Verify 验证答案 maxAttempts为允许的错误次数 达到后删除
+	Verify(ctx context.Context, id, text string, maxAttempts int) error
 }
 
 type ImgCaptcha struct {
-	Records map[string]ImgCaptchaItem
-	mutex   sync.Mutex
+	// Deprecated: 使用 Store 使用内存存储时与 MemoryCaptchaStore.Records 为同一个map 其他存储时为nil
+	Records     map[string]ImgCaptchaItem
+	Store       CaptchaStore
+	Expire      time.Duration // 有效期 默认5分钟
+	MaxAttempts int           // 允许的错误次数 默认1次 即验证一次后就失效
 }
 
 // 定义验证码相关的错误类型
@@ -34,12 +49,25 @@ var (
 )
 
 func NewImgCaptcha() *ImgCaptcha {
-	c := &ImgCaptcha{
-		Records: make(map[string]ImgCaptchaItem),
+	store := NewMemoryCaptchaStore()
+	return &ImgCaptcha{
+		Records:     store.Records,
+		Store:       store,
+		Expire:      5 * time.Minute,
+		MaxAttempts: 1,
+	}
+}
+
+// SetStore 设置存储 多实例部署时需要使用redis存储 原有的内存存储会被关闭
+func (c *ImgCaptcha) SetStore(store CaptchaStore) {
+	if old, ok := c.Store.(*MemoryCaptchaStore); ok && CaptchaStore(old) != store {
+		old.Close()
+	}
+	c.Store = store
+	c.Records = nil
+	if mem, ok := store.(*MemoryCaptchaStore); ok {
+		c.Records = mem.Records
 	}
-	// 启动清理协程
-	go c.cleanExpired()
-	return c
 }
 
 func (c *ImgCaptcha) GetNewImg(width, height int, textSize int, difficulty gocaptcha.CaptchaDifficulty) (string, []byte, error) {
@@ -49,47 +77,169 @@ func (c *ImgCaptcha) GetNewImg(width, height int, textSize int, difficulty gocap
 	}
 
 	id := uuid.New().String()
-	c.mutex.Lock()
-	c.Records[id] = ImgCaptchaItem{
-		Text:       text,
-		CreateTime: time.Now(),
+	err = c.Store.Set(context.TODO(), id, strings.ToLower(text), c.Expire)
+	if err != nil {
+		return "", nil, err
 	}
-	c.mutex.Unlock()
 
 	return id, bt, nil
 }
 
 // Verify 验证验证码，返回验证结果和具体错误信息
 func (c *ImgCaptcha) Verify(id, text string) (bool, error) {
+	maxAttempts := c.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	err := c.Store.Verify(context.TODO(), id, strings.ToLower(text), maxAttempts)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// MemoryCaptchaStore 进程内存储 多实例之间不共享
+type MemoryCaptchaStore struct {
+	Records map[string]ImgCaptchaItem
+	ttl     map[string]time.Duration
+	mutex   sync.Mutex
+	stop    chan struct{}
+	once    sync.Once
+}
+
+func NewMemoryCaptchaStore() *MemoryCaptchaStore {
+	c := &MemoryCaptchaStore{
+		Records: make(map[string]ImgCaptchaItem),
+		ttl:     make(map[string]time.Duration),
+		stop:    make(chan struct{}),
+	}
+	// 启动清理协程
+	go c.cleanExpired()
+	return c
+}
+
+// Close 停止清理协程 不再使用时调用
+func (c *MemoryCaptchaStore) Close() {
+	c.once.Do(func() {
+		close(c.stop)
+	})
+}
+
+func (c *MemoryCaptchaStore) Set(ctx context.Context, id, text string, ttl time.Duration) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.Records[id] = ImgCaptchaItem{
+		Text:       text,
+		CreateTime: time.Now(),
+	}
+	c.ttl[id] = ttl
+	return nil
+}
+
+func (c *MemoryCaptchaStore) Verify(ctx context.Context, id, text string, maxAttempts int) error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
 	item, exists := c.Records[id]
-	if !exists {
-		return false, ErrCaptchaNotFound
+	if !exists || time.Since(item.CreateTime) > c.ttl[id] {
+		return ErrCaptchaNotFound
 	}
 
-	// 验证后删除记录，防止重复使用
-	delete(c.Records, id)
-
-	if strings.ToLower(item.Text) != strings.ToLower(text) {
-		return false, ErrCaptchaMismatch
+	if item.Text == text {
+		// 验证后删除记录，防止重复使用
+		delete(c.Records, id)
+		delete(c.ttl, id)
+		return nil
 	}
 
-	return true, nil
+	item.Attempts++
+	if item.Attempts >= maxAttempts {
+		delete(c.Records, id)
+		delete(c.ttl, id)
+	} else {
+		c.Records[id] = item
+	}
+	return ErrCaptchaMismatch
 }
 
 // cleanExpired 清理过期的验证码
-func (c *ImgCaptcha) cleanExpired() {
+func (c *MemoryCaptchaStore) cleanExpired() {
 	ticker := time.NewTicker(5 * time.Second)
-	for range ticker.C {
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
 		c.mutex.Lock()
 		now := time.Now()
 		for id, item := range c.Records {
-			if now.Sub(item.CreateTime) > 5*time.Minute {
+			if now.Sub(item.CreateTime) > c.ttl[id] {
 				delete(c.Records, id)
+				delete(c.ttl, id)
 			}
 		}
 		c.mutex.Unlock()
 	}
 }
+
+var captchaVerifyScript = rueidis.NewLuaScript(`
+local text = redis.call("hget", KEYS[1], "text")
+if not text then
+	return -1
+end
+if text == ARGV[1] then
+	redis.call("del", KEYS[1])
+	return 1
+end
+local n = redis.call("hincrby", KEYS[1], "attempts", 1)
+if n >= tonumber(ARGV[2]) then
+	redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+// RedisCaptchaStore 基于redis的存储 验证与计数在脚本中原子执行
+type RedisCaptchaStore struct {
+	Prefix string
+	rdb    rueidis.Client
+}
+
+func NewRedisCaptchaStore(rdb rueidis.Client, prefix string) *RedisCaptchaStore {
+	return &RedisCaptchaStore{
+		Prefix: prefix,
+		rdb:    rdb,
+	}
+}
+
+func (c *RedisCaptchaStore) cacheKey(id string) string {
+	return c.Prefix + "captcha:" + id
+}
+
+func (c *RedisCaptchaStore) Set(ctx context.Context, id, text string, ttl time.Duration) error {
+	key := c.cacheKey(id)
+	for _, resp := range c.rdb.DoMulti(ctx,
+		c.rdb.B().Hset().Key(key).FieldValue().FieldValue("text", text).FieldValue("attempts", "0").Build(),
+		c.rdb.B().Pexpire().Key(key).Milliseconds(ttl.Milliseconds()).Build(),
+	) {
+		if err := resp.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *RedisCaptchaStore) Verify(ctx context.Context, id, text string, maxAttempts int) error {
+	ret, err := captchaVerifyScript.Exec(ctx, c.rdb, []string{c.cacheKey(id)}, []string{text, strconv.Itoa(maxAttempts)}).AsInt64()
+	if err != nil {
+		return err
+	}
+	switch ret {
+	case 1:
+		return nil
+	case -1:
+		return ErrCaptchaNotFound
+	}
+	return ErrCaptchaMismatch
+}
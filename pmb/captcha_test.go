@@ -1,7 +1,10 @@
 package pmb
 
 import (
+	"context"
 	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/rueidis"
 	"testing"
 	"time"
 )
@@ -52,3 +55,111 @@ func TestNewImgCaptcha(t *testing.T) {
 		t.Errorf("期望错误 ErrCaptchaNotFound，得到：%v", err)
 	}
 }
+
+func TestCaptchaAttempts(t *testing.T) {
+	c := NewImgCaptcha()
+	c.MaxAttempts = 3
+	ctx := context.TODO()
+	_ = c.Store.Set(ctx, "a", "abcd", time.Minute)
+
+	// 错误次数未达到上限时仍然可以继续验证
+	for i := 0; i < 2; i++ {
+		_, err := c.Verify("a", "wrong")
+		if !errors.Is(err, ErrCaptchaMismatch) {
+			t.Fatalf("期望错误 ErrCaptchaMismatch，得到：%v", err)
+		}
+	}
+	ok, err := c.Verify("a", "ABCD")
+	if !ok || err != nil {
+		t.Fatalf("正确的验证码应验证通过 %v", err)
+	}
+	// 一次性使用
+	_, err = c.Verify("a", "abcd")
+	if !errors.Is(err, ErrCaptchaNotFound) {
+		t.Fatalf("期望错误 ErrCaptchaNotFound，得到：%v", err)
+	}
+
+	// 达到上限后删除
+	_ = c.Store.Set(ctx, "b", "abcd", time.Minute)
+	for i := 0; i < 3; i++ {
+		_, _ = c.Verify("b", "wrong")
+	}
+	_, err = c.Verify("b", "abcd")
+	if !errors.Is(err, ErrCaptchaNotFound) {
+		t.Fatalf("期望错误 ErrCaptchaNotFound，得到：%v", err)
+	}
+
+	// 过期
+	_ = c.Store.Set(ctx, "c", "abcd", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	_, err = c.Verify("c", "abcd")
+	if !errors.Is(err, ErrCaptchaNotFound) {
+		t.Fatalf("期望错误 ErrCaptchaNotFound，得到：%v", err)
+	}
+}
+
+func TestCaptchaSetStore(t *testing.T) {
+	c := NewImgCaptcha()
+	mem := c.Store.(*MemoryCaptchaStore)
+	c.SetStore(NewRedisCaptchaStore(nil, ""))
+	// 原有的内存存储被关闭
+	select {
+	case <-mem.stop:
+	default:
+		t.Fatal("原有的内存存储应被关闭")
+	}
+	if c.Records != nil {
+		t.Fatal("非内存存储时Records应为nil")
+	}
+	mem.Close()
+}
+
+func TestRedisCaptchaStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb, err := rueidis.NewClient(rueidis.ClientOption{InitAddress: []string{mr.Addr()}, DisableCache: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(rdb.Close)
+
+	c := NewImgCaptcha()
+	c.MaxAttempts = 2
+	store := NewRedisCaptchaStore(rdb, "test:")
+	c.SetStore(store)
+	ctx := context.TODO()
+
+	_ = store.Set(ctx, "a", "abcd", time.Minute)
+	if !mr.Exists("test:captcha:a") || mr.TTL("test:captcha:a") != time.Minute {
+		t.Fatal("验证码应写入redis并设置过期时间")
+	}
+	_, err = c.Verify("a", "wrong")
+	if !errors.Is(err, ErrCaptchaMismatch) {
+		t.Fatalf("期望错误 ErrCaptchaMismatch，得到：%v", err)
+	}
+	ok, err := c.Verify("a", "ABCD")
+	if !ok || err != nil {
+		t.Fatalf("正确的验证码应验证通过 %v", err)
+	}
+	_, err = c.Verify("a", "abcd")
+	if !errors.Is(err, ErrCaptchaNotFound) {
+		t.Fatalf("期望错误 ErrCaptchaNotFound，得到：%v", err)
+	}
+
+	// 达到上限后删除
+	_ = store.Set(ctx, "b", "abcd", time.Minute)
+	for i := 0; i < 2; i++ {
+		_, _ = c.Verify("b", "wrong")
+	}
+	_, err = c.Verify("b", "abcd")
+	if !errors.Is(err, ErrCaptchaNotFound) {
+		t.Fatalf("期望错误 ErrCaptchaNotFound，得到：%v", err)
+	}
+
+	// 过期
+	_ = store.Set(ctx, "c", "abcd", time.Minute)
+	mr.FastForward(time.Minute)
+	_, err = c.Verify("c", "abcd")
+	if !errors.Is(err, ErrCaptchaNotFound) {
+		t.Fatalf("期望错误 ErrCaptchaNotFound，得到：%v", err)
+	}
+}
@@ -0,0 +1,504 @@
+package pmb
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/23233/ggg/pipe"
+	"github.com/23233/ggg/ut"
+	"github.com/23233/jsonschema"
+	"github.com/kataras/iris/v12"
+	"github.com/pkg/errors"
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 导出按表格schema的列 表头为comment 导入按新增schema映射列 表头可以是comment或字段名
+
+var (
+	// ExportMaxRows 单次导出的最大行数
+	ExportMaxRows int64 = 10000
+	// ImportMaxSize 导入文件的最大字节数
+	ImportMaxSize int64 = 10 << 20
+)
+
+const exportPageSize = 500
+
+// 导入导出支持的格式
+const (
+	FileFormatCsv  = "csv"
+	FileFormatXlsx = "xlsx"
+)
+
+// ImportLineErr 导入时某一行的错误 line为表格中的行号 表头为第1行
+type ImportLineErr struct {
+	Line   int    `json:"line"`
+	Column string `json:"column,omitempty"`
+	Err    string `json:"err"`
+}
+
+type ImportResp struct {
+	Total  int              `json:"total"`
+	Errors []*ImportLineErr `json:"errors,omitempty"` // 存在解析或验证错误时不会写入任何行
+	Batch  *BatchResp       `json:"batch,omitempty"`  // 写入的结果
+}
+
+type fileColumn struct {
+	key    string
+	title  string
+	schema *jsonschema.Schema
+}
+
+// schemaColumns 按schema中字段的顺序获取列
+func schemaColumns(schema *jsonschema.Schema) []*fileColumn {
+	cols := make([]*fileColumn, 0)
+	if schema == nil || schema.Properties == nil {
+		return cols
+	}
+	for _, key := range schema.Properties.Keys() {
+		v, _ := schema.Properties.Get(key)
+		sch, _ := v.(*jsonschema.Schema)
+		if sch == nil {
+			sch = new(jsonschema.Schema)
+		}
+		title := sch.Title
+		if len(title) < 1 {
+			title = key
+		}
+		cols = append(cols, &fileColumn{key: key, title: title, schema: sch})
+	}
+	return cols
+}
+
+// tableWriter csv和xlsx共用的行写入
+type tableWriter interface {
+	WriteRow(cells []string) error
+	Close() error
+}
+
+type csvTableWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvTableWriter) WriteRow(cells []string) error {
+	return c.w.Write(cells)
+}
+func (c *csvTableWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func newTableWriter(w io.Writer, format string, sheet string) (tableWriter, error) {
+	switch format {
+	case FileFormatCsv:
+		// 写入BOM 否则excel打开中文会乱码
+		if _, err := w.Write([]byte("\xEF\xBB\xBF")); err != nil {
+			return nil, err
+		}
+		return &csvTableWriter{w: csv.NewWriter(w)}, nil
+	case FileFormatXlsx:
+		return ut.NewXlsxWriter(w, sheet)
+	}
+	return nil, errors.Errorf("不支持的格式 %s", format)
+}
+
+// readTable 读取上传的表格 返回的行下标+1即为行号
+func readTable(b []byte, format string) ([][]string, error) {
+	switch format {
+	case FileFormatCsv:
+		r := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(b, []byte("\xEF\xBB\xBF"))))
+		r.FieldsPerRecord = -1
+		return r.ReadAll()
+	case FileFormatXlsx:
+		return ut.ReadXlsx(bytes.NewReader(b), int64(len(b)))
+	}
+	return nil, errors.Errorf("不支持的格式 %s", format)
+}
+
+// exportFormulaPrefix 以这些字符开头的单元格会被excel当作公式执行
+const exportFormulaPrefix = "=+-@\t\r"
+
+// exportEscape 文本单元格以公式字符开头时加上'前缀 防止公式注入 导入时会去掉
+func exportEscape(s string) string {
+	if len(s) > 0 && strings.IndexByte(exportFormulaPrefix, s[0]) >= 0 {
+		return "'" + s
+	}
+	return s
+}
+
+// importUnescape 去掉导出时加上的'前缀
+func importUnescape(s string) string {
+	if len(s) > 1 && s[0] == '\'' && strings.IndexByte(exportFormulaPrefix, s[1]) >= 0 {
+		return s[1:]
+	}
+	return s
+}
+
+// exportValue 把数据库中的值转换为单元格文本 数字按原样输出 文本会经过 exportEscape
+func exportValue(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return exportEscape(val)
+	case bool:
+		return strconv.FormatBool(val)
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(val), 'f', -1, 32)
+	case int, int32, int64, uint, uint32, uint64:
+		return fmt.Sprint(val)
+	case time.Time:
+		return val.Local().Format(time.DateTime)
+	case primitive.DateTime:
+		return val.Time().Local().Format(time.DateTime)
+	case primitive.ObjectID:
+		return val.Hex()
+	}
+	bin, err := json.Marshal(exportNormalize(v))
+	if err != nil {
+		return exportEscape(fmt.Sprint(v))
+	}
+	return string(bin)
+}
+
+// exportNormalize 把bson的文档和数组转换为普通的map和slice 便于序列化为json
+func exportNormalize(v any) any {
+	switch val := v.(type) {
+	case primitive.D:
+		m := make(map[string]any, len(val))
+		for _, e := range val {
+			m[e.Key] = exportNormalize(e.Value)
+		}
+		return m
+	case primitive.M:
+		m := make(map[string]any, len(val))
+		for k, item := range val {
+			m[k] = exportNormalize(item)
+		}
+		return m
+	case map[string]any:
+		m := make(map[string]any, len(val))
+		for k, item := range val {
+			m[k] = exportNormalize(item)
+		}
+		return m
+	case primitive.A:
+		arr := make([]any, 0, len(val))
+		for _, item := range val {
+			arr = append(arr, exportNormalize(item))
+		}
+		return arr
+	case []any:
+		arr := make([]any, 0, len(val))
+		for _, item := range val {
+			arr = append(arr, exportNormalize(item))
+		}
+		return arr
+	case primitive.DateTime:
+		return val.Time()
+	case primitive.ObjectID:
+		return val.Hex()
+	}
+	return v
+}
+
+// importValue 按schema把单元格文本转换为对应类型
+func importValue(raw string, sch *jsonschema.Schema) (any, error) {
+	raw = importUnescape(strings.TrimSpace(raw))
+	switch sch.Type {
+	case "integer":
+		if v, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			return v, nil
+		}
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil || f != float64(int64(f)) {
+			return nil, errors.Errorf("%s 不是整数", raw)
+		}
+		return int64(f), nil
+	case "number":
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, errors.Errorf("%s 不是数字", raw)
+		}
+		return f, nil
+	case "boolean":
+		switch raw {
+		case "是":
+			return true, nil
+		case "否":
+			return false, nil
+		}
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, errors.Errorf("%s 不是布尔值", raw)
+		}
+		return b, nil
+	case "array":
+		var arr []any
+		if strings.HasPrefix(raw, "[") {
+			if err := json.Unmarshal([]byte(raw), &arr); err != nil {
+				return nil, errors.Wrap(err, "数组格式错误")
+			}
+			return arr, nil
+		}
+		// 非json时按逗号分隔
+		for _, item := range strings.Split(raw, ",") {
+			arr = append(arr, strings.TrimSpace(item))
+		}
+		return arr, nil
+	case "object":
+		var obj map[string]any
+		if err := json.Unmarshal([]byte(raw), &obj); err != nil {
+			return nil, errors.Wrap(err, "对象格式错误")
+		}
+		return obj, nil
+	case "string":
+		if sch.Format == "date-time" {
+			for _, layout := range []string{time.RFC3339, time.DateTime, time.DateOnly, "2006/01/02 15:04:05", "2006/01/02"} {
+				if t, err := time.ParseInLocation(layout, raw, time.Local); err == nil {
+					return t.Format(time.RFC3339), nil
+				}
+			}
+			return nil, errors.Errorf("%s 不是有效的时间", raw)
+		}
+		return raw, nil
+	}
+	// 引用的结构体等 尝试按json解析
+	if strings.HasPrefix(raw, "{") || strings.HasPrefix(raw, "[") {
+		var v any
+		if err := json.Unmarshal([]byte(raw), &v); err == nil {
+			return v, nil
+		}
+	}
+	return raw, nil
+}
+
+// Export 按当前的过滤条件导出表格 直接写入响应
+func (s *SchemaModel[T]) Export(ctx iris.Context, queryParams pipe.QueryParseConfig, getParams pipe.ModelGetData, format string) error {
+	getParams.Single = false
+	getParams.GetQueryCount = false
+	query, err := s.getQuery(ctx, queryParams, &getParams, "")
+	if err != nil {
+		return err
+	}
+	query.PageSize = exportPageSize
+
+	fetch := func(page int64) ([]map[string]any, error) {
+		query.Page = page
+		dataResp := pipe.QueryGetData.Run(ctx, &pipe.ModelGetDataDep{
+			ModelId: s.GetTableName(),
+			Query:   query,
+		}, &getParams, s.db)
+		if dataResp.Err != nil && dataResp.Err != qmgo.ErrNoSuchDocuments {
+			return nil, dataResp.Err
+		}
+		if s.Hooks.OnGetAfter != nil {
+			err := s.Hooks.OnGetAfter(ctx, dataResp, s)
+			if err != nil {
+				return nil, err
+			}
+		}
+		rows, _ := dataResp.Result.Data.([]map[string]any)
+		return rows, nil
+	}
+
+	// 先获取第一页 出错时还能正常返回错误
+	rows, err := fetch(1)
+	if err != nil {
+		return err
+	}
+
+	name := s.Alias
+	if len(name) < 1 {
+		name = s.GetTableName()
+	}
+	filename := fmt.Sprintf("%s_%s.%s", name, time.Now().Format("20060102150405"), format)
+	switch format {
+	case FileFormatCsv:
+		ctx.ContentType("text/csv; charset=utf-8")
+	case FileFormatXlsx:
+		ctx.ContentType("application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	default:
+		return errors.Errorf("不支持的格式 %s", format)
+	}
+	ctx.Header("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(filename))
+
+	w, err := newTableWriter(ctx.ResponseWriter(), format, name)
+	if err != nil {
+		return err
+	}
+	cols := append([]*fileColumn{{key: ut.DefaultUidTag, title: ut.DefaultUidTag}}, schemaColumns(s.GetSchema(SchemaModeTable))...)
+	header := make([]string, 0, len(cols))
+	for _, col := range cols {
+		header = append(header, exportEscape(col.title))
+	}
+	if err = w.WriteRow(header); err != nil {
+		return err
+	}
+
+	var total int64
+	for page := int64(1); ; page++ {
+		if page > 1 {
+			rows, err = fetch(page)
+			if err != nil {
+				return err
+			}
+		}
+		for _, row := range rows {
+			if total >= ExportMaxRows {
+				break
+			}
+			cells := make([]string, 0, len(cols))
+			for _, col := range cols {
+				cells = append(cells, exportValue(row[col.key]))
+			}
+			if err = w.WriteRow(cells); err != nil {
+				return err
+			}
+			total++
+		}
+		if len(rows) < exportPageSize || total >= ExportMaxRows {
+			break
+		}
+	}
+	return w.Close()
+}
+
+// Import 导入表格 先解析并验证全部行 存在错误时按行返回且不写入
+// 全部通过后按批量新增写入 每行会经过新增的hooks
+func (s *SchemaModel[T]) Import(ctx iris.Context, params ut.ModelCtxMapperPack) (*ImportResp, error) {
+	file, header, err := ctx.FormFile("file")
+	if err != nil {
+		return nil, errors.Wrap(err, "获取上传文件失败")
+	}
+	defer file.Close()
+	if header.Size > ImportMaxSize {
+		return nil, errors.Errorf("文件大小超出上限%d", ImportMaxSize)
+	}
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(header.Filename)), ".")
+	b, err := io.ReadAll(io.LimitReader(file, ImportMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	table, err := readTable(b, format)
+	if err != nil {
+		return nil, errors.Wrap(err, "解析文件失败")
+	}
+	if len(table) < 2 {
+		return nil, errors.New("文件中没有数据")
+	}
+
+	// 表头可以是comment或字段名
+	addSchema := s.GetSchema(SchemaModeAdd)
+	cols := schemaColumns(addSchema)
+	colMap := make(map[int]*fileColumn)
+	for i, title := range table[0] {
+		title = importUnescape(strings.TrimSpace(title))
+		for _, col := range cols {
+			if title == col.title || title == col.key {
+				colMap[i] = col
+				break
+			}
+		}
+	}
+	if len(colMap) < 1 {
+		return nil, errors.New("表头中没有可导入的列")
+	}
+
+	schemaBin, err := json.Marshal(addSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &ImportResp{Errors: make([]*ImportLineErr, 0)}
+	rows := make([]map[string]any, 0, len(table)-1)
+	lines := make([]int, 0, len(table)-1)
+	for i, cells := range table[1:] {
+		line := i + 2
+		row := make(map[string]any)
+		rowErr := false
+		for j, cell := range cells {
+			col, ok := colMap[j]
+			if !ok || len(strings.TrimSpace(cell)) < 1 {
+				continue
+			}
+			v, err := importValue(cell, col.schema)
+			if err != nil {
+				resp.Errors = append(resp.Errors, &ImportLineErr{Line: line, Column: col.title, Err: err.Error()})
+				rowErr = true
+				continue
+			}
+			row[col.key] = v
+		}
+		// 跳过空行
+		if len(row) < 1 && !rowErr {
+			continue
+		}
+		if !rowErr {
+			// 注入的内容也参与验证 避免必填的注入字段验证失败
+			valid := make(map[string]any, len(row)+len(params.InjectData))
+			for k, v := range row {
+				valid[k] = v
+			}
+			for k, v := range params.InjectData {
+				valid[k] = v
+			}
+			if err = pipe.SchemaValidFunc(schemaBin, valid); err != nil {
+				resp.Errors = append(resp.Errors, &ImportLineErr{Line: line, Err: err.Error()})
+			}
+		}
+		rows = append(rows, row)
+		lines = append(lines, line)
+	}
+	resp.Total = len(rows)
+	if len(resp.Errors) > 0 {
+		return resp, nil
+	}
+	if len(rows) > BatchMaxRows {
+		return nil, errors.Errorf("导入行数超出上限%d", BatchMaxRows)
+	}
+
+	batch, err := s.BatchAdd(ctx, params, &BatchReq{Rows: rows})
+	if err != nil {
+		return nil, err
+	}
+	resp.Batch = batch
+	for _, r := range batch.Results {
+		if !r.Ok && len(r.Err) > 0 {
+			resp.Errors = append(resp.Errors, &ImportLineErr{Line: lines[r.Index], Err: r.Err})
+		}
+	}
+	return resp, nil
+}
+
+// ExportHandler 导出 通过format参数指定csv或xlsx 其余参数与列表一致
+func (s *SchemaModel[T]) ExportHandler(ctx iris.Context) {
+	err := s.Export(ctx, s.GetHandlerConfig, pipe.ModelGetData{}, ctx.URLParamDefault("format", FileFormatXlsx))
+	if err != nil {
+		IrisRespErr("", err, ctx)
+		return
+	}
+}
+
+// ImportHandler 导入 使用multipart上传file字段
+func (s *SchemaModel[T]) ImportHandler(ctx iris.Context) {
+	if s.Hooks.CustomAddHandler != nil {
+		IrisRespErr("自定义新增不支持导入", nil, ctx)
+		return
+	}
+	result, err := s.Import(ctx, s.PostHandlerConfig)
+	if err != nil {
+		IrisRespErr("", err, ctx)
+		return
+	}
+	ctx.JSON(result)
+}
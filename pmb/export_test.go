@@ -0,0 +1,70 @@
+package pmb
+
+import (
+	"bytes"
+	"github.com/23233/jsonschema"
+	"github.com/gookit/goutil/testutil/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+	"time"
+)
+
+func TestExportImportValue(t *testing.T) {
+	assert.Eq(t, "", exportValue(nil))
+	assert.Eq(t, "1.5", exportValue(1.5))
+	assert.Eq(t, "12", exportValue(int64(12)))
+	assert.Eq(t, `["a","b"]`, exportValue(primitive.A{"a", "b"}))
+	assert.Eq(t, `{"k":1}`, exportValue(primitive.D{{Key: "k", Value: 1}}))
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local)
+	assert.Eq(t, "2024-01-02 03:04:05", exportValue(primitive.NewDateTimeFromTime(now)))
+	// 公式注入 数字不受影响
+	assert.Eq(t, "'=1+1", exportValue("=1+1"))
+	assert.Eq(t, "'@SUM(A1)", exportValue("@SUM(A1)"))
+	assert.Eq(t, "'\tx", exportValue("\tx"))
+	assert.Eq(t, "-1", exportValue(-1.0))
+	assert.Eq(t, "a=1", exportValue("a=1"))
+
+	v, err := importValue(" 12 ", &jsonschema.Schema{Type: "integer"})
+	assert.NoErr(t, err)
+	assert.Eq(t, int64(12), v)
+	_, err = importValue("1.5", &jsonschema.Schema{Type: "integer"})
+	assert.Err(t, err)
+	v, err = importValue("是", &jsonschema.Schema{Type: "boolean"})
+	assert.NoErr(t, err)
+	assert.Eq(t, true, v)
+	v, err = importValue("a, b", &jsonschema.Schema{Type: "array"})
+	assert.NoErr(t, err)
+	assert.Eq(t, []any{"a", "b"}, v)
+	v, err = importValue("2024-01-02 03:04:05", &jsonschema.Schema{Type: "string", Format: "date-time"})
+	assert.NoErr(t, err)
+	assert.Eq(t, now.Format(time.RFC3339), v)
+	_, err = importValue("abc", &jsonschema.Schema{Type: "string", Format: "date-time"})
+	assert.Err(t, err)
+	v, err = importValue(exportValue("-cmd"), &jsonschema.Schema{Type: "string"})
+	assert.NoErr(t, err)
+	assert.Eq(t, "-cmd", v)
+	v, err = importValue("'abc", &jsonschema.Schema{Type: "string"})
+	assert.NoErr(t, err)
+	assert.Eq(t, "'abc", v)
+}
+
+func TestSchemaColumns(t *testing.T) {
+	m := NewSchemaModel(new(testModelStruct), nil)
+	cols := schemaColumns(m.GetSchema(SchemaModeTable))
+	assert.True(t, len(cols) > 0)
+	assert.Eq(t, "name", cols[0].key)
+
+	table := [][]string{{"name", "age"}, {"a", "1"}}
+	for _, format := range []string{FileFormatCsv, FileFormatXlsx} {
+		var buf bytes.Buffer
+		w, err := newTableWriter(&buf, format, "t")
+		assert.NoErr(t, err)
+		for _, row := range table {
+			assert.NoErr(t, w.WriteRow(row))
+		}
+		assert.NoErr(t, w.Close())
+		result, err := readTable(buf.Bytes(), format)
+		assert.NoErr(t, err)
+		assert.Eq(t, table, result)
+	}
+}
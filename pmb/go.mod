@@ -14,6 +14,7 @@ require (
 	github.com/23233/ggg/ut v0.0.0-20250521015733-ba3370e5e495
 	github.com/23233/gocaptcha v0.0.0-20250220112835-76f99983361f
 	github.com/23233/jsonschema v0.11.2
+	github.com/alicebob/miniredis/v2 v2.35.0
 	github.com/kataras/iris/v12 v12.2.11
 	github.com/pkg/errors v0.9.1
 	github.com/qiniu/qmgo v1.1.9
@@ -155,6 +156,7 @@ require (
 	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78 // indirect
 	github.com/yudai/gojsondiff v1.0.0 // indirect
 	github.com/yudai/golcs v0.0.0-20170316035057-ecda9a501e82 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 	go.uber.org/atomic v1.11.0 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
 	go.uber.org/zap v1.27.0 // indirect
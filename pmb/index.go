@@ -79,6 +79,8 @@ type SchemaHooks[T any] struct {
 	OnEditAfter      func(ctx iris.Context, args *pipe.RunResp[map[string]any], model *SchemaModel[T]) error                           // 在修改之后
 	OnDelBefore      func(ctx iris.Context, args pipe.ModelDelConfig, model *SchemaModel[T]) error                                     // 在删除之前
 	OnDelAfter       func(ctx iris.Context, args *pipe.RunResp[any], model *SchemaModel[T]) error                                      // 在删除之后
+	OnBatchBefore    func(ctx iris.Context, op string, req *BatchReq, model *SchemaModel[T]) error                                     // 在批量操作之前 每行仍会经过单行的hooks
+	OnBatchAfter     func(ctx iris.Context, op string, resp *BatchResp, model *SchemaModel[T]) error                                   // 在批量操作之后
 }
 
 type SchemaIframe struct {
@@ -134,6 +136,7 @@ type SchemaModel[T any] struct {
 	Actions       []ISchemaAction     `json:"actions,omitempty"`        // 各类操作
 	DynamicFields []*DynamicField     `json:"dynamic_fields,omitempty"` // 动态字段
 	AllowMethods  *SchemaAllowMethods `json:"allow_methods"`
+	SoftDelete    bool                `json:"soft_delete,omitempty"` // 软删除 删除时仅写入delete_at 可在回收站恢复
 
 	GetHandlerConfig    pipe.QueryParseConfig
 	PostHandlerConfig   ut.ModelCtxMapperPack
@@ -173,6 +176,15 @@ func (s *SchemaModel[T]) GetBase() SchemaBase {
 func (s *SchemaModel[T]) GetRoles() *SchemaRole {
 	return s.Roles
 }
+func (s *SchemaModel[T]) GetAllowMethods() *SchemaAllowMethods {
+	return s.AllowMethods
+}
+func (s *SchemaModel[T]) GetDynamicFields() []*DynamicField {
+	return s.DynamicFields
+}
+func (s *SchemaModel[T]) IsSoftDelete() bool {
+	return s.SoftDelete
+}
 
 func NewSchemaModel[T any](raw T, db *qmgo.Database) *SchemaModel[T] {
 	var r = &SchemaModel[T]{
@@ -384,16 +396,69 @@ func (s *SchemaModel[T]) GetAllAction() []ISchemaAction {
 
 // GetHandler 仅获取数据
 func (s *SchemaModel[T]) GetHandler(ctx iris.Context, queryParams pipe.QueryParseConfig, getParams pipe.ModelGetData, uid string) error {
-	injectQuery, err := s.ParseInject(ctx)
+	query, err := s.getQuery(ctx, queryParams, &getParams, uid)
 	if err != nil {
 		return err
 	}
 
+	// 获取数据
+	dataResp := pipe.QueryGetData.Run(ctx,
+		&pipe.ModelGetDataDep{
+			ModelId: s.GetTableName(),
+			Query:   query,
+		},
+		&getParams,
+		s.db)
+	if dataResp.Err != nil {
+		if getParams.Single {
+			return dataResp.Err
+		}
+		if dataResp.Err != qmgo.ErrNoSuchDocuments {
+			return dataResp.Err
+		}
+	}
+
+	if s.Hooks.OnGetAfter != nil {
+		err := s.Hooks.OnGetAfter(ctx, dataResp, s)
+		if err != nil {
+			return err
+		}
+	}
+
+	if getParams.Single {
+		// 未获取到
+		if dataResp.Result.Data == nil {
+			return errors.New("获取单条数据失败")
+		}
+		ctx.JSON(dataResp.Result.Data)
+
+		return nil
+	}
+
+	var result = new(SchemaGetResp)
+	result.MongoFacetResult = dataResp.Result
+	result.Page = query.Page
+	result.PageSize = query.PageSize
+	result.Filters = query.QueryParse
+	result.Sorts = query.BaseSort
+	ctx.JSON(result)
+	return nil
+
+}
+
+// getQuery 解析出获取数据的查询条件 会注入上下文过滤并经过OnGetBefore
+func (s *SchemaModel[T]) getQuery(ctx iris.Context, queryParams pipe.QueryParseConfig, getParams *pipe.ModelGetData, uid string) (*ut.QueryFull, error) {
+	getParams.SoftDelete = s.SoftDelete
+	injectQuery, err := s.ParseInject(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	if getParams.Single {
 		if len(uid) < 1 {
 			uid, err = s.getUid(ctx)
 			if err != nil {
-				return err
+				return nil, err
 			}
 		}
 		if queryParams.InjectAnd == nil {
@@ -414,7 +479,7 @@ func (s *SchemaModel[T]) GetHandler(ctx iris.Context, queryParams pipe.QueryPars
 	// 解析query
 	resp := pipe.QueryParse.Run(ctx, nil, &queryParams, nil)
 	if resp.Err != nil {
-		return resp.Err
+		return nil, resp.Err
 	}
 	paramsByte, _ := json.Marshal(resp.Result)
 	if s.Debug {
@@ -424,7 +489,7 @@ func (s *SchemaModel[T]) GetHandler(ctx iris.Context, queryParams pipe.QueryPars
 	if s.filterCanPass != nil {
 		err = s.filterCanPass(ctx, s, resp.Result)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
@@ -452,55 +517,13 @@ func (s *SchemaModel[T]) GetHandler(ctx iris.Context, queryParams pipe.QueryPars
 	}
 
 	if s.Hooks.OnGetBefore != nil {
-		err := s.Hooks.OnGetBefore(ctx, resp, &getParams, s)
+		err := s.Hooks.OnGetBefore(ctx, resp, getParams, s)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	// 获取数据
-	dataResp := pipe.QueryGetData.Run(ctx,
-		&pipe.ModelGetDataDep{
-			ModelId: s.GetTableName(),
-			Query:   resp.Result,
-		},
-		&getParams,
-		s.db)
-	if dataResp.Err != nil {
-		if getParams.Single {
-			return dataResp.Err
-		}
-		if dataResp.Err != qmgo.ErrNoSuchDocuments {
-			return dataResp.Err
-		}
-	}
-
-	if s.Hooks.OnGetAfter != nil {
-		err := s.Hooks.OnGetAfter(ctx, dataResp, s)
-		if err != nil {
-			return err
-		}
-	}
-
-	if getParams.Single {
-		// 未获取到
-		if dataResp.Result.Data == nil {
-			return errors.New("获取单条数据失败")
-		}
-		ctx.JSON(dataResp.Result.Data)
-
-		return nil
-	}
-
-	var result = new(SchemaGetResp)
-	result.MongoFacetResult = dataResp.Result
-	result.Page = resp.Result.Page
-	result.PageSize = resp.Result.PageSize
-	result.Filters = resp.Result.QueryParse
-	result.Sorts = resp.Result.BaseSort
-	ctx.JSON(result)
-	return nil
-
+	return resp.Result, nil
 }
 
 func checkKeys(keys []string, raw interface{}) error {
@@ -549,74 +572,94 @@ func (s *SchemaModel[T]) PostHandler(ctx iris.Context, params ut.ModelCtxMapperP
 		return s.Hooks.CustomAddHandler(ctx, params, s)
 	}
 
+	params, err := s.addParamsPrepare(ctx, params)
+	if err != nil {
+		return err
+	}
+
+	newV := s.newRaw()
+	err = ctx.ReadBody(newV)
+	if err != nil {
+		return err
+	}
+
+	result, log, err := s.addRow(ctx, params, newV)
+	if err != nil {
+		return err
+	}
+
+	ctx.JSON(result)
+
+	s.writeOpLog(ctx, log)
+
+	return nil
+}
+
+// addParamsPrepare 开启了WriteInsert时把注入内容写入新增体
+func (s *SchemaModel[T]) addParamsPrepare(ctx iris.Context, params ut.ModelCtxMapperPack) (ut.ModelCtxMapperPack, error) {
 	if s.WriteInsert {
 		injectQuery, err := s.ParseInject(ctx)
 		if err != nil {
-			return err
+			return params, err
 		}
-		if params.InjectData == nil {
-			params.InjectData = make(map[string]any)
+		inject := make(map[string]any, len(params.InjectData)+len(injectQuery))
+		for k, v := range params.InjectData {
+			inject[k] = v
 		}
 		for _, kov := range injectQuery {
-			params.InjectData[kov.Key] = kov.Value
+			inject[kov.Key] = kov.Value
 		}
+		params.InjectData = inject
 	}
+	return params, nil
+}
 
-	newV := s.newRaw()
-	err := ctx.ReadBody(newV)
-	if err != nil {
-		return err
-	}
-
-	err = params.Process(newV)
+// addRow 执行单行新增 会经过hooks 操作日志由调用方写入
+func (s *SchemaModel[T]) addRow(ctx iris.Context, params ut.ModelCtxMapperPack, newV any) (map[string]any, *opLogEntry, error) {
+	err := params.Process(newV)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	// 必须出现在body中的字段名
 	if s.PostMustKeys != nil {
 		err := checkKeys(s.PostMustKeys, newV)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 	}
 
 	if s.Hooks.OnAddBefore != nil {
 		err := s.Hooks.OnAddBefore(ctx, pipe.NewPipeResult(newV), s)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 	}
 
 	// 进行新增
 	insertResult := pipe.ModelAdd.Run(ctx, newV, &pipe.ModelCtxAddConfig{ModelId: s.GetTableName()}, s.db)
 	if insertResult.Err != nil {
-		return insertResult.Err
+		return nil, nil, insertResult.Err
 	}
 
 	if s.Hooks.OnAddAfter != nil {
 		err := s.Hooks.OnAddAfter(ctx, insertResult, s)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 	}
 
-	ctx.JSON(insertResult.Result)
-
-	user := s.GetContextUser(ctx)
 	uid := insertResult.Result[ut.DefaultUidTag]
 	uidStr, _ := uid.(string)
-	MustOpLog(ctx, s.db.Collection("operation_log"), "post", user, s.GetTableName(), "新增一行", uidStr, nil)
-
-	return nil
+	return insertResult.Result, &opLogEntry{method: "post", msg: "新增一行", rowId: uidStr}, nil
 }
 
 func (s *SchemaModel[T]) SetPathId(newId string) {
 	s.PathId = newId
 }
 
-func (s *SchemaModel[T]) PutHandler(ctx iris.Context, params pipe.ModelPutConfig) error {
-
+// putParamsPrepare 填充修改共用的参数
+func (s *SchemaModel[T]) putParamsPrepare(ctx iris.Context, params *pipe.ModelPutConfig) error {
 	injectQuery, err := s.ParseInject(ctx)
 	if err != nil {
 		return err
@@ -640,6 +683,14 @@ func (s *SchemaModel[T]) PutHandler(ctx iris.Context, params pipe.ModelPutConfig
 	params.QueryFilter.QueryParse.InsertOrReplaces("and", injectQuery...)
 
 	params.ModelId = s.GetTableName()
+	return nil
+}
+
+func (s *SchemaModel[T]) PutHandler(ctx iris.Context, params pipe.ModelPutConfig) error {
+	err := s.putParamsPrepare(ctx, &params)
+	if err != nil {
+		return err
+	}
 
 	newV := s.newRaw()
 	err = ctx.ReadBody(&newV)
@@ -655,28 +706,41 @@ func (s *SchemaModel[T]) PutHandler(ctx iris.Context, params pipe.ModelPutConfig
 
 	params.BodyMap = bodyMap
 
+	result, log, err := s.putRow(ctx, params, newV, "put", "修改行")
+	if err != nil {
+		return err
+	}
+
+	ctx.JSON(result)
+
+	s.writeOpLog(ctx, log)
+
+	return nil
+}
+
+// putRow 执行修改并返回带有变更前后快照的日志 newV为nil时以BodyMap进行对比
+func (s *SchemaModel[T]) putRow(ctx iris.Context, params pipe.ModelPutConfig, newV any, method string, msg string) (map[string]any, *opLogEntry, error) {
+	var err error
+	params.SoftDelete = s.SoftDelete
 	if s.Hooks.OnEditBefore != nil {
 		err = s.Hooks.OnEditBefore(ctx, params, s)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 	}
 
 	resp := pipe.ModelPut.Run(ctx, newV, &params, s.db)
 	if resp.Err != nil {
-		return resp.Err
+		return nil, nil, resp.Err
 	}
 
 	if s.Hooks.OnEditAfter != nil {
 		err = s.Hooks.OnEditAfter(ctx, resp, s)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 	}
 
-	ctx.JSON(resp.Result)
-
-	user := s.GetContextUser(ctx)
 	var fields = make([]ut.Kov, 0, len(resp.Result))
 	for k, v := range resp.Result {
 		fields = append(fields, ut.Kov{
@@ -684,12 +748,19 @@ func (s *SchemaModel[T]) PutHandler(ctx iris.Context, params pipe.ModelPutConfig
 			Value: v,
 		})
 	}
-	MustOpLog(ctx, s.db.Collection("operation_log"), "put", user, s.GetTableName(), "修改行", params.RowId, fields)
 
-	return nil
+	return resp.Result, &opLogEntry{
+		method: method,
+		msg:    msg,
+		rowId:  params.RowId,
+		fields: fields,
+		before: params.Before,
+		after:  resp.Result,
+	}, nil
 }
 
-func (s *SchemaModel[T]) DelHandler(ctx iris.Context, params pipe.ModelDelConfig) error {
+// delParamsPrepare 填充删除/恢复/彻底删除共用的参数
+func (s *SchemaModel[T]) delParamsPrepare(ctx iris.Context, params *pipe.ModelDelConfig) error {
 	params.ModelId = s.GetTableName()
 
 	if len(params.RowId) < 1 {
@@ -713,30 +784,104 @@ func (s *SchemaModel[T]) DelHandler(ctx iris.Context, params pipe.ModelDelConfig
 	}
 
 	params.QueryFilter.QueryParse.InsertOrReplaces("and", injectQuery...)
+	return nil
+}
+
+func (s *SchemaModel[T]) DelHandler(ctx iris.Context, params pipe.ModelDelConfig) error {
+	err := s.delParamsPrepare(ctx, &params)
+	if err != nil {
+		return err
+	}
+
+	result, log, err := s.delRow(ctx, params)
+	if err != nil {
+		return err
+	}
+
+	_, _ = ctx.WriteString(result)
+
+	s.writeOpLog(ctx, log)
+
+	return nil
+}
+
+// delRow 执行单行删除 开启软删除时仅写入delete_at
+func (s *SchemaModel[T]) delRow(ctx iris.Context, params pipe.ModelDelConfig) (string, *opLogEntry, error) {
+	var err error
+	if s.SoftDelete {
+		params.Soft = true
+	}
 
 	if s.Hooks.OnDelBefore != nil {
 		err = s.Hooks.OnDelBefore(ctx, params, s)
 		if err != nil {
-			return err
+			return "", nil, err
 		}
 	}
 
 	resp := pipe.ModelDel.Run(ctx, nil, &params, s.db)
 	if resp.Err != nil {
-		return resp.Err
+		return "", nil, resp.Err
 	}
 
 	if s.Hooks.OnDelAfter != nil {
 		err = s.Hooks.OnDelAfter(ctx, resp, s)
 		if err != nil {
-			return err
+			return "", nil, err
 		}
 	}
 
+	log := &opLogEntry{method: "del", msg: "删除行", rowId: params.RowId, before: params.Before}
+	if params.Soft {
+		log.msg = "软删除行"
+		log.after = map[string]any{pipe.SoftDeleteKey: time.Now()}
+	}
+	result, _ := resp.Result.(string)
+	return result, log, nil
+}
+
+// RestoreHandler 恢复软删除的行
+func (s *SchemaModel[T]) RestoreHandler(ctx iris.Context, params pipe.ModelDelConfig) error {
+	if !s.SoftDelete {
+		return errors.New("未开启软删除")
+	}
+	err := s.delParamsPrepare(ctx, &params)
+	if err != nil {
+		return err
+	}
+
+	resp := pipe.ModelRestore.Run(ctx, nil, &params, s.db)
+	if resp.Err != nil {
+		return resp.Err
+	}
+
 	_, _ = ctx.WriteString(resp.Result.(string))
 
 	user := s.GetContextUser(ctx)
-	MustOpLog(ctx, s.db.Collection("operation_log"), "del", user, s.GetTableName(), "删除行", params.RowId, nil)
+	MustOpLogDiff(ctx, s.db.Collection("operation_log"), "restore", user, s.GetTableName(), "恢复行", params.RowId, nil, params.Before, nil)
+
+	return nil
+}
+
+// PurgeHandler 彻底删除软删除的行
+func (s *SchemaModel[T]) PurgeHandler(ctx iris.Context, params pipe.ModelDelConfig) error {
+	if !s.SoftDelete {
+		return errors.New("未开启软删除")
+	}
+	err := s.delParamsPrepare(ctx, &params)
+	if err != nil {
+		return err
+	}
+
+	resp := pipe.ModelPurge.Run(ctx, nil, &params, s.db)
+	if resp.Err != nil {
+		return resp.Err
+	}
+
+	_, _ = ctx.WriteString(resp.Result.(string))
+
+	user := s.GetContextUser(ctx)
+	MustOpLogDiff(ctx, s.db.Collection("operation_log"), "purge", user, s.GetTableName(), "彻底删除行", params.RowId, nil, params.Before, nil)
 
 	return nil
 }
@@ -790,18 +935,30 @@ func (s *SchemaModel[T]) RegistryConfigAction(p iris.Party) {
 func (s *SchemaModel[T]) RegistryCrud(p iris.Party) {
 	if s.AllowMethods.GetAll {
 		p.Get("/", s.CrudHandler)
+		p.Get("/export", s.ExportHandler)
 	}
 	if s.AllowMethods.GetSingle {
 		p.Get("/{uid:string}", s.CrudHandler)
 	}
 	if s.AllowMethods.Post {
 		p.Post("/", s.CrudHandler)
+		p.Post("/batch", s.BatchHandler)
+		p.Post("/import", s.ImportHandler)
 	}
 	if s.AllowMethods.Put {
 		p.Put("/{uid:string}", s.CrudHandler)
+		p.Put("/batch", s.BatchHandler)
+		p.Get("/{uid:string}/revisions", s.RevisionHandler)
+		p.Post("/{uid:string}/revisions/{rev:string}/revert", s.RevisionHandler)
 	}
 	if s.AllowMethods.Delete {
 		p.Delete("/{uid:string}", s.CrudHandler)
+		p.Delete("/batch", s.BatchHandler)
+		if s.SoftDelete {
+			p.Get("/trash", s.TrashHandler)
+			p.Post("/trash/{uid:string}/restore", s.TrashHandler)
+			p.Delete("/trash/{uid:string}", s.TrashHandler)
+		}
 	}
 }
 
@@ -848,6 +1005,35 @@ func (s *SchemaModel[T]) CrudHandler(ctx iris.Context) {
 	}
 
 }
+
+// TrashHandler 回收站 get为列表 post为恢复 delete为彻底删除
+func (s *SchemaModel[T]) TrashHandler(ctx iris.Context) {
+	method := strings.ToLower(ctx.Method())
+	var err error
+	switch method {
+	case "get":
+		if !s.SoftDelete {
+			err = errors.New("未开启软删除")
+			break
+		}
+		err = s.GetHandler(ctx, s.GetHandlerConfig, pipe.ModelGetData{
+			GetQueryCount: true,
+			OnlyDeleted:   true,
+		}, "")
+	case "post":
+		err = s.RestoreHandler(ctx, s.DeleteHandlerConfig)
+	case "delete":
+		err = s.PurgeHandler(ctx, s.DeleteHandlerConfig)
+	default:
+		err = errors.New("未被支持的方法")
+	}
+
+	if err != nil {
+		IrisRespErr("", err, ctx)
+		return
+	}
+}
+
 func (s *SchemaModel[T]) GetSchema(mode ISchemaMode) *jsonschema.Schema {
 	switch mode {
 	case SchemaModeAdd:
@@ -904,6 +1090,18 @@ type IModelItem interface {
 	PostHandler(ctx iris.Context, params ut.ModelCtxMapperPack) error
 	PutHandler(ctx iris.Context, params pipe.ModelPutConfig) error
 	DelHandler(ctx iris.Context, params pipe.ModelDelConfig) error
+	RestoreHandler(ctx iris.Context, params pipe.ModelDelConfig) error
+	PurgeHandler(ctx iris.Context, params pipe.ModelDelConfig) error
+	TrashHandler(ctx iris.Context)
+	RevisionHandler(ctx iris.Context)
+	BatchAdd(ctx iris.Context, params ut.ModelCtxMapperPack, req *BatchReq) (*BatchResp, error)
+	BatchPut(ctx iris.Context, params pipe.ModelPutConfig, req *BatchReq) (*BatchResp, error)
+	BatchDel(ctx iris.Context, params pipe.ModelDelConfig, req *BatchReq) (*BatchResp, error)
+	BatchHandler(ctx iris.Context)
+	Export(ctx iris.Context, queryParams pipe.QueryParseConfig, getParams pipe.ModelGetData, format string) error
+	Import(ctx iris.Context, params ut.ModelCtxMapperPack) (*ImportResp, error)
+	ExportHandler(ctx iris.Context)
+	ImportHandler(ctx iris.Context)
 	ActionEntry(ctx iris.Context)
 	DynamicFieldsEntry(ctx iris.Context)
 	Registry(part iris.Party)
@@ -916,6 +1114,9 @@ type IModelItem interface {
 	GetAllAction() []ISchemaAction
 	SetPathId(newId string)
 	GetRoles() *SchemaRole
+	GetAllowMethods() *SchemaAllowMethods
+	GetDynamicFields() []*DynamicField
+	IsSoftDelete() bool
 	HaveUserKey(schema *jsonschema.Schema) bool
 	GetSchema(mode ISchemaMode) *jsonschema.Schema
 	SetSchemaRaw(mode ISchemaMode, raw any)
@@ -1,93 +1,510 @@
 package pmb
 
 import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/redis/rueidis"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+var (
+	// MessageMaxLen 每个用户最多保留的消息条数
+	MessageMaxLen int64 = 1000
+	// MessageExpire 消息保留时长 以最后一条消息的写入时间计算
+	MessageExpire = 48 * time.Hour
+
+	ErrMsgIdInvalid = errors.New("消息id格式错误")
+)
+
+var msgIdRe = regexp.MustCompile(`^\d{1,19}-\d{1,19}$`)
+
+// MsgIdValid id是否为 毫秒-序号 格式
+func MsgIdValid(id string) bool {
+	return msgIdRe.MatchString(id)
+}
+
 type Message struct {
-	UID       string          `json:"-"`
-	Content   string          `json:"content,omitempty"`
-	CreatedAt time.Time       `json:"created_at,omitempty"`
-	Sequence  int             `json:"sequence,omitempty"`
-	UA        map[string]bool `json:"-"`
+	Id        string    `json:"id"`
+	UID       string    `json:"-"`
+	Content   string    `json:"content,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+	Read      bool      `json:"read"`
+}
+
+// MessageStore 消息存储 每个用户一个有序的消息列表 以游标记录已读位置
+// 消息id的格式与redis stream一致 为 毫秒-序号 可以直接比较先后
+type MessageStore interface {
+	// Put 写入一条消息
+	Put(ctx context.Context, uid, content string) (*Message, error)
+	// List 获取afterId之后的消息 按时间正序 afterId为空则从最早的开始 格式错误时返回 ErrMsgIdInvalid
+	List(ctx context.Context, uid, afterId string, limit int64) ([]*Message, error)
+	// Cursor 获取已读游标 小于等于游标的消息均为已读
+	Cursor(ctx context.Context, uid string) (string, error)
+	// MarkRead 把已读游标推进到id 不会回退
+	MarkRead(ctx context.Context, uid, id string) error
+	// DeviceCursor 获取设备的消费游标 与已读游标相互独立
+	DeviceCursor(ctx context.Context, uid, device string) (string, error)
+	// MarkDevice 把设备的消费游标推进到id 不会回退
+	MarkDevice(ctx context.Context, uid, device, id string) error
+	// Unread 未读数量
+	Unread(ctx context.Context, uid string) (int64, error)
+	// Subscribe 订阅新消息 ctx结束后关闭通道
+	Subscribe(ctx context.Context, uid string) (<-chan *Message, error)
+}
+
+// parseMsgId 解析 毫秒-序号 格式的id
+func parseMsgId(id string) (int64, int64) {
+	ms, seq, _ := strings.Cut(id, "-")
+	a, _ := strconv.ParseInt(ms, 10, 64)
+	b, _ := strconv.ParseInt(seq, 10, 64)
+	return a, b
+}
+
+// MsgIdCompare 比较两个消息id a在b之前返回-1 相同返回0 之后返回1 空字符串在最前
+func MsgIdCompare(a, b string) int {
+	if a == b {
+		return 0
+	}
+	if len(a) < 1 {
+		return -1
+	}
+	if len(b) < 1 {
+		return 1
+	}
+	a1, a2 := parseMsgId(a)
+	b1, b2 := parseMsgId(b)
+	if a1 < b1 || (a1 == b1 && a2 < b2) {
+		return -1
+	}
+	if a1 == b1 && a2 == b2 {
+		return 0
+	}
+	return 1
+}
+
+// ConsumeDeviceMessage 获取设备尚未消费的下一条消息 并推进设备游标与已读游标
+// 每条消息在每个设备上只会被消费一次 设备首次消费时从已读游标之后开始 没有消息时返回nil
+func ConsumeDeviceMessage(ctx context.Context, store MessageStore, uid, device string) (*Message, error) {
+	cursor, err := store.DeviceCursor(ctx, uid, device)
+	if err != nil {
+		return nil, err
+	}
+	if len(cursor) < 1 {
+		if cursor, err = store.Cursor(ctx, uid); err != nil {
+			return nil, err
+		}
+	}
+	msgs, err := store.List(ctx, uid, cursor, 1)
+	if err != nil || len(msgs) < 1 {
+		return nil, err
+	}
+	msg := msgs[0]
+	if err = store.MarkDevice(ctx, uid, device, msg.Id); err != nil {
+		return nil, err
+	}
+	if err = store.MarkRead(ctx, uid, msg.Id); err != nil {
+		return nil, err
+	}
+	msg.Read = true
+	return msg, nil
 }
+
+// MessageQueue 旧版的进程内消息队列 每个设备(User-Agent)各消费一次
+//
+// Deprecated: 使用 MessageStore 配合 ConsumeDeviceMessage
 type MessageQueue struct {
-	msgMap  map[string][]Message
-	counter map[string]int
-	mu      sync.Mutex
+	store *MemoryMessageStore
 }
 
+// NewMessageQueue
+//
+// Deprecated: 使用 NewMemoryMessageStore 或 NewRedisMessageStore
 func NewMessageQueue() *MessageQueue {
-	mq := &MessageQueue{
-		msgMap:  make(map[string][]Message),
-		counter: make(map[string]int),
+	return &MessageQueue{store: NewMemoryMessageStore()}
+}
+
+func (mq *MessageQueue) Put(uid, content string) {
+	_, _ = mq.store.Put(context.Background(), uid, content)
+}
+
+func (mq *MessageQueue) Consume(uid, ua string) (Message, bool) {
+	msg, err := ConsumeDeviceMessage(context.Background(), mq.store, uid, ua)
+	if err != nil || msg == nil {
+		return Message{}, false
+	}
+	return *msg, true
+}
+
+// Store 底层的存储 迁移时可以传给 Backend.SetMsgStore
+func (mq *MessageQueue) Store() *MemoryMessageStore {
+	return mq.store
+}
+
+// MemoryMessageStore 进程内的消息存储 重启后丢失且多实例之间不共享
+type MemoryMessageStore struct {
+	msgMap  map[string][]*Message
+	cursors map[string]string
+	devices map[string]map[string]string
+	subs    map[string]map[chan *Message]struct{}
+	lastMs  int64
+	lastSeq int64
+	mu      sync.Mutex
+}
+
+func NewMemoryMessageStore() *MemoryMessageStore {
+	mq := &MemoryMessageStore{
+		msgMap:  make(map[string][]*Message),
+		cursors: make(map[string]string),
+		devices: make(map[string]map[string]string),
+		subs:    make(map[string]map[chan *Message]struct{}),
 	}
 	go mq.cleanUp()
 	return mq
 }
 
-func (mq *MessageQueue) Put(uid, content string) {
+// nextId 生成递增的id 同一毫秒内递增序号
+func (mq *MemoryMessageStore) nextId(now time.Time) string {
+	ms := now.UnixMilli()
+	if ms > mq.lastMs {
+		mq.lastMs = ms
+		mq.lastSeq = 0
+	} else {
+		mq.lastSeq++
+	}
+	return fmt.Sprintf("%d-%d", mq.lastMs, mq.lastSeq)
+}
+
+func (mq *MemoryMessageStore) Put(ctx context.Context, uid, content string) (*Message, error) {
 	mq.mu.Lock()
 	defer mq.mu.Unlock()
-	seq := mq.counter[uid] + 1
-	mq.counter[uid] = seq
-	message := Message{
+	now := time.Now()
+	msg := &Message{
+		Id:        mq.nextId(now),
 		UID:       uid,
 		Content:   content,
-		UA:        make(map[string]bool),
-		CreatedAt: time.Now(),
-		Sequence:  seq,
+		CreatedAt: now,
+	}
+	list := append(mq.msgMap[uid], msg)
+	if int64(len(list)) > MessageMaxLen {
+		list = list[int64(len(list))-MessageMaxLen:]
+	}
+	mq.msgMap[uid] = list
+
+	for ch := range mq.subs[uid] {
+		select {
+		case ch <- msg:
+		default:
+			// 订阅方消费过慢时丢弃 可以通过List补齐
+		}
 	}
-	mq.msgMap[uid] = append(mq.msgMap[uid], message)
+	return msg, nil
 }
 
-func (mq *MessageQueue) Consume(uid, ua string) (Message, bool) {
+func (mq *MemoryMessageStore) List(ctx context.Context, uid, afterId string, limit int64) ([]*Message, error) {
+	if len(afterId) > 0 && !MsgIdValid(afterId) {
+		return nil, ErrMsgIdInvalid
+	}
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	cursor := mq.cursors[uid]
+	result := make([]*Message, 0)
+	for _, msg := range mq.msgMap[uid] {
+		if limit > 0 && int64(len(result)) >= limit {
+			break
+		}
+		if MsgIdCompare(msg.Id, afterId) <= 0 {
+			continue
+		}
+		item := *msg
+		item.Read = MsgIdCompare(msg.Id, cursor) <= 0
+		result = append(result, &item)
+	}
+	return result, nil
+}
+
+func (mq *MemoryMessageStore) Cursor(ctx context.Context, uid string) (string, error) {
 	mq.mu.Lock()
 	defer mq.mu.Unlock()
+	return mq.cursors[uid], nil
+}
 
-	messages, ok := mq.msgMap[uid]
-	if !ok || len(messages) == 0 {
-		return Message{}, false
+func (mq *MemoryMessageStore) MarkRead(ctx context.Context, uid, id string) error {
+	if !MsgIdValid(id) {
+		return ErrMsgIdInvalid
+	}
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	if MsgIdCompare(id, mq.cursors[uid]) > 0 {
+		mq.cursors[uid] = id
 	}
+	return nil
+}
 
-	for _, msg := range messages {
-		if _, ok := msg.UA[ua]; !ok {
-			msg.UA[ua] = true
+func (mq *MemoryMessageStore) DeviceCursor(ctx context.Context, uid, device string) (string, error) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	return mq.devices[uid][device], nil
+}
 
-			// Remove the consumed message after 30 seconds
-			go func(uid string, sequence int) {
-				time.Sleep(30 * time.Second)
-				mq.mu.Lock()
-				for i, msg := range mq.msgMap[uid] {
-					if msg.Sequence == sequence {
-						mq.msgMap[uid] = append(mq.msgMap[uid][:i], mq.msgMap[uid][i+1:]...)
-						break
-					}
-				}
-				mq.mu.Unlock()
-			}(uid, msg.Sequence)
+func (mq *MemoryMessageStore) MarkDevice(ctx context.Context, uid, device, id string) error {
+	if !MsgIdValid(id) {
+		return ErrMsgIdInvalid
+	}
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	if mq.devices[uid] == nil {
+		mq.devices[uid] = make(map[string]string)
+	}
+	if MsgIdCompare(id, mq.devices[uid][device]) > 0 {
+		mq.devices[uid][device] = id
+	}
+	return nil
+}
 
-			return msg, true
+func (mq *MemoryMessageStore) Unread(ctx context.Context, uid string) (int64, error) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	cursor := mq.cursors[uid]
+	var count int64
+	for _, msg := range mq.msgMap[uid] {
+		if MsgIdCompare(msg.Id, cursor) > 0 {
+			count++
 		}
 	}
+	return count, nil
+}
+
+func (mq *MemoryMessageStore) Subscribe(ctx context.Context, uid string) (<-chan *Message, error) {
+	ch := make(chan *Message, 16)
+	mq.mu.Lock()
+	if mq.subs[uid] == nil {
+		mq.subs[uid] = make(map[chan *Message]struct{})
+	}
+	mq.subs[uid][ch] = struct{}{}
+	mq.mu.Unlock()
 
-	return Message{}, false
+	go func() {
+		<-ctx.Done()
+		mq.mu.Lock()
+		delete(mq.subs[uid], ch)
+		if len(mq.subs[uid]) < 1 {
+			delete(mq.subs, uid)
+		}
+		mq.mu.Unlock()
+		close(ch)
+	}()
+	return ch, nil
 }
-func (mq *MessageQueue) cleanUp() {
+
+func (mq *MemoryMessageStore) cleanUp() {
 	for {
 		time.Sleep(30 * time.Minute)
 		mq.mu.Lock()
 		now := time.Now()
 		for uid, messages := range mq.msgMap {
-			var newMessages []Message
+			var newMessages []*Message
 			for _, msg := range messages {
-				if now.Sub(msg.CreatedAt) < 48*time.Hour {
+				if now.Sub(msg.CreatedAt) < MessageExpire {
 					newMessages = append(newMessages, msg)
 				}
 			}
+			if len(newMessages) < 1 {
+				delete(mq.msgMap, uid)
+				delete(mq.cursors, uid)
+				delete(mq.devices, uid)
+				continue
+			}
 			mq.msgMap[uid] = newMessages
 		}
 		mq.mu.Unlock()
 	}
 }
+
+var msgMarkReadScript = rueidis.NewLuaScript(`
+local cur = redis.call("get", KEYS[1])
+if cur then
+	local a1, a2 = string.match(cur, "(%d+)-(%d+)")
+	local b1, b2 = string.match(ARGV[1], "(%d+)-(%d+)")
+	a1, a2, b1, b2 = tonumber(a1), tonumber(a2), tonumber(b1), tonumber(b2)
+	if b1 < a1 or (b1 == a1 and b2 <= a2) then
+		return 0
+	end
+end
+redis.call("set", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1
+`)
+
+// RedisMessageStore 基于redis stream的消息存储 多实例共享 游标存储在单独的key中
+type RedisMessageStore struct {
+	Prefix string
+	rdb    rueidis.Client
+}
+
+func NewRedisMessageStore(rdb rueidis.Client, prefix string) *RedisMessageStore {
+	return &RedisMessageStore{
+		Prefix: prefix,
+		rdb:    rdb,
+	}
+}
+
+func (c *RedisMessageStore) streamKey(uid string) string {
+	return c.Prefix + "msg:" + uid
+}
+func (c *RedisMessageStore) cursorKey(uid string) string {
+	return c.Prefix + "msg_cursor:" + uid
+}
+func (c *RedisMessageStore) deviceKey(uid, device string) string {
+	return c.Prefix + "msg_device:" + uid + ":" + device
+}
+
+func (c *RedisMessageStore) getCursor(ctx context.Context, key string) (string, error) {
+	cursor, err := c.rdb.Do(ctx, c.rdb.B().Get().Key(key).Build()).ToString()
+	if err != nil && !rueidis.IsRedisNil(err) {
+		return "", err
+	}
+	return cursor, nil
+}
+
+// markCursor 脚本中按 毫秒-序号 解析 必须先校验格式
+func (c *RedisMessageStore) markCursor(ctx context.Context, key, id string) error {
+	if !MsgIdValid(id) {
+		return ErrMsgIdInvalid
+	}
+	return msgMarkReadScript.Exec(ctx, c.rdb, []string{key}, []string{id, strconv.FormatInt(MessageExpire.Milliseconds(), 10)}).Error()
+}
+
+func (c *RedisMessageStore) entryToMsg(uid string, entry rueidis.XRangeEntry) *Message {
+	ms, _ := strconv.ParseInt(entry.FieldValues["created_at"], 10, 64)
+	return &Message{
+		Id:        entry.ID,
+		UID:       uid,
+		Content:   entry.FieldValues["content"],
+		CreatedAt: time.UnixMilli(ms),
+	}
+}
+
+func (c *RedisMessageStore) Put(ctx context.Context, uid, content string) (*Message, error) {
+	now := time.Now()
+	key := c.streamKey(uid)
+	resps := c.rdb.DoMulti(ctx,
+		c.rdb.B().Xadd().Key(key).Maxlen().Almost().Threshold(strconv.FormatInt(MessageMaxLen, 10)).Id("*").
+			FieldValue().FieldValue("content", content).FieldValue("created_at", strconv.FormatInt(now.UnixMilli(), 10)).Build(),
+		c.rdb.B().Pexpire().Key(key).Milliseconds(MessageExpire.Milliseconds()).Build(),
+	)
+	id, err := resps[0].ToString()
+	if err != nil {
+		return nil, err
+	}
+	// 过期时间设置失败时消息流会一直保留
+	if err = resps[1].Error(); err != nil {
+		return nil, err
+	}
+	return &Message{
+		Id:        id,
+		UID:       uid,
+		Content:   content,
+		CreatedAt: now,
+	}, nil
+}
+
+func (c *RedisMessageStore) List(ctx context.Context, uid, afterId string, limit int64) ([]*Message, error) {
+	if limit <= 0 {
+		limit = MessageMaxLen
+	}
+	start := "-"
+	if len(afterId) > 0 {
+		if !MsgIdValid(afterId) {
+			return nil, ErrMsgIdInvalid
+		}
+		start = "(" + afterId
+	}
+	entries, err := c.rdb.Do(ctx, c.rdb.B().Xrange().Key(c.streamKey(uid)).Start(start).End("+").Count(limit).Build()).AsXRange()
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := c.Cursor(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*Message, 0, len(entries))
+	for _, entry := range entries {
+		msg := c.entryToMsg(uid, entry)
+		msg.Read = MsgIdCompare(msg.Id, cursor) <= 0
+		result = append(result, msg)
+	}
+	return result, nil
+}
+
+func (c *RedisMessageStore) Cursor(ctx context.Context, uid string) (string, error) {
+	return c.getCursor(ctx, c.cursorKey(uid))
+}
+
+func (c *RedisMessageStore) MarkRead(ctx context.Context, uid, id string) error {
+	return c.markCursor(ctx, c.cursorKey(uid), id)
+}
+
+func (c *RedisMessageStore) DeviceCursor(ctx context.Context, uid, device string) (string, error) {
+	return c.getCursor(ctx, c.deviceKey(uid, device))
+}
+
+func (c *RedisMessageStore) MarkDevice(ctx context.Context, uid, device, id string) error {
+	return c.markCursor(ctx, c.deviceKey(uid, device), id)
+}
+
+func (c *RedisMessageStore) Unread(ctx context.Context, uid string) (int64, error) {
+	cursor, err := c.Cursor(ctx, uid)
+	if err != nil {
+		return 0, err
+	}
+	msgs, err := c.List(ctx, uid, cursor, MessageMaxLen)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(msgs)), nil
+}
+
+// Subscribe 使用阻塞的XREAD获取新消息 每个订阅占用一个连接
+func (c *RedisMessageStore) Subscribe(ctx context.Context, uid string) (<-chan *Message, error) {
+	key := c.streamKey(uid)
+	// 从当前最后一条之后开始 避免使用$在两次读取之间丢失消息
+	last := "0-0"
+	entries, err := c.rdb.Do(ctx, c.rdb.B().Xrevrange().Key(key).End("+").Start("-").Count(1).Build()).AsXRange()
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		last = entries[0].ID
+	}
+
+	ch := make(chan *Message, 16)
+	go func() {
+		defer close(ch)
+		for ctx.Err() == nil {
+			streams, err := c.rdb.Do(ctx, c.rdb.B().Xread().Count(100).Block(5000).Streams().Key(key).Id(last).Build()).AsXRead()
+			if err != nil {
+				if rueidis.IsRedisNil(err) {
+					continue
+				}
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+				}
+				continue
+			}
+			for _, entry := range streams[key] {
+				last = entry.ID
+				select {
+				case ch <- c.entryToMsg(uid, entry):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
@@ -0,0 +1,148 @@
+package pmb
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gookit/goutil/testutil/assert"
+	"github.com/redis/rueidis"
+	"testing"
+	"time"
+)
+
+func TestMsgIdCompare(t *testing.T) {
+	assert.Eq(t, -1, MsgIdCompare("", "1-0"))
+	assert.Eq(t, 0, MsgIdCompare("", ""))
+	assert.Eq(t, -1, MsgIdCompare("9-5", "10-0"))
+	assert.Eq(t, 1, MsgIdCompare("10-1", "10-0"))
+	assert.Eq(t, 0, MsgIdCompare("10-1", "10-1"))
+}
+
+func TestMemoryMessageStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := NewMemoryMessageStore()
+
+	ch, err := store.Subscribe(ctx, "u1")
+	assert.NoErr(t, err)
+
+	m1, err := store.Put(ctx, "u1", "first")
+	assert.NoErr(t, err)
+	m2, err := store.Put(ctx, "u1", "second")
+	assert.NoErr(t, err)
+	_, err = store.Put(ctx, "u2", "other")
+	assert.NoErr(t, err)
+	assert.Eq(t, -1, MsgIdCompare(m1.Id, m2.Id))
+
+	select {
+	case msg := <-ch:
+		assert.Eq(t, "first", msg.Content)
+	case <-time.After(time.Second):
+		t.Fatal("未收到订阅的消息")
+	}
+
+	unread, err := store.Unread(ctx, "u1")
+	assert.NoErr(t, err)
+	assert.Eq(t, int64(2), unread)
+
+	assert.NoErr(t, store.MarkRead(ctx, "u1", m1.Id))
+	msgs, err := store.List(ctx, "u1", "", 10)
+	assert.NoErr(t, err)
+	assert.Len(t, msgs, 2)
+	assert.True(t, msgs[0].Read)
+	assert.False(t, msgs[1].Read)
+
+	// 游标不会回退
+	assert.NoErr(t, store.MarkRead(ctx, "u1", m2.Id))
+	assert.NoErr(t, store.MarkRead(ctx, "u1", m1.Id))
+	cursor, err := store.Cursor(ctx, "u1")
+	assert.NoErr(t, err)
+	assert.Eq(t, m2.Id, cursor)
+
+	msgs, err = store.List(ctx, "u1", m1.Id, 10)
+	assert.NoErr(t, err)
+	assert.Len(t, msgs, 1)
+	assert.Eq(t, "second", msgs[0].Content)
+
+	cancel()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("订阅在ctx结束后未关闭")
+		}
+	}
+}
+
+func TestConsumeDeviceMessage(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryMessageStore()
+	m1, err := store.Put(ctx, "u1", "first")
+	assert.NoErr(t, err)
+	m2, err := store.Put(ctx, "u1", "second")
+	assert.NoErr(t, err)
+
+	// 每个设备各消费一次
+	msg, err := ConsumeDeviceMessage(ctx, store, "u1", "pc")
+	assert.NoErr(t, err)
+	assert.Eq(t, m1.Id, msg.Id)
+	msg, err = ConsumeDeviceMessage(ctx, store, "u1", "pc")
+	assert.NoErr(t, err)
+	assert.Eq(t, m2.Id, msg.Id)
+	msg, err = ConsumeDeviceMessage(ctx, store, "u1", "pc")
+	assert.NoErr(t, err)
+	assert.Nil(t, msg)
+
+	// 其他设备从已读游标之后开始
+	_, err = store.Put(ctx, "u1", "third")
+	assert.NoErr(t, err)
+	msg, err = ConsumeDeviceMessage(ctx, store, "u1", "phone")
+	assert.NoErr(t, err)
+	assert.Eq(t, "third", msg.Content)
+	msg, err = ConsumeDeviceMessage(ctx, store, "u1", "pc")
+	assert.NoErr(t, err)
+	assert.Eq(t, "third", msg.Content)
+
+	// 旧版接口
+	mq := NewMessageQueue()
+	mq.Put("u1", "a")
+	got, ok := mq.Consume("u1", "ua1")
+	assert.True(t, ok)
+	assert.Eq(t, "a", got.Content)
+	_, ok = mq.Consume("u1", "ua1")
+	assert.False(t, ok)
+	_, ok = mq.Consume("u1", "ua2")
+	assert.False(t, ok)
+}
+
+func TestMsgIdValid(t *testing.T) {
+	assert.True(t, MsgIdValid("1700000000000-0"))
+	for _, id := range []string{"", "abc", "1-", "-1", "1-2-3", "1-a", " 1-2"} {
+		assert.False(t, MsgIdValid(id))
+	}
+	store := NewMemoryMessageStore()
+	assert.Eq(t, ErrMsgIdInvalid, store.MarkRead(context.Background(), "u1", "abc"))
+	_, err := store.List(context.Background(), "u1", "abc", 10)
+	assert.Eq(t, ErrMsgIdInvalid, err)
+}
+
+func TestRedisMessageStorePut(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb, err := rueidis.NewClient(rueidis.ClientOption{InitAddress: []string{mr.Addr()}, DisableCache: true})
+	assert.NoErr(t, err)
+	t.Cleanup(rdb.Close)
+	store := NewRedisMessageStore(rdb, "test:")
+
+	msg, err := store.Put(context.TODO(), "u1", "hello")
+	assert.NoErr(t, err)
+	assert.True(t, MsgIdValid(msg.Id))
+	// 消息流设置了过期时间
+	assert.Eq(t, MessageExpire, mr.TTL("test:msg:u1"))
+
+	mr.Close()
+	_, err = store.Put(context.TODO(), "u1", "hello")
+	assert.Err(t, err)
+}
@@ -0,0 +1,560 @@
+package pmb
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/23233/ggg/pipe"
+	"github.com/23233/jsonschema"
+	"github.com/kataras/iris/v12"
+	"sort"
+	"strings"
+)
+
+// OpenApiInfo 文档基础信息
+type OpenApiInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// 各类字段允许的过滤操作符 等于操作直接使用字段名
+var (
+	openApiNumberOps = []string{"gt", "gte", "lt", "lte", "ne", "in", "nin"}
+	openApiStringOps = []string{"ne", "in", "nin", "regex"}
+	openApiBoolOps   = []string{"ne"}
+)
+
+type openApiBuilder struct {
+	components iris.Map
+	named      map[*jsonschema.Schema]string
+}
+
+// schemaRef 把jsonschema放入components 返回引用 $defs会提升为 {name}.{def}
+func (c *openApiBuilder) schemaRef(name string, schema *jsonschema.Schema) iris.Map {
+	if schema == nil {
+		return iris.Map{"type": "object"}
+	}
+	if n, ok := c.named[schema]; ok {
+		return openApiRef(n)
+	}
+	bin, err := json.Marshal(schema)
+	if err != nil {
+		return iris.Map{"type": "object"}
+	}
+	bin = []byte(strings.ReplaceAll(string(bin), `"#/$defs/`, `"#/components/schemas/`+name+"."))
+	var mp iris.Map
+	err = json.Unmarshal(bin, &mp)
+	if err != nil {
+		return iris.Map{"type": "object"}
+	}
+	if defs, ok := mp["$defs"].(map[string]any); ok {
+		for k, v := range defs {
+			c.components[name+"."+k] = v
+		}
+	}
+	delete(mp, "$defs")
+	delete(mp, "$schema")
+	delete(mp, "$id")
+	c.components[name] = mp
+	c.named[schema] = name
+	return openApiRef(name)
+}
+
+func (c *openApiBuilder) raw(name string, raw any) iris.Map {
+	return c.schemaRef(name, ToJsonSchema(raw))
+}
+
+func openApiRef(name string) iris.Map {
+	return iris.Map{"$ref": "#/components/schemas/" + name}
+}
+
+func openApiJsonBody(schema iris.Map) iris.Map {
+	return iris.Map{
+		"required": true,
+		"content": iris.Map{
+			"application/json": iris.Map{"schema": schema},
+		},
+	}
+}
+
+func openApiJsonResp(desc string, schema iris.Map) iris.Map {
+	return iris.Map{
+		"description": desc,
+		"content": iris.Map{
+			"application/json": iris.Map{"schema": schema},
+		},
+	}
+}
+
+func openApiParam(in, name, desc string, schema iris.Map, required bool) iris.Map {
+	p := iris.Map{
+		"name":   name,
+		"in":     in,
+		"schema": schema,
+	}
+	if len(desc) > 0 {
+		p["description"] = desc
+	}
+	if required {
+		p["required"] = true
+	}
+	return p
+}
+
+// openApiOp 组装一个操作 附带通用的错误返回
+func openApiOp(tag, id, summary string, secure bool, resp iris.Map) iris.Map {
+	op := iris.Map{
+		"operationId": id,
+		"summary":     summary,
+		"responses": iris.Map{
+			"200":     resp,
+			"default": iris.Map{"$ref": "#/components/responses/Error"},
+		},
+	}
+	if len(tag) > 0 {
+		op["tags"] = []string{tag}
+	}
+	if secure {
+		op["security"] = []iris.Map{{"bearerAuth": []string{}}}
+	}
+	return op
+}
+
+// openApiListParams 按照 ut.PruneCtxQuery 的约定生成列表查询参数
+func openApiListParams(table iris.Map) []iris.Map {
+	str := iris.Map{"type": "string"}
+	integer := iris.Map{"type": "integer", "minimum": 1}
+	params := []iris.Map{
+		openApiParam("query", "page", "页码 默认1 最大100", integer, false),
+		openApiParam("query", "page_size", "每页数量 默认10 最大100", integer, false),
+		openApiParam("query", "_o", "正序排序字段 逗号分隔", str, false),
+		openApiParam("query", "_od", "倒序排序字段 逗号分隔 默认update_at", str, false),
+		openApiParam("query", "_s", "全局搜索 需模型配置搜索字段 __在前为前匹配 __在后为后匹配", str, false),
+		openApiParam("query", "_last", "游标分页 上一页最后一条的uid", str, false),
+		openApiParam("query", "_lastSort", "游标方向 默认gt", iris.Map{"type": "string", "enum": []string{"gt", "lt"}}, false),
+		openApiParam("query", "_g", "地理位置 格式为 经度,纬度 需模型配置geo字段", str, false),
+		openApiParam("query", "_gmin", "地理位置最小距离(米)", iris.Map{"type": "integer"}, false),
+		openApiParam("query", "_gmax", "地理位置最大距离(米)", iris.Map{"type": "integer"}, false),
+	}
+
+	props, _ := table["properties"].(map[string]any)
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		prop, _ := props[k].(map[string]any)
+		tp, _ := prop["type"].(string)
+		format, _ := prop["format"].(string)
+		var ops []string
+		switch {
+		case tp == "integer" || tp == "number" || format == "date-time":
+			ops = openApiNumberOps
+		case tp == "string":
+			ops = openApiStringOps
+		case tp == "boolean":
+			ops = openApiBoolOps
+		default:
+			// 对象和数组不生成 嵌套字段使用 __ 分隔自行传递
+			continue
+		}
+		schema := iris.Map{"type": tp}
+		if len(format) > 0 {
+			schema["format"] = format
+		}
+		title, _ := prop["title"].(string)
+		params = append(params, openApiParam("query", k, title, schema, false))
+		for _, op := range ops {
+			desc := fmt.Sprintf("%s %s", title, op)
+			opSchema := schema
+			if op == "in" || op == "nin" {
+				desc += " 逗号分隔"
+				opSchema = str
+			}
+			if op == "regex" {
+				opSchema = str
+			}
+			params = append(params, openApiParam("query", k+"_"+op, strings.TrimSpace(desc), opSchema, false))
+		}
+	}
+	return params
+}
+
+// OpenApi 生成全部模型的OpenAPI 3.1文档 serverUrl为api的挂载路径
+func (b *Backend) OpenApi(serverUrl string) iris.Map {
+	return b.openApi(serverUrl, b.models)
+}
+
+func (b *Backend) openApi(serverUrl string, models []IModelItem) iris.Map {
+	builder := &openApiBuilder{
+		components: iris.Map{},
+		named:      make(map[*jsonschema.Schema]string),
+	}
+	builder.components["Error"] = iris.Map{
+		"type": "object",
+		"properties": iris.Map{
+			"detail": iris.Map{"type": "string"},
+		},
+	}
+	objSchema := iris.Map{"type": "object"}
+	uidParam := openApiParam("path", "uid", "数据uid", iris.Map{"type": "string"}, true)
+
+	paths := iris.Map{}
+	tags := make([]iris.Map, 0, len(models))
+
+	userTag := "user"
+	login := openApiOp(userTag, "login", "用户名密码登录", false, openApiJsonResp("登录成功", builder.raw("LoginResp", new(openApiTokenResp))))
+	login["requestBody"] = openApiJsonBody(builder.raw("UserPasswordLoginReq", new(UserPasswordLoginReq)))
+	paths["/login"] = iris.Map{"post": login}
+	reg := openApiOp(userTag, "reg", "用户名密码注册", false, openApiJsonResp("注册成功", openApiRef("LoginResp")))
+	reg["requestBody"] = openApiJsonBody(builder.raw("UserRegLoginReq", new(UserRegLoginReq)))
+	paths["/reg"] = iris.Map{"post": reg}
+	changePwd := openApiOp(userTag, "userChangePassword", "修改密码", true, openApiJsonResp("修改成功", objSchema))
+	changePwd["requestBody"] = openApiJsonBody(builder.raw("UserChangePasswordReq", new(UserChangePasswordReq)))
+	paths["/user_change_password"] = iris.Map{"post": changePwd}
+	login2fa := openApiOp(userTag, "login2fa", "两步验证 通过后发放令牌", false, openApiJsonResp("登录成功", openApiRef("LoginResp")))
+	login2fa["requestBody"] = openApiJsonBody(builder.raw("Login2faReq", new(Login2faReq)))
+	paths["/login_2fa"] = iris.Map{"post": login2fa}
+	refresh := openApiOp(userTag, "tokenRefresh", "刷新令牌 刷新令牌同时轮换", false, openApiJsonResp("新令牌", builder.raw("JwtTokenPair", new(pipe.JwtTokenPair))))
+	refresh["requestBody"] = openApiJsonBody(builder.raw("TokenRefreshReq", new(TokenRefreshReq)))
+	paths["/token/refresh"] = iris.Map{"post": refresh}
+	paths["/sessions"] = iris.Map{"get": openApiOp(userTag, "sessionList", "登录会话列表", true, openApiJsonResp("会话列表", iris.Map{
+		"type": "object",
+		"properties": iris.Map{
+			"data": iris.Map{"type": "array", "items": builder.raw("UserSession", new(UserSession))},
+		},
+	}))}
+	sessionRevoke := openApiOp(userTag, "sessionRevoke", "注销会话 不传参数为退出当前登录", true, openApiJsonResp("注销成功", objSchema))
+	sessionRevoke["requestBody"] = openApiJsonBody(builder.raw("SessionRevokeReq", new(SessionRevokeReq)))
+	paths["/sessions/revoke"] = iris.Map{"post": sessionRevoke}
+	totpSecretSchema := iris.Map{"type": "object", "properties": iris.Map{
+		"secret": iris.Map{"type": "string"},
+		"uri":    iris.Map{"type": "string", "description": "otpauth地址 生成二维码使用"},
+	}}
+	recoverySchema := iris.Map{"type": "object", "properties": iris.Map{
+		"recovery_codes": iris.Map{"type": "array", "items": iris.Map{"type": "string"}},
+	}}
+	login2faSetup := openApiOp(userTag, "login2faSetup", "登录时强制绑定两步验证 生成秘钥", false, openApiJsonResp("秘钥", totpSecretSchema))
+	login2faSetup["requestBody"] = openApiJsonBody(openApiRef("Login2faReq"))
+	paths["/login_2fa/setup"] = iris.Map{"post": login2faSetup}
+	paths["/totp"] = iris.Map{"get": openApiOp(userTag, "totpStatus", "两步验证状态", true, openApiJsonResp("状态", iris.Map{
+		"type": "object",
+		"properties": iris.Map{
+			"enabled":       iris.Map{"type": "boolean"},
+			"required":      iris.Map{"type": "boolean"},
+			"recovery_left": iris.Map{"type": "integer"},
+		},
+	}))}
+	paths["/totp/setup"] = iris.Map{"post": openApiOp(userTag, "totpSetup", "生成待绑定的两步验证秘钥", true, openApiJsonResp("秘钥", totpSecretSchema))}
+	totpCodeBody := openApiJsonBody(builder.raw("TotpCodeReq", new(TotpCodeReq)))
+	totpEnable := openApiOp(userTag, "totpEnable", "开启两步验证", true, openApiJsonResp("恢复码", recoverySchema))
+	totpEnable["requestBody"] = totpCodeBody
+	paths["/totp/enable"] = iris.Map{"post": totpEnable}
+	totpDisable := openApiOp(userTag, "totpDisable", "关闭两步验证", true, openApiJsonResp("关闭成功", objSchema))
+	totpDisable["requestBody"] = totpCodeBody
+	paths["/totp/disable"] = iris.Map{"post": totpDisable}
+	totpRecovery := openApiOp(userTag, "totpRecoveryCodes", "重新生成恢复码", true, openApiJsonResp("恢复码", recoverySchema))
+	totpRecovery["requestBody"] = totpCodeBody
+	paths["/totp/recovery_codes"] = iris.Map{"post": totpRecovery}
+	paths["/self"] = iris.Map{"get": openApiOp(userTag, "self", "当前用户信息", true,
+		openApiJsonResp("当前用户", iris.Map{
+			"type":       "object",
+			"properties": iris.Map{"info": builder.raw("SimpleUserModel", new(SimpleUserModel))},
+		}))}
+	paths["/message"] = iris.Map{"get": openApiOp(userTag, "message", "获取当前设备(User-Agent)的下一条消息 每个设备各消费一次 同时标记为已读", true,
+		openApiJsonResp("消息", builder.raw("Message", new(Message))))}
+	msgList := openApiOp(userTag, "messageList", "消息列表 按时间正序", true, openApiJsonResp("消息列表", iris.Map{
+		"type": "object",
+		"properties": iris.Map{
+			"data":   iris.Map{"type": "array", "items": builder.raw("Message", new(Message))},
+			"cursor": iris.Map{"type": "string", "description": "已读游标"},
+			"unread": iris.Map{"type": "integer"},
+		},
+	}))
+	msgList["parameters"] = []iris.Map{
+		openApiParam("query", "after", "上一页最后一条消息的id", iris.Map{"type": "string"}, false),
+		openApiParam("query", "limit", "数量 默认20", iris.Map{"type": "integer", "minimum": 1, "maximum": 100}, false),
+	}
+	paths["/message/list"] = iris.Map{"get": msgList}
+	msgRead := openApiOp(userTag, "messageRead", "标记已读 id及之前的消息均为已读 不传则全部已读", true,
+		openApiJsonResp("新的已读游标", iris.Map{"type": "object", "properties": iris.Map{"cursor": iris.Map{"type": "string"}}}))
+	msgRead["requestBody"] = openApiJsonBody(iris.Map{"type": "object", "properties": iris.Map{"id": iris.Map{"type": "string"}}})
+	paths["/message/read"] = iris.Map{"post": msgRead}
+	paths["/message/sse"] = iris.Map{"get": openApiOp(userTag, "messageSse", "server-sent events推送新消息 支持Last-Event-ID", true, iris.Map{
+		"description": "事件流 每条消息为一个message事件",
+		"content":     iris.Map{"text/event-stream": iris.Map{"schema": iris.Map{"type": "string"}}},
+	})}
+	paths["/models"] = iris.Map{"get": openApiOp(userTag, "models", "可访问的模型配置", true,
+		openApiJsonResp("模型列表", iris.Map{
+			"type":       "object",
+			"properties": iris.Map{"models": iris.Map{"type": "array", "items": objSchema}},
+		}))}
+	captcha := openApiOp(userTag, "captchaImg", "图片验证码 id在响应头X-Captcha-Id中", false, iris.Map{
+		"description": "验证码图片",
+		"headers": iris.Map{
+			"X-Captcha-Id": iris.Map{"schema": iris.Map{"type": "string"}},
+		},
+		"content": iris.Map{
+			"image/png": iris.Map{"schema": iris.Map{"type": "string", "format": "binary"}},
+		},
+	})
+	paths["/captcha_img"] = iris.Map{"get": captcha}
+	tags = append(tags, iris.Map{"name": userTag, "description": "用户"})
+
+	for _, model := range models {
+		base := model.GetBase()
+		pid := base.PathId
+		tag := pid
+		desc := base.Alias
+		if len(desc) < 1 {
+			desc = base.RawName
+		}
+		tags = append(tags, iris.Map{"name": tag, "description": desc})
+
+		allow := model.GetAllowMethods()
+		if allow == nil {
+			allow = new(SchemaAllowMethods)
+		}
+
+		tableRef := builder.schemaRef(pid+".table", model.GetSchema(SchemaModeTable))
+		table, _ := builder.components[strings.TrimPrefix(tableRef["$ref"].(string), "#/components/schemas/")].(iris.Map)
+
+		builder.components[pid+".list"] = iris.Map{
+			"type": "object",
+			"properties": iris.Map{
+				"count":     iris.Map{"type": "integer"},
+				"page":      iris.Map{"type": "integer"},
+				"page_size": iris.Map{"type": "integer"},
+				"data":      iris.Map{"type": "array", "items": tableRef},
+				"sorts":     objSchema,
+				"filters":   objSchema,
+			},
+		}
+
+		paths["/config/"+pid] = iris.Map{"get": openApiOp(tag, pid+"Config", desc+" 模型配置", true, openApiJsonResp("模型配置", objSchema))}
+
+		list := iris.Map{}
+		if allow.GetAll {
+			op := openApiOp(tag, pid+"List", desc+" 列表 额外字段过滤可使用 字段_操作符 嵌套字段用__分隔 _o_前缀为或条件", true,
+				openApiJsonResp("列表数据", openApiRef(pid+".list")))
+			op["parameters"] = openApiListParams(table)
+			list["get"] = op
+		}
+		if allow.Post {
+			op := openApiOp(tag, pid+"Create", desc+" 新增", true, openApiJsonResp("新增后的数据", tableRef))
+			op["requestBody"] = openApiJsonBody(builder.schemaRef(pid+".add", model.GetSchema(SchemaModeAdd)))
+			list["post"] = op
+		}
+		if len(list) > 0 {
+			paths["/"+pid+"/"] = list
+		}
+
+		if allow.GetAll {
+			op := openApiOp(tag, pid+"Export", desc+" 导出 过滤参数与列表一致", true, iris.Map{
+				"description": "表格文件",
+				"content": iris.Map{
+					"text/csv": iris.Map{"schema": iris.Map{"type": "string"}},
+					"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": iris.Map{"schema": iris.Map{"type": "string", "format": "binary"}},
+				},
+			})
+			params := []iris.Map{
+				openApiParam("query", "format", "导出格式 默认xlsx", iris.Map{"type": "string", "enum": []string{FileFormatCsv, FileFormatXlsx}}, false),
+			}
+			// 导出会获取全部匹配行 分页参数无效
+			for _, param := range openApiListParams(table) {
+				if param["name"] != "page" && param["name"] != "page_size" {
+					params = append(params, param)
+				}
+			}
+			op["parameters"] = params
+			paths["/"+pid+"/export"] = iris.Map{"get": op}
+		}
+		if allow.Post {
+			op := openApiOp(tag, pid+"Import", desc+" 导入 表头为字段说明或字段名 任意行错误则不写入", true,
+				openApiJsonResp("导入结果", builder.raw("ImportResp", new(ImportResp))))
+			op["requestBody"] = iris.Map{
+				"required": true,
+				"content": iris.Map{
+					"multipart/form-data": iris.Map{"schema": iris.Map{
+						"type":       "object",
+						"required":   []string{"file"},
+						"properties": iris.Map{"file": iris.Map{"type": "string", "format": "binary", "description": "csv或xlsx文件"}},
+					}},
+				},
+			}
+			paths["/"+pid+"/import"] = iris.Map{"post": op}
+		}
+
+		single := iris.Map{}
+		if allow.GetSingle {
+			single["get"] = openApiOp(tag, pid+"Get", desc+" 单条", true, openApiJsonResp("单条数据", tableRef))
+		}
+		if allow.Put {
+			op := openApiOp(tag, pid+"Update", desc+" 修改 仅传递变更字段", true, openApiJsonResp("变更的字段", objSchema))
+			op["requestBody"] = openApiJsonBody(builder.schemaRef(pid+".edit", model.GetSchema(SchemaModeEdit)))
+			single["put"] = op
+		}
+		if allow.Delete {
+			single["delete"] = openApiOp(tag, pid+"Delete", desc+" 删除", true, openApiJsonResp("删除成功", objSchema))
+		}
+		if len(single) > 0 {
+			single["parameters"] = []iris.Map{uidParam}
+			paths["/"+pid+"/{uid}"] = single
+		}
+
+		if allow.Put {
+			revisions := openApiOp(tag, pid+"Revisions", desc+" 修订记录", true, openApiJsonResp("修订记录", iris.Map{
+				"type": "object",
+				"properties": iris.Map{
+					"count":     iris.Map{"type": "integer"},
+					"page":      iris.Map{"type": "integer"},
+					"page_size": iris.Map{"type": "integer"},
+					"data":      iris.Map{"type": "array", "items": builder.raw("OperationLog", new(OperationLog))},
+				},
+			}))
+			revisions["parameters"] = []iris.Map{
+				openApiParam("query", "page", "页码", iris.Map{"type": "integer", "minimum": 1}, false),
+				openApiParam("query", "page_size", "每页数量 默认20", iris.Map{"type": "integer", "minimum": 1}, false),
+			}
+			paths["/"+pid+"/{uid}/revisions"] = iris.Map{
+				"get":        revisions,
+				"parameters": []iris.Map{uidParam},
+			}
+			paths["/"+pid+"/{uid}/revisions/{rev}/revert"] = iris.Map{
+				"post": openApiOp(tag, pid+"Revert", desc+" 回滚到该修订之前", true, openApiJsonResp("回滚后的变更", objSchema)),
+				"parameters": []iris.Map{
+					uidParam,
+					openApiParam("path", "rev", "修订记录uid", iris.Map{"type": "string"}, true),
+				},
+			}
+		}
+
+		batch := iris.Map{}
+		batchOp := func(id, summary string) iris.Map {
+			op := openApiOp(tag, pid+id, desc+" "+summary, true, openApiJsonResp("每行的执行结果", builder.raw("BatchResp", new(BatchResp))))
+			op["requestBody"] = openApiJsonBody(builder.raw("BatchReq", new(BatchReq)))
+			return op
+		}
+		if allow.Post {
+			batch["post"] = batchOp("BatchCreate", "批量新增 传入rows")
+		}
+		if allow.Put {
+			batch["put"] = batchOp("BatchUpdate", "批量修改 rows中每行需包含uid 或传入filter与data")
+		}
+		if allow.Delete {
+			batch["delete"] = batchOp("BatchDelete", "批量删除 传入uids或filter")
+		}
+		if len(batch) > 0 {
+			paths["/"+pid+"/batch"] = batch
+		}
+
+		if model.IsSoftDelete() && allow.Delete {
+			trashList := openApiOp(tag, pid+"TrashList", desc+" 回收站列表", true,
+				openApiJsonResp("已软删除的数据", openApiRef(pid+".list")))
+			trashList["parameters"] = openApiListParams(table)
+			paths["/"+pid+"/trash"] = iris.Map{"get": trashList}
+			paths["/"+pid+"/trash/{uid}/restore"] = iris.Map{
+				"post":       openApiOp(tag, pid+"Restore", desc+" 恢复", true, openApiJsonResp("恢复成功", objSchema)),
+				"parameters": []iris.Map{uidParam},
+			}
+			paths["/"+pid+"/trash/{uid}"] = iris.Map{
+				"delete":     openApiOp(tag, pid+"Purge", desc+" 彻底删除", true, openApiJsonResp("删除成功", objSchema)),
+				"parameters": []iris.Map{uidParam},
+			}
+		}
+
+		if actions := model.GetAllAction(); len(actions) > 0 {
+			names := make([]string, 0, len(actions))
+			forms := make([]iris.Map, 0, len(actions))
+			for i, action := range actions {
+				ab := action.GetBase()
+				names = append(names, ab.Name)
+				if ab.Form != nil {
+					forms = append(forms, builder.schemaRef(fmt.Sprintf("%s.action%d", pid, i), ab.Form))
+				}
+			}
+			formData := objSchema
+			if len(forms) > 0 {
+				formData = iris.Map{"oneOf": forms}
+			}
+			op := openApiOp(tag, pid+"Action", desc+" 执行操作", true, openApiJsonResp("操作结果", objSchema))
+			op["requestBody"] = openApiJsonBody(iris.Map{
+				"type":     "object",
+				"required": []string{"name"},
+				"properties": iris.Map{
+					"name":      iris.Map{"type": "string", "enum": names},
+					"rows":      iris.Map{"type": "array", "items": iris.Map{"type": "string"}},
+					"form_data": formData,
+				},
+			})
+			paths["/action/"+pid] = iris.Map{"post": op}
+		}
+
+		if fields := model.GetDynamicFields(); len(fields) > 0 {
+			ids := make([]string, 0, len(fields))
+			for _, f := range fields {
+				ids = append(ids, f.Id)
+			}
+			op := openApiOp(tag, pid+"Dynamic", desc+" 动态字段", true, openApiJsonResp("动态字段结果", builder.raw("DynamicResult", new(DynamicResult))))
+			op["requestBody"] = openApiJsonBody(iris.Map{
+				"type":     "object",
+				"required": []string{"row_uid", "id"},
+				"properties": iris.Map{
+					"row_uid": iris.Map{"type": "string"},
+					"id":      iris.Map{"type": "string", "enum": ids},
+				},
+			})
+			paths["/dynamic/"+pid] = iris.Map{"post": op}
+		}
+	}
+
+	return iris.Map{
+		"openapi": "3.1.0",
+		"info":    b.ApiInfo,
+		"servers": []iris.Map{{"url": serverUrl}},
+		"tags":    tags,
+		"paths":   paths,
+		"components": iris.Map{
+			"schemas": builder.components,
+			"responses": iris.Map{
+				"Error": openApiJsonResp("请求错误", openApiRef("Error")),
+			},
+			"securitySchemes": iris.Map{
+				"bearerAuth": iris.Map{
+					"type":         "http",
+					"scheme":       "bearer",
+					"bearerFormat": "JWT",
+				},
+			},
+		},
+	}
+}
+
+type openApiTokenResp struct {
+	Token        string           `json:"token"`
+	RefreshToken string           `json:"refresh_token,omitempty"`
+	ExpiresIn    int64            `json:"expires_in,omitempty"`
+	Info         *SimpleUserModel `json:"info"`
+	// 需要两步验证时不返回token 使用challenge调用/login_2fa
+	Need2fa   bool   `json:"need_2fa,omitempty"`
+	Challenge string `json:"challenge,omitempty"`
+	Enroll    bool   `json:"enroll,omitempty"`
+	// 登录时绑定两步验证成功后返回 仅展示一次
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+// OpenApiHandler 仅输出当前用户有权限的模型
+func (b *Backend) OpenApiHandler(serverUrl string) iris.Handler {
+	return func(ctx iris.Context) {
+		user := ctx.Values().Get(UserContextKey).(*SimpleUserModel)
+		var models = make([]IModelItem, 0, len(b.models))
+		for _, model := range b.models {
+			if b.canRole(user, model) {
+				models = append(models, model)
+			}
+		}
+		ctx.JSON(b.openApi(serverUrl, models))
+	}
+}
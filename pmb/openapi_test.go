@@ -0,0 +1,87 @@
+package pmb
+
+import (
+	"encoding/json"
+	"github.com/gookit/goutil/testutil/assert"
+	"github.com/kataras/iris/v12"
+	"strings"
+	"testing"
+)
+
+func TestBackendOpenApi(t *testing.T) {
+	bk := NewBackend()
+	m := bk.AddModelAny(new(testModelStruct))
+	m.AddDF("df", "动态", nil)
+	m.GetAllowMethods().ChangeDelete(false)
+	pid := m.GetBase().PathId
+
+	doc := bk.OpenApi("/manager/apis")
+	bin, err := json.Marshal(doc)
+	assert.NoErr(t, err)
+	// $defs 必须都被提升到components
+	assert.False(t, strings.Contains(string(bin), "#/$defs/"))
+
+	var result map[string]any
+	assert.NoErr(t, json.Unmarshal(bin, &result))
+	assert.Eq(t, "3.1.0", result["openapi"])
+
+	paths := result["paths"].(map[string]any)
+	for _, p := range []string{"/login", "/reg", "/self", "/config/" + pid, "/" + pid + "/", "/" + pid + "/{uid}", "/dynamic/" + pid} {
+		_, ok := paths[p]
+		assert.True(t, ok, p)
+	}
+	_, ok := paths["/action/"+pid]
+	assert.False(t, ok)
+
+	single := paths["/"+pid+"/{uid}"].(map[string]any)
+	_, ok = single["delete"]
+	assert.False(t, ok)
+	_, ok = single["put"]
+	assert.True(t, ok)
+
+	list := paths["/"+pid+"/"].(map[string]any)["get"].(map[string]any)
+	names := make(map[string]bool)
+	for _, p := range list["parameters"].([]any) {
+		names[p.(map[string]any)["name"].(string)] = true
+	}
+	for _, n := range []string{"page", "page_size", "_s", "_o", "_od", "_g", "age", "age_gte", "name_regex", "name_in"} {
+		assert.True(t, names[n], n)
+	}
+	assert.False(t, names["name_gt"])
+}
+
+func TestBackendOpenApiTrash(t *testing.T) {
+	bk := NewBackend()
+	m := NewSchemaModel(new(testModelStruct), nil)
+	m.SoftDelete = true
+	bk.AddModel(m)
+	pid := m.PathId
+
+	paths := bk.OpenApi("/manager/apis")["paths"].(map[string]any)
+	for _, p := range []string{"/" + pid + "/trash", "/" + pid + "/trash/{uid}/restore", "/" + pid + "/trash/{uid}"} {
+		_, ok := paths[p]
+		assert.True(t, ok, p)
+	}
+
+	m.SoftDelete = false
+	paths = bk.OpenApi("/manager/apis")["paths"].(map[string]any)
+	_, ok := paths["/"+pid+"/trash"]
+	assert.False(t, ok)
+}
+
+func TestBackendOpenApiBatch(t *testing.T) {
+	bk := NewBackend()
+	m := bk.AddModelAny(new(testModelStruct))
+	m.GetAllowMethods().ChangeDelete(false)
+	pid := m.GetBase().PathId
+
+	paths := bk.OpenApi("/manager/apis")["paths"].(map[string]any)
+	batch, ok := paths["/"+pid+"/batch"].(iris.Map)
+	assert.True(t, ok)
+	_, ok = batch["post"]
+	assert.True(t, ok)
+	_, ok = batch["put"]
+	assert.True(t, ok)
+	_, ok = batch["delete"]
+	assert.False(t, ok)
+}
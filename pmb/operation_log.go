@@ -8,6 +8,11 @@ import (
 	"github.com/kataras/iris/v12"
 	"github.com/kataras/realip"
 	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 )
 
 // 记录任何的操作日志
@@ -16,6 +21,9 @@ import (
 
 var (
 	RecordOperationLog = true
+	// OpLogSecretKeys 操作日志不记录的敏感字段 字段名包含其中任意一项即不记录 不区分大小写
+	// 模型字段也可以通过 `secret:"true"` 标记为敏感字段
+	OpLogSecretKeys = []string{"password", "salt", "secret", "totp", "recovery_code"}
 )
 
 func ChangeRecordOperationLog(b bool) {
@@ -32,9 +40,141 @@ type OperationLog struct {
 	ToRowId  string   `json:"to_row_id,omitempty" bson:"to_row_id,omitempty" comment:"行ID"`
 	ToFields []ut.Kov `json:"to_fields,omitempty" bson:"to_fields,omitempty" comment:"字段内容"`
 	Msg      string   `json:"msg,omitempty" bson:"msg,omitempty" comment:"消息"`
+	Before   []ut.Kov `json:"before,omitempty" bson:"before,omitempty" comment:"变更前"`
+	After    []ut.Kov `json:"after,omitempty" bson:"after,omitempty" comment:"变更后"`
+}
+
+// BeforeMap 变更前的快照
+func (c *OperationLog) BeforeMap() map[string]any {
+	return kovToMap(c.Before)
+}
+
+// AfterMap 变更后的快照
+func (c *OperationLog) AfterMap() map[string]any {
+	return kovToMap(c.After)
+}
+
+// snapshotKov 快照转换为有序的kov 更新时间与敏感字段不记录
+func snapshotKov(mp map[string]any, secrets map[string]struct{}) []ut.Kov {
+	if len(mp) < 1 {
+		return nil
+	}
+	keys := make([]string, 0, len(mp))
+	for k := range mp {
+		if k == "update_at" || opLogSecret(k, secrets) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := make([]ut.Kov, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, ut.Kov{Key: k, Value: opLogMask(mp[k], secrets)})
+	}
+	return result
+}
+
+// opLogSecret 是否为敏感字段 secrets为模型中标记的字段
+func opLogSecret(key string, secrets map[string]struct{}) bool {
+	if _, ok := secrets[key]; ok {
+		return true
+	}
+	key = strings.ToLower(key)
+	for _, k := range OpLogSecretKeys {
+		if strings.Contains(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// opLogMask 去除嵌套文档中的敏感字段 返回副本 不修改原内容
+func opLogMask(v any, secrets map[string]struct{}) any {
+	switch val := v.(type) {
+	case map[string]any:
+		result := make(map[string]any, len(val))
+		for k, item := range val {
+			if !opLogSecret(k, secrets) {
+				result[k] = opLogMask(item, secrets)
+			}
+		}
+		return result
+	case bson.M:
+		return bson.M(opLogMask(map[string]any(val), secrets).(map[string]any))
+	case bson.D:
+		result := make(bson.D, 0, len(val))
+		for _, item := range val {
+			if !opLogSecret(item.Key, secrets) {
+				result = append(result, bson.E{Key: item.Key, Value: opLogMask(item.Value, secrets)})
+			}
+		}
+		return result
+	case []any:
+		result := make([]any, len(val))
+		for i, item := range val {
+			result[i] = opLogMask(item, secrets)
+		}
+		return result
+	case bson.A:
+		return bson.A(opLogMask([]any(val), secrets).([]any))
+	}
+	return v
+}
+
+var opLogSecretCache sync.Map
+
+// opLogSecretTags 模型中通过 `secret:"true"` 标记的字段 使用bson名称
+func opLogSecretTags(t reflect.Type) map[string]struct{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	if v, ok := opLogSecretCache.Load(t); ok {
+		return v.(map[string]struct{})
+	}
+	result := make(map[string]struct{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, opts, _ := strings.Cut(field.Tag.Get("bson"), ",")
+		if field.Anonymous && strings.Contains(opts, "inline") {
+			for k := range opLogSecretTags(field.Type) {
+				result[k] = struct{}{}
+			}
+			continue
+		}
+		if field.Tag.Get("secret") != "true" || name == "-" {
+			continue
+		}
+		if len(name) < 1 {
+			name = strings.ToLower(field.Name)
+		}
+		result[name] = struct{}{}
+	}
+	opLogSecretCache.Store(t, result)
+	return result
+}
+
+func kovToMap(kovs []ut.Kov) map[string]any {
+	mp := make(map[string]any, len(kovs))
+	for _, kov := range kovs {
+		mp[kov.Key] = kov.Value
+	}
+	return mp
 }
 
 func MustOpLog(ctx iris.Context, db *qmgo.Collection, method string, user *SimpleUserModel, sheet string, msg string, rowId string, toFields []ut.Kov) {
+	MustOpLogDiff(ctx, db, method, user, sheet, msg, rowId, toFields, nil, nil)
+}
+
+// MustOpLogDiff 记录带有变更前后快照的操作日志 用于修订记录和回滚
+// 敏感字段不会被记录 见 OpLogSecretKeys
+func MustOpLogDiff(ctx iris.Context, db *qmgo.Collection, method string, user *SimpleUserModel, sheet string, msg string, rowId string, toFields []ut.Kov, before, after map[string]any) {
+	opLogDiff(ctx, db, method, user, sheet, msg, rowId, toFields, before, after, nil)
+}
+
+func opLogDiff(ctx iris.Context, db *qmgo.Collection, method string, user *SimpleUserModel, sheet string, msg string, rowId string, toFields []ut.Kov, before, after map[string]any, secrets map[string]struct{}) {
 	if !RecordOperationLog {
 		return
 	}
@@ -49,9 +189,13 @@ func MustOpLog(ctx iris.Context, db *qmgo.Collection, method string, user *Simpl
 		user.Uid = ""
 	}
 
-	if toFields == nil {
-		toFields = make([]ut.Kov, 0)
+	fields := make([]ut.Kov, 0, len(toFields)+2)
+	for _, kov := range toFields {
+		if !opLogSecret(kov.Key, secrets) {
+			fields = append(fields, ut.Kov{Key: kov.Key, Op: kov.Op, Value: opLogMask(kov.Value, secrets)})
+		}
 	}
+	toFields = fields
 	// 加入操作者设备信息
 	toFields = append(toFields, ut.Kov{
 		Key:   "ua",
@@ -66,6 +210,8 @@ func MustOpLog(ctx iris.Context, db *qmgo.Collection, method string, user *Simpl
 	inst.ToRowId = rowId
 	inst.ToFields = toFields
 	inst.Msg = msg
+	inst.Before = snapshotKov(before, secrets)
+	inst.After = snapshotKov(after, secrets)
 	_ = inst.BeforeInsert(context.TODO())
 
 	_, err := db.InsertOne(context.TODO(), inst)
@@ -74,6 +220,27 @@ func MustOpLog(ctx iris.Context, db *qmgo.Collection, method string, user *Simpl
 	}
 }
 
+// opLogEntry 待写入的操作日志 批量操作在事务提交后统一写入
+type opLogEntry struct {
+	method string
+	msg    string
+	rowId  string
+	fields []ut.Kov
+	before map[string]any
+	after  map[string]any
+}
+
+func (s *SchemaModel[T]) writeOpLog(ctx iris.Context, logs ...*opLogEntry) {
+	user := s.GetContextUser(ctx)
+	secrets := opLogSecretTags(reflect.TypeOf(new(T)))
+	for _, log := range logs {
+		if log == nil {
+			continue
+		}
+		opLogDiff(ctx, s.opLogColl(), log.method, user, s.GetTableName(), log.msg, log.rowId, log.fields, log.before, log.after, secrets)
+	}
+}
+
 func OpLogSyncIndex(ctx context.Context, coll *qmgo.Collection) error {
 	cl, err := coll.CloneCollection()
 	if err != nil {
@@ -0,0 +1,82 @@
+package pmb
+
+import (
+	"github.com/23233/ggg/pipe"
+	"github.com/23233/ggg/ut"
+	"github.com/gookit/goutil/testutil/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOpLogSnapshot(t *testing.T) {
+	kovs := snapshotKov(map[string]any{
+		"name":      "b",
+		"age":       1,
+		"update_at": time.Now(),
+	}, nil)
+	// 按key排序 且不记录更新时间
+	assert.Len(t, kovs, 2)
+	assert.Eq(t, "age", kovs[0].Key)
+	assert.Eq(t, "name", kovs[1].Key)
+
+	log := &OperationLog{Before: kovs}
+	before := log.BeforeMap()
+	assert.Eq(t, "b", before["name"])
+	assert.Eq(t, 1, before["age"])
+	assert.Len(t, log.AfterMap(), 0)
+
+	assert.Nil(t, snapshotKov(nil, nil))
+}
+
+func TestOpLogSecret(t *testing.T) {
+	type account struct {
+		pipe.ModelBase `bson:",inline"`
+		Name           string `bson:"name"`
+		ApiKey         string `bson:"api_key" secret:"true"`
+	}
+	secrets := opLogSecretTags(reflect.TypeOf(new(account)))
+	assert.Len(t, secrets, 1)
+
+	row := map[string]any{
+		"name":     "a",
+		"password": "hash",
+		"salt":     "s",
+		"api_key":  "k",
+		"totp":     map[string]any{"secret": "x", "recovery_codes": []any{"c"}},
+		"profile":  bson.M{"nick": "n", "Password": "p"},
+		"devices":  bson.A{bson.D{{Key: "id", Value: "d1"}, {Key: "token_secret", Value: "t"}}},
+	}
+	kovs := snapshotKov(row, secrets)
+	assert.Len(t, kovs, 3)
+	mp := kovToMap(kovs)
+	assert.Eq(t, "a", mp["name"])
+	assert.Eq(t, bson.M{"nick": "n"}, mp["profile"])
+	assert.Eq(t, bson.A{bson.D{{Key: "id", Value: "d1"}}}, mp["devices"])
+	// 不修改原内容
+	assert.Len(t, row, 7)
+	assert.Eq(t, "p", row["profile"].(bson.M)["Password"])
+}
+
+func TestSnapshotMatch(t *testing.T) {
+	row := map[string]any{"uid": "r1", "user_id": "u1", "age": int32(3)}
+	query := &ut.QueryFull{QueryParse: &ut.QueryParse{And: []*ut.Kov{
+		{Key: "uid", Value: "r1"},
+		{Key: "user_id", Value: "u1"},
+	}}}
+	assert.True(t, snapshotMatch(row, query))
+
+	// 其他用户的快照
+	query.And[1].Value = "u2"
+	assert.False(t, snapshotMatch(row, query))
+
+	// 数字类型不同时按文本比较
+	query.And = []*ut.Kov{{Key: "age", Op: "eq", Value: int64(3)}}
+	assert.True(t, snapshotMatch(row, query))
+
+	// 不支持的条件视为不满足
+	query.And = []*ut.Kov{{Key: "age", Op: "gt", Value: 1}}
+	assert.False(t, snapshotMatch(row, query))
+	assert.False(t, snapshotMatch(nil, &ut.QueryFull{QueryParse: new(ut.QueryParse)}))
+}
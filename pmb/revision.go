@@ -0,0 +1,265 @@
+package pmb
+
+import (
+	"fmt"
+	"github.com/23233/ggg/pipe"
+	"github.com/23233/ggg/ut"
+	"github.com/kataras/iris/v12"
+	"github.com/pkg/errors"
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"strings"
+)
+
+// 修订记录基于操作日志中的变更前后快照
+// 修改可回滚为修改前的值 软删除可回滚为恢复 删除和彻底删除可回滚为重新插入
+// 查看和回滚都需要当前用户能访问该行 与正常的获取和修改一样经过注入过滤和hooks
+
+var ErrRevisionForbidden = errors.New("无权访问该行的修订记录")
+
+func (s *SchemaModel[T]) opLogColl() *qmgo.Collection {
+	return s.db.Collection("operation_log")
+}
+
+// revisionRowQuery 该行的查询条件 与获取单行一样注入上下文过滤并经过OnGetBefore
+func (s *SchemaModel[T]) revisionRowQuery(ctx iris.Context, rowId string) (*ut.QueryFull, error) {
+	injectQuery, err := s.ParseInject(ctx)
+	if err != nil {
+		return nil, err
+	}
+	and := []*ut.Kov{{Key: ut.DefaultUidTag, Value: rowId}}
+	and = append(and, injectQuery...)
+	and = append(and, s.queryFilterInject...)
+	resp := pipe.NewPipeResult(&ut.QueryFull{QueryParse: &ut.QueryParse{And: and}})
+	if s.Hooks.OnGetBefore != nil {
+		err = s.Hooks.OnGetBefore(ctx, resp, &pipe.ModelGetData{Single: true, SoftDelete: s.SoftDelete}, s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp.Result, nil
+}
+
+// revisionCheckRow 检查当前用户能否访问该行 已被删除的行以最后一次删除前的快照判断
+func (s *SchemaModel[T]) revisionCheckRow(ctx iris.Context, rowId string) error {
+	query, err := s.revisionRowQuery(ctx, rowId)
+	if err != nil {
+		return err
+	}
+	var row = make(map[string]any)
+	err = s.GetCollection().Aggregate(ctx, ut.QueryToMongoPipeline(query)).One(&row)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, qmgo.ErrNoSuchDocuments) {
+		return err
+	}
+	count, err := s.GetCollection().Find(ctx, bson.M{ut.DefaultUidTag: rowId}).Count()
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrRevisionForbidden
+	}
+
+	var rev = new(OperationLog)
+	err = s.opLogColl().Find(ctx, bson.M{
+		"to_sheet":  s.GetTableName(),
+		"to_row_id": rowId,
+		"method":    bson.M{"$in": bson.A{"del", "purge"}},
+	}).Sort("-create_at").One(rev)
+	if err != nil {
+		if errors.Is(err, qmgo.ErrNoSuchDocuments) {
+			return ErrRevisionForbidden
+		}
+		return err
+	}
+	if !snapshotMatch(rev.BeforeMap(), query) {
+		return ErrRevisionForbidden
+	}
+	return nil
+}
+
+// snapshotMatch 快照是否满足查询条件 仅支持相等判断 其他条件视为不满足
+func snapshotMatch(row map[string]any, query *ut.QueryFull) bool {
+	if len(row) < 1 {
+		return false
+	}
+	match := func(kov *ut.Kov) bool {
+		if kov.Op != "" && kov.Op != "eq" {
+			return false
+		}
+		v, ok := row[kov.Key]
+		return ok && fmt.Sprint(exportNormalize(v)) == fmt.Sprint(exportNormalize(kov.Value))
+	}
+	for _, kov := range query.And {
+		if !match(kov) {
+			return false
+		}
+	}
+	if len(query.Or) < 1 {
+		return true
+	}
+	for _, kov := range query.Or {
+		if match(kov) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRevisions 获取某一行的修订记录 按时间倒序
+func (s *SchemaModel[T]) GetRevisions(ctx iris.Context, rowId string, page, pageSize int64) (*SchemaGetResp, error) {
+	if err := s.revisionCheckRow(ctx, rowId); err != nil {
+		return nil, err
+	}
+	if page < 1 {
+		page = 1
+	}
+	if pageSize <= 0 || pageSize > 100 {
+		pageSize = 20
+	}
+	filter := bson.M{"to_sheet": s.GetTableName(), "to_row_id": rowId}
+	count, err := s.opLogColl().Find(ctx, filter).Count()
+	if err != nil {
+		return nil, err
+	}
+	var logs = make([]*OperationLog, 0)
+	err = s.opLogColl().Find(ctx, filter).Sort("-create_at").Skip((page - 1) * pageSize).Limit(pageSize).All(&logs)
+	if err != nil {
+		return nil, err
+	}
+	return &SchemaGetResp{
+		MongoFacetResult: &ut.MongoFacetResult{
+			Count: count,
+			Data:  logs,
+		},
+		Page:     page,
+		PageSize: pageSize,
+	}, nil
+}
+
+// RevertHandler 回滚到某条修订之前的状态 会经过正常的hooks
+func (s *SchemaModel[T]) RevertHandler(ctx iris.Context, rowId string, revId string) error {
+	var rev = new(OperationLog)
+	err := s.opLogColl().Find(ctx, bson.M{
+		ut.DefaultUidTag: revId,
+		"to_sheet":       s.GetTableName(),
+		"to_row_id":      rowId,
+	}).One(rev)
+	if err != nil {
+		return errors.Wrap(err, "获取修订记录失败")
+	}
+	msg := "回滚修订 " + revId
+
+	switch rev.Method {
+	case "put", "revert":
+		before := rev.BeforeMap()
+		if len(before) < 1 {
+			return errors.New("该修订没有可回滚的内容")
+		}
+		params := s.PutHandlerConfig
+		params.DropKeys = append([]string{}, s.PutHandlerConfig.DropKeys...)
+		params.RowId = rowId
+		params.UpdateTime = true
+		params.BodyMap = before
+		params.QueryFilter = nil
+		if err = s.putParamsPrepare(ctx, &params); err != nil {
+			return err
+		}
+		result, log, err := s.putRow(ctx, params, nil, "revert", msg)
+		if err != nil {
+			return err
+		}
+		ctx.JSON(result)
+		s.writeOpLog(ctx, log)
+		return nil
+	case "del":
+		if _, ok := rev.AfterMap()[pipe.SoftDeleteKey]; ok {
+			return s.RestoreHandler(ctx, pipe.ModelDelConfig{RowId: rowId})
+		}
+		return s.reinsertRow(ctx, rowId, rev.BeforeMap(), msg)
+	case "purge":
+		return s.reinsertRow(ctx, rowId, rev.BeforeMap(), msg)
+	}
+	return errors.New("该操作不支持回滚")
+}
+
+// reinsertRow 把删除前的快照重新插入 快照需要满足当前用户的注入过滤 与新增一样经过hooks
+func (s *SchemaModel[T]) reinsertRow(ctx iris.Context, rowId string, row map[string]any, msg string) error {
+	if len(row) < 1 {
+		return errors.New("该修订没有可回滚的内容")
+	}
+	count, err := s.GetCollection().Find(ctx, bson.M{ut.DefaultUidTag: rowId}).Count()
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errors.New("该行仍然存在 无法重新插入")
+	}
+	query, err := s.revisionRowQuery(ctx, rowId)
+	if err != nil {
+		return err
+	}
+	if !snapshotMatch(row, query) {
+		return ErrRevisionForbidden
+	}
+	delete(row, pipe.SoftDeleteKey)
+
+	if s.PostMustKeys != nil {
+		if err = checkKeys(s.PostMustKeys, row); err != nil {
+			return err
+		}
+	}
+
+	if s.Hooks.OnAddBefore != nil {
+		err = s.Hooks.OnAddBefore(ctx, pipe.NewPipeResult[any](row), s)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = s.GetCollection().InsertOne(ctx, row)
+	if err != nil {
+		return err
+	}
+
+	if s.Hooks.OnAddAfter != nil {
+		err = s.Hooks.OnAddAfter(ctx, pipe.NewPipeResult(row), s)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx.JSON(row)
+
+	s.writeOpLog(ctx, &opLogEntry{method: "revert", msg: msg, rowId: rowId, after: row})
+	return nil
+}
+
+// RevisionHandler 修订记录 get为列表 post为回滚
+func (s *SchemaModel[T]) RevisionHandler(ctx iris.Context) {
+	method := strings.ToLower(ctx.Method())
+	uid, err := s.getUid(ctx)
+	if err != nil {
+		IrisRespErr("", err, ctx)
+		return
+	}
+	switch method {
+	case "get":
+		var result *SchemaGetResp
+		result, err = s.GetRevisions(ctx, uid, ctx.URLParamInt64Default("page", 1), ctx.URLParamInt64Default("page_size", 20))
+		if err == nil {
+			ctx.JSON(result)
+		}
+	case "post":
+		err = s.RevertHandler(ctx, uid, ctx.Params().Get("rev"))
+	default:
+		err = errors.New("未被支持的方法")
+	}
+
+	if err != nil {
+		IrisRespErr("", err, ctx)
+		return
+	}
+}
@@ -0,0 +1,248 @@
+package pmb
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/rueidis"
+)
+
+// 基于 RFC 6238 的TOTP 使用HMAC-SHA1 30秒步长 6位数字 与常见的验证器app兼容
+
+const (
+	TotpPeriod        = 30
+	TotpDigits        = 6
+	TotpRecoveryCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// UserTotp 用户的两步验证配置 不会通过json输出
+type UserTotp struct {
+	Secret        string    `json:"-" bson:"secret,omitempty"`
+	Pending       string    `json:"-" bson:"pending,omitempty"` // 绑定中 验证通过后才会成为Secret
+	Enabled       bool      `json:"-" bson:"enabled,omitempty"`
+	EnabledAt     time.Time `json:"-" bson:"enabled_at,omitempty"`
+	LastStep      int64     `json:"-" bson:"last_step,omitempty"`      // 最后一次使用的步数 防止同一个验证码重复使用
+	RecoveryCodes []string  `json:"-" bson:"recovery_codes,omitempty"` // 恢复码的sha256
+}
+
+// TotpGenerateSecret 生成160位的随机秘钥 base32编码
+func TotpGenerateSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// TotpUri 生成验证器app扫码使用的otpauth地址 二维码内容即为该地址
+func TotpUri(issuer, account, secret string) string {
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(TotpDigits))
+	q.Set("period", fmt.Sprint(TotpPeriod))
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// TotpCode 计算某一步的验证码
+func TotpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < TotpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TotpDigits, value%mod), nil
+}
+
+// TotpVerify 验证验证码 允许前后skew步的时间误差 返回匹配的步数
+func TotpVerify(secret, code string, t time.Time, skew int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != TotpDigits {
+		return 0, false
+	}
+	now := t.Unix() / TotpPeriod
+	for i := -skew; i <= skew; i++ {
+		want, err := TotpCode(secret, now+i)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(want), []byte(code)) {
+			return now + i, true
+		}
+	}
+	return 0, false
+}
+
+// totpRecoveryCodes 生成恢复码 返回明文与存储的哈希
+func totpRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, TotpRecoveryCount)
+	hashes := make([]string, 0, TotpRecoveryCount)
+	for i := 0; i < TotpRecoveryCount; i++ {
+		b := make([]byte, 6)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		s := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		code := s[:5] + "-" + s[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, totpRecoveryHash(code))
+	}
+	return codes, hashes, nil
+}
+
+func totpRecoveryHash(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// loginChallenge 密码验证通过后等待两步验证的登录 存储在服务端 id返回给客户端
+type loginChallenge struct {
+	Uid    string `json:"uid"`
+	Event  string `json:"event"`
+	Force  bool   `json:"force"`
+	Strict bool   `json:"strict"`
+	Enroll bool   `json:"enroll"`           // 强制开启但尚未绑定 需要先绑定
+	Secret string `json:"secret,omitempty"` // 绑定时生成的秘钥
+}
+
+var (
+	// LoginChallengeExpire 两步验证的有效期
+	LoginChallengeExpire = 5 * time.Minute
+	// LoginChallengeMaxAttempts 两步验证允许的错误次数
+	LoginChallengeMaxAttempts = 5
+
+	ErrChallengeNotFound = errors.New("两步验证已过期 请重新登录")
+	ErrTotpMismatch      = errors.New("两步验证码错误")
+)
+
+type memoryChallenge struct {
+	data     []byte
+	expire   time.Time
+	attempts *atomic.Int64
+}
+
+// 未配置redis时使用 仅单实例可用
+var loginChallenges sync.Map
+
+func (c *SimpleUserModel) challengeKey(id string) string {
+	return "pmb:login_2fa:" + id
+}
+func (c *SimpleUserModel) challengeAttemptsKey(id string) string {
+	return "pmb:login_2fa_attempts:" + id
+}
+
+// challengeAttempt 原子的增加尝试次数并返回增加后的次数
+// 在验证之前调用 并发的请求也不会超过 LoginChallengeMaxAttempts
+func (c *SimpleUserModel) challengeAttempt(ctx context.Context, id string, ttl time.Duration) (int64, error) {
+	if c.rdb != nil {
+		key := c.challengeAttemptsKey(id)
+		resps := c.rdb.DoMulti(ctx,
+			c.rdb.B().Incr().Key(key).Build(),
+			c.rdb.B().Pexpire().Key(key).Milliseconds(ttl.Milliseconds()).Build(),
+		)
+		return resps[0].AsInt64()
+	}
+	v, ok := loginChallenges.Load(id)
+	if !ok {
+		return 0, ErrChallengeNotFound
+	}
+	return v.(*memoryChallenge).attempts.Add(1), nil
+}
+
+func (c *SimpleUserModel) challengeSave(ctx context.Context, id string, ch *loginChallenge, ttl time.Duration) error {
+	bin, err := json.Marshal(ch)
+	if err != nil {
+		return err
+	}
+	if c.rdb != nil {
+		return c.rdb.Do(ctx, c.rdb.B().Set().Key(c.challengeKey(id)).Value(string(bin)).Px(ttl).Build()).Error()
+	}
+	now := time.Now()
+	loginChallenges.Range(func(key, value any) bool {
+		if value.(*memoryChallenge).expire.Before(now) {
+			loginChallenges.Delete(key)
+		}
+		return true
+	})
+	// 更新时保留已尝试的次数
+	attempts := new(atomic.Int64)
+	if v, ok := loginChallenges.Load(id); ok {
+		attempts = v.(*memoryChallenge).attempts
+	}
+	loginChallenges.Store(id, &memoryChallenge{data: bin, expire: now.Add(ttl), attempts: attempts})
+	return nil
+}
+
+func (c *SimpleUserModel) challengeGet(ctx context.Context, id string) (*loginChallenge, time.Duration, error) {
+	var bin []byte
+	var ttl time.Duration
+	if c.rdb != nil {
+		resps := c.rdb.DoMulti(ctx,
+			c.rdb.B().Get().Key(c.challengeKey(id)).Build(),
+			c.rdb.B().Pttl().Key(c.challengeKey(id)).Build(),
+		)
+		s, err := resps[0].ToString()
+		if err != nil {
+			if rueidis.IsRedisNil(err) {
+				return nil, 0, ErrChallengeNotFound
+			}
+			return nil, 0, err
+		}
+		ms, _ := resps[1].AsInt64()
+		bin, ttl = []byte(s), time.Duration(ms)*time.Millisecond
+	} else {
+		v, ok := loginChallenges.Load(id)
+		if !ok {
+			return nil, 0, ErrChallengeNotFound
+		}
+		item := v.(*memoryChallenge)
+		ttl = time.Until(item.expire)
+		if ttl <= 0 {
+			loginChallenges.Delete(id)
+			return nil, 0, ErrChallengeNotFound
+		}
+		bin = item.data
+	}
+	ch := new(loginChallenge)
+	if err := json.Unmarshal(bin, ch); err != nil {
+		return nil, 0, err
+	}
+	return ch, ttl, nil
+}
+
+func (c *SimpleUserModel) challengeDel(ctx context.Context, id string) {
+	if c.rdb != nil {
+		_ = c.rdb.Do(ctx, c.rdb.B().Del().Key(c.challengeKey(id), c.challengeAttemptsKey(id)).Build()).Error()
+		return
+	}
+	loginChallenges.Delete(id)
+}
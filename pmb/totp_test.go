@@ -0,0 +1,129 @@
+package pmb
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// RFC 6238 附录B的SHA1测试向量 秘钥为ascii的12345678901234567890 取后6位
+const totpTestSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTotpCode(t *testing.T) {
+	cases := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for ts, want := range cases {
+		code, err := TotpCode(totpTestSecret, ts/TotpPeriod)
+		if err != nil {
+			t.Fatalf("计算验证码失败: %v", err)
+		}
+		if code != want {
+			t.Errorf("时间%d 期望%s 实际%s", ts, want, code)
+		}
+	}
+}
+
+func TestTotpVerify(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	step := now.Unix() / TotpPeriod
+	prev, _ := TotpCode(totpTestSecret, step-1)
+	far, _ := TotpCode(totpTestSecret, step-3)
+
+	if got, ok := TotpVerify(totpTestSecret, "081804", now, 1); !ok || got != step {
+		t.Errorf("当前步验证失败 %d %v", got, ok)
+	}
+	if got, ok := TotpVerify(totpTestSecret, prev, now, 1); !ok || got != step-1 {
+		t.Errorf("允许误差内的验证码验证失败 %d %v", got, ok)
+	}
+	if _, ok := TotpVerify(totpTestSecret, far, now, 1); ok {
+		t.Error("超出误差的验证码不应通过")
+	}
+	if _, ok := TotpVerify(totpTestSecret, "08180", now, 1); ok {
+		t.Error("位数错误的验证码不应通过")
+	}
+
+	secret, err := TotpGenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := TotpUri("pmb", "admin", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/pmb:admin?") || !strings.Contains(uri, "secret="+secret) {
+		t.Errorf("otpauth地址错误 %s", uri)
+	}
+}
+
+func TestTotpRecoveryCodes(t *testing.T) {
+	codes, hashes, err := totpRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != TotpRecoveryCount || len(hashes) != TotpRecoveryCount {
+		t.Fatalf("恢复码数量错误 %d", len(codes))
+	}
+	// 输入时忽略大小写与分隔符
+	input := strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))
+	if totpRecoveryHash(input) != hashes[0] {
+		t.Error("恢复码哈希应忽略大小写与分隔符")
+	}
+}
+
+func TestLoginChallengeMemory(t *testing.T) {
+	c := NewUserModel()
+	ctx := context.TODO()
+	err := c.challengeSave(ctx, "test", &loginChallenge{Uid: "u1", Event: "用户名", Enroll: true}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, ttl, err := c.challengeGet(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.Uid != "u1" || !ch.Enroll || ttl <= 0 || ttl > time.Minute {
+		t.Errorf("读取challenge错误 %+v %s", ch, ttl)
+	}
+	c.challengeDel(ctx, "test")
+	if _, _, err = c.challengeGet(ctx, "test"); !errors.Is(err, ErrChallengeNotFound) {
+		t.Errorf("删除后应不存在 %v", err)
+	}
+
+	_ = c.challengeSave(ctx, "expire", &loginChallenge{Uid: "u2"}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, _, err = c.challengeGet(ctx, "expire"); !errors.Is(err, ErrChallengeNotFound) {
+		t.Errorf("过期后应不存在 %v", err)
+	}
+}
+
+func TestLoginChallengeAttempt(t *testing.T) {
+	c := NewUserModel()
+	ctx := context.TODO()
+	if _, err := c.challengeAttempt(ctx, "none", time.Minute); !errors.Is(err, ErrChallengeNotFound) {
+		t.Fatalf("不存在的challenge应返回错误 %v", err)
+	}
+	_ = c.challengeSave(ctx, "attempt", &loginChallenge{Uid: "u1"}, time.Minute)
+	defer c.challengeDel(ctx, "attempt")
+
+	// 并发时每次增加都是独立的
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = c.challengeAttempt(ctx, "attempt", time.Minute)
+		}()
+	}
+	wg.Wait()
+	// 更新challenge时保留次数
+	_ = c.challengeSave(ctx, "attempt", &loginChallenge{Uid: "u1", Secret: "s"}, time.Minute)
+	n, err := c.challengeAttempt(ctx, "attempt", time.Minute)
+	if err != nil || n != 11 {
+		t.Fatalf("尝试次数错误 %d %v", n, err)
+	}
+}
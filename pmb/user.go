@@ -37,8 +37,11 @@ type SimpleUserHooks struct {
 
 type SimpleUserModel struct {
 	pipe.GenericsAccount `bson:",inline"`
+	Totp                 *UserTotp `json:"-" bson:"totp,omitempty"`
 	hooks                *SimpleUserHooks
 	roleSecret           string
+	totpRoles            []string
+	totpIssuer           string
 	connectInfo
 }
 
@@ -52,6 +55,28 @@ func (c *SimpleUserModel) SetRoleSecret(roleSecret string) {
 	c.roleSecret = roleSecret
 }
 
+// SetTotpRequireRoles 拥有这些角色的用户必须开启两步验证 未绑定的会在登录时要求绑定
+func (c *SimpleUserModel) SetTotpRequireRoles(roles ...string) {
+	c.totpRoles = roles
+}
+
+// SetTotpIssuer 验证器app中显示的名称
+func (c *SimpleUserModel) SetTotpIssuer(issuer string) {
+	c.totpIssuer = issuer
+}
+
+func (c *SimpleUserModel) TotpIssuer() string {
+	if len(c.totpIssuer) > 0 {
+		return c.totpIssuer
+	}
+	return "pmb"
+}
+
+// TotpEnabled 是否已开启两步验证
+func (c *SimpleUserModel) TotpEnabled() bool {
+	return c.Totp != nil && c.Totp.Enabled && len(c.Totp.Secret) > 0
+}
+
 func (c *SimpleUserModel) SetHooks(hooks *SimpleUserHooks) {
 	c.hooks = hooks
 }
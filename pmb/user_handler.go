@@ -73,6 +73,7 @@ func (c *SimpleUserModel) SyncIndex(ctx context.Context) error {
 		ut.MGenNormal("platforms.name"),
 		ut.MGenNormal("platforms.pid"),
 		ut.MGenNormal("platforms.union_id"),
+		pipe.OauthIndexModel(),
 	)
 	return err
 }
@@ -161,12 +162,16 @@ func (c *SimpleUserModel) ChangePassword(useValid bool) iris.Handler {
 		}
 		user := ctx.Values().Get(UserContextKey).(*SimpleUserModel)
 		// 判断密码是否正确
-		if !validPassword(body.OldPassword, user.Salt, user.Password) {
+		if ok, _ := validPassword(body.OldPassword, user.Salt, user.Password); !ok {
 			IrisRespErr("密码错误", nil, ctx)
 			return
 		}
 		// 密码正确就进行密码的修改
-		saltPassword, salt := passwordSalt(body.Password)
+		saltPassword, salt, err := passwordSalt(body.Password)
+		if err != nil {
+			IrisRespErr("修改密码失败", err, ctx)
+			return
+		}
 		err = c.db.Collection(UserModelName).UpdateId(ctx, user.Id, bson.M{
 			"$set": bson.M{
 				"password": saltPassword,
@@ -272,13 +277,41 @@ func (c *SimpleUserModel) RoleSetHandler() iris.Handler {
 		return
 	}
 }
+
+// rehashPassword 使用默认算法重新加密密码并保存
+func (c *SimpleUserModel) rehashPassword(ctx iris.Context, user *SimpleUserModel, password string) {
+	encoded, salt, err := passwordSalt(password)
+	if err != nil {
+		logger.JM.ErrorE(err, "[%s]迁移密码算法失败", user.Uid)
+		return
+	}
+	update := bson.M{"$set": bson.M{"password": encoded}}
+	if len(salt) > 0 {
+		update["$set"].(bson.M)["salt"] = salt
+	} else {
+		update["$unset"] = bson.M{"salt": ""}
+	}
+	err = c.db.Collection(UserModelName).UpdateId(ctx, user.Id, update)
+	if err != nil {
+		logger.JM.ErrorE(err, "[%s]迁移密码算法失败", user.Uid)
+		return
+	}
+	user.Password = encoded
+	user.Salt = salt
+}
+
 func (c *SimpleUserModel) passwordLogin(ctx iris.Context, event string, user *SimpleUserModel, password string, force bool, strict bool) {
 
 	// 验证密码是否正确
-	if !validPassword(password, user.Salt, user.Password) {
+	ok, needRehash := validPassword(password, user.Salt, user.Password)
+	if !ok {
 		IrisRespErr(event+"或密码错误", nil, ctx)
 		return
 	}
+	// 旧算法的密码在登录成功后迁移 失败不影响登录
+	if needRehash {
+		c.rehashPassword(ctx, user, password)
+	}
 
 	// 正确的情况下 判断是否可以登录
 	disableLoginResp := pipe.RbacAllow.Run(ctx, nil, &pipe.RbacAllowPipe{
@@ -294,11 +327,24 @@ func (c *SimpleUserModel) passwordLogin(ctx iris.Context, event string, user *Si
 		return
 	}
 
-	token, err := user.GenJwtToken(ctx, force, strict)
+	// 开启了两步验证或角色要求开启的 先不发放令牌
+	required := c.totpRequired(user)
+	if required || user.TotpEnabled() {
+		c.totpChallenge(ctx, event, user, force, strict, required && !user.TotpEnabled())
+		return
+	}
+
+	c.loginSuccess(ctx, event, user, force, strict, nil)
+}
+
+// loginSuccess 验证全部通过后发放令牌 extra会合并到返回中
+func (c *SimpleUserModel) loginSuccess(ctx iris.Context, event string, user *SimpleUserModel, force bool, strict bool, extra iris.Map) {
+	pair, err := user.GenJwtSession(ctx, force, strict)
 	if err != nil {
 		IrisRespErr("生成登录令牌失败", err, ctx)
 		return
 	}
+	token := pair.AccessToken
 
 	// 更新用户信息
 	upBody := bson.M{
@@ -324,7 +370,11 @@ func (c *SimpleUserModel) passwordLogin(ctx iris.Context, event string, user *Si
 	// 写入cookie
 	ctx.SetCookieKV(UserCookieKey, token, iris.CookieExpires(0))
 
-	ctx.JSON(iris.Map{"token": token, "info": user.Masking(0)})
+	result := iris.Map{"token": token, "refresh_token": pair.RefreshToken, "expires_in": pair.ExpiresIn, "info": user.Masking(0)}
+	for k, v := range extra {
+		result[k] = v
+	}
+	ctx.JSON(result)
 
 	// 写入日志
 	MustOpLog(ctx, c.OpLog(), "login", user, "user", event+"登录成功", "", nil)
@@ -388,7 +438,11 @@ func (c *SimpleUserModel) RegistryUseUserNameHandler(useValid bool) iris.Handler
 		}
 
 		// 进行注册
-		password, salt := passwordSalt(body.Password)
+		password, salt, err := passwordSalt(body.Password)
+		if err != nil {
+			IrisRespErr("注册失败", err, ctx)
+			return
+		}
 		userModel.UserName = body.UserName
 		userModel.Password = password
 		userModel.ReferrerUid = body.Invite
@@ -406,14 +460,14 @@ func (c *SimpleUserModel) RegistryUseUserNameHandler(useValid bool) iris.Handler
 			return
 		}
 		userModel.connectInfo = c.connectInfo
-		token, err := userModel.GenJwtToken(ctx, false, false)
+		pair, err := userModel.GenJwtSession(ctx, false, false)
 		if err != nil {
 			IrisRespErr("生成登录令牌失败", err, ctx)
 			return
 		}
 
-		ctx.SetCookieKV(UserCookieKey, token, iris.CookieExpires(0))
-		ctx.JSON(iris.Map{"token": token, "info": userModel.Masking(0)})
+		ctx.SetCookieKV(UserCookieKey, pair.AccessToken, iris.CookieExpires(0))
+		ctx.JSON(iris.Map{"token": pair.AccessToken, "refresh_token": pair.RefreshToken, "expires_in": pair.ExpiresIn, "info": userModel.Masking(0)})
 
 		MustOpLog(ctx, c.OpLog(), "reg", userModel, "user", "用户名密码注册", "", nil)
 
@@ -491,6 +545,20 @@ func (c *SimpleUserModel) GenJwtToken(ctx iris.Context, force bool, strict bool)
 	return jwtResp.Result, jwtResp.Err
 }
 
+// GenJwtSession 生成会话令牌 同时返回刷新令牌 可在会话列表中查看与注销
+func (c *SimpleUserModel) GenJwtSession(ctx iris.Context, force bool, strict bool) (*pipe.JwtTokenPair, error) {
+	resp := pipe.JwtSessionGen.Run(ctx, &pipe.PipeJwtDep{
+		Env:    pipe.CtxGetEnv(ctx),
+		UserId: c.Uid,
+		Device: ctx.GetHeader("User-Agent"),
+		Ip:     realip.Get(ctx.Request()),
+	}, &pipe.JwtGenPipe{
+		Force:  force,
+		Strict: strict,
+	}, c.rdb)
+	return resp.Result, resp.Err
+}
+
 func (c *SimpleUserModel) SetRoleUseUserName(ctx context.Context, userName string, roleTarget string) error {
 	return c.SetRole(ctx, bson.M{"user_name": userName}, roleTarget)
 }
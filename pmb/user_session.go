@@ -0,0 +1,122 @@
+package pmb
+
+import (
+	"github.com/23233/ggg/pipe"
+	"github.com/kataras/iris/v12"
+	"net/http"
+)
+
+type TokenRefreshReq struct {
+	RefreshToken string `json:"refresh_token,omitempty" comment:"刷新令牌" validate:"required"`
+}
+
+type SessionRevokeReq struct {
+	Id     string `json:"id,omitempty" comment:"会话id 为空时注销当前会话"`
+	All    bool   `json:"all,omitempty" comment:"注销全部会话 包括当前会话"`
+	Others bool   `json:"others,omitempty" comment:"注销除当前会话外的全部会话"`
+}
+
+type UserSession struct {
+	*pipe.JwtSession
+	Current bool `json:"current"`
+}
+
+// currentSessionId 当前请求令牌所属的会话
+func currentSessionId(ctx iris.Context) string {
+	if v, ok := ctx.Values().Get("_jwt").(pipe.JwtFlatBase); ok {
+		return v.SessionId
+	}
+	return ""
+}
+
+// TokenRefreshHandler 使用刷新令牌换取新的令牌 刷新令牌同时轮换 旧的刷新令牌再次使用会注销会话
+func (c *SimpleUserModel) TokenRefreshHandler() iris.Handler {
+	return func(ctx iris.Context) {
+		var body = new(TokenRefreshReq)
+		err := ctx.ReadBody(&body)
+		if err != nil {
+			IrisRespErr("解析请求包参数错误", err, ctx)
+			return
+		}
+		resp := pipe.JwtRefresh.Run(ctx, &pipe.JwtRefreshDep{
+			Env:          pipe.CtxGetEnv(ctx),
+			RefreshToken: body.RefreshToken,
+		}, nil, c.rdb)
+		if resp.Err != nil {
+			IrisRespErr("", resp.Err, ctx, http.StatusUnauthorized)
+			return
+		}
+		ctx.SetCookieKV(UserCookieKey, resp.Result.AccessToken, iris.CookieExpires(0))
+		ctx.JSON(iris.Map{
+			"token":         resp.Result.AccessToken,
+			"refresh_token": resp.Result.RefreshToken,
+			"expires_in":    resp.Result.ExpiresIn,
+		})
+	}
+}
+
+// SessionListHandler 当前用户的登录会话
+func (c *SimpleUserModel) SessionListHandler() iris.Handler {
+	return func(ctx iris.Context) {
+		user := ctx.Values().Get(UserContextKey).(*SimpleUserModel)
+		sessions, err := pipe.NewJwtHelper(c.rdb).ListSessions(ctx, user.Uid)
+		if err != nil {
+			IrisRespErr("获取会话列表失败", err, ctx)
+			return
+		}
+		current := currentSessionId(ctx)
+		result := make([]UserSession, 0, len(sessions))
+		for _, s := range sessions {
+			result = append(result, UserSession{JwtSession: s, Current: s.Id == current})
+		}
+		ctx.JSON(iris.Map{"data": result})
+	}
+}
+
+// SessionRevokeHandler 注销会话 被注销的设备立即失效
+func (c *SimpleUserModel) SessionRevokeHandler() iris.Handler {
+	return func(ctx iris.Context) {
+		var body = new(SessionRevokeReq)
+		err := ctx.ReadBody(&body)
+		if err != nil {
+			IrisRespErr("解析请求包参数错误", err, ctx)
+			return
+		}
+		user := ctx.Values().Get(UserContextKey).(*SimpleUserModel)
+		current := currentSessionId(ctx)
+
+		dep := &pipe.JwtRevokeDep{UserId: user.Uid}
+		msg := "注销会话"
+		switch {
+		case body.All:
+			msg = "注销全部会话"
+		case body.Others:
+			if len(current) < 1 {
+				IrisRespErr("当前登录不是会话令牌", nil, ctx)
+				return
+			}
+			dep.Except = current
+			msg = "注销其他会话"
+		case len(body.Id) > 0:
+			dep.SessionId = body.Id
+		default:
+			if len(current) < 1 {
+				IrisRespErr("当前登录不是会话令牌", nil, ctx)
+				return
+			}
+			dep.SessionId = current
+			msg = "退出登录"
+		}
+
+		resp := pipe.JwtRevoke.Run(ctx, dep, nil, c.rdb)
+		if resp.Err != nil {
+			IrisRespErr("注销会话失败", resp.Err, ctx)
+			return
+		}
+		if body.All || dep.SessionId == current {
+			ctx.RemoveCookie(UserCookieKey)
+		}
+		ctx.JSON(iris.Map{"detail": "已注销"})
+		MustOpLog(ctx, c.OpLog(), "session", user, "user", msg, dep.SessionId, nil)
+	}
+}
@@ -1,26 +1,20 @@
 package pmb
 
 import (
-	"crypto/md5"
-	"encoding/hex"
-	"github.com/23233/ggg/ut"
+	"github.com/23233/ggg/pipe"
+	"github.com/pkg/errors"
 )
 
-func passwordSalt(rawPassword string) (ps string, salt string) {
-	salt = ut.RandomStr(4)
-	m5 := md5.New()
-	m5.Write([]byte(rawPassword))
-	m5.Write([]byte(salt))
-	st := m5.Sum(nil)
-	ps = hex.EncodeToString(st)
-	return ps, salt
+// passwordSalt 使用默认的密码算法加密 新算法的salt包含在密文中 返回的salt为空
+func passwordSalt(rawPassword string) (ps string, salt string, err error) {
+	ps, err = pipe.PasswordHash(rawPassword)
+	if err != nil {
+		return "", "", errors.Wrap(err, "密码加密失败")
+	}
+	return ps, "", nil
 }
 
-func validPassword(password, salt, m5 string) bool {
-	r := md5.New()
-	r.Write([]byte(password))
-	r.Write([]byte(salt))
-	st := r.Sum(nil)
-	ps := hex.EncodeToString(st)
-	return ps == m5
+// validPassword 验证密码 兼容旧版md5 needRehash为true时应当重新加密后保存
+func validPassword(password, salt, encoded string) (ok bool, needRehash bool) {
+	return pipe.PasswordVerify(password, encoded, salt)
 }
@@ -0,0 +1,357 @@
+package pmb
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kataras/iris/v12"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type Login2faReq struct {
+	Challenge    string `json:"challenge,omitempty" comment:"登录返回的challenge" validate:"required"`
+	Code         string `json:"code,omitempty" comment:"验证器中的6位验证码"`
+	RecoveryCode string `json:"recovery_code,omitempty" comment:"恢复码 无法使用验证器时使用"`
+}
+
+type TotpCodeReq struct {
+	Code         string `json:"code,omitempty" comment:"验证器中的6位验证码"`
+	RecoveryCode string `json:"recovery_code,omitempty" comment:"恢复码"`
+}
+
+// totpRequired 用户的角色是否要求开启两步验证
+func (c *SimpleUserModel) totpRequired(user *SimpleUserModel) bool {
+	if len(c.totpRoles) < 1 || c.rbac == nil {
+		return false
+	}
+	return c.rbac.HasRoles(user.Uid, c.totpRoles)
+}
+
+// totpChallenge 密码验证通过 返回challenge等待第二步验证
+func (c *SimpleUserModel) totpChallenge(ctx iris.Context, event string, user *SimpleUserModel, force bool, strict bool, enroll bool) {
+	id := uuid.New().String()
+	err := c.challengeSave(ctx, id, &loginChallenge{
+		Uid:    user.Uid,
+		Event:  event,
+		Force:  force,
+		Strict: strict,
+		Enroll: enroll,
+	}, LoginChallengeExpire)
+	if err != nil {
+		IrisRespErr("创建两步验证失败", err, ctx)
+		return
+	}
+	ctx.JSON(iris.Map{
+		"need_2fa":  true,
+		"challenge": id,
+		"enroll":    enroll,
+		"expire":    int64(LoginChallengeExpire.Seconds()),
+	})
+}
+
+// totpConsumeStep 记录使用过的步数 同一个验证码只能使用一次
+func (c *SimpleUserModel) totpConsumeStep(ctx iris.Context, user *SimpleUserModel, step int64) error {
+	result, err := c.db.Collection(UserModelName).UpdateAll(ctx, bson.M{
+		"_id": user.Id,
+		"$or": bson.A{
+			bson.M{"totp.last_step": bson.M{"$lt": step}},
+			bson.M{"totp.last_step": bson.M{"$exists": false}},
+		},
+	}, bson.M{"$set": bson.M{"totp.last_step": step}})
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount < 1 {
+		return ErrTotpMismatch
+	}
+	user.Totp.LastStep = step
+	return nil
+}
+
+// totpConsumeRecovery 使用恢复码 使用后即删除
+func (c *SimpleUserModel) totpConsumeRecovery(ctx iris.Context, user *SimpleUserModel, code string) error {
+	hash := totpRecoveryHash(code)
+	result, err := c.db.Collection(UserModelName).UpdateAll(ctx, bson.M{
+		"_id":                 user.Id,
+		"totp.recovery_codes": hash,
+	}, bson.M{"$pull": bson.M{"totp.recovery_codes": hash}})
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount < 1 {
+		return ErrTotpMismatch
+	}
+	return nil
+}
+
+// totpCheck 验证已开启两步验证用户的验证码或恢复码
+func (c *SimpleUserModel) totpCheck(ctx iris.Context, user *SimpleUserModel, code string, recoveryCode string, allowRecovery bool) error {
+	if !user.TotpEnabled() {
+		return ErrTotpMismatch
+	}
+	if len(code) > 0 {
+		step, ok := TotpVerify(user.Totp.Secret, code, time.Now(), 1)
+		if !ok || step <= user.Totp.LastStep {
+			return ErrTotpMismatch
+		}
+		return c.totpConsumeStep(ctx, user, step)
+	}
+	if allowRecovery && len(recoveryCode) > 0 {
+		return c.totpConsumeRecovery(ctx, user, recoveryCode)
+	}
+	return ErrTotpMismatch
+}
+
+// totpEnable 验证通过后开启 返回恢复码明文 仅展示这一次
+func (c *SimpleUserModel) totpEnable(ctx iris.Context, user *SimpleUserModel, secret string, step int64) ([]string, error) {
+	codes, hashes, err := totpRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	user.Totp = &UserTotp{
+		Secret:        secret,
+		Enabled:       true,
+		EnabledAt:     time.Now(),
+		LastStep:      step,
+		RecoveryCodes: hashes,
+	}
+	err = c.db.Collection(UserModelName).UpdateId(ctx, user.Id, bson.M{"$set": bson.M{"totp": user.Totp}})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Login2faSetupHandler 登录时强制绑定 生成秘钥
+func (c *SimpleUserModel) Login2faSetupHandler() iris.Handler {
+	return func(ctx iris.Context) {
+		var body = new(Login2faReq)
+		err := ctx.ReadBody(&body)
+		if err != nil {
+			IrisRespErr("解析请求包参数错误", err, ctx)
+			return
+		}
+		ch, ttl, err := c.challengeGet(ctx, body.Challenge)
+		if err != nil {
+			IrisRespErr("", err, ctx)
+			return
+		}
+		if !ch.Enroll {
+			IrisRespErr("已绑定两步验证", nil, ctx)
+			return
+		}
+		user, err := c.GetUserItem(ctx, bson.M{"uid": ch.Uid})
+		if err != nil {
+			IrisRespErr("获取用户信息失败", err, ctx)
+			return
+		}
+		if len(ch.Secret) < 1 {
+			ch.Secret, err = TotpGenerateSecret()
+			if err != nil {
+				IrisRespErr("生成秘钥失败", err, ctx)
+				return
+			}
+			err = c.challengeSave(ctx, body.Challenge, ch, ttl)
+			if err != nil {
+				IrisRespErr("保存秘钥失败", err, ctx)
+				return
+			}
+		}
+		ctx.JSON(iris.Map{"secret": ch.Secret, "uri": TotpUri(c.TotpIssuer(), user.UserName, ch.Secret)})
+	}
+}
+
+// Login2faHandler 登录的第二步 验证通过后发放令牌
+func (c *SimpleUserModel) Login2faHandler() iris.Handler {
+	return func(ctx iris.Context) {
+		var body = new(Login2faReq)
+		err := ctx.ReadBody(&body)
+		if err != nil {
+			IrisRespErr("解析请求包参数错误", err, ctx)
+			return
+		}
+		ch, ttl, err := c.challengeGet(ctx, body.Challenge)
+		if err != nil {
+			IrisRespErr("", err, ctx)
+			return
+		}
+		// 先占用一次尝试次数再验证
+		attempts, err := c.challengeAttempt(ctx, body.Challenge, ttl)
+		if err != nil {
+			IrisRespErr("", err, ctx)
+			return
+		}
+		if attempts > int64(LoginChallengeMaxAttempts) {
+			c.challengeDel(ctx, body.Challenge)
+			IrisRespErr("", ErrChallengeNotFound, ctx)
+			return
+		}
+		user, err := c.GetUserItem(ctx, bson.M{"uid": ch.Uid})
+		if err != nil {
+			IrisRespErr("获取用户信息失败", err, ctx)
+			return
+		}
+
+		var extra iris.Map
+		if ch.Enroll {
+			step, ok := int64(0), false
+			if len(ch.Secret) > 0 {
+				step, ok = TotpVerify(ch.Secret, body.Code, time.Now(), 1)
+			}
+			if ok {
+				codes, err := c.totpEnable(ctx, user, ch.Secret, step)
+				if err != nil {
+					IrisRespErr("开启两步验证失败", err, ctx)
+					return
+				}
+				extra = iris.Map{"recovery_codes": codes}
+				MustOpLog(ctx, c.OpLog(), "totp", user, "user", "登录时绑定两步验证", "", nil)
+			} else {
+				err = ErrTotpMismatch
+			}
+		} else {
+			err = c.totpCheck(ctx, user, body.Code, body.RecoveryCode, true)
+		}
+
+		if err != nil {
+			if attempts >= int64(LoginChallengeMaxAttempts) {
+				c.challengeDel(ctx, body.Challenge)
+			}
+			IrisRespErr("", err, ctx)
+			return
+		}
+		c.challengeDel(ctx, body.Challenge)
+
+		c.loginSuccess(ctx, ch.Event, user, ch.Force, ch.Strict, extra)
+	}
+}
+
+// TotpStatusHandler 当前用户的两步验证状态
+func (c *SimpleUserModel) TotpStatusHandler() iris.Handler {
+	return func(ctx iris.Context) {
+		user := ctx.Values().Get(UserContextKey).(*SimpleUserModel)
+		recoveryLeft := 0
+		if user.TotpEnabled() {
+			recoveryLeft = len(user.Totp.RecoveryCodes)
+		}
+		ctx.JSON(iris.Map{
+			"enabled":       user.TotpEnabled(),
+			"required":      c.totpRequired(user),
+			"recovery_left": recoveryLeft,
+		})
+	}
+}
+
+// TotpSetupHandler 生成待绑定的秘钥 需要调用enable验证后才会生效
+func (c *SimpleUserModel) TotpSetupHandler() iris.Handler {
+	return func(ctx iris.Context) {
+		user := ctx.Values().Get(UserContextKey).(*SimpleUserModel)
+		if user.TotpEnabled() {
+			IrisRespErr("已开启两步验证", nil, ctx)
+			return
+		}
+		secret, err := TotpGenerateSecret()
+		if err != nil {
+			IrisRespErr("生成秘钥失败", err, ctx)
+			return
+		}
+		err = c.db.Collection(UserModelName).UpdateId(ctx, user.Id, bson.M{"$set": bson.M{"totp.pending": secret}})
+		if err != nil {
+			IrisRespErr("保存秘钥失败", err, ctx)
+			return
+		}
+		ctx.JSON(iris.Map{"secret": secret, "uri": TotpUri(c.TotpIssuer(), user.UserName, secret)})
+	}
+}
+
+// TotpEnableHandler 验证待绑定的秘钥 通过后开启并返回恢复码
+func (c *SimpleUserModel) TotpEnableHandler() iris.Handler {
+	return func(ctx iris.Context) {
+		var body = new(TotpCodeReq)
+		err := ctx.ReadBody(&body)
+		if err != nil {
+			IrisRespErr("解析请求包参数错误", err, ctx)
+			return
+		}
+		user := ctx.Values().Get(UserContextKey).(*SimpleUserModel)
+		if user.TotpEnabled() {
+			IrisRespErr("已开启两步验证", nil, ctx)
+			return
+		}
+		if user.Totp == nil || len(user.Totp.Pending) < 1 {
+			IrisRespErr("请先生成秘钥", nil, ctx)
+			return
+		}
+		step, ok := TotpVerify(user.Totp.Pending, body.Code, time.Now(), 1)
+		if !ok {
+			IrisRespErr("", ErrTotpMismatch, ctx)
+			return
+		}
+		codes, err := c.totpEnable(ctx, user, user.Totp.Pending, step)
+		if err != nil {
+			IrisRespErr("开启两步验证失败", err, ctx)
+			return
+		}
+		ctx.JSON(iris.Map{"recovery_codes": codes})
+		MustOpLog(ctx, c.OpLog(), "totp", user, "user", "开启两步验证", "", nil)
+	}
+}
+
+// TotpDisableHandler 关闭两步验证 角色要求开启的不允许关闭
+func (c *SimpleUserModel) TotpDisableHandler() iris.Handler {
+	return func(ctx iris.Context) {
+		var body = new(TotpCodeReq)
+		err := ctx.ReadBody(&body)
+		if err != nil {
+			IrisRespErr("解析请求包参数错误", err, ctx)
+			return
+		}
+		user := ctx.Values().Get(UserContextKey).(*SimpleUserModel)
+		if c.totpRequired(user) {
+			IrisRespErr("当前角色必须开启两步验证", nil, ctx)
+			return
+		}
+		err = c.totpCheck(ctx, user, body.Code, body.RecoveryCode, true)
+		if err != nil {
+			IrisRespErr("", err, ctx)
+			return
+		}
+		err = c.db.Collection(UserModelName).UpdateId(ctx, user.Id, bson.M{"$unset": bson.M{"totp": ""}})
+		if err != nil {
+			IrisRespErr("关闭两步验证失败", err, ctx)
+			return
+		}
+		ctx.JSON(iris.Map{"detail": "已关闭"})
+		MustOpLog(ctx, c.OpLog(), "totp", user, "user", "关闭两步验证", "", nil)
+	}
+}
+
+// TotpRecoveryCodesHandler 重新生成恢复码 旧的全部失效
+func (c *SimpleUserModel) TotpRecoveryCodesHandler() iris.Handler {
+	return func(ctx iris.Context) {
+		var body = new(TotpCodeReq)
+		err := ctx.ReadBody(&body)
+		if err != nil {
+			IrisRespErr("解析请求包参数错误", err, ctx)
+			return
+		}
+		user := ctx.Values().Get(UserContextKey).(*SimpleUserModel)
+		err = c.totpCheck(ctx, user, body.Code, "", false)
+		if err != nil {
+			IrisRespErr("", err, ctx)
+			return
+		}
+		codes, hashes, err := totpRecoveryCodes()
+		if err != nil {
+			IrisRespErr("生成恢复码失败", err, ctx)
+			return
+		}
+		err = c.db.Collection(UserModelName).UpdateId(ctx, user.Id, bson.M{"$set": bson.M{"totp.recovery_codes": hashes}})
+		if err != nil {
+			IrisRespErr("保存恢复码失败", err, ctx)
+			return
+		}
+		ctx.JSON(iris.Map{"recovery_codes": codes})
+		MustOpLog(ctx, c.OpLog(), "totp", user, "user", "重新生成两步验证恢复码", "", nil)
+	}
+}
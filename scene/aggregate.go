@@ -0,0 +1,254 @@
+package scene
+
+import (
+	"github.com/23233/ggg/pipe"
+	"github.com/23233/ggg/ut"
+	"github.com/kataras/iris/v12"
+	"github.com/pkg/errors"
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"slices"
+	"strings"
+)
+
+// 聚合场景 服务端声明允许的分组字段 指标与时间分桶 客户端通过query选择
+// _group=status,channel  _metric=total,amount  _bucket=day 其余query与 GET_All 一致作为过滤条件
+// 时间分桶使用 $dateTrunc 需要mongodb 5.0以上
+
+const (
+	AggCount = "count"
+	AggSum   = "sum"
+	AggAvg   = "avg"
+	AggMin   = "min"
+	AggMax   = "max"
+
+	BucketHour  = "hour"
+	BucketDay   = "day"
+	BucketWeek  = "week"
+	BucketMonth = "month"
+	BucketYear  = "year"
+
+	AggGroupKey  = "_group"
+	AggMetricKey = "_metric"
+	AggBucketKey = "_bucket"
+
+	// 分组结果中时间分桶的字段名
+	AggBucketField = "bucket"
+
+	defaultAggMaxGroups = 1000
+)
+
+var (
+	aggBuckets = []string{BucketHour, BucketDay, BucketWeek, BucketMonth, BucketYear}
+
+	ErrAggGroupNotAllow  = errors.New("不允许的分组字段")
+	ErrAggMetricNotAllow = errors.New("不允许的统计指标")
+	ErrAggBucketNotAllow = errors.New("不允许的时间分桶")
+)
+
+// AggregateMetric 统计指标 Name为返回的字段名 count无需Field
+type AggregateMetric struct {
+	Name  string `json:"name"`
+	Op    string `json:"op"`
+	Field string `json:"field,omitempty"`
+}
+
+// AggregateConfig 聚合配置
+type AggregateConfig struct {
+	GroupFields []string           `json:"group_fields,omitempty"` // 允许的分组字段
+	Metrics     []*AggregateMetric `json:"metrics"`                // 允许的指标 客户端未指定时返回全部
+	TimeField   string             `json:"time_field,omitempty"`   // 时间分桶字段 为空则不允许分桶
+	Buckets     []string           `json:"buckets,omitempty"`      // 允许的分桶粒度 为空则允许全部
+	Timezone    string             `json:"timezone,omitempty"`     // 分桶时区 默认 Asia/Shanghai
+	MaxGroups   int64              `json:"max_groups,omitempty"`   // 最大返回分组数 默认1000
+}
+
+// AggregateResp 聚合结果 data中每行为 group(分组字段与bucket) 加上各指标
+type AggregateResp struct {
+	Group   []string       `json:"group,omitempty"`
+	Bucket  string         `json:"bucket,omitempty"`
+	Metrics []string       `json:"metrics"`
+	Filters *ut.QueryParse `json:"filters,omitempty"`
+	Data    []bson.M       `json:"data"`
+}
+
+func (c *AggregateConfig) Valid() error {
+	if len(c.Metrics) < 1 {
+		return errors.New("至少需要一个统计指标")
+	}
+	names := make(map[string]bool, len(c.Metrics))
+	for _, m := range c.Metrics {
+		if len(m.Name) < 1 || strings.HasPrefix(m.Name, "$") || strings.Contains(m.Name, ".") || m.Name == "group" || names[m.Name] {
+			return errors.Errorf("指标名称错误 %s", m.Name)
+		}
+		names[m.Name] = true
+		switch m.Op {
+		case AggCount:
+		case AggSum, AggAvg, AggMin, AggMax:
+			if len(m.Field) < 1 {
+				return errors.Errorf("指标 %s 缺少字段", m.Name)
+			}
+		default:
+			return errors.Errorf("不支持的统计方式 %s", m.Op)
+		}
+	}
+	for _, b := range c.Buckets {
+		if !slices.Contains(aggBuckets, b) {
+			return errors.Errorf("不支持的时间分桶 %s", b)
+		}
+	}
+	if slices.Contains(c.GroupFields, AggBucketField) {
+		return errors.New("分组字段不能为 " + AggBucketField)
+	}
+	if len(c.Buckets) > 0 && len(c.TimeField) < 1 {
+		return errors.New("时间分桶需要设置时间字段")
+	}
+	return nil
+}
+
+func splitAggParam(raw string) []string {
+	result := make([]string, 0)
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// PopParams 从query中取出聚合参数 剩余部分作为过滤条件
+func (c *AggregateConfig) PopParams(query map[string]string) (params map[string]string, group []string, metrics []*AggregateMetric, bucket string, err error) {
+	params = make(map[string]string, len(query))
+	for k, v := range query {
+		params[k] = v
+	}
+	group = splitAggParam(params[AggGroupKey])
+	for _, field := range group {
+		if !slices.Contains(c.GroupFields, field) {
+			return nil, nil, nil, "", ErrAggGroupNotAllow
+		}
+	}
+	names := splitAggParam(params[AggMetricKey])
+	if len(names) < 1 {
+		metrics = c.Metrics
+	}
+	for _, name := range names {
+		var metric *AggregateMetric
+		for _, m := range c.Metrics {
+			if m.Name == name {
+				metric = m
+				break
+			}
+		}
+		if metric == nil {
+			return nil, nil, nil, "", ErrAggMetricNotAllow
+		}
+		metrics = append(metrics, metric)
+	}
+	bucket = params[AggBucketKey]
+	if len(bucket) > 0 {
+		if len(c.TimeField) < 1 || !slices.Contains(aggBuckets, bucket) || (len(c.Buckets) > 0 && !slices.Contains(c.Buckets, bucket)) {
+			return nil, nil, nil, "", ErrAggBucketNotAllow
+		}
+	}
+	delete(params, AggGroupKey)
+	delete(params, AggMetricKey)
+	delete(params, AggBucketKey)
+	return params, group, metrics, bucket, nil
+}
+
+// Pipeline 在过滤条件后追加 $group $sort $limit $project
+func (c *AggregateConfig) Pipeline(query *ut.QueryFull, group []string, metrics []*AggregateMetric, bucket string) []bson.D {
+	// 过滤部分不需要分页与排序
+	filter := &ut.QueryFull{QueryParse: query.QueryParse, Pks: query.Pks}
+	if filter.QueryParse == nil {
+		filter.QueryParse = new(ut.QueryParse)
+	}
+	pipeline := ut.QueryToMongoPipeline(filter)
+
+	var id any
+	if len(group) > 0 || len(bucket) > 0 {
+		groupId := bson.D{}
+		for _, field := range group {
+			// 表达式的key不能包含 .
+			groupId = append(groupId, bson.E{Key: strings.ReplaceAll(field, ".", "__"), Value: "$" + field})
+		}
+		if len(bucket) > 0 {
+			tz := c.Timezone
+			if len(tz) < 1 {
+				tz = "Asia/Shanghai"
+			}
+			groupId = append(groupId, bson.E{Key: AggBucketField, Value: bson.D{{"$dateTrunc", bson.D{
+				{"date", "$" + c.TimeField},
+				{"unit", bucket},
+				{"timezone", tz},
+			}}}})
+		}
+		id = groupId
+	}
+
+	groupStage := bson.D{{"_id", id}}
+	project := bson.D{{"_id", 0}, {"group", "$_id"}}
+	for _, m := range metrics {
+		var acc bson.D
+		if m.Op == AggCount {
+			acc = bson.D{{"$sum", 1}}
+		} else {
+			acc = bson.D{{"$" + m.Op, "$" + m.Field}}
+		}
+		groupStage = append(groupStage, bson.E{Key: m.Name, Value: acc})
+		project = append(project, bson.E{Key: m.Name, Value: 1})
+	}
+
+	maxGroups := c.MaxGroups
+	if maxGroups < 1 {
+		maxGroups = defaultAggMaxGroups
+	}
+	return append(pipeline,
+		bson.D{{"$group", groupStage}},
+		bson.D{{"$sort", bson.D{{"_id", 1}}}},
+		bson.D{{"$limit", maxGroups}},
+		bson.D{{"$project", project}},
+	)
+}
+
+var FuncAggregate = func(ctx iris.Context, self ISceneModelItem) *pipe.RunResp[any] {
+	mapper := self.GetMapper()
+	if mapper == nil {
+		return pipe.NewPipeErrMsg[any]("mapper为空", nil)
+	}
+	cfg := self.GetExtra().Aggregate
+	if cfg == nil {
+		return pipe.NewPipeErrMsg[any]("未配置聚合参数", nil)
+	}
+	params, group, metrics, bucket, err := cfg.PopParams(mapper.Query)
+	if err != nil {
+		return pipe.NewPipeErrMsg[any](err.Error(), err)
+	}
+
+	q, err := getQueryParse(ctx, self.GetContextInjectFilter(), self.GetFilterInjects(), pipe.QueryParseConfig{UrlParams: params})
+	if err != nil {
+		return pipe.NewPipeErrMsg[any]("解析注入内容失败", err)
+	}
+	resp := pipe.QueryParse.Run(ctx, nil, q, nil)
+	if resp.Err != nil {
+		return pipe.NewPipeErrMsg[any]("解析查询参数失败", resp.Err)
+	}
+
+	var data = make([]bson.M, 0)
+	err = self.GetDb().Collection(self.GetTableName()).Aggregate(ctx, cfg.Pipeline(resp.Result, group, metrics, bucket)).All(&data)
+	if err != nil && err != qmgo.ErrNoSuchDocuments {
+		return pipe.NewPipeErrMsg[any]("聚合查询失败", err)
+	}
+
+	result := &AggregateResp{
+		Group:   group,
+		Bucket:  bucket,
+		Filters: resp.Result.QueryParse,
+		Data:    data,
+	}
+	for _, m := range metrics {
+		result.Metrics = append(result.Metrics, m.Name)
+	}
+	return pipe.NewPipeResult[any](result)
+}
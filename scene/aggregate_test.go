@@ -0,0 +1,82 @@
+package scene
+
+import (
+	"github.com/23233/ggg/ut"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"testing"
+)
+
+func newAggConfig() *AggregateConfig {
+	return &AggregateConfig{
+		GroupFields: []string{"status", "user.channel"},
+		Metrics: []*AggregateMetric{
+			{Name: "total", Op: AggCount},
+			{Name: "amount", Op: AggSum, Field: "price"},
+			{Name: "avg_price", Op: AggAvg, Field: "price"},
+		},
+		TimeField: "create_at",
+		Buckets:   []string{BucketDay, BucketMonth},
+	}
+}
+
+func TestAggregateConfigValid(t *testing.T) {
+	assert.Nil(t, newAggConfig().Valid())
+	assert.NotNil(t, (&AggregateConfig{}).Valid())
+	assert.NotNil(t, (&AggregateConfig{Metrics: []*AggregateMetric{{Name: "a", Op: AggSum}}}).Valid())
+	assert.NotNil(t, (&AggregateConfig{Metrics: []*AggregateMetric{{Name: "a", Op: "median", Field: "x"}}}).Valid())
+	assert.NotNil(t, (&AggregateConfig{Metrics: []*AggregateMetric{{Name: "a", Op: AggCount}, {Name: "a", Op: AggCount}}}).Valid())
+	assert.NotNil(t, (&AggregateConfig{Metrics: []*AggregateMetric{{Name: "$a", Op: AggCount}}}).Valid())
+	assert.NotNil(t, (&AggregateConfig{Metrics: []*AggregateMetric{{Name: "a", Op: AggCount}}, Buckets: []string{BucketDay}}).Valid())
+	assert.NotNil(t, (&AggregateConfig{Metrics: []*AggregateMetric{{Name: "a", Op: AggCount}}, TimeField: "t", Buckets: []string{"minute"}}).Valid())
+}
+
+func TestAggregatePopParams(t *testing.T) {
+	cfg := newAggConfig()
+	query := map[string]string{AggGroupKey: "status, user.channel", AggMetricKey: "amount", AggBucketKey: BucketDay, "status_ne": "deleted"}
+	params, group, metrics, bucket, err := cfg.PopParams(query)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"status_ne": "deleted"}, params)
+	assert.Equal(t, []string{"status", "user.channel"}, group)
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, "amount", metrics[0].Name)
+	assert.Equal(t, BucketDay, bucket)
+	// 原始query不被修改
+	assert.Len(t, query, 4)
+
+	_, _, metrics, _, err = cfg.PopParams(map[string]string{})
+	assert.Nil(t, err)
+	assert.Len(t, metrics, 3)
+
+	_, _, _, _, err = cfg.PopParams(map[string]string{AggGroupKey: "price"})
+	assert.ErrorIs(t, err, ErrAggGroupNotAllow)
+	_, _, _, _, err = cfg.PopParams(map[string]string{AggMetricKey: "max_price"})
+	assert.ErrorIs(t, err, ErrAggMetricNotAllow)
+	_, _, _, _, err = cfg.PopParams(map[string]string{AggBucketKey: BucketHour})
+	assert.ErrorIs(t, err, ErrAggBucketNotAllow)
+}
+
+func TestAggregatePipeline(t *testing.T) {
+	cfg := newAggConfig()
+	query := &ut.QueryFull{
+		QueryParse: &ut.QueryParse{And: []*ut.Kov{{Key: "uid", Value: "u1"}}},
+		BaseQuery:  &ut.BaseQuery{BasePage: &ut.BasePage{Page: 2, PageSize: 10}},
+	}
+	pipeline := cfg.Pipeline(query, []string{"user.channel"}, cfg.Metrics[:2], BucketMonth)
+	assert.Len(t, pipeline, 5)
+	assert.Equal(t, "$match", pipeline[0][0].Key)
+
+	group := pipeline[1][0].Value.(bson.D)
+	id := group[0].Value.(bson.D)
+	assert.Equal(t, bson.E{Key: "user__channel", Value: "$user.channel"}, id[0])
+	assert.Equal(t, AggBucketField, id[1].Key)
+	assert.Equal(t, bson.E{Key: "total", Value: bson.D{{"$sum", 1}}}, group[1])
+	assert.Equal(t, bson.E{Key: "amount", Value: bson.D{{"$sum", "$price"}}}, group[2])
+	assert.Equal(t, "$limit", pipeline[3][0].Key)
+	assert.Equal(t, int64(defaultAggMaxGroups), pipeline[3][0].Value)
+
+	// 无分组时统计全部
+	pipeline = cfg.Pipeline(&ut.QueryFull{}, nil, cfg.Metrics[:1], "")
+	assert.Len(t, pipeline, 4)
+	assert.Nil(t, pipeline[0][0].Value.(bson.D)[0].Value)
+}
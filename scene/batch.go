@@ -0,0 +1,177 @@
+package scene
+
+import (
+	"bytes"
+	"github.com/23233/ggg/pipe"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/context"
+	"net/http"
+	"sync"
+)
+
+// 批量请求 默认关闭 通过 SetBatch 开启
+// 请求体为 RequestData 数组时逐个分发 每项独立执行限速与前后处理程序
+// 返回与请求顺序一致的结果数组 单项失败不影响其他项
+// 开启防重放时每一项都会校验comm 任一项失败则整个请求被拒绝
+//
+// 开启前需确认所有场景的处理程序在批量模式下是安全的
+// - 场景处理程序与前后处理程序只能通过返回的 RunResp 输出结果 直接写入ctx(ctx.JSON ctx.StopWithJSON 等)会混入批量响应导致格式错误 并发执行时则被丢弃
+// - 只会执行 AddPreHandler AddAfterHandler 与场景处理程序 在 RegistryRouter 之后追加到路由上(ParseRequest之后)的iris handler 不会执行
+// - 并发执行时每项的ctx为复制 处理程序写入ctx values的内容在项之间及与原ctx之间不共享
+
+// DefaultBatchMaxItems 推荐的单次最大数量
+const DefaultBatchMaxItems = 20
+
+// BatchResult 单项结果 status为该项对应的http状态码
+type BatchResult struct {
+	Status     int    `json:"status"`
+	Code       int    `json:"code"`
+	Data       any    `json:"data,omitempty"`
+	Detail     string `json:"detail,omitempty"`
+	RetryAfter int64  `json:"retry_after,omitempty"` // 限速时的重试秒数
+}
+
+func newBatchResult(resp *pipe.RunResp[any]) *BatchResult {
+	if resp.Err != nil {
+		detail := resp.Msg
+		if len(detail) < 1 {
+			detail = resp.Err.Error()
+		}
+		status := http.StatusBadRequest
+		if resp.ReqCode > 0 {
+			status = resp.ReqCode
+		}
+		return &BatchResult{Status: status, Code: resp.BusinessCode, Detail: detail}
+	}
+	return &BatchResult{Status: http.StatusOK, Code: resp.BusinessCode, Data: resp.Result}
+}
+
+func batchErr(status int, detail string) *BatchResult {
+	return &BatchResult{Status: status, Detail: detail}
+}
+
+// SetBatch 设置批量请求 maxItems为单次最大数量 大于0时开启 小于等于0时关闭 默认关闭
+// concurrency大于1时并发执行 此时每项使用复制的ctx 拥有独立的values 写入ctx的响应会被丢弃
+func (m *Scenes) SetBatch(maxItems int, concurrency int) {
+	m.batchMax = maxItems
+	m.batchConcurrency = concurrency
+}
+
+// getBatchMax 单次最大数量 为0时未开启批量
+func (m *Scenes) getBatchMax() int {
+	if m.batchMax < 0 {
+		return 0
+	}
+	return m.batchMax
+}
+
+// discardWriter 并发执行时单项ctx的响应写入 结果只通过RunResp返回
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+// itemContext 复制ctx供单项并发使用 iris.Context并非协程安全
+func itemContext(ctx iris.Context, mapper *RequestData) (iris.Context, func()) {
+	itemCtx := ctx.Clone()
+	w := context.AcquireResponseWriter()
+	w.BeginResponse(&discardWriter{header: make(http.Header)})
+	itemCtx.ResetResponseWriter(w)
+	itemCtx.Values().Set("body_data", mapper)
+	return itemCtx, w.EndResponse
+}
+
+func isBatchBody(body []byte) bool {
+	body = bytes.TrimSpace(body)
+	return len(body) > 0 && body[0] == '['
+}
+
+// dispatchItem 执行单项 与单个请求的处理流程一致 但结果不直接写入ctx
+func (m *Scenes) dispatchItem(ctx iris.Context, mapper *RequestData) (result *BatchResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = batchErr(http.StatusInternalServerError, "执行过程错误")
+		}
+	}()
+	if mapper == nil || len(mapper.Module.Scope) < 1 || len(mapper.Module.Model) < 1 || len(mapper.Module.Scene) < 1 {
+		return batchErr(http.StatusBadRequest, "必传参数缺失")
+	}
+	for _, handler := range m.GetPreHandler() {
+		if resp := handler(ctx, mapper); resp.Err != nil {
+			return newBatchResult(resp)
+		}
+	}
+
+	item, ok := m.GetItem(mapper.Module.Scope, mapper.Module.Model, mapper.Module.Scene)
+	if !ok {
+		return batchErr(http.StatusBadRequest, "获取对应handler失败")
+	}
+	if item.rate != nil {
+		key, err := item.rateKey(ctx)
+		if err != nil {
+			return batchErr(http.StatusBadRequest, "获取限速器字段失败")
+		}
+		rateResult, err := item.rate.Take(ctx, key)
+		if err != nil {
+			return batchErr(http.StatusBadRequest, "限速器执行失败")
+		}
+		if !rateResult.Allowed {
+			result = batchErr(http.StatusTooManyRequests, "当前请求过多,请稍后重试")
+			result.RetryAfter = rateHeaderSeconds(rateResult.RetryAfter)
+			return result
+		}
+	}
+
+	cloneItem := item.Scene.Clone()
+	cloneItem.SetMapper(mapper)
+	resp := cloneItem.GetHandler()(ctx, cloneItem)
+	if resp.Err != nil {
+		return newBatchResult(resp)
+	}
+	for _, handler := range m.GetAfterHandler() {
+		if afterResp := handler(ctx, mapper); afterResp.Err != nil {
+			return newBatchResult(afterResp)
+		}
+	}
+	return newBatchResult(resp)
+}
+
+// dispatchBatch 分发批量请求并写入结果数组
+func (m *Scenes) dispatchBatch(ctx iris.Context, items []*RequestData) {
+	if len(items) < 1 {
+		m.errMsg(ctx, "必传参数缺失", nil)
+		return
+	}
+	if len(items) > m.getBatchMax() {
+		m.errMsg(ctx, "批量请求数量超出限制", nil)
+		return
+	}
+	results := make([]*BatchResult, len(items))
+	if m.batchConcurrency > 1 {
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, m.batchConcurrency)
+		for i, item := range items {
+			wg.Add(1)
+			sem <- struct{}{}
+			itemCtx, release := itemContext(ctx, item)
+			go func(i int, item *RequestData) {
+				defer func() {
+					release()
+					<-sem
+					wg.Done()
+				}()
+				results[i] = m.dispatchItem(itemCtx, item)
+			}(i, item)
+		}
+		wg.Wait()
+	} else {
+		for i, item := range items {
+			ctx.Values().Set("body_data", item)
+			results[i] = m.dispatchItem(ctx, item)
+		}
+	}
+	pipe.NewPipeResult[any](results).Return(ctx)
+}
@@ -0,0 +1,134 @@
+package scene
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/23233/ggg/pipe"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/httptest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// onceLimiter 只允许一次请求
+type onceLimiter struct {
+	count atomic.Int64
+}
+
+func (l *onceLimiter) Take(ctx context.Context, identifier string) (*RateResult, error) {
+	n := l.count.Add(1)
+	return &RateResult{Allowed: n <= 1, Limit: 1, RetryAfter: 2 * time.Second}, nil
+}
+
+type batchInput struct {
+	Name string `json:"name"`
+}
+
+func newBatchScenes(t *testing.T) IScenes {
+	sc := NewScenes()
+	echo, err := NewItem(nil, "batch", batchInput{}, func(ctx iris.Context, self ISceneModelItem) *pipe.RunResp[any] {
+		name := self.GetMapper().Query["name"]
+		// 每项的ctx中body_data应为当前项
+		if body, ok := ctx.Values().Get("body_data").(*RequestData); !ok || body.Query["name"] != name {
+			return pipe.NewPipeErrMsg[any]("上下文错误", errors.New("body_data mismatch"))
+		}
+		if name == "bad" {
+			return pipe.NewPipeErrMsg[any]("名称错误", errors.New("bad name")).SetBusinessCode(1001)
+		}
+		return pipe.NewPipeResult[any](name)
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, sc.RegistryItem("app", "batch", "echo", echo))
+	limited, err := NewItem(nil, "batch", batchInput{}, func(ctx iris.Context, self ISceneModelItem) *pipe.RunResp[any] {
+		return pipe.NewPipeResult[any]("limited")
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, sc.RegistryItem("app", "batch", "limited", limited))
+	assert.Nil(t, sc.AddItemLimiter("app", "batch", "limited", new(onceLimiter), func(ctx iris.Context) (string, error) {
+		return "ip", nil
+	}))
+	sc.AddPreHandler(func(ctx iris.Context, mapper *RequestData) *pipe.RunResp[any] {
+		if mapper.Comm["deny"] == "1" {
+			return pipe.NewPipeErrMsg[any]("无权限", errors.New("deny")).SetReqCode(iris.StatusForbidden)
+		}
+		return pipe.NewPipeResult[any](nil)
+	})
+	return sc
+}
+
+func batchItem(scene string, name string) *RequestData {
+	return &RequestData{
+		Module: RequestModule{Scope: "app", Model: "batch", Scene: scene},
+		Query:  map[string]string{"name": name},
+	}
+}
+
+func TestBatchScene(t *testing.T) {
+	for _, concurrency := range []int{1, 4} {
+		sc := newBatchScenes(t)
+		sc.SetBatch(5, concurrency)
+		app := iris.New()
+		sc.RegistryRouter(app.Party("/"), "scene")
+		e := httptest.New(t, app)
+
+		denied := batchItem("echo", "x")
+		denied.Comm = map[string]string{"deny": "1"}
+		items := []*RequestData{
+			batchItem("echo", "a"),
+			batchItem("echo", "bad"),
+			batchItem("missing", "c"),
+			denied,
+			batchItem("limited", ""),
+		}
+		raw, _ := json.Marshal(items)
+		body := e.POST("/scene").WithBytes(raw).Expect().Status(iris.StatusOK).Body().Raw()
+
+		var resp struct {
+			Data []*BatchResult `json:"data"`
+		}
+		assert.Nil(t, json.Unmarshal([]byte(body), &resp))
+		assert.Len(t, resp.Data, 5)
+		assert.Equal(t, iris.StatusOK, resp.Data[0].Status)
+		assert.Equal(t, "a", resp.Data[0].Data)
+		assert.Equal(t, iris.StatusBadRequest, resp.Data[1].Status)
+		assert.Equal(t, "名称错误", resp.Data[1].Detail)
+		assert.Equal(t, 1001, resp.Data[1].Code)
+		assert.Equal(t, "获取对应handler失败", resp.Data[2].Detail)
+		assert.Equal(t, iris.StatusForbidden, resp.Data[3].Status)
+		assert.Equal(t, iris.StatusOK, resp.Data[4].Status)
+
+		// 同一请求中第二次调用被限速
+		raw, _ = json.Marshal([]*RequestData{batchItem("limited", ""), batchItem("echo", "b")})
+		body = e.POST("/scene").WithBytes(raw).Expect().Status(iris.StatusOK).Body().Raw()
+		assert.Nil(t, json.Unmarshal([]byte(body), &resp))
+		assert.Equal(t, iris.StatusTooManyRequests, resp.Data[0].Status)
+		assert.Equal(t, int64(2), resp.Data[0].RetryAfter)
+		assert.Equal(t, "b", resp.Data[1].Data)
+
+		// 数量超出与空数组
+		raw, _ = json.Marshal(append(items, batchItem("echo", "f")))
+		e.POST("/scene").WithBytes(raw).Expect().Status(iris.StatusBadRequest)
+		e.POST("/scene").WithBytes([]byte("[]")).Expect().Status(iris.StatusBadRequest)
+
+		// 单个请求不受影响 预处理程序在解析请求后执行
+		raw, _ = json.Marshal(batchItem("echo", "single"))
+		e.POST("/scene").WithBytes(raw).Expect().Status(iris.StatusOK).JSON().Object().Value("data").String().Equal("single")
+		raw, _ = json.Marshal(denied)
+		e.POST("/scene").WithBytes(raw).Expect().Status(iris.StatusForbidden)
+	}
+
+	// 默认关闭 数组请求无法解析
+	raw, _ := json.Marshal([]*RequestData{batchItem("echo", "a")})
+	for _, n := range []int{0, -1} {
+		sc := newBatchScenes(t)
+		if n != 0 {
+			sc.SetBatch(n, 0)
+		}
+		app := iris.New()
+		sc.RegistryRouter(app.Party("/"), "scene")
+		httptest.New(t, app).POST("/scene").WithBytes(raw).Expect().Status(iris.StatusBadRequest)
+	}
+}
@@ -13,12 +13,15 @@ require (
 	github.com/23233/ggg/pipe v0.0.0-20240629110827-fd5c161b4d32
 	github.com/23233/ggg/ut v0.0.0-20250521015733-ba3370e5e495
 	github.com/23233/jsonschema v0.11.2
+	github.com/alicebob/miniredis/v2 v2.35.0
 	github.com/kataras/iris/v12 v12.2.11
 	github.com/kataras/realip v0.0.2
 	github.com/pkg/errors v0.9.1
 	github.com/qiniu/qmgo v1.1.9
 	github.com/redis/rueidis v1.0.60
+	github.com/redis/rueidis/rueidiscompat v1.0.60
 	github.com/stretchr/testify v1.10.0
+	go.mongodb.org/mongo-driver v1.17.3
 )
 
 require (
@@ -122,7 +125,7 @@ require (
 	github.com/xdg-go/stringprep v1.0.4 // indirect
 	github.com/yosssi/ace v0.0.5 // indirect
 	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78 // indirect
-	go.mongodb.org/mongo-driver v1.17.3 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 	go.uber.org/atomic v1.11.0 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
 	go.uber.org/zap v1.27.0 // indirect
@@ -0,0 +1,117 @@
+package scene
+
+import (
+	"github.com/23233/jsonschema"
+	"github.com/kataras/iris/v12"
+	"sort"
+)
+
+// 场景自省 列出所有已注册的scope/model/scene 及其输入结构 限速配置与类型
+// 前端可据此生成客户端 避免硬编码场景字符串与body结构
+
+// LimiterDescribe 限速配置 period为毫秒
+type LimiterDescribe struct {
+	Kind   string `json:"kind"` // sliding token_bucket gcra custom
+	Period int64  `json:"period,omitempty"`
+	Rate   int    `json:"rate,omitempty"` // 滑窗为周期内最大次数 令牌桶与gcra为每周期补充数量
+	Burst  int    `json:"burst,omitempty"`
+}
+
+// SceneDescribe 单个场景
+type SceneDescribe struct {
+	Scope  string             `json:"scope"`
+	Model  string             `json:"model"`
+	Scene  string             `json:"scene"`
+	Kind   string             `json:"kind"`
+	Table  string             `json:"table,omitempty"`
+	Schema *jsonschema.Schema `json:"schema,omitempty"`
+	Rate   *LimiterDescribe   `json:"rate,omitempty"`
+	// Aggregate 聚合场景的可选分组 指标与分桶
+	Aggregate *AggregateConfig `json:"aggregate,omitempty"`
+}
+
+// ScenesDescribe 整体描述 包含协议相关的配置
+type ScenesDescribe struct {
+	Prefix          string           `json:"prefix"`
+	Encrypt         bool             `json:"encrypt"`
+	Envelope        bool             `json:"envelope"`
+	LegacyCbc       bool             `json:"legacy_cbc"`
+	ResponseEncrypt bool             `json:"response_encrypt"`
+	ReplayGuard     bool             `json:"replay_guard"`
+	BatchMax        int              `json:"batch_max"` // 为0时未开启批量
+	Scenes          []*SceneDescribe `json:"scenes"`
+}
+
+func describeLimiter(limiter Limiter) *LimiterDescribe {
+	switch l := limiter.(type) {
+	case nil:
+		return nil
+	case *RateLimiter:
+		return &LimiterDescribe{Kind: "sliding", Period: l.window.Milliseconds(), Rate: l.maxCount}
+	case *TokenBucketLimiter:
+		return &LimiterDescribe{Kind: "token_bucket", Period: l.period.Milliseconds(), Rate: l.rate, Burst: l.burst}
+	case *GCRALimiter:
+		return &LimiterDescribe{Kind: "gcra", Period: l.period.Milliseconds(), Rate: l.rate, Burst: l.burst}
+	}
+	return &LimiterDescribe{Kind: "custom"}
+}
+
+// Describe 按注册顺序列出场景 同一model下按scene名排序
+func (m *Scenes) Describe() *ScenesDescribe {
+	result := &ScenesDescribe{
+		Prefix:          m.prefix,
+		Encrypt:         m.GetCbcSign(),
+		Envelope:        m.envelope != nil,
+		LegacyCbc:       m.cbcIv != nil,
+		ResponseEncrypt: m.GetResponseEncrypt(),
+		ReplayGuard:     m.GetCbcSign() && m.replayGuard != nil,
+		BatchMax:        m.getBatchMax(),
+		Scenes:          make([]*SceneDescribe, 0),
+	}
+	for _, module := range m.modules {
+		names := make([]string, 0, len(module.scenes))
+		for name := range module.scenes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			opt := module.scenes[name]
+			item := &SceneDescribe{
+				Scope: module.scope,
+				Model: module.model,
+				Scene: name,
+				Kind:  ItemKindCustom,
+				Table: opt.Scene.GetTableName(),
+				Rate:  describeLimiter(opt.rate),
+			}
+			if extra := opt.Scene.GetExtra(); extra != nil {
+				if len(extra.Kind) > 0 {
+					item.Kind = extra.Kind
+				}
+				item.Aggregate = extra.Aggregate
+			}
+			item.Schema = opt.Scene.GetSchema()
+			result.Scenes = append(result.Scenes, item)
+		}
+	}
+	return result
+}
+
+// IntrospectHandler 返回场景描述 ?format=ts 时返回生成的typescript客户端
+// 描述中包含输入结构 建议挂载在需要鉴权的路由下
+func (m *Scenes) IntrospectHandler() iris.Handler {
+	return func(ctx iris.Context) {
+		desc := m.Describe()
+		if ctx.URLParam("format") == "ts" {
+			ctx.ContentType("application/typescript")
+			ctx.WriteString(GenTypescriptClient(desc))
+			return
+		}
+		ctx.JSON(desc)
+	}
+}
+
+// RegistryIntrospect 注册自省路由 handlers为前置中间件 例如鉴权
+func (m *Scenes) RegistryIntrospect(party iris.Party, path string, handlers ...iris.Handler) {
+	party.Get(path, append(handlers, m.IntrospectHandler())...)
+}
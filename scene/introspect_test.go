@@ -0,0 +1,67 @@
+package scene
+
+import (
+	"github.com/23233/ggg/pipe"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/httptest"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+type introspectInput struct {
+	Name string   `json:"name" comment:"名称"`
+	Age  int      `json:"age,omitempty"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+func TestDescribe(t *testing.T) {
+	sc := NewScenes()
+	echo, err := NewItem(nil, "users", introspectInput{}, func(ctx iris.Context, self ISceneModelItem) *pipe.RunResp[any] {
+		return pipe.NewPipeResult[any](nil)
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, sc.RegistryItem("app", "user", "echo", echo))
+	assert.Nil(t, NewCrud(nil, "users", introspectInput{}).RegistryToManager(sc, "app", "user"))
+	assert.Nil(t, sc.AddItemLimiter("app", "user", "echo", NewGCRALimiter(nil, time.Second, 5, 10, "echo"), nil))
+	sc.SetCbcSign([]byte("0123456789abcdef"))
+
+	desc := sc.Describe()
+	assert.True(t, desc.Encrypt)
+	assert.True(t, desc.LegacyCbc)
+	assert.Equal(t, 0, desc.BatchMax)
+	assert.Len(t, desc.Scenes, 6)
+	kinds := make(map[string]*SceneDescribe)
+	for _, item := range desc.Scenes {
+		kinds[item.Scene] = item
+	}
+	assert.Equal(t, ItemKindCustom, kinds["echo"].Kind)
+	assert.Equal(t, &LimiterDescribe{Kind: "gcra", Period: 1000, Rate: 5, Burst: 10}, kinds["echo"].Rate)
+	assert.Equal(t, ItemKindGetAll, kinds["GET_All"].Kind)
+	assert.Equal(t, ItemKindDelete, kinds["DELETE"].Kind)
+	assert.Nil(t, kinds["ADD"].Rate)
+	assert.NotNil(t, kinds["ADD"].Schema)
+
+	ts := GenTypescriptClient(desc)
+	assert.Contains(t, ts, `"app/user/echo": {`)
+	assert.Contains(t, ts, `"app/user/GET_All": "get_all",`)
+	assert.Contains(t, ts, "/** 名称 */")
+	assert.Contains(t, ts, "tags?: string[];")
+	assert.Contains(t, ts, "export class SceneClient")
+
+	app := iris.New()
+	sc.RegistryRouter(app.Party("/"), "scene")
+	sc.RegistryIntrospect(app.Party("/"), "/scene/describe")
+	e := httptest.New(t, app)
+	e.GET("/scene/describe").Expect().Status(iris.StatusOK).JSON().Object().Value("prefix").IsEqual("scene")
+	body := e.GET("/scene/describe").WithQuery("format", "ts").Expect().Status(iris.StatusOK).Body().Raw()
+	assert.True(t, strings.Contains(body, `export const ScenePrefix = "scene";`))
+}
+
+func TestTsPascal(t *testing.T) {
+	assert.Equal(t, "AppUserGetAll", tsPascal("app", "user", "GET_All"))
+	assert.Equal(t, "UserInfo", tsPascal("userInfo"))
+	assert.Equal(t, "T1abc", tsPascal("1abc"))
+	assert.Equal(t, `"kebab-key"`, tsKey("kebab-key"))
+}
@@ -11,9 +11,22 @@ import (
 
 type ItemHandler func(ctx iris.Context, self ISceneModelItem) *pipe.RunResp[any]
 
+// item类型 用于自省接口区分crud与自定义场景
+const (
+	ItemKindCustom    = "custom"
+	ItemKindGetAll    = "get_all"
+	ItemKindGetSingle = "get_single"
+	ItemKindAdd       = "add"
+	ItemKindEdit      = "edit"
+	ItemKindDelete    = "delete"
+	ItemKindAggregate = "aggregate"
+)
+
 type ItemExtra struct {
 	GetCount   bool
 	MustLastId bool
+	Kind       string
+	Aggregate  *AggregateConfig
 }
 
 type Item struct {
@@ -2,6 +2,7 @@ package scene
 
 import (
 	"github.com/23233/ggg/ut"
+	"github.com/pkg/errors"
 	"github.com/qiniu/qmgo"
 )
 
@@ -15,11 +16,15 @@ func NewItem(db *qmgo.Database, tableName string, inputStruct any, f ItemHandler
 	item.SetHandler(f)
 	item.SetDb(db)
 	item.SetRaw(inputStruct)
-	item.extra = new(ItemExtra)
+	item.extra = &ItemExtra{Kind: ItemKindCustom}
 	return item, nil
 }
 func NewGetAllItem(db *qmgo.Database, tableName string, inputStruct any, contextInjectToFilter []ContextValueInject, injectsToFilter []*ut.Kov, getCount bool, mustLastId bool) (ISceneModelItem, error) {
 	item, err := NewItem(db, tableName, inputStruct, FuncGetAll)
+	if err != nil {
+		return nil, err
+	}
+	item.GetExtra().Kind = ItemKindGetAll
 	item.SetContextInjectFilter(contextInjectToFilter)
 	item.SetFilterInjects(injectsToFilter)
 	item.GetExtra().GetCount = getCount
@@ -28,25 +33,60 @@ func NewGetAllItem(db *qmgo.Database, tableName string, inputStruct any, context
 }
 func NewGetSingleItem(db *qmgo.Database, tableName string, inputStruct any, contextInjectToFilter []ContextValueInject, injectsToFilter []*ut.Kov) (ISceneModelItem, error) {
 	item, err := NewItem(db, tableName, inputStruct, FuncGetSingle)
+	if err != nil {
+		return nil, err
+	}
+	item.GetExtra().Kind = ItemKindGetSingle
 	item.SetContextInjectFilter(contextInjectToFilter)
 	item.SetFilterInjects(injectsToFilter)
 	return item, err
 }
 func NewAddItem(db *qmgo.Database, tableName string, inputStruct any, contextInjectToBody []ContextValueInject, injectsToBody []*ut.Kov) (ISceneModelItem, error) {
 	item, err := NewItem(db, tableName, inputStruct, FuncPostAdd)
+	if err != nil {
+		return nil, err
+	}
+	item.GetExtra().Kind = ItemKindAdd
 	item.SetContextInjectFilter(contextInjectToBody)
 	item.SetFilterInjects(injectsToBody)
 	return item, err
 }
 func NewEditItem(db *qmgo.Database, tableName string, inputStruct any, contextInjectToFilter []ContextValueInject, injectsToFilter []*ut.Kov) (ISceneModelItem, error) {
 	item, err := NewItem(db, tableName, inputStruct, FuncEdit)
+	if err != nil {
+		return nil, err
+	}
+	item.GetExtra().Kind = ItemKindEdit
 	item.SetContextInjectFilter(contextInjectToFilter)
 	item.SetFilterInjects(injectsToFilter)
 	return item, err
 }
 func NewDeleteItem(db *qmgo.Database, tableName string, inputStruct any, contextInjectToFilter []ContextValueInject, injectsToFilter []*ut.Kov) (ISceneModelItem, error) {
 	item, err := NewItem(db, tableName, inputStruct, FuncDelete)
+	if err != nil {
+		return nil, err
+	}
+	item.GetExtra().Kind = ItemKindDelete
 	item.SetContextInjectFilter(contextInjectToFilter)
 	item.SetFilterInjects(injectsToFilter)
 	return item, err
 }
+
+// NewAggregateItem 聚合场景 inputStruct仅用于生成schema 客户端通过query选择分组 指标与时间分桶
+func NewAggregateItem(db *qmgo.Database, tableName string, inputStruct any, config *AggregateConfig, contextInjectToFilter []ContextValueInject, injectsToFilter []*ut.Kov) (ISceneModelItem, error) {
+	if config == nil {
+		return nil, errors.New("聚合配置不能为空")
+	}
+	if err := config.Valid(); err != nil {
+		return nil, err
+	}
+	item, err := NewItem(db, tableName, inputStruct, FuncAggregate)
+	if err != nil {
+		return nil, err
+	}
+	item.GetExtra().Kind = ItemKindAggregate
+	item.GetExtra().Aggregate = config
+	item.SetContextInjectFilter(contextInjectToFilter)
+	item.SetFilterInjects(injectsToFilter)
+	return item, nil
+}
@@ -0,0 +1,198 @@
+package scene
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/redis/rueidis/rueidiscompat"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Limiter 限速器 每个scene可以选择不同的算法
+// RateLimiter 滑动窗口 带封禁
+// TokenBucketLimiter 令牌桶
+// GCRALimiter 通用信元速率算法
+type Limiter interface {
+	Take(ctx context.Context, identifier string) (*RateResult, error)
+}
+
+// RateResult 限速检查结果
+type RateResult struct {
+	Allowed    bool
+	Limit      int64         // 限额 令牌桶与gcra为burst
+	Remaining  int64         // 剩余可请求次数
+	Reset      time.Duration // 距离额度完全恢复的时间
+	RetryAfter time.Duration // 被拒绝时距离可以再次请求的时间
+}
+
+func parseLimiterResult(result []int64, limit int64) (*RateResult, error) {
+	if len(result) != 4 {
+		return nil, errors.New("限速器返回值错误")
+	}
+	return &RateResult{
+		Allowed:    result[0] == 1,
+		Limit:      limit,
+		Remaining:  max(result[2], 0),
+		Reset:      time.Duration(result[3]) * time.Millisecond,
+		RetryAfter: time.Duration(result[1]) * time.Millisecond,
+	}, nil
+}
+
+// limiterParams 修正不合法的参数 避免脚本中出现除以0
+// period小于1毫秒时为1秒 rate小于1时为1 burst小于1时等于rate
+func limiterParams(period time.Duration, rate int, burst int) (time.Duration, int, int) {
+	if period < time.Millisecond {
+		period = time.Second
+	}
+	if rate < 1 {
+		rate = 1
+	}
+	if burst < 1 {
+		burst = rate
+	}
+	return period, rate, burst
+}
+
+const tokenBucketScript = `
+local key = KEYS[1]
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+
+local data = redis.call('hmget', key, 'tokens', 'ts')
+local tokens = tonumber(data[1])
+local ts = tonumber(data[2])
+if tokens == nil or ts == nil then
+    tokens = capacity
+    ts = now
+end
+
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+local retry = 0
+if tokens >= cost then
+    tokens = tokens - cost
+    allowed = 1
+else
+    retry = math.ceil((cost - tokens) / rate)
+end
+
+local reset = math.ceil((capacity - tokens) / rate)
+redis.call('hset', key, 'tokens', tostring(tokens), 'ts', now)
+redis.call('pexpire', key, math.max(reset, 1000))
+return {allowed, retry, math.floor(tokens), reset}
+`
+
+// TokenBucketLimiter 基于redis hash的令牌桶 每个标识只占用一个key
+// 令牌按 rate/period 的速度补充 桶容量为 burst
+type TokenBucketLimiter struct {
+	redisClient rueidiscompat.Cmdable
+	period      time.Duration
+	rate        int
+	burst       int
+	key         string
+	now         func() time.Time
+}
+
+func (c *TokenBucketLimiter) Take(ctx context.Context, identifier string) (*RateResult, error) {
+	// 每毫秒补充的令牌数
+	perMs := float64(c.rate) / float64(c.period.Milliseconds())
+	argv := []string{
+		strconv.Itoa(c.burst),
+		strconv.FormatFloat(perMs, 'f', -1, 64),
+		strconv.FormatInt(c.now().UnixMilli(), 10),
+		"1",
+	}
+	result, err := c.redisClient.Eval(ctx, tokenBucketScript, []string{c.key + identifier}, argv).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+	return parseLimiterResult(result, int64(c.burst))
+}
+
+// NewTokenBucketLimiter 初始化令牌桶 每period补充rate个令牌 burst为桶容量 参数修正见 limiterParams
+func NewTokenBucketLimiter(redisClient rueidiscompat.Cmdable, period time.Duration, rate int, burst int, interfaceKey string) *TokenBucketLimiter {
+	period, rate, burst = limiterParams(period, rate, burst)
+	return &TokenBucketLimiter{
+		redisClient: redisClient,
+		period:      period,
+		rate:        rate,
+		burst:       burst,
+		key:         "rate_bucket:" + interfaceKey + ":",
+		now:         time.Now,
+	}
+}
+
+const gcraScript = `
+local key = KEYS[1]
+local burst = tonumber(ARGV[1])
+local emission = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+
+local tolerance = emission * burst
+local tat = tonumber(redis.call('get', key))
+if tat == nil then
+    tat = now
+end
+tat = math.max(tat, now)
+
+local newTat = tat + emission * cost
+local allowAt = newTat - tolerance
+local diff = now - allowAt
+if diff < 0 then
+    return {0, math.ceil(-diff), 0, math.ceil(tat - now)}
+end
+
+local reset = newTat - now
+redis.call('set', key, tostring(newTat), 'PX', math.ceil(reset))
+return {1, 0, math.floor(diff / emission), math.ceil(reset)}
+`
+
+// GCRALimiter 基于redis的GCRA 每个标识只存储一个理论到达时间
+// 平均速度为 rate/period 允许瞬间突发 burst 个请求
+type GCRALimiter struct {
+	redisClient rueidiscompat.Cmdable
+	period      time.Duration
+	rate        int
+	burst       int
+	key         string
+	now         func() time.Time
+}
+
+func (c *GCRALimiter) Take(ctx context.Context, identifier string) (*RateResult, error) {
+	// 每个请求的间隔毫秒数
+	emission := float64(c.period.Milliseconds()) / float64(c.rate)
+	argv := []string{
+		strconv.Itoa(c.burst),
+		strconv.FormatFloat(emission, 'f', -1, 64),
+		strconv.FormatInt(c.now().UnixMilli(), 10),
+		"1",
+	}
+	result, err := c.redisClient.Eval(ctx, gcraScript, []string{c.key + identifier}, argv).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+	return parseLimiterResult(result, int64(c.burst))
+}
+
+// NewGCRALimiter 初始化GCRA 每period允许rate个请求 burst为可突发的请求数 参数修正见 limiterParams
+func NewGCRALimiter(redisClient rueidiscompat.Cmdable, period time.Duration, rate int, burst int, interfaceKey string) *GCRALimiter {
+	period, rate, burst = limiterParams(period, rate, burst)
+	return &GCRALimiter{
+		redisClient: redisClient,
+		period:      period,
+		rate:        rate,
+		burst:       burst,
+		key:         "rate_gcra:" + interfaceKey + ":",
+		now:         time.Now,
+	}
+}
+
+// rateHeaderSeconds 向上取整的秒数
+func rateHeaderSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
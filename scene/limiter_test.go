@@ -0,0 +1,134 @@
+package scene
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/rueidis"
+	"github.com/redis/rueidis/rueidiscompat"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newLimiterTestClient(t *testing.T) rueidiscompat.Cmdable {
+	mr := miniredis.RunT(t)
+	rdb, err := rueidis.NewClient(rueidis.ClientOption{
+		InitAddress:       []string{mr.Addr()},
+		DisableCache:      true,
+		ForceSingleClient: true,
+	})
+	assert.Nil(t, err)
+	t.Cleanup(rdb.Close)
+	return rueidiscompat.NewAdapter(rdb)
+}
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func TestTokenBucketLimiter(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{t: time.UnixMilli(1_700_000_000_000)}
+	// 每秒补充1个 桶容量3
+	limiter := NewTokenBucketLimiter(newLimiterTestClient(t), time.Second, 1, 3, "test_bucket")
+	limiter.now = clock.now
+
+	for i := 2; i >= 0; i-- {
+		r, err := limiter.Take(ctx, "u")
+		assert.Nil(t, err)
+		assert.True(t, r.Allowed)
+		assert.Equal(t, int64(3), r.Limit)
+		assert.Equal(t, int64(i), r.Remaining)
+	}
+	r, err := limiter.Take(ctx, "u")
+	assert.Nil(t, err)
+	assert.False(t, r.Allowed)
+	assert.Equal(t, time.Second, r.RetryAfter)
+	assert.Equal(t, 3*time.Second, r.Reset)
+
+	// 半秒后仍不足一个令牌
+	clock.t = clock.t.Add(500 * time.Millisecond)
+	r, err = limiter.Take(ctx, "u")
+	assert.Nil(t, err)
+	assert.False(t, r.Allowed)
+	assert.Equal(t, 500*time.Millisecond, r.RetryAfter)
+
+	clock.t = clock.t.Add(500 * time.Millisecond)
+	r, err = limiter.Take(ctx, "u")
+	assert.Nil(t, err)
+	assert.True(t, r.Allowed)
+	assert.Equal(t, int64(0), r.Remaining)
+
+	// 其他标识不受影响
+	r, err = limiter.Take(ctx, "other")
+	assert.Nil(t, err)
+	assert.True(t, r.Allowed)
+}
+
+func TestGCRALimiter(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{t: time.UnixMilli(1_700_000_000_000)}
+	// 每秒10个 可突发2个
+	limiter := NewGCRALimiter(newLimiterTestClient(t), time.Second, 10, 2, "test_gcra")
+	limiter.now = clock.now
+
+	r, err := limiter.Take(ctx, "u")
+	assert.Nil(t, err)
+	assert.True(t, r.Allowed)
+	assert.Equal(t, int64(1), r.Remaining)
+	assert.Equal(t, 100*time.Millisecond, r.Reset)
+
+	r, err = limiter.Take(ctx, "u")
+	assert.Nil(t, err)
+	assert.True(t, r.Allowed)
+	assert.Equal(t, int64(0), r.Remaining)
+
+	r, err = limiter.Take(ctx, "u")
+	assert.Nil(t, err)
+	assert.False(t, r.Allowed)
+	assert.Equal(t, 100*time.Millisecond, r.RetryAfter)
+
+	// 按平均速度恢复
+	clock.t = clock.t.Add(100 * time.Millisecond)
+	r, err = limiter.Take(ctx, "u")
+	assert.Nil(t, err)
+	assert.True(t, r.Allowed)
+	r, err = limiter.Take(ctx, "u")
+	assert.Nil(t, err)
+	assert.False(t, r.Allowed)
+}
+
+func TestLimiterParams(t *testing.T) {
+	bucket := NewTokenBucketLimiter(nil, 0, 0, 0, "p")
+	assert.Equal(t, time.Second, bucket.period)
+	assert.Equal(t, 1, bucket.rate)
+	assert.Equal(t, 1, bucket.burst)
+
+	gcra := NewGCRALimiter(nil, -time.Second, -5, 3, "p")
+	assert.Equal(t, time.Second, gcra.period)
+	assert.Equal(t, 1, gcra.rate)
+	assert.Equal(t, 3, gcra.burst)
+
+	// 不足1毫秒时脚本中的速率会是无穷大
+	gcra = NewGCRALimiter(newLimiterTestClient(t), time.Microsecond, 10, 0, "p")
+	assert.Equal(t, time.Second, gcra.period)
+	result, err := gcra.Take(context.Background(), "u")
+	assert.Nil(t, err)
+	assert.True(t, result.Allowed)
+}
+
+func TestSlidingLimiterResult(t *testing.T) {
+	ctx := context.Background()
+	var limiter Limiter = NewRateLimiter(newLimiterTestClient(t), time.Minute, 2, "test_sliding")
+
+	r, err := limiter.Take(ctx, "u")
+	assert.Nil(t, err)
+	assert.True(t, r.Allowed)
+	assert.Equal(t, int64(2), r.Limit)
+	assert.Equal(t, int64(1), r.Remaining)
+	assert.True(t, r.Reset > 0 && r.Reset <= time.Minute)
+}
@@ -7,11 +7,12 @@ import (
 	"github.com/pkg/errors"
 	"github.com/redis/rueidis/rueidiscompat"
 	"strconv"
+	"strings"
 	"time"
 )
 
-// RateLimiter 基于redis的滑窗限速带加入黑名单功能
-// 默认黑名单时间为 黑名单次数*滑窗时间周期*2
+// RateLimiter 基于redis的滑窗限速带加入黑名单功能 每次请求占用一个zset成员
+// 每个标识独立封禁 封禁时间为 封禁次数*滑窗时间周期*2
 type RateLimiter struct {
 	redisClient  rueidiscompat.Cmdable
 	window       time.Duration
@@ -21,6 +22,13 @@ type RateLimiter struct {
 	rateLimitKey string
 }
 
+// RateBanInfo 封禁信息
+type RateBanInfo struct {
+	Identifier string        `json:"identifier"`
+	Count      int64         `json:"count"` // 累计封禁次数
+	TTL        time.Duration `json:"ttl"`   // 剩余封禁时间
+}
+
 // NewRateLimiter 初始化
 func NewRateLimiter(redisClient rueidiscompat.Cmdable, period time.Duration, maxCount int, interfaceKey string) *RateLimiter {
 	return &RateLimiter{
@@ -33,58 +41,149 @@ func NewRateLimiter(redisClient rueidiscompat.Cmdable, period time.Duration, max
 	}
 }
 
-// Allow 检查请求是否被允许
-func (rl *RateLimiter) Allow(ctx context.Context, identifier string) (bool, error) {
-	now := time.Now().UnixMilli() // 获取当前时间的毫秒表示
-	windowStart := now - rl.window.Milliseconds()
+// banKey 标识的封禁key
+func (rl *RateLimiter) banKey(identifier string) string {
+	return rl.blacklistKey + ":" + identifier
+}
+
+// banCountKey 标识的累计封禁次数key
+func (rl *RateLimiter) banCountKey(identifier string) string {
+	return rl.countKey + ":" + identifier
+}
+
+const rateSlidingScript = `
+local rateLimitKey = KEYS[1]
+local banKey = KEYS[2]
+local countKey = KEYS[3]
+local maxCount = tonumber(ARGV[1])
+local windowStart = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local window = tonumber(ARGV[4])
+local member = ARGV[5]
 
-	luaScript := `
-        local rateLimitKey = KEYS[1]
-        local blacklistKey = KEYS[2]
-        local countKey = KEYS[3]
-        local maxCount = tonumber(ARGV[1])
-        local windowStart = tonumber(ARGV[2])
-        local now = tonumber(ARGV[3])
-
-        if redis.call('sismember', blacklistKey, ARGV[4]) == 1 then
-            return 0
-        end
-
-        redis.call('zremrangebyscore', rateLimitKey, '0', windowStart)
-        redis.call('zadd', rateLimitKey, now, now)
-        redis.call('expire', rateLimitKey, ARGV[5])
-
-        local count = redis.call('zcount', rateLimitKey, windowStart, now)
-        if count > maxCount then
-            local blacklistCount = redis.call('incr', countKey)
-            local duration = tonumber(ARGV[5]) * blacklistCount * 2
-            redis.call('sadd', blacklistKey, ARGV[4])
-            redis.call('expire', blacklistKey, duration)
-            return 0
-        end
-
-        return 1
-    `
+local banTtl = redis.call('pttl', banKey)
+if banTtl > 0 then
+    return {0, banTtl, maxCount, banTtl}
+end
+
+redis.call('zremrangebyscore', rateLimitKey, '0', windowStart)
+redis.call('zadd', rateLimitKey, now, member)
+redis.call('expire', rateLimitKey, window)
+
+local count = redis.call('zcount', rateLimitKey, windowStart, now)
+if count > maxCount then
+    local blacklistCount = redis.call('incr', countKey)
+    local duration = window * blacklistCount * 2
+    redis.call('set', banKey, blacklistCount, 'EX', duration)
+    return {0, duration * 1000, count, duration * 1000}
+end
+
+local oldest = redis.call('zrange', rateLimitKey, 0, 0, 'WITHSCORES')
+local reset = window * 1000
+if oldest[2] then
+    reset = tonumber(oldest[2]) + window * 1000 - now
+end
+return {1, 0, count, reset}
+`
+
+// Take 检查请求是否被允许 并返回被拒绝时的等待时间
+func (rl *RateLimiter) Take(ctx context.Context, identifier string) (*RateResult, error) {
+	current := time.Now()
+	now := current.UnixMilli() // 获取当前时间的毫秒表示
+	windowStart := now - rl.window.Milliseconds()
 
 	keys := []string{
 		rl.rateLimitKey + identifier,
-		rl.blacklistKey,
-		rl.countKey + ":" + identifier,
+		rl.banKey(identifier),
+		rl.banCountKey(identifier),
 	}
 	argv := []string{
 		strconv.Itoa(rl.maxCount),
 		strconv.FormatInt(windowStart, 10),
 		strconv.FormatInt(now, 10),
-		identifier,
 		strconv.Itoa(int(rl.window.Seconds())),
+		strconv.FormatInt(current.UnixNano(), 10), // 同一毫秒内的多次请求也要分别计数
+	}
+
+	result, err := rl.redisClient.Eval(ctx, rateSlidingScript, keys, argv).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+	if len(result) != 4 {
+		return nil, errors.New("限速器返回值错误")
 	}
 
-	result, err := rl.redisClient.Eval(ctx, luaScript, keys, argv).Result()
+	return &RateResult{
+		Allowed:    result[0] == 1,
+		Limit:      int64(rl.maxCount),
+		Remaining:  max(int64(rl.maxCount)-result[2], 0),
+		Reset:      time.Duration(result[3]) * time.Millisecond,
+		RetryAfter: time.Duration(result[1]) * time.Millisecond,
+	}, nil
+}
+
+// Allow 检查请求是否被允许
+func (rl *RateLimiter) Allow(ctx context.Context, identifier string) (bool, error) {
+	r, err := rl.Take(ctx, identifier)
 	if err != nil {
 		return false, err
 	}
+	return r.Allowed, nil
+}
+
+// GetBan 获取标识的封禁信息 未封禁时返回nil
+func (rl *RateLimiter) GetBan(ctx context.Context, identifier string) (*RateBanInfo, error) {
+	ttl, err := rl.redisClient.PTTL(ctx, rl.banKey(identifier)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		return nil, nil
+	}
+	count, err := rl.redisClient.Get(ctx, rl.banCountKey(identifier)).Int64()
+	if err != nil && err != rueidiscompat.Nil {
+		return nil, err
+	}
+	return &RateBanInfo{
+		Identifier: identifier,
+		Count:      count,
+		TTL:        ttl,
+	}, nil
+}
 
-	return result == int64(1), nil
+// ListBans 列出当前所有封禁中的标识
+func (rl *RateLimiter) ListBans(ctx context.Context) ([]*RateBanInfo, error) {
+	var result = make([]*RateBanInfo, 0)
+	var cursor uint64
+	for {
+		keys, next, err := rl.redisClient.Scan(ctx, cursor, rl.banKey("*"), 100).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			info, err := rl.GetBan(ctx, strings.TrimPrefix(k, rl.banKey("")))
+			if err != nil {
+				return nil, err
+			}
+			if info != nil {
+				result = append(result, info)
+			}
+		}
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+	return result, nil
+}
+
+// Unban 手动解除封禁 同时清空滑窗记录 resetCount为true时封禁次数也会清零
+func (rl *RateLimiter) Unban(ctx context.Context, identifier string, resetCount bool) error {
+	keys := []string{rl.banKey(identifier), rl.rateLimitKey + identifier}
+	if resetCount {
+		keys = append(keys, rl.banCountKey(identifier))
+	}
+	return rl.redisClient.Del(ctx, keys...).Err()
 }
 
 func RateUserIdKeyFunc(contextUserId string) ScenesRateKeyFunc {
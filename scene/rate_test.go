@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/23233/ggg/ut"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/redis/rueidis"
 	"github.com/redis/rueidis/rueidiscompat"
 	"github.com/stretchr/testify/assert"
@@ -49,3 +50,69 @@ func TestRateLimiter(t *testing.T) {
 	assert.Nil(t, err)
 	assert.True(t, allowed, "黑名单过期后，请求应该再次被允许")
 }
+
+func TestRateLimiterBan(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb, err := rueidis.NewClient(rueidis.ClientOption{
+		InitAddress:       []string{mr.Addr()},
+		DisableCache:      true,
+		ForceSingleClient: true,
+	})
+	assert.Nil(t, err)
+	defer rdb.Close()
+	compat := rueidiscompat.NewAdapter(rdb)
+
+	rateLimiter := NewRateLimiter(compat, 10*time.Second, 1, "test_ban")
+	ctx := context.Background()
+
+	// 两个标识各自超限
+	for _, id := range []string{"user_a", "user_b"} {
+		r, err := rateLimiter.Take(ctx, id)
+		assert.Nil(t, err)
+		assert.True(t, r.Allowed)
+		r, err = rateLimiter.Take(ctx, id)
+		assert.Nil(t, err)
+		assert.False(t, r.Allowed)
+		assert.Equal(t, 20*time.Second, r.RetryAfter)
+		mr.FastForward(5 * time.Second)
+	}
+
+	// 封禁期间返回剩余时间
+	r, err := rateLimiter.Take(ctx, "user_b")
+	assert.Nil(t, err)
+	assert.False(t, r.Allowed)
+	assert.True(t, r.RetryAfter > 0 && r.RetryAfter <= 20*time.Second)
+
+	bans, err := rateLimiter.ListBans(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, bans, 2)
+
+	// user_a 先到期 不影响 user_b
+	mr.FastForward(11 * time.Second)
+	info, err := rateLimiter.GetBan(ctx, "user_a")
+	assert.Nil(t, err)
+	assert.Nil(t, info)
+	info, err = rateLimiter.GetBan(ctx, "user_b")
+	assert.Nil(t, err)
+	assert.NotNil(t, info)
+	assert.Equal(t, int64(1), info.Count)
+
+	// 再次超限 封禁时间递增
+	allowed, err := rateLimiter.Allow(ctx, "user_a")
+	assert.Nil(t, err)
+	assert.True(t, allowed)
+	r, err = rateLimiter.Take(ctx, "user_a")
+	assert.Nil(t, err)
+	assert.False(t, r.Allowed)
+	assert.Equal(t, 40*time.Second, r.RetryAfter)
+
+	// 手动解除
+	assert.Nil(t, rateLimiter.Unban(ctx, "user_b", true))
+	allowed, err = rateLimiter.Allow(ctx, "user_b")
+	assert.Nil(t, err)
+	assert.True(t, allowed)
+	bans, err = rateLimiter.ListBans(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, bans, 1)
+	assert.Equal(t, "user_a", bans[0].Identifier)
+}
@@ -1,19 +1,14 @@
 package scene
 
 import (
-	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/23233/ggg/pipe"
 	"github.com/kataras/iris/v12"
 	"github.com/pkg/errors"
 	"github.com/redis/rueidis/rueidiscompat"
-	"io"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -25,7 +20,7 @@ type ScenesRateKeyFunc func(ctx iris.Context) (string, error)
 
 type ScenesOptions struct {
 	Scene   ISceneModelItem
-	rate    *RateLimiter
+	rate    Limiter
 	rateKey ScenesRateKeyFunc
 }
 
@@ -38,12 +33,17 @@ type ScenesItem struct {
 type ScenesHandler func(ctx iris.Context, mapper *RequestData) *pipe.RunResp[any]
 
 type Scenes struct {
-	modules      []*ScenesItem
-	cbcIv        []byte
-	preHandler   []ScenesHandler
-	afterHandler []ScenesHandler
-	prefix       string
-	party        iris.Party
+	modules          []*ScenesItem
+	cbcIv            []byte
+	preHandler       []ScenesHandler
+	afterHandler     []ScenesHandler
+	prefix           string
+	party            iris.Party
+	encryptResp      bool
+	replayGuard      *ReplayGuard
+	envelope         *pipe.Envelope
+	batchMax         int
+	batchConcurrency int
 }
 
 type IScenes interface {
@@ -55,9 +55,14 @@ type IScenes interface {
 	GetCbcSign() bool
 	SetCbcSign(iv []byte)
 	GetCbcIv() []byte
+	SetEnvelope(envelope *pipe.Envelope)
 
 	Decrypt(cipherText string) ([]byte, error)
 	Encrypt(plainText []byte) (string, error)
+	SetResponseEncrypt(enable bool)
+	GetResponseEncrypt() bool
+	SetReplayGuard(guard *ReplayGuard)
+	SetBatch(maxItems int, concurrency int)
 
 	AddPreHandler(handler ...ScenesHandler)
 	GetPreHandler() []ScenesHandler
@@ -67,15 +72,22 @@ type IScenes interface {
 	RegistryRouter(party iris.Party, prefix string)
 	ParseRequest() iris.Handler
 
+	Describe() *ScenesDescribe
+	IntrospectHandler() iris.Handler
+	RegistryIntrospect(party iris.Party, path string, handlers ...iris.Handler)
+
 	GetItem(scope string, model string, scene string) (*ScenesOptions, bool)
 	GetScope(scope string) []*ScenesItem
 	GetModel(scope string, model string) []*ScenesItem
 	RegistryItem(scope string, model string, scene string, item ISceneModelItem) error
 	AddItemRate(scope string, model string, scene string, redisClient rueidiscompat.Cmdable, period time.Duration, maxCount int, interfaceKey string, keyFunc ScenesRateKeyFunc) error
+	AddItemLimiter(scope string, model string, scene string, limiter Limiter, keyFunc ScenesRateKeyFunc) error
+	GetItemRate(scope string, model string, scene string) (*RateLimiter, bool)
+	GetItemLimiter(scope string, model string, scene string) (Limiter, bool)
 }
 
 func (m *Scenes) GetCbcSign() bool {
-	return m.cbcIv != nil
+	return m.cbcIv != nil || m.envelope != nil
 }
 
 func (m *Scenes) SetCbcSign(iv []byte) {
@@ -144,51 +156,26 @@ func (m *Scenes) RegistryItem(scope string, model string, scene string, item ISc
 	return nil
 }
 
+// Decrypt 信封格式使用 SetEnvelope 的密钥 否则按旧版cbc处理
 func (m *Scenes) Decrypt(cipherText string) ([]byte, error) {
-	cipherData, err := base64.URLEncoding.DecodeString(cipherText)
-	if err != nil {
-		return nil, err
-	}
-
-	block, err := aes.NewCipher(m.cbcIv)
-	if err != nil {
-		return nil, err
+	if pipe.IsEnvelope(cipherText) {
+		if m.envelope == nil {
+			return nil, pipe.ErrCipherInvalid
+		}
+		return m.envelope.Open(cipherText)
 	}
-
-	if len(cipherData) < aes.BlockSize {
-		return nil, fmt.Errorf("cipher text too short")
+	if m.cbcIv == nil {
+		return nil, pipe.ErrCipherInvalid
 	}
-
-	iv := cipherData[:aes.BlockSize]
-	cipherData = cipherData[aes.BlockSize:]
-
-	mode := cipher.NewCBCDecrypter(block, iv)
-	mode.CryptBlocks(cipherData, cipherData)
-
-	padding := cipherData[len(cipherData)-1]
-	return cipherData[:len(cipherData)-int(padding)], nil
+	return pipe.CbcDecrypt(m.cbcIv, cipherText)
 }
 
+// Encrypt 设置了信封时使用信封加密
 func (m *Scenes) Encrypt(plainText []byte) (string, error) {
-	block, err := aes.NewCipher(m.cbcIv)
-	if err != nil {
-		return "", err
-	}
-
-	padding := aes.BlockSize - len(plainText)%aes.BlockSize
-	padText := bytes.Repeat([]byte{byte(padding)}, padding)
-	plainText = append(plainText, padText...)
-
-	cipherText := make([]byte, aes.BlockSize+len(plainText))
-	iv := cipherText[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return "", err
+	if m.envelope != nil {
+		return m.envelope.Seal(plainText)
 	}
-
-	mode := cipher.NewCBCEncrypter(block, iv)
-	mode.CryptBlocks(cipherText[aes.BlockSize:], plainText)
-
-	return base64.URLEncoding.EncodeToString(cipherText), nil
+	return pipe.CbcEncrypt(m.cbcIv, plainText)
 }
 
 func (m *Scenes) AddPreHandler(handler ...ScenesHandler) {
@@ -238,34 +225,71 @@ func (m *Scenes) ParseRequest() iris.Handler {
 
 		var requestData = new(RequestData)
 
+		// 响应加密 先记录响应体 后续处理完成后统一加密
+		if m.GetResponseEncrypt() {
+			ctx.Record()
+			defer m.encryptResponse(ctx)
+		}
+
+		// 读取请求体
+		body, err := ctx.GetBody()
+		if err != nil {
+			m.errMsg(ctx, "获取body失败", err)
+			return
+		}
+
 		// 检查是否需要解密
+		parseMsg := "解析请求参数格式失败"
 		if m.GetCbcSign() {
-			// 读取请求体
-			body, err := ctx.GetBody()
-			if err != nil {
-				m.errMsg(ctx, "获取body失败", err)
-				return
-			}
-
-			// 解密请求体
+			parseMsg = "请求参数错误"
+			// 解密请求体 记录请求格式 响应使用相同格式加密
 			decryptedBody, err := m.Decrypt(string(body))
 			if err != nil {
 				m.errMsg(ctx, "解密失败", err)
 				return
 			}
+			ctx.Values().Set(legacyCipherKey, !pipe.IsEnvelope(string(body)))
+			body = decryptedBody
+		}
 
-			// 解析请求数据
-			if err := json.Unmarshal(decryptedBody, requestData); err != nil {
-				m.errMsg(ctx, "请求参数错误", err)
+		// 批量请求
+		var batch []*RequestData
+		if m.getBatchMax() > 0 && isBatchBody(body) {
+			if err := json.Unmarshal(body, &batch); err != nil {
+				m.errMsg(ctx, parseMsg, err)
 				return
 			}
-		} else {
-			// 直接解析请求数据
-			if err := ctx.ReadJSON(requestData); err != nil {
-				m.errMsg(ctx, "解析请求参数格式失败", err)
-				return
+		} else if err := json.Unmarshal(body, requestData); err != nil {
+			m.errMsg(ctx, parseMsg, err)
+			return
+		}
+
+		// 防重放 批量请求的每一项都需要携带独立的随机数
+		if m.GetCbcSign() && m.replayGuard != nil {
+			items := batch
+			if items == nil {
+				items = []*RequestData{requestData}
+			}
+			for _, item := range items {
+				var comm map[string]string
+				if item != nil {
+					comm = item.Comm
+				}
+				if err := m.replayGuard.Check(ctx, comm); err != nil {
+					msg := "防重放校验失败"
+					if errors.Is(err, ErrReplayMissing) || errors.Is(err, ErrReplayExpired) || errors.Is(err, ErrReplayReused) {
+						msg = err.Error()
+					}
+					m.errMsg(ctx, msg, err)
+					return
+				}
 			}
 		}
+
+		if batch != nil {
+			m.dispatchBatch(ctx, batch)
+			return
+		}
 		if len(requestData.Module.Scope) < 1 || len(requestData.Module.Model) < 1 || len(requestData.Module.Scene) < 1 {
 			m.errMsg(ctx, "必传参数缺失", nil)
 			return
@@ -280,12 +304,12 @@ func (m *Scenes) RegistryRouter(party iris.Party, prefix string) {
 	m.SetParty(party)
 	req := party.Post("/"+prefix, m.ParseRequest())
 
-	// 添加预处理程序
+	// 添加预处理程序 需在ParseRequest之后执行 此时body_data才存在
 	for _, handler := range m.GetPreHandler() {
-		req.Use(func(ctx iris.Context) {
+		req.Handlers = append(req.Handlers, func(ctx iris.Context) {
 			resp := handler(ctx, ctx.Values().Get("body_data").(*RequestData))
-			resp.Return(ctx)
 			if resp.Err != nil {
+				resp.Return(ctx)
 				return
 			}
 			ctx.Next()
@@ -308,12 +332,18 @@ func (m *Scenes) RegistryRouter(party iris.Party, prefix string) {
 				m.errMsg(ctx, "获取限速器字段失败", err)
 				return
 			}
-			allow, err := item.rate.Allow(ctx, key)
+			rateResult, err := item.rate.Take(ctx, key)
 			if err != nil {
 				m.errMsg(ctx, "限速器执行失败", err)
 				return
 			}
-			if !allow {
+			ctx.Header("X-RateLimit-Limit", strconv.FormatInt(rateResult.Limit, 10))
+			ctx.Header("X-RateLimit-Remaining", strconv.FormatInt(rateResult.Remaining, 10))
+			ctx.Header("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(rateResult.Reset).Unix(), 10))
+			if !rateResult.Allowed {
+				if rateResult.RetryAfter > 0 {
+					ctx.Header("Retry-After", strconv.FormatInt(rateHeaderSeconds(rateResult.RetryAfter), 10))
+				}
 				m.errMsg(ctx, "当前请求过多,请稍后重试", nil, http.StatusTooManyRequests)
 				return
 			}
@@ -343,15 +373,38 @@ func (m *Scenes) RegistryRouter(party iris.Party, prefix string) {
 }
 
 func (m *Scenes) AddItemRate(scope string, model string, scene string, redisClient rueidiscompat.Cmdable, period time.Duration, maxCount int, interfaceKey string, keyFunc ScenesRateKeyFunc) error {
+	return m.AddItemLimiter(scope, model, scene, NewRateLimiter(redisClient, period, maxCount, interfaceKey), keyFunc)
+}
+
+// AddItemLimiter 为scene设置任意算法的限速器
+func (m *Scenes) AddItemLimiter(scope string, model string, scene string, limiter Limiter, keyFunc ScenesRateKeyFunc) error {
 	item, ok := m.GetItem(scope, model, scene)
 	if !ok {
 		return errors.New("未找到对应的scene")
 	}
-	item.rate = NewRateLimiter(redisClient, period, maxCount, interfaceKey)
+	item.rate = limiter
 	item.rateKey = keyFunc
 	return nil
 }
 
+// GetItemRate 获取scene的滑窗限速器 用于查看和解除封禁
+func (m *Scenes) GetItemRate(scope string, model string, scene string) (*RateLimiter, bool) {
+	limiter, ok := m.GetItemLimiter(scope, model, scene)
+	if !ok {
+		return nil, false
+	}
+	rl, ok := limiter.(*RateLimiter)
+	return rl, ok
+}
+
+func (m *Scenes) GetItemLimiter(scope string, model string, scene string) (Limiter, bool) {
+	item, ok := m.GetItem(scope, model, scene)
+	if !ok || item.rate == nil {
+		return nil, false
+	}
+	return item.rate, true
+}
+
 func NewScenes() IScenes {
 	return new(Scenes)
 }
@@ -0,0 +1,135 @@
+package scene
+
+import (
+	"context"
+	"github.com/23233/ggg/pipe"
+	"github.com/kataras/iris/v12"
+	"github.com/pkg/errors"
+	"github.com/redis/rueidis"
+	"strconv"
+	"time"
+)
+
+// 加密模式下的响应加密与防重放
+// 客户端在加密前的 RequestData.Comm 中放入 ts(unix秒或毫秒) 与 nonce 服务端校验时间窗口并在redis中记录nonce
+
+const (
+	CommTimestampKey = "ts"
+	CommNonceKey     = "nonce"
+	// EncryptHeader 响应已加密时的响应头 值为 cbc 或 v1(信封格式)
+	EncryptHeader = "X-Scene-Encrypt"
+
+	legacyCipherKey = "scene_legacy_cipher"
+)
+
+var (
+	ErrReplayMissing = errors.New("缺少请求时间或随机数")
+	ErrReplayExpired = errors.New("请求已过期")
+	ErrReplayReused  = errors.New("重复的请求")
+)
+
+// ReplayGuard 防重放 skew为允许的时钟偏差 nonce保存2倍skew 超出窗口的请求会因时间校验失败
+type ReplayGuard struct {
+	rdb       rueidis.Client
+	skew      time.Duration
+	keyPrefix string
+}
+
+func NewReplayGuard(rdb rueidis.Client, skew time.Duration) *ReplayGuard {
+	if skew <= 0 {
+		skew = 5 * time.Minute
+	}
+	return &ReplayGuard{rdb: rdb, skew: skew, keyPrefix: "scene:nonce:"}
+}
+
+func (g *ReplayGuard) SetKeyPrefix(prefix string) *ReplayGuard {
+	g.keyPrefix = prefix
+	return g
+}
+
+// parseCommTime 兼容秒与毫秒
+func parseCommTime(raw string) (time.Time, error) {
+	ts, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ts > 1e12 {
+		return time.UnixMilli(ts), nil
+	}
+	return time.Unix(ts, 0), nil
+}
+
+// Check 校验时间窗口并占用nonce
+func (g *ReplayGuard) Check(ctx context.Context, comm map[string]string) error {
+	rawTs, nonce := comm[CommTimestampKey], comm[CommNonceKey]
+	if len(rawTs) < 1 || len(nonce) < 8 || len(nonce) > 64 {
+		return ErrReplayMissing
+	}
+	ts, err := parseCommTime(rawTs)
+	if err != nil {
+		return ErrReplayMissing
+	}
+	diff := time.Since(ts)
+	if diff > g.skew || diff < -g.skew {
+		return ErrReplayExpired
+	}
+	err = g.rdb.Do(ctx, g.rdb.B().Set().Key(g.keyPrefix+nonce).Value(rawTs).Nx().Px(2*g.skew).Build()).Error()
+	if err != nil {
+		if rueidis.IsRedisNil(err) {
+			return ErrReplayReused
+		}
+		return err
+	}
+	return nil
+}
+
+// SetEnvelope 使用带认证的信封加密 迁移期间可与 SetCbcSign 同时设置 两种格式的请求都接受
+// 只设置信封不设置cbc时拒绝旧版cbc请求
+func (m *Scenes) SetEnvelope(envelope *pipe.Envelope) {
+	m.envelope = envelope
+}
+
+// SetResponseEncrypt 加密模式下是否加密响应体 需要先 SetCbcSign 或 SetEnvelope
+func (m *Scenes) SetResponseEncrypt(enable bool) {
+	m.encryptResp = enable
+}
+
+func (m *Scenes) GetResponseEncrypt() bool {
+	return m.encryptResp && m.GetCbcSign()
+}
+
+// SetReplayGuard 加密模式下校验Comm中的时间与随机数 传nil关闭
+func (m *Scenes) SetReplayGuard(guard *ReplayGuard) {
+	m.replayGuard = guard
+}
+
+// encryptResponse 将已写入的响应体加密后替换 响应体为base64字符串
+func (m *Scenes) encryptResponse(ctx iris.Context) {
+	recorder, ok := ctx.IsRecording()
+	if !ok {
+		return
+	}
+	body := recorder.Body()
+	if len(body) < 1 {
+		return
+	}
+	// 旧版cbc请求仍以cbc响应 避免未升级的客户端无法解密
+	format := "cbc"
+	var cipherText string
+	var err error
+	if m.envelope != nil && !ctx.Values().GetBoolDefault(legacyCipherKey, false) {
+		format = pipe.EnvelopeVersion
+		cipherText, err = m.envelope.Seal(body)
+	} else {
+		cipherText, err = pipe.CbcEncrypt(m.cbcIv, body)
+	}
+	if err != nil {
+		recorder.ResetBody()
+		ctx.StatusCode(iris.StatusInternalServerError)
+		recorder.SetBodyString(`{"detail":"响应加密失败"}`)
+		return
+	}
+	recorder.SetBodyString(cipherText)
+	ctx.ContentType("text/plain")
+	ctx.Header(EncryptHeader, format)
+}
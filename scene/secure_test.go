@@ -0,0 +1,182 @@
+package scene
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/23233/ggg/pipe"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/httptest"
+	"github.com/redis/rueidis"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newSecureRedis(t *testing.T) (*miniredis.Miniredis, rueidis.Client) {
+	mr := miniredis.RunT(t)
+	rdb, err := rueidis.NewClient(rueidis.ClientOption{
+		InitAddress:       []string{mr.Addr()},
+		DisableCache:      true,
+		ForceSingleClient: true,
+	})
+	assert.Nil(t, err)
+	t.Cleanup(rdb.Close)
+	return mr, rdb
+}
+
+func TestReplayGuard(t *testing.T) {
+	_, rdb := newSecureRedis(t)
+	guard := NewReplayGuard(rdb, time.Minute)
+	ctx := context.Background()
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	assert.ErrorIs(t, guard.Check(ctx, map[string]string{CommTimestampKey: now}), ErrReplayMissing)
+	assert.Nil(t, guard.Check(ctx, map[string]string{CommTimestampKey: now, CommNonceKey: "nonce-0001"}))
+	assert.ErrorIs(t, guard.Check(ctx, map[string]string{CommTimestampKey: now, CommNonceKey: "nonce-0001"}), ErrReplayReused)
+
+	// 毫秒时间戳
+	ms := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	assert.Nil(t, guard.Check(ctx, map[string]string{CommTimestampKey: ms, CommNonceKey: "nonce-0002"}))
+
+	// 超出时钟偏差
+	old := strconv.FormatInt(time.Now().Add(-2*time.Minute).Unix(), 10)
+	assert.ErrorIs(t, guard.Check(ctx, map[string]string{CommTimestampKey: old, CommNonceKey: "nonce-0003"}), ErrReplayExpired)
+	future := strconv.FormatInt(time.Now().Add(2*time.Minute).Unix(), 10)
+	assert.ErrorIs(t, guard.Check(ctx, map[string]string{CommTimestampKey: future, CommNonceKey: "nonce-0004"}), ErrReplayExpired)
+}
+
+type secureInput struct {
+	Name string `json:"name"`
+}
+
+func TestEncryptedScene(t *testing.T) {
+	_, rdb := newSecureRedis(t)
+	sc := NewScenes()
+	sc.SetCbcSign([]byte("0123456789abcdef"))
+	sc.SetResponseEncrypt(true)
+	sc.SetReplayGuard(NewReplayGuard(rdb, time.Minute))
+	sc.SetBatch(DefaultBatchMaxItems, 0)
+
+	item, err := NewItem(nil, "secure", secureInput{}, func(ctx iris.Context, self ISceneModelItem) *pipe.RunResp[any] {
+		return pipe.NewPipeResult[any](self.GetMapper().Query["name"])
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, sc.RegistryItem("app", "secure", "echo", item))
+
+	app := iris.New()
+	sc.RegistryRouter(app.Party("/"), "scene")
+	e := httptest.New(t, app)
+
+	send := func(comm map[string]string) (int, map[string]any) {
+		raw, _ := json.Marshal(RequestData{
+			Module: RequestModule{Scope: "app", Model: "secure", Scene: "echo"},
+			Query:  map[string]string{"name": "ggg"},
+			Comm:   comm,
+		})
+		body, err := sc.Encrypt(raw)
+		assert.Nil(t, err)
+		resp := e.POST("/scene").WithBytes([]byte(body)).Expect()
+		resp.Header(EncryptHeader).IsEqual("cbc")
+		plain, err := sc.Decrypt(resp.Body().Raw())
+		assert.Nil(t, err)
+		result := make(map[string]any)
+		assert.Nil(t, json.Unmarshal(plain, &result))
+		return resp.Raw().StatusCode, result
+	}
+
+	comm := map[string]string{CommTimestampKey: strconv.FormatInt(time.Now().Unix(), 10), CommNonceKey: "abcdefgh"}
+	code, result := send(comm)
+	assert.Equal(t, iris.StatusOK, code)
+	assert.Equal(t, "ggg", result["data"])
+
+	// 重放同一个请求
+	code, result = send(comm)
+	assert.Equal(t, iris.StatusBadRequest, code)
+	assert.Equal(t, ErrReplayReused.Error(), result["detail"])
+
+	// 缺少随机数
+	code, _ = send(map[string]string{CommTimestampKey: comm[CommTimestampKey]})
+	assert.Equal(t, iris.StatusBadRequest, code)
+
+	// 批量请求每一项都校验随机数
+	sendBatch := func(comms ...map[string]string) int {
+		items := make([]RequestData, 0, len(comms))
+		for _, c := range comms {
+			items = append(items, RequestData{
+				Module: RequestModule{Scope: "app", Model: "secure", Scene: "echo"},
+				Query:  map[string]string{"name": "ggg"},
+				Comm:   c,
+			})
+		}
+		raw, _ := json.Marshal(items)
+		body, err := sc.Encrypt(raw)
+		assert.Nil(t, err)
+		return e.POST("/scene").WithBytes([]byte(body)).Expect().Raw().StatusCode
+	}
+	ts := comm[CommTimestampKey]
+	assert.Equal(t, iris.StatusOK, sendBatch(map[string]string{CommTimestampKey: ts, CommNonceKey: "batch-0001"}, map[string]string{CommTimestampKey: ts, CommNonceKey: "batch-0002"}))
+	// 后续项重放已使用的随机数
+	assert.Equal(t, iris.StatusBadRequest, sendBatch(map[string]string{CommTimestampKey: ts, CommNonceKey: "batch-0003"}, comm))
+	// 后续项缺少随机数
+	assert.Equal(t, iris.StatusBadRequest, sendBatch(map[string]string{CommTimestampKey: ts, CommNonceKey: "batch-0004"}, nil))
+}
+
+func TestEnvelopeScene(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	env, err := pipe.NewEnvelopeWithKey("k1", pipe.EnvelopeAesGcm, []byte("0123456789abcdef0123456789abcdef"))
+	assert.Nil(t, err)
+	sc := NewScenes()
+	sc.SetCbcSign(key)
+	sc.SetEnvelope(env)
+	sc.SetResponseEncrypt(true)
+
+	item, err := NewItem(nil, "secure", secureInput{}, func(ctx iris.Context, self ISceneModelItem) *pipe.RunResp[any] {
+		return pipe.NewPipeResult[any](self.GetMapper().Query["name"])
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, sc.RegistryItem("app", "secure", "echo", item))
+
+	app := iris.New()
+	sc.RegistryRouter(app.Party("/"), "scene")
+	e := httptest.New(t, app)
+
+	raw, _ := json.Marshal(RequestData{
+		Module: RequestModule{Scope: "app", Model: "secure", Scene: "echo"},
+		Query:  map[string]string{"name": "ggg"},
+	})
+
+	// 信封请求以信封响应
+	sealed, err := sc.Encrypt(raw)
+	assert.Nil(t, err)
+	assert.True(t, pipe.IsEnvelope(sealed))
+	resp := e.POST("/scene").WithBytes([]byte(sealed)).Expect().Status(iris.StatusOK)
+	resp.Header(EncryptHeader).IsEqual(pipe.EnvelopeVersion)
+	plain, err := env.Open(resp.Body().Raw())
+	assert.Nil(t, err)
+	assert.Contains(t, string(plain), "ggg")
+
+	// 旧版cbc请求以cbc响应
+	legacy, err := pipe.CbcEncrypt(key, raw)
+	assert.Nil(t, err)
+	resp = e.POST("/scene").WithBytes([]byte(legacy)).Expect().Status(iris.StatusOK)
+	resp.Header(EncryptHeader).IsEqual("cbc")
+	plain, err = pipe.CbcDecrypt(key, resp.Body().Raw())
+	assert.Nil(t, err)
+	assert.Contains(t, string(plain), "ggg")
+
+	// 篡改的密文
+	tampered := []byte(sealed)
+	i := len(tampered) - 10
+	if tampered[i] == 'A' {
+		tampered[i] = 'B'
+	} else {
+		tampered[i] = 'A'
+	}
+	e.POST("/scene").WithBytes(tampered).Expect().Status(iris.StatusBadRequest)
+
+	// 只保留信封时拒绝cbc
+	sc.SetCbcSign(nil)
+	e.POST("/scene").WithBytes([]byte(legacy)).Expect().Status(iris.StatusBadRequest)
+}
@@ -0,0 +1,427 @@
+package scene
+
+import (
+	"encoding/json"
+	"github.com/23233/jsonschema"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// typescript客户端生成 根据 Describe 的结果生成场景类型与请求客户端
+// 加密使用WebCrypto 支持旧版cbc与信封的gcm 浏览器没有chacha20 信封密钥需使用gcm
+
+var (
+	tsIdentRe = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+	tsWordRe  = regexp.MustCompile(`[^A-Za-z0-9]+`)
+)
+
+type tsGen struct {
+	defs    map[string]*jsonschema.Schema
+	defKeys []string
+}
+
+// tsPascal 转换为帕斯卡命名 全大写的片段按首字母大写处理
+func tsPascal(parts ...string) string {
+	var sb strings.Builder
+	for _, part := range parts {
+		for _, word := range tsWordRe.Split(part, -1) {
+			if len(word) < 1 {
+				continue
+			}
+			if strings.ToUpper(word) == word {
+				word = strings.ToLower(word)
+			}
+			sb.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	name := sb.String()
+	if len(name) < 1 || (name[0] >= '0' && name[0] <= '9') {
+		name = "T" + name
+	}
+	return name
+}
+
+func tsKey(key string) string {
+	if tsIdentRe.MatchString(key) {
+		return key
+	}
+	raw, _ := json.Marshal(key)
+	return string(raw)
+}
+
+// addDefs 收集$defs 同名定义只保留第一个
+func (g *tsGen) addDefs(schema *jsonschema.Schema) {
+	if schema == nil {
+		return
+	}
+	for name, def := range schema.Definitions {
+		if _, ok := g.defs[name]; ok {
+			continue
+		}
+		g.defs[name] = def
+		g.defKeys = append(g.defKeys, name)
+	}
+}
+
+func (g *tsGen) typeOf(s *jsonschema.Schema, indent string) string {
+	if s == nil {
+		return "any"
+	}
+	if len(s.Ref) > 0 {
+		name := s.Ref[strings.LastIndex(s.Ref, "/")+1:]
+		if _, ok := g.defs[name]; ok {
+			return tsPascal(name)
+		}
+		return "any"
+	}
+	if len(s.Enum) > 0 {
+		values := make([]string, 0, len(s.Enum))
+		for _, v := range s.Enum {
+			raw, _ := json.Marshal(v)
+			values = append(values, string(raw))
+		}
+		return strings.Join(values, " | ")
+	}
+	union := s.AnyOf
+	if len(union) < 1 {
+		union = s.OneOf
+	}
+	if len(union) > 0 {
+		values := make([]string, 0, len(union))
+		for _, item := range union {
+			values = append(values, g.typeOf(item, indent))
+		}
+		return strings.Join(values, " | ")
+	}
+	switch s.Type {
+	case "string":
+		return "string"
+	case "integer", "number":
+		return "number"
+	case "boolean":
+		return "boolean"
+	case "null":
+		return "null"
+	case "array":
+		item := g.typeOf(s.Items, indent)
+		if strings.Contains(item, "|") {
+			item = "(" + item + ")"
+		}
+		return item + "[]"
+	case "object":
+		if s.Properties != nil && len(s.Properties.Keys()) > 0 {
+			return g.objectOf(s, indent)
+		}
+		if s.AdditionalProperties != nil {
+			return "Record<string, " + g.typeOf(s.AdditionalProperties, indent) + ">"
+		}
+		// map[string]T 反射为单个 patternProperties
+		if len(s.PatternProperties) == 1 {
+			for _, v := range s.PatternProperties {
+				return "Record<string, " + g.typeOf(v, indent) + ">"
+			}
+		}
+		return "Record<string, any>"
+	}
+	return "any"
+}
+
+func (g *tsGen) objectOf(s *jsonschema.Schema, indent string) string {
+	if s.Properties == nil {
+		return "Record<string, any>"
+	}
+	required := make(map[string]bool, len(s.Required))
+	for _, key := range s.Required {
+		required[key] = true
+	}
+	var sb strings.Builder
+	sb.WriteString("{\n")
+	for _, key := range s.Properties.Keys() {
+		v, _ := s.Properties.Get(key)
+		prop, _ := v.(*jsonschema.Schema)
+		if prop != nil && len(prop.Title) > 0 {
+			sb.WriteString(indent + "  /** " + strings.ReplaceAll(prop.Title, "*/", "") + " */\n")
+		}
+		opt := "?"
+		if required[key] {
+			opt = ""
+		}
+		sb.WriteString(indent + "  " + tsKey(key) + opt + ": " + g.typeOf(prop, indent+"  ") + ";\n")
+	}
+	sb.WriteString(indent + "}")
+	return sb.String()
+}
+
+func sceneKey(item *SceneDescribe) string {
+	return item.Scope + "/" + item.Model + "/" + item.Scene
+}
+
+// GenTypescriptClient 生成typescript客户端源码
+func GenTypescriptClient(desc *ScenesDescribe) string {
+	g := &tsGen{defs: make(map[string]*jsonschema.Schema)}
+	for _, item := range desc.Scenes {
+		g.addDefs(item.Schema)
+	}
+	sort.Strings(g.defKeys)
+
+	var sb strings.Builder
+	sb.WriteString("// 由 scene.GenTypescriptClient 生成 请勿手动修改\n\n")
+	sb.WriteString(tsRuntimeTypes)
+
+	for _, name := range g.defKeys {
+		sb.WriteString("\nexport type " + tsPascal(name) + " = " + g.typeOf(g.defs[name], "") + ";\n")
+	}
+
+	sb.WriteString("\nexport interface SceneMap {\n")
+	for _, item := range desc.Scenes {
+		typ := "Record<string, any>"
+		if item.Schema != nil {
+			schema := *item.Schema
+			schema.Definitions = nil
+			typ = g.typeOf(&schema, "  ")
+			if typ == "any" {
+				typ = "Record<string, any>"
+			}
+		}
+		raw, _ := json.Marshal(sceneKey(item))
+		sb.WriteString("  /** " + item.Kind + " */\n")
+		sb.WriteString("  " + string(raw) + ": " + typ + ";\n")
+	}
+	sb.WriteString("}\n\nexport type SceneKey = keyof SceneMap;\n\n")
+
+	sb.WriteString("export const SceneKinds: Record<SceneKey, string> = {\n")
+	for _, item := range desc.Scenes {
+		raw, _ := json.Marshal(sceneKey(item))
+		kind, _ := json.Marshal(item.Kind)
+		sb.WriteString("  " + string(raw) + ": " + string(kind) + ",\n")
+	}
+	sb.WriteString("};\n\n")
+
+	prefix, _ := json.Marshal(desc.Prefix)
+	sb.WriteString("export const ScenePrefix = " + string(prefix) + ";\n")
+	sb.WriteString("export const SceneBatchMax = " + strconv.Itoa(desc.BatchMax) + ";\n")
+	sb.WriteString(tsRuntimeClient)
+	return sb.String()
+}
+
+const tsRuntimeTypes = `export interface RequestModule {
+  scope: string;
+  model: string;
+  scene: string;
+  action?: string;
+}
+
+export interface RequestData {
+  module: RequestModule;
+  query?: Record<string, string>;
+  body?: string;
+  comm?: Record<string, string>;
+}
+
+export interface SceneResult<T = any> {
+  code: number;
+  data: T;
+}
+
+export interface BatchResult<T = any> {
+  status: number;
+  code: number;
+  data?: T;
+  detail?: string;
+  retry_after?: number;
+}
+`
+
+const tsRuntimeClient = `
+export interface SceneClientOptions {
+  /** 包含party路径的地址 例如 https://api.example.com/api */
+  baseUrl: string;
+  prefix?: string;
+  /** SetCbcSign 使用的key */
+  cbcKey?: string | Uint8Array;
+  /** SetEnvelope 中的gcm密钥 设置后优先使用信封 */
+  envelope?: { kid: string; key: string | Uint8Array };
+  /** 服务端开启防重放时自动填充 ts 与 nonce */
+  replay?: boolean;
+  headers?: () => Record<string, string> | Promise<Record<string, string>>;
+  comm?: () => Record<string, string>;
+  fetch?: typeof fetch;
+}
+
+export interface SceneCall<K extends SceneKey = SceneKey> {
+  key: K;
+  body?: Partial<SceneMap[K]>;
+  query?: Record<string, string>;
+  comm?: Record<string, string>;
+}
+
+export class SceneError extends Error {
+  status: number;
+  code: number;
+
+  constructor(status: number, detail: string, code: number) {
+    super(detail);
+    this.status = status;
+    this.code = code;
+  }
+}
+
+const textEncoder = new TextEncoder();
+const textDecoder = new TextDecoder();
+
+function toBytes(v: string | Uint8Array): Uint8Array {
+  return typeof v === "string" ? textEncoder.encode(v) : v;
+}
+
+function b64urlEncode(data: Uint8Array, padding: boolean): string {
+  let bin = "";
+  data.forEach((b) => (bin += String.fromCharCode(b)));
+  const out = btoa(bin).replace(/\+/g, "-").replace(/\//g, "_");
+  return padding ? out : out.replace(/=+$/, "");
+}
+
+function b64urlDecode(s: string): Uint8Array {
+  s = s.replace(/-/g, "+").replace(/_/g, "/").replace(/=+$/, "");
+  while (s.length % 4 !== 0) s += "=";
+  const bin = atob(s);
+  const out = new Uint8Array(bin.length);
+  for (let i = 0; i < bin.length; i++) out[i] = bin.charCodeAt(i);
+  return out;
+}
+
+function concatBytes(a: Uint8Array, b: Uint8Array): Uint8Array {
+  const out = new Uint8Array(a.length + b.length);
+  out.set(a, 0);
+  out.set(b, a.length);
+  return out;
+}
+
+function randomBytes(n: number): Uint8Array {
+  return crypto.getRandomValues(new Uint8Array(n));
+}
+
+async function cbcEncrypt(key: Uint8Array, plain: string): Promise<string> {
+  const k = await crypto.subtle.importKey("raw", key, "AES-CBC", false, ["encrypt"]);
+  const iv = randomBytes(16);
+  const ct = new Uint8Array(await crypto.subtle.encrypt({ name: "AES-CBC", iv }, k, textEncoder.encode(plain)));
+  return b64urlEncode(concatBytes(iv, ct), true);
+}
+
+async function cbcDecrypt(key: Uint8Array, cipherText: string): Promise<string> {
+  const data = b64urlDecode(cipherText);
+  const k = await crypto.subtle.importKey("raw", key, "AES-CBC", false, ["decrypt"]);
+  const plain = await crypto.subtle.decrypt({ name: "AES-CBC", iv: data.slice(0, 16) }, k, data.slice(16));
+  return textDecoder.decode(plain);
+}
+
+async function envelopeSeal(kid: string, key: Uint8Array, plain: string): Promise<string> {
+  const header = "v1.gcm." + kid;
+  const k = await crypto.subtle.importKey("raw", key, "AES-GCM", false, ["encrypt"]);
+  const nonce = randomBytes(12);
+  const ct = new Uint8Array(
+    await crypto.subtle.encrypt({ name: "AES-GCM", iv: nonce, additionalData: textEncoder.encode(header) }, k, textEncoder.encode(plain)),
+  );
+  return header + "." + b64urlEncode(concatBytes(nonce, ct), false);
+}
+
+async function envelopeOpen(kid: string, key: Uint8Array, cipherText: string): Promise<string> {
+  const parts = cipherText.split(".");
+  if (parts.length !== 4 || parts[0] !== "v1" || parts[1] !== "gcm" || parts[2] !== kid) {
+    throw new SceneError(0, "密文无效", 0);
+  }
+  const data = b64urlDecode(parts[3]);
+  const k = await crypto.subtle.importKey("raw", key, "AES-GCM", false, ["decrypt"]);
+  const plain = await crypto.subtle.decrypt(
+    { name: "AES-GCM", iv: data.slice(0, 12), additionalData: textEncoder.encode(parts.slice(0, 3).join(".")) },
+    k,
+    data.slice(12),
+  );
+  return textDecoder.decode(plain);
+}
+
+export class SceneClient {
+  private opts: SceneClientOptions;
+
+  constructor(opts: SceneClientOptions) {
+    this.opts = opts;
+  }
+
+  private buildItem(call: SceneCall): RequestData {
+    const [scope, model, scene] = (call.key as string).split("/");
+    const comm: Record<string, string> = { ...(this.opts.comm ? this.opts.comm() : {}), ...(call.comm || {}) };
+    if (this.opts.replay) {
+      comm.ts = String(Date.now());
+      comm.nonce = b64urlEncode(randomBytes(12), false);
+    }
+    return {
+      module: { scope, model, scene },
+      query: call.query || {},
+      body: call.body === undefined ? "" : JSON.stringify(call.body),
+      comm,
+    };
+  }
+
+  private async encode(payload: string): Promise<string> {
+    if (this.opts.envelope) {
+      return envelopeSeal(this.opts.envelope.kid, toBytes(this.opts.envelope.key), payload);
+    }
+    if (this.opts.cbcKey) {
+      return cbcEncrypt(toBytes(this.opts.cbcKey), payload);
+    }
+    return payload;
+  }
+
+  private async decode(res: Response): Promise<any> {
+    let text = await res.text();
+    const mode = res.headers.get("X-Scene-Encrypt");
+    if (mode === "v1" && this.opts.envelope) {
+      text = await envelopeOpen(this.opts.envelope.kid, toBytes(this.opts.envelope.key), text);
+    } else if (mode === "cbc" && this.opts.cbcKey) {
+      text = await cbcDecrypt(toBytes(this.opts.cbcKey), text);
+    }
+    return text ? JSON.parse(text) : {};
+  }
+
+  private async send(payload: unknown): Promise<any> {
+    const doFetch = this.opts.fetch || fetch;
+    const headers: Record<string, string> = {
+      "Content-Type": this.opts.envelope || this.opts.cbcKey ? "text/plain" : "application/json",
+      ...(this.opts.headers ? await this.opts.headers() : {}),
+    };
+    const res = await doFetch(this.opts.baseUrl.replace(/\/+$/, "") + "/" + (this.opts.prefix ?? ScenePrefix), {
+      method: "POST",
+      headers,
+      body: await this.encode(JSON.stringify(payload)),
+    });
+    const data = await this.decode(res);
+    if (!res.ok) {
+      throw new SceneError(res.status, data.detail || res.statusText, data.code || 0);
+    }
+    return data;
+  }
+
+  /** 调用单个场景 */
+  async call<K extends SceneKey, R = any>(
+    key: K,
+    body?: Partial<SceneMap[K]>,
+    query?: Record<string, string>,
+    comm?: Record<string, string>,
+  ): Promise<SceneResult<R>> {
+    return this.send(this.buildItem({ key, body, query, comm }));
+  }
+
+  /** 批量调用 结果顺序与传入一致 单项失败不会抛出 */
+  async batch(calls: SceneCall[]): Promise<BatchResult[]> {
+    if (SceneBatchMax < 1) {
+      throw new SceneError(0, "未开启批量请求", 0);
+    }
+    if (calls.length > SceneBatchMax) {
+      throw new SceneError(0, "批量请求数量超出限制", 0);
+    }
+    const resp = await this.send(calls.map((call) => this.buildItem(call)));
+    return resp.data;
+  }
+}
+`
@@ -0,0 +1,337 @@
+package ut
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// 最小化的xlsx读写 仅支持单个sheet的纯文本单元格 不引入额外依赖
+// 写入时使用内联字符串 可以边查询边写入 读取时兼容共享字符串
+
+const (
+	xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`
+	xlsxRootRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`
+	xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets></workbook>`
+	xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`
+	xlsxSheetHead = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`
+	xlsxSheetTail = `</sheetData></worksheet>`
+)
+
+// excel的上限
+const (
+	xlsxMaxRows      = 1048576
+	xlsxMaxCols      = 16384
+	xlsxMaxSheetName = 31
+)
+
+var (
+	// XlsxMaxSize 读取的xlsx文件最大字节数
+	XlsxMaxSize int64 = 20 << 20
+	// XlsxMaxUncompressed 读取时解压后的总字节数上限 防止压缩炸弹
+	XlsxMaxUncompressed int64 = 100 << 20
+	// XlsxMaxCells 读取时补齐空单元格后的总单元格数上限
+	XlsxMaxCells = 5_000_000
+
+	ErrXlsxTooLarge = errors.New("xlsx文件过大")
+)
+
+// XlsxWriter 流式写入xlsx 必须调用Close才会写入完整文件
+type XlsxWriter struct {
+	zw    *zip.Writer
+	sheet io.Writer
+	row   int
+}
+
+// XlsxSheetName 去掉sheet名称中不允许的字符 并截断为31个字符 为空则为Sheet1
+func XlsxSheetName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return -1
+		}
+		return r
+	}, name)
+	// 首尾不能是单引号
+	name = strings.Trim(name, "'")
+	if runes := []rune(name); len(runes) > xlsxMaxSheetName {
+		name = strings.TrimRight(string(runes[:xlsxMaxSheetName]), "'")
+	}
+	if len(name) < 1 {
+		return "Sheet1"
+	}
+	return name
+}
+
+// NewXlsxWriter 创建写入器 sheetName会经过 XlsxSheetName 处理
+func NewXlsxWriter(w io.Writer, sheetName string) (*XlsxWriter, error) {
+	sheetName = XlsxSheetName(sheetName)
+	var name bytes.Buffer
+	_ = xml.EscapeText(&name, []byte(sheetName))
+
+	zw := zip.NewWriter(w)
+	files := [][2]string{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRootRels},
+		{"xl/workbook.xml", fmt.Sprintf(xlsxWorkbook, name.String())},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+	}
+	for _, f := range files {
+		fw, err := zw.Create(f[0])
+		if err != nil {
+			return nil, err
+		}
+		if _, err = io.WriteString(fw, f[1]); err != nil {
+			return nil, err
+		}
+	}
+	// sheet必须最后创建 之后的内容都写在这个文件中
+	sheet, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.WriteString(sheet, xlsxSheetHead); err != nil {
+		return nil, err
+	}
+	return &XlsxWriter{zw: zw, sheet: sheet}, nil
+}
+
+// WriteRow 写入一行
+func (x *XlsxWriter) WriteRow(cells []string) error {
+	x.row++
+	var buf bytes.Buffer
+	buf.WriteString(`<row r="` + strconv.Itoa(x.row) + `">`)
+	for i, cell := range cells {
+		if len(cell) < 1 {
+			continue
+		}
+		buf.WriteString(`<c r="` + XlsxColName(i) + strconv.Itoa(x.row) + `" t="inlineStr"><is><t xml:space="preserve">`)
+		_ = xml.EscapeText(&buf, []byte(cell))
+		buf.WriteString(`</t></is></c>`)
+	}
+	buf.WriteString(`</row>`)
+	_, err := x.sheet.Write(buf.Bytes())
+	return err
+}
+
+func (x *XlsxWriter) Close() error {
+	if _, err := io.WriteString(x.sheet, xlsxSheetTail); err != nil {
+		return err
+	}
+	return x.zw.Close()
+}
+
+// XlsxColName 列序号转为列名 0为A 26为AA
+func XlsxColName(i int) string {
+	name := ""
+	for i >= 0 {
+		name = string(rune('A'+i%26)) + name
+		i = i/26 - 1
+	}
+	return name
+}
+
+// xlsxColIndex 从单元格引用中解析出列序号 B3为1
+func xlsxColIndex(ref string) int {
+	idx := 0
+	for _, c := range ref {
+		if c < 'A' || c > 'Z' {
+			break
+		}
+		idx = idx*26 + int(c-'A') + 1
+	}
+	return idx - 1
+}
+
+type xlsxText struct {
+	T string `xml:"t"`
+	R []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t *xlsxText) String() string {
+	if len(t.R) < 1 {
+		return t.T
+	}
+	var sb strings.Builder
+	sb.WriteString(t.T)
+	for _, r := range t.R {
+		sb.WriteString(r.T)
+	}
+	return sb.String()
+}
+
+type xlsxSheetXml struct {
+	Rows []struct {
+		R     int `xml:"r,attr"`
+		Cells []struct {
+			R  string    `xml:"r,attr"`
+			T  string    `xml:"t,attr"`
+			V  string    `xml:"v"`
+			Is *xlsxText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// xlsxLimitReader 多个文件共用的解压字节数额度 超出后返回 ErrXlsxTooLarge
+// 不信任zip中记录的解压大小 以实际读取的为准
+type xlsxLimitReader struct {
+	r    io.Reader
+	left *int64
+}
+
+func (l *xlsxLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	*l.left -= int64(n)
+	if *l.left < 0 {
+		return n, ErrXlsxTooLarge
+	}
+	return n, err
+}
+
+func xlsxDecode(zr *zip.Reader, name string, v any, left *int64) (bool, error) {
+	for _, f := range zr.File {
+		if f.Name != name {
+			continue
+		}
+		if f.UncompressedSize64 > uint64(*left) {
+			return true, ErrXlsxTooLarge
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return true, err
+		}
+		defer rc.Close()
+		return true, xml.NewDecoder(&xlsxLimitReader{r: rc, left: left}).Decode(v)
+	}
+	return false, nil
+}
+
+// ReadXlsx 读取第一个sheet 返回的行下标+1即为表格中的行号 空行为nil
+// 文件大小超过 XlsxMaxSize 或解压后超过 XlsxMaxUncompressed 时返回 ErrXlsxTooLarge
+func ReadXlsx(r io.ReaderAt, size int64) ([][]string, error) {
+	if size > XlsxMaxSize {
+		return nil, ErrXlsxTooLarge
+	}
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	left := XlsxMaxUncompressed
+
+	// 找到第一个sheet的路径
+	var workbook struct {
+		Sheets []struct {
+			Rid string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	found, err := xlsxDecode(zr, "xl/workbook.xml", &workbook, &left)
+	if err != nil {
+		return nil, err
+	}
+	if !found || len(workbook.Sheets) < 1 {
+		return nil, fmt.Errorf("xlsx中没有sheet")
+	}
+	var rels struct {
+		Items []struct {
+			Id     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	if _, err = xlsxDecode(zr, "xl/_rels/workbook.xml.rels", &rels, &left); err != nil {
+		return nil, err
+	}
+	sheetPath := "xl/worksheets/sheet1.xml"
+	for _, item := range rels.Items {
+		if item.Id == workbook.Sheets[0].Rid {
+			if strings.HasPrefix(item.Target, "/") {
+				sheetPath = strings.TrimPrefix(item.Target, "/")
+			} else {
+				sheetPath = path.Join("xl", item.Target)
+			}
+			break
+		}
+	}
+
+	var sst struct {
+		Items []*xlsxText `xml:"si"`
+	}
+	if _, err = xlsxDecode(zr, "xl/sharedStrings.xml", &sst, &left); err != nil {
+		return nil, err
+	}
+
+	var sheet xlsxSheetXml
+	found, err = xlsxDecode(zr, sheetPath, &sheet, &left)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("xlsx中没有找到%s", sheetPath)
+	}
+
+	// 共享字符串只拼接一次 被多个单元格引用时共用同一个字符串
+	shared := make([]string, 0, len(sst.Items))
+	for _, item := range sst.Items {
+		shared = append(shared, item.String())
+	}
+
+	result := make([][]string, 0, len(sheet.Rows))
+	cellCount := 0
+	for _, row := range sheet.Rows {
+		line := row.R
+		if line < 1 {
+			line = len(result) + 1
+		}
+		if line > xlsxMaxRows {
+			return nil, fmt.Errorf("行号%d超出范围", line)
+		}
+		for len(result) < line-1 {
+			result = append(result, nil)
+		}
+		cells := make([]string, 0, len(row.Cells))
+		for i, c := range row.Cells {
+			col := i
+			if len(c.R) > 0 {
+				col = xlsxColIndex(c.R)
+			}
+			if col < 0 || col >= xlsxMaxCols {
+				return nil, fmt.Errorf("单元格%s超出范围", c.R)
+			}
+			if col >= len(cells) {
+				if cellCount += col + 1 - len(cells); cellCount > XlsxMaxCells {
+					return nil, ErrXlsxTooLarge
+				}
+			}
+			for len(cells) <= col {
+				cells = append(cells, "")
+			}
+			switch c.T {
+			case "s":
+				idx, err := strconv.Atoi(c.V)
+				if err != nil || idx < 0 || idx >= len(shared) {
+					return nil, fmt.Errorf("单元格%s共享字符串索引错误", c.R)
+				}
+				cells[col] = shared[idx]
+			case "inlineStr":
+				if c.Is != nil {
+					cells[col] = c.Is.String()
+				}
+			default:
+				cells[col] = c.V
+			}
+		}
+		result = append(result, cells)
+	}
+	return result, nil
+}
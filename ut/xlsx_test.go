@@ -0,0 +1,112 @@
+package ut
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestXlsxRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewXlsxWriter(&buf, "测试<表>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := [][]string{
+		{"名称", "年龄", "备注"},
+		{"张三", "18", "a<b & \"c\""},
+		{"李四", "", "多行\n内容"},
+	}
+	for _, row := range rows {
+		if err = w.WriteRow(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ReadXlsx(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != len(rows) {
+		t.Fatalf("行数错误 %d", len(result))
+	}
+	if result[1][2] != rows[1][2] || result[2][2] != rows[2][2] {
+		t.Fatalf("内容不一致 %v", result)
+	}
+	// 空单元格不写入 读取时补齐为空字符串
+	if result[2][1] != "" || result[2][0] != "李四" {
+		t.Fatalf("空单元格错误 %v", result[2])
+	}
+}
+
+func TestXlsxColName(t *testing.T) {
+	for i, want := range map[int]string{0: "A", 25: "Z", 26: "AA", 27: "AB", 701: "ZZ", 702: "AAA"} {
+		if got := XlsxColName(i); got != want {
+			t.Fatalf("%d want %s got %s", i, want, got)
+		}
+		if got := xlsxColIndex(want + "12"); got != i {
+			t.Fatalf("%s want %d got %d", want, i, got)
+		}
+	}
+}
+
+func TestXlsxSheetName(t *testing.T) {
+	for name, want := range map[string]string{
+		"":                      "Sheet1",
+		"a[b]:c*d?e/f\\g":       "abcdefg",
+		"'引号'":                  "引号",
+		"[]":                    "Sheet1",
+		strings.Repeat("表", 40): strings.Repeat("表", 31),
+	} {
+		if got := XlsxSheetName(name); got != want {
+			t.Fatalf("%q want %q got %q", name, want, got)
+		}
+	}
+}
+
+func TestXlsxReadLimit(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewXlsxWriter(&buf, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err = w.WriteRow([]string{strings.Repeat("a", 100)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	old := XlsxMaxUncompressed
+	defer func() { XlsxMaxUncompressed = old }()
+	XlsxMaxUncompressed = 5000
+	if _, err = ReadXlsx(bytes.NewReader(buf.Bytes()), int64(buf.Len())); !errors.Is(err, ErrXlsxTooLarge) {
+		t.Fatalf("解压后超出限制应返回错误 %v", err)
+	}
+	XlsxMaxUncompressed = old
+	if _, err = ReadXlsx(bytes.NewReader(buf.Bytes()), XlsxMaxSize+1); !errors.Is(err, ErrXlsxTooLarge) {
+		t.Fatalf("文件超出限制应返回错误 %v", err)
+	}
+
+	// 单元格引用超出范围 不会按行号补齐
+	var zb bytes.Buffer
+	zw := zip.NewWriter(&zb)
+	for name, content := range map[string]string{
+		"xl/workbook.xml":          `<workbook><sheets><sheet name="a"/></sheets></workbook>`,
+		"xl/worksheets/sheet1.xml": `<worksheet><sheetData><row r="999999999"><c r="A999999999"><v>1</v></c></row></sheetData></worksheet>`,
+	} {
+		fw, _ := zw.Create(name)
+		_, _ = fw.Write([]byte(content))
+	}
+	_ = zw.Close()
+	if _, err = ReadXlsx(bytes.NewReader(zb.Bytes()), int64(zb.Len())); err == nil {
+		t.Fatal("行号超出范围应返回错误")
+	}
+}